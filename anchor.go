@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+var (
+	anchorMethod   string
+	anchorURL      string
+	anchorFrom     string
+	anchorInterval = time.Hour
+	anchorClient   = &http.Client{Timeout: 30 * time.Second}
+)
+
+// AnchorReceipt records that a tip hash was published outside the chain.
+// For Ethereum the receipt is the hash of the transaction carrying the tip
+// hash as its data; for RFC 3161 it is the base64 DER time-stamp token over
+// the SHA-256 of the tip hash bytes.
+type AnchorReceipt struct {
+	Method  string `json:"method"`
+	Service string `json:"service"`
+	Height  int    `json:"height"`
+	TipHash string `json:"tip_hash"`
+	Receipt string `json:"receipt"`
+	Time    string `json:"time"`
+}
+
+// Anchorer publishes a tip hash to an external service and returns the
+// service's receipt.
+type Anchorer interface {
+	Anchor(ctx context.Context, tipHash string) (string, error)
+}
+
+func newAnchorer(method, url, from string) (Anchorer, error) {
+	if url == "" {
+		return nil, errors.New("-anchor-url is required")
+	}
+	switch method {
+	case "ethereum":
+		if from == "" {
+			return nil, errors.New("-anchor-from is required for ethereum anchoring")
+		}
+		return &ethAnchorer{url: url, from: from}, nil
+	case "rfc3161":
+		return &tsaAnchorer{url: url}, nil
+	}
+	return nil, fmt.Errorf("unknown anchor method %q", method)
+}
+
+// ethAnchorer sends a zero-value transaction from an account unlocked on the
+// node at url to itself, with the tip hash as data.
+type ethAnchorer struct {
+	url  string
+	from string
+}
+
+func (a *ethAnchorer) Anchor(ctx context.Context, tipHash string) (string, error) {
+	body, _ := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "eth_sendTransaction",
+		"params":  []map[string]string{{"from": a.from, "to": a.from, "value": "0x0", "data": "0x" + tipHash}},
+	})
+	req, err := http.NewRequestWithContext(ctx, "POST", a.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := anchorClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Result string `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return "", fmt.Errorf("invalid JSON-RPC reply (status %d): %w", resp.StatusCode, err)
+	}
+	if reply.Error != nil {
+		return "", fmt.Errorf("eth_sendTransaction: %s (code %d)", reply.Error.Message, reply.Error.Code)
+	}
+	if reply.Result == "" {
+		return "", errors.New("eth_sendTransaction returned no transaction hash")
+	}
+	return reply.Result, nil
+}
+
+// tsaAnchorer requests an RFC 3161 time-stamp token from the service at url.
+type tsaAnchorer struct {
+	url string
+}
+
+var oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	Nonce          *big.Int
+	CertReq        bool `asn1:"optional"`
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString asn1.RawValue  `asn1:"optional"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+type timeStampResp struct {
+	Status pkiStatusInfo
+	Token  asn1.RawValue `asn1:"optional"`
+}
+
+func (a *tsaAnchorer) Anchor(ctx context.Context, tipHash string) (string, error) {
+	tip, err := hex.DecodeString(tipHash)
+	if err != nil {
+		return "", fmt.Errorf("invalid tip hash: %w", err)
+	}
+	digest := sha256.Sum256(tip)
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return "", err
+	}
+	body, err := asn1.Marshal(timeStampReq{
+		Version:        1,
+		MessageImprint: messageImprint{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}, HashedMessage: digest[:]},
+		Nonce:          nonce,
+		CertReq:        true,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", a.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/timestamp-query")
+	resp, err := anchorClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("time-stamp service returned %s", resp.Status)
+	}
+	var tsr timeStampResp
+	if _, err := asn1.Unmarshal(data, &tsr); err != nil {
+		return "", fmt.Errorf("invalid time-stamp response: %w", err)
+	}
+	// 0 is granted and 1 granted with modifications.
+	if tsr.Status.Status > 1 {
+		return "", fmt.Errorf("time-stamp request rejected with status %d", tsr.Status.Status)
+	}
+	if len(tsr.Token.FullBytes) == 0 {
+		return "", errors.New("time-stamp response has no token")
+	}
+	if !bytes.Contains(tsr.Token.FullBytes, digest[:]) {
+		return "", errors.New("time-stamp token does not cover the tip hash")
+	}
+	return base64.StdEncoding.EncodeToString(tsr.Token.FullBytes), nil
+}
+
+// anchorTx builds the on-chain record of a receipt, signed by this node.
+func anchorTx(receipt AnchorReceipt) Transaction {
+	tx := Transaction{Type: TxAnchor, Anchor: &receipt}
+	tx.Sign(NodeKey)
+	return tx
+}
+
+// anchorLoop anchors the tip every interval. A tip whose block holds only
+// anchor records is not anchored again, so an idle chain does not grow a
+// block per interval.
+func anchorLoop(a Anchorer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		tip := BlockChain.Tip()
+		if onlyAnchors(tip) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		receipt, err := a.Anchor(ctx, tip.Hash)
+		cancel()
+		if err != nil {
+			log.Printf("Could not anchor block %d: %v", tip.Pos, err)
+			continue
+		}
+		tx := anchorTx(AnchorReceipt{
+			Method:  anchorMethod,
+			Service: anchorURL,
+			Height:  tip.Pos,
+			TipHash: tip.Hash,
+			Receipt: receipt,
+			Time:    time.Now().UTC().Format(time.RFC3339),
+		})
+		if _, err := queueTx(homeTenant, tx); err != nil {
+			log.Printf("Could not record anchor of block %d: %v", tip.Pos, err)
+			continue
+		}
+		log.Printf("Anchored block %d via %s", tip.Pos, anchorMethod)
+	}
+}
+
+func onlyAnchors(b *Block) bool {
+	if b.Pos == 0 {
+		return false
+	}
+	for _, tx := range b.Transactions {
+		if tx.Kind() != TxAnchor {
+			return false
+		}
+	}
+	return true
+}
+
+// Anchors returns the anchor records on the chain, oldest first.
+func (bc *Blockchain) Anchors() []TxEvent {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return append([]TxEvent{}, bc.anchors...)
+}
+
+func getAnchors(w http.ResponseWriter, r *http.Request) {
+	respond(w, r, BlockChain.Anchors())
+}
@@ -0,0 +1,151 @@
+// Package apierr defines the errors the HTTP API reports and writes them in
+// one envelope: {"code", "message", "details", "request_id"}. Each code has a
+// fixed HTTP status, so clients can branch on the code alone.
+package apierr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Code is a machine-readable error code such as "not_found".
+type Code string
+
+var (
+	mu       sync.RWMutex
+	statuses = map[Code]int{}
+)
+
+// Define registers a code and the HTTP status it is reported with. It
+// panics if the code is already defined, so it belongs in package-level
+// variable declarations.
+func Define(code string, status int) Code {
+	mu.Lock()
+	defer mu.Unlock()
+	c := Code(code)
+	if _, ok := statuses[c]; ok {
+		panic("apierr: code " + code + " defined twice")
+	}
+	statuses[c] = status
+	return c
+}
+
+// Status is the HTTP status of code, 500 for an unknown one.
+func (c Code) Status() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	if s, ok := statuses[c]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+// The generic codes. Callers define more specific ones with Define.
+var (
+	InvalidRequest   = Define("invalid_request", http.StatusBadRequest)
+	Unauthenticated  = Define("unauthenticated", http.StatusUnauthorized)
+	Forbidden        = Define("forbidden", http.StatusForbidden)
+	NotFound         = Define("not_found", http.StatusNotFound)
+	MethodNotAllowed = Define("method_not_allowed", http.StatusMethodNotAllowed)
+	NotAcceptable    = Define("not_acceptable", http.StatusNotAcceptable)
+	Conflict         = Define("conflict", http.StatusConflict)
+	Unprocessable    = Define("unprocessable", http.StatusUnprocessableEntity)
+	InvalidFields    = Define("invalid_fields", http.StatusUnprocessableEntity)
+	Internal         = Define("internal", http.StatusInternalServerError)
+	NotImplemented   = Define("not_implemented", http.StatusNotImplemented)
+	Unavailable      = Define("unavailable", http.StatusServiceUnavailable)
+)
+
+// Error is an error with a code, a message for people and optional details
+// for programs. Err is the cause, if any.
+type Error struct {
+	Code    Code
+	Message string
+	Details any
+	Err     error
+}
+
+// New returns an error with code and message.
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Errorf returns an error with code and a formatted message. A %w verb
+// makes the wrapped error its cause.
+func Errorf(code Code, format string, args ...any) *Error {
+	err := fmt.Errorf(format, args...)
+	return &Error{Code: code, Message: err.Error(), Err: errors.Unwrap(err)}
+}
+
+// Wrap returns an error with code whose message is err's.
+func Wrap(code Code, err error) *Error {
+	return &Error{Code: code, Message: err.Error(), Err: err}
+}
+
+// WithDetails sets the error's details and returns it.
+func (e *Error) WithDetails(details any) *Error {
+	e.Details = details
+	return e
+}
+
+func (e *Error) Error() string { return e.Message }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Status is the HTTP status of the error's code.
+func (e *Error) Status() int { return e.Code.Status() }
+
+// FieldError is one field of a payload that failed validation. Field is its
+// JSON name, with nested fields joined by dots.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Fields collects the field errors of a payload.
+type Fields []FieldError
+
+// Add records that field failed.
+func (f *Fields) Add(field, format string, args ...any) {
+	*f = append(*f, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Err returns nil if no field failed, and otherwise an InvalidFields error
+// naming them, with the field errors as its details.
+func (f Fields) Err() error {
+	if len(f) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(f))
+	for _, fe := range f {
+		if !slices.Contains(names, fe.Field) {
+			names = append(names, fe.Field)
+		}
+	}
+	return Errorf(InvalidFields, "invalid %s", strings.Join(names, ", ")).WithDetails(map[string]Fields{"fields": f})
+}
+
+// Envelope is the body of every error response.
+type Envelope struct {
+	Code      Code   `json:"code"`
+	Message   string `json:"message"`
+	Details   any    `json:"details,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Write sends err as an error response. An error that is not an *Error, and
+// does not wrap one, is reported as internal.
+func Write(w http.ResponseWriter, requestID string, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = Wrap(Internal, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status())
+	json.NewEncoder(w).Encode(Envelope{Code: e.Code, Message: e.Message, Details: e.Details, RequestID: requestID})
+}
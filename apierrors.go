@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"blockchain/apierr"
+	"blockchain/keys"
+)
+
+// Error codes for what the chain, the catalog and the keystores refuse,
+// beyond apierr's generic ones.
+var (
+	codeChainInvalid     = apierr.Define("chain_invalid", http.StatusServiceUnavailable)
+	codeWrongChain       = apierr.Define("wrong_chain", http.StatusConflict)
+	codeBlockNotFound    = apierr.Define("block_not_found", http.StatusNotFound)
+	codeTxNotFound       = apierr.Define("transaction_not_found", http.StatusNotFound)
+	codeDuplicateTx      = apierr.Define("duplicate_transaction", http.StatusConflict)
+	codeUnsigned         = apierr.Define("unsigned", http.StatusBadRequest)
+	codeInvalidSignature = apierr.Define("invalid_signature", http.StatusBadRequest)
+	codeBookNotFound     = apierr.Define("book_not_found", http.StatusNotFound)
+	codeUnknownBook      = apierr.Define("unknown_book", http.StatusConflict)
+	codeBookWithdrawn    = apierr.Define("book_withdrawn", http.StatusConflict)
+	codeCheckedOut       = apierr.Define("book_checked_out", http.StatusConflict)
+	codeNotCheckedOut    = apierr.Define("book_not_checked_out", http.StatusConflict)
+	codeNotBorrower      = apierr.Define("not_borrower", http.StatusConflict)
+	codeHasBook          = apierr.Define("already_borrowed", http.StatusConflict)
+	codeBookOnHold       = apierr.Define("book_on_hold", http.StatusConflict)
+	codeHoldExists       = apierr.Define("hold_exists", http.StatusConflict)
+	codeNoHold           = apierr.Define("hold_not_found", http.StatusConflict)
+	codeRenewalLimit     = apierr.Define("renewal_limit", http.StatusConflict)
+	codeOverpayment      = apierr.Define("overpayment", http.StatusConflict)
+	codeBookAway         = apierr.Define("book_at_other_branch", http.StatusConflict)
+	codeWrittenOff       = apierr.Define("written_off", http.StatusConflict)
+	codeAlreadyDonated   = apierr.Define("already_donated", http.StatusConflict)
+	codeLoanLimit        = apierr.Define("loan_limit", http.StatusConflict)
+	codeAgeRestricted    = apierr.Define("age_restricted", http.StatusConflict)
+	codeMemberNotFound   = apierr.Define("member_not_found", http.StatusNotFound)
+	codeMemberExists     = apierr.Define("member_exists", http.StatusConflict)
+	codeUnknownMember    = apierr.Define("unknown_member", http.StatusConflict)
+	codeMemberSuspended  = apierr.Define("member_suspended", http.StatusConflict)
+	codeNotPseudonymous  = apierr.Define("not_pseudonymous", http.StatusBadRequest)
+	codePseudonymUnknown = apierr.Define("pseudonym_not_found", http.StatusNotFound)
+	codePayloadNotFound  = apierr.Define("payload_not_found", http.StatusNotFound)
+	codeMemberActive     = apierr.Define("member_active", http.StatusConflict)
+	codeWalletNotFound   = apierr.Define("wallet_not_found", http.StatusNotFound)
+	codeWalletExists     = apierr.Define("wallet_exists", http.StatusConflict)
+	codeWrongPassphrase  = apierr.Define("wrong_passphrase", http.StatusForbidden)
+	codeAPIKeyNotFound   = apierr.Define("api_key_not_found", http.StatusNotFound)
+	codeTenantNotFound   = apierr.Define("tenant_not_found", http.StatusNotFound)
+	codeTenantExists     = apierr.Define("tenant_exists", http.StatusConflict)
+	codeBodyTooLarge     = apierr.Define("body_too_large", http.StatusRequestEntityTooLarge)
+	codePoWRequired      = apierr.Define("pow_required", http.StatusPreconditionRequired)
+	codeTxTooLarge       = apierr.Define("tx_too_large", http.StatusRequestEntityTooLarge)
+)
+
+// errorCodes gives the code of each error handlers pass on from below.
+var errorCodes = []struct {
+	err  error
+	code apierr.Code
+}{
+	{ErrChainInvalid, codeChainInvalid},
+	{ErrWrongChain, codeWrongChain},
+	{ErrDuplicateTx, codeDuplicateTx},
+	{ErrUnsigned, codeUnsigned},
+	{ErrInvalidPublicKey, codeInvalidSignature},
+	{ErrInvalidSignature, codeInvalidSignature},
+	{ErrBookNotFound, codeBookNotFound},
+	{ErrUnknownBook, codeUnknownBook},
+	{ErrBookWithdrawn, codeBookWithdrawn},
+	{ErrCheckedOut, codeCheckedOut},
+	{ErrNotCheckedOut, codeNotCheckedOut},
+	{ErrNotHolder, codeNotBorrower},
+	{ErrHasBook, codeHasBook},
+	{ErrBookOnHold, codeBookOnHold},
+	{ErrAlreadyHeld, codeHoldExists},
+	{ErrNoHold, codeNoHold},
+	{ErrRenewalLimit, codeRenewalLimit},
+	{ErrOverpayment, codeOverpayment},
+	{ErrBookAway, codeBookAway},
+	{ErrWrittenOff, codeWrittenOff},
+	{ErrAlreadyDonated, codeAlreadyDonated},
+	{ErrLoanLimit, codeLoanLimit},
+	{ErrAgeRestricted, codeAgeRestricted},
+	{ErrMemberNotFound, codeMemberNotFound},
+	{ErrMemberExists, codeMemberExists},
+	{ErrUnknownMember, codeUnknownMember},
+	{ErrMemberSuspended, codeMemberSuspended},
+	{keys.ErrNotFound, codeWalletNotFound},
+	{keys.ErrExists, codeWalletExists},
+	{keys.ErrBadPassphrase, codeWrongPassphrase},
+	{keys.ErrInvalidName, apierr.InvalidRequest},
+	{ErrAPIKeyNotFound, codeAPIKeyNotFound},
+	{ErrInvalidScope, apierr.InvalidRequest},
+	{ErrTenantNotFound, codeTenantNotFound},
+	{ErrTenantExists, codeTenantExists},
+	{ErrInvalidTenant, apierr.InvalidRequest},
+	{ErrUnknownClient, apierr.Unauthenticated},
+	{ErrBadSignature, apierr.Unauthenticated},
+	{ErrStaleRequest, apierr.Unauthenticated},
+	{ErrReplayed, apierr.Unauthenticated},
+	{ErrOIDCUnavailable, apierr.Unavailable},
+	{ErrNotPseudonymous, codeNotPseudonymous},
+	{ErrUnknownPseudonym, codePseudonymUnknown},
+	{ErrPayloadHash, apierr.InvalidRequest},
+	{ErrSealedUser, apierr.InvalidRequest},
+	{ErrRedacted, codePayloadNotFound},
+	{ErrMemberActive, codeMemberActive},
+	{ErrTxTooLarge, codeTxTooLarge},
+	{ErrBlockTooLarge, codeTxTooLarge},
+	{ErrBackupTooLarge, codeBodyTooLarge},
+}
+
+// apiError gives err a code: its own if it is already an *apierr.Error, the
+// code of a known cause from errorCodes, or else fallback.
+func apiError(err error, fallback apierr.Code) *apierr.Error {
+	var e *apierr.Error
+	if errors.As(err, &e) {
+		return e
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return apierr.Errorf(codeBodyTooLarge, "request body is over %d bytes", tooLarge.Limit)
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return apierr.Wrap(c.code, err)
+		}
+	}
+	return apierr.Wrap(fallback, err)
+}
+
+// txError is the error reported for a transaction the chain refused. Like
+// the checks behind it, anything not known to conflict with the chain is
+// the client's mistake.
+func txError(err error) *apierr.Error {
+	return apiError(err, apierr.InvalidRequest)
+}
+
+// writeError sends err in the error envelope, with the request's ID.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	apierr.Write(w, requestID(r.Context()), err)
+}
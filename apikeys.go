@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"blockchain/apierr"
+)
+
+// API key scopes. Each scope includes the ones below it.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+const apiKeyPrefix = "lk_"
+
+var apiKeyFile = "apikeys.json"
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInvalidScope   = errors.New(`scopes must be "read", "write" or "admin"`)
+)
+
+// APIKey is a stored key for a machine integration. Only the SHA-256 of the
+// secret is kept; the full key is shown once, when it is created or rotated.
+type APIKey struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	SecretHash string   `json:"secret_hash,omitempty"`
+	Created    string   `json:"created"`
+	Rotated    string   `json:"rotated,omitempty"`
+	Revoked    string   `json:"revoked,omitempty"`
+}
+
+var (
+	scopeLevel = map[string]int{ScopeRead: 1, ScopeWrite: 2, ScopeAdmin: 3}
+	roleLevel  = map[string]int{RoleAuditor: 1, RoleMember: 2, RoleLibrarian: 3}
+)
+
+// allows reports whether the key may use a route open to the given roles.
+// Librarian routes need admin, member routes write and auditor routes read.
+// A write key may act for any member.
+func (k APIKey) allows(roles []string) bool {
+	have := 0
+	for _, s := range k.Scopes {
+		have = max(have, scopeLevel[s])
+	}
+	for _, role := range roles {
+		if need := roleLevel[role]; need > 0 && have >= need {
+			return true
+		}
+	}
+	return false
+}
+
+type APIKeyStore struct {
+	mu   sync.Mutex
+	path string
+	keys map[string]APIKey
+}
+
+var APIKeys *APIKeyStore
+
+func OpenAPIKeys(path string) (*APIKeyStore, error) {
+	s := &APIKeyStore{path: path, keys: map[string]APIKey{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		s.keys[k.ID] = k
+	}
+	return s, nil
+}
+
+func (s *APIKeyStore) saveLocked() error {
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return writeFileAtomic(s.path, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(keys)
+	})
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Create stores a new key and returns it with the full key string.
+func (s *APIKeyStore) Create(name string, scopes []string) (APIKey, string, error) {
+	if len(scopes) == 0 {
+		return APIKey{}, "", ErrInvalidScope
+	}
+	for _, sc := range scopes {
+		if sc != ScopeRead && sc != ScopeWrite && sc != ScopeAdmin {
+			return APIKey{}, "", ErrInvalidScope
+		}
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return APIKey{}, "", err
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	k := APIKey{
+		ID:         hex.EncodeToString(id),
+		Name:       name,
+		Scopes:     slices.Compact(slices.Sorted(slices.Values(scopes))),
+		SecretHash: hashSecret(secret),
+		Created:    time.Now().UTC().Format(time.RFC3339),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.ID] = k
+	if err := s.saveLocked(); err != nil {
+		delete(s.keys, k.ID)
+		return APIKey{}, "", err
+	}
+	return k, apiKeyPrefix + k.ID + "_" + secret, nil
+}
+
+// Rotate replaces a key's secret. The old key stops working at once.
+func (s *APIKeyStore) Rotate(id string) (APIKey, string, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.keys[id]
+	if !ok || old.Revoked != "" {
+		return APIKey{}, "", ErrAPIKeyNotFound
+	}
+	k := old
+	k.SecretHash = hashSecret(secret)
+	k.Rotated = time.Now().UTC().Format(time.RFC3339)
+	s.keys[id] = k
+	if err := s.saveLocked(); err != nil {
+		s.keys[id] = old
+		return APIKey{}, "", err
+	}
+	return k, apiKeyPrefix + id + "_" + secret, nil
+}
+
+// Revoke disables a key. Revoked keys stay listed.
+func (s *APIKeyStore) Revoke(id string) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	if old.Revoked != "" {
+		return old, nil
+	}
+	k := old
+	k.Revoked = time.Now().UTC().Format(time.RFC3339)
+	s.keys[id] = k
+	if err := s.saveLocked(); err != nil {
+		s.keys[id] = old
+		return APIKey{}, err
+	}
+	return k, nil
+}
+
+func (s *APIKeyStore) List() []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		k.SecretHash = ""
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Check returns the live key matching a full key string.
+func (s *APIKeyStore) Check(key string) (APIKey, bool) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(key, apiKeyPrefix) {
+		return APIKey{}, false
+	}
+	s.mu.Lock()
+	k, found := s.keys[id]
+	s.mu.Unlock()
+	if !found || k.Revoked != "" {
+		return APIKey{}, false
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(k.SecretHash)) != 1 {
+		return APIKey{}, false
+	}
+	return k, true
+}
+
+// apiKeyResponse is a key as returned once on creation or rotation.
+type apiKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+func listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	respond(w, r, APIKeys.List())
+}
+
+func createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := decodeJSON(r.Body, &req); err != nil || req.Name == "" {
+		writeError(w, r, apierr.New(apierr.InvalidRequest, "invalid api key request"))
+		return
+	}
+	k, key, err := APIKeys.Create(req.Name, req.Scopes)
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	k.SecretHash = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(apiKeyResponse{APIKey: k, Key: key})
+}
+
+func rotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	k, key, err := APIKeys.Rotate(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	k.SecretHash = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiKeyResponse{APIKey: k, Key: key})
+}
+
+func revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	k, err := APIKeys.Revoke(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	k.SecretHash = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(k)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"blockchain/apierr"
+)
+
+const (
+	apiVersionHeader = "API-Version"
+	// apiMediaType is the vendor media type clients can put in Accept to ask
+	// for a version, as application/vnd.library-chain.v1+json.
+	apiMediaType = "application/vnd.library-chain"
+	// legacyAPIVersion is the version the unversioned routes serve when a
+	// request does not ask for one.
+	legacyAPIVersion = "v1"
+)
+
+// legacyAPIDeprecated is when the unversioned routes were deprecated.
+var legacyAPIDeprecated = time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)
+
+// legacyAPISunset is the date, as YYYY-MM-DD, after which the unversioned
+// routes may be removed. It is sent in the Sunset header; empty leaves it out.
+var legacyAPISunset = "2027-04-15"
+
+// apiVersion is one version of the HTTP API, served under /api/<name>.
+type apiVersion struct {
+	name   string
+	routes func(r *mux.Router)
+}
+
+// apiVersions are the versions served, oldest first. A new version, such as
+// one with multi-transaction blocks, is added here with its own routes and
+// is served next to the others.
+var apiVersions = []apiVersion{
+	{name: "v1", routes: apiV1Routes},
+}
+
+// apiRouters holds the subrouter of each version, for legacy requests that
+// ask for a version other than legacyAPIVersion.
+var apiRouters = map[string]*mux.Router{}
+
+// mountAPI serves every API version under /api/<version>, and the legacy
+// version's routes at their old unversioned paths too, marked deprecated.
+func mountAPI(r *mux.Router) error {
+	var sunset string
+	if legacyAPISunset != "" {
+		t, err := time.Parse(time.DateOnly, legacyAPISunset)
+		if err != nil {
+			return fmt.Errorf("invalid -legacy-api-sunset %q: want YYYY-MM-DD", legacyAPISunset)
+		}
+		sunset = t.Format(http.TimeFormat)
+	}
+	var legacy *apiVersion
+	for i, v := range apiVersions {
+		sub := r.PathPrefix("/api/" + v.name).Subrouter()
+		sub.Use(withAPIVersion(v.name))
+		v.routes(sub)
+		sub.NotFoundHandler = unmatched(notFoundOrNotAllowed(sub))
+		apiRouters[v.name] = sub
+		if v.name == legacyAPIVersion {
+			legacy = &apiVersions[i]
+		}
+	}
+	if legacy == nil {
+		return fmt.Errorf("legacy API version %s is not served", legacyAPIVersion)
+	}
+	// The legacy routes leave /api/ paths to the versioned routers.
+	sub := r.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+		return !strings.HasPrefix(req.URL.Path, "/api/")
+	}).Subrouter()
+	sub.Use(middlewareLegacyAPI(sunset))
+	legacy.routes(sub)
+	sub.NotFoundHandler = unmatched(notFoundOrNotAllowed(sub))
+	r.NotFoundHandler = unmatched(http.HandlerFunc(notFound))
+	return nil
+}
+
+// unmatched wraps a handler for requests no route matched, which gorilla/mux
+// serves without the router's middleware, so they still get a request ID
+// and CORS headers.
+func unmatched(h http.Handler) http.Handler {
+	return middlewareLogging(middlewareCORS(h))
+}
+
+// notFoundOrNotAllowed answers 405 when sub has the path for other methods,
+// and 404 otherwise. gorilla/mux reports a wrong method as 404 inside a
+// subrouter.
+func notFoundOrNotAllowed(sub *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var allow []string
+		for _, method := range []string{"GET", "POST", "PUT", "DELETE"} {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			var match mux.RouteMatch
+			if sub.Match(probe, &match) && match.MatchErr == nil {
+				allow = append(allow, method)
+			}
+		}
+		if len(allow) == 0 {
+			notFound(w, r)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		writeError(w, r, apierr.Errorf(apierr.MethodNotAllowed, "%s is not allowed here", r.Method))
+	})
+}
+
+// notFound answers requests for paths no route serves.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, apierr.Errorf(apierr.NotFound, "no route for %s", r.URL.Path))
+}
+
+// withAPIVersion labels responses with the version that served them.
+func withAPIVersion(name string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(apiVersionHeader, name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// middlewareLegacyAPI marks responses from the unversioned routes as
+// deprecated (RFC 9745), with their Sunset date (RFC 8594) and a Link to the
+// versioned route. A request that asks for another version is handed to it.
+func middlewareLegacyAPI(sunset string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			version, err := requestedAPIVersion(r)
+			if err != nil {
+				writeError(w, r, apierr.Wrap(apierr.NotAcceptable, err).WithDetails(map[string][]string{"supported_versions": apiVersionNames()}))
+				return
+			}
+			if version == "" {
+				version = legacyAPIVersion
+			}
+			successor := "/api/" + version + r.URL.EscapedPath()
+			w.Header().Set("Deprecation", fmt.Sprintf("@%d", legacyAPIDeprecated.Unix()))
+			if sunset != "" {
+				w.Header().Set("Sunset", sunset)
+			}
+			w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+			if version == legacyAPIVersion {
+				w.Header().Set(apiVersionHeader, version)
+				next.ServeHTTP(w, r)
+				return
+			}
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = "/api/" + version + r.URL.Path
+			r2.URL.RawPath = ""
+			apiRouters[version].ServeHTTP(w, r2)
+		})
+	}
+}
+
+// requestedAPIVersion returns the version a request asks for in the
+// API-Version header or the Accept header, or "" if it asks for none.
+func requestedAPIVersion(r *http.Request) (string, error) {
+	version := r.Header.Get(apiVersionHeader)
+	if version == "" {
+		for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+			mt, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+			if err != nil {
+				continue
+			}
+			if v, ok := strings.CutPrefix(mt, apiMediaType+"."); ok {
+				version = strings.TrimSuffix(v, "+json")
+				break
+			}
+		}
+	}
+	if version == "" {
+		return "", nil
+	}
+	if _, ok := apiRouters[version]; !ok {
+		return "", fmt.Errorf("unsupported API version %q", version)
+	}
+	return version, nil
+}
+
+func apiVersionNames() []string {
+	names := make([]string, len(apiVersions))
+	for i, v := range apiVersions {
+		names[i] = v.name
+	}
+	return names
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// KindBook is the kind of a catalog entry with an empty Kind. Books keep
+// their ISBN-based IDs and use the -loan-days, -max-renewals and
+// -fine-per-day policy.
+const KindBook = "book"
+
+const maxSerialLen = 64
+
+// AssetKind is a kind of item the library lends besides books, such as DVDs
+// or laptops, with its own loan policy. Items of other kinds are identified
+// by a serial number (an asset tag) rather than an ISBN.
+type AssetKind struct {
+	Name        string `json:"name"`
+	LoanDays    int    `json:"loan_days"`
+	MaxRenewals int    `json:"max_renewals"`
+	FinePerDay  int64  `json:"fine_per_day"`
+}
+
+var (
+	assetKindsSpec = "dvd:7:1:50,laptop:3:0:500,room-key:1:0:1000,equipment:7:1:200"
+	assetKinds     map[string]AssetKind
+)
+
+var validKindName = regexp.MustCompile(`^[a-z][a-z0-9-]{0,31}$`)
+
+// parseAssetKinds reads -asset-kinds: comma-separated
+// name:loan-days:max-renewals:fine-per-day entries.
+func parseAssetKinds(spec string) (map[string]AssetKind, error) {
+	kinds := map[string]AssetKind{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("asset kind %q is not name:loan-days:max-renewals:fine-per-day", entry)
+		}
+		name := parts[0]
+		if name == KindBook || !validKindName.MatchString(name) {
+			return nil, fmt.Errorf("invalid asset kind name %q", name)
+		}
+		days, err1 := strconv.Atoi(parts[1])
+		renewals, err2 := strconv.Atoi(parts[2])
+		fine, err3 := strconv.ParseInt(parts[3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil || days < 1 || renewals < 0 || fine < 0 {
+			return nil, fmt.Errorf("invalid policy for asset kind %s", name)
+		}
+		kinds[name] = AssetKind{Name: name, LoanDays: days, MaxRenewals: renewals, FinePerDay: fine}
+	}
+	return kinds, nil
+}
+
+// policyFor returns the loan policy of a kind. Books, and items of a kind
+// no longer configured, get the book policy.
+// Either may be overridden by -loan-rules.
+func policyFor(kind string) AssetKind {
+	k, ok := assetKinds[kind]
+	if !ok {
+		k = AssetKind{Name: KindBook, LoanDays: loanDays, MaxRenewals: maxRenewals, FinePerDay: finePerDay}
+	}
+	return currentRules().overrides(k)
+}
+
+// knownKind reports whether kind can be given to a new catalog entry.
+func knownKind(kind string) bool {
+	_, ok := assetKinds[kind]
+	return kind == "" || ok
+}
+
+// kindNames lists the configured kinds, books first.
+func kindNames() []string {
+	names := make([]string, 0, len(assetKinds))
+	for name := range assetKinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{KindBook}, names...)
+}
+
+// kindOf names the kind of a catalog entry.
+func (b Book) kindOf() string {
+	if b.Kind == "" {
+		return KindBook
+	}
+	return b.Kind
+}
+
+// getAssetKinds answers GET /asset-kinds with each kind's loan policy.
+func getAssetKinds(w http.ResponseWriter, r *http.Request) {
+	out := make([]AssetKind, 0, len(assetKinds)+1)
+	for _, name := range kindNames() {
+		out = append(out, policyFor(name))
+	}
+	respond(w, r, out)
+}
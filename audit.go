@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"blockchain/apierr"
+	"blockchain/chainpb"
+)
+
+var auditFile = "audit.log"
+
+// Outcomes of an audited call.
+const (
+	AuditSuccess  = "success"
+	AuditRejected = "rejected"
+	AuditFailed   = "failed"
+)
+
+// AuditEntry is one API call that could change the node's state, recorded
+// whether it succeeded or not. Each entry carries the hash of the one before
+// it, so an entry edited or removed from the middle of the log is noticed.
+type AuditEntry struct {
+	Seq       int       `json:"seq"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Actor     string    `json:"actor,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Route     string    `json:"route,omitempty"`
+	Status    int       `json:"status,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Code      string    `json:"code,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash"`
+}
+
+// hash is the entry's hash, over its JSON encoding without the hash itself.
+func (e AuditEntry) hash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditLog is an append-only file of audit entries, one JSON object per
+// line, kept apart from the chain, which records only what succeeded.
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	seq  int
+	last string
+}
+
+var Audit *AuditLog
+
+// OpenAuditLog opens the log at path, checking that every entry links to
+// the one before. A torn last line left by a crash is cut off; any other
+// damage is an error.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	a := &AuditLog{file: file}
+	var good int64
+	err = a.scan(func(e AuditEntry, end int64) bool {
+		good, a.seq, a.last = end, e.Seq, e.Hash
+		return true
+	})
+	var torn *tornAuditError
+	if errors.As(err, &torn) {
+		log.Printf("Warning: cutting the torn last entry off %s", path)
+		err = file.Truncate(good)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("audit log %s: %w", path, err)
+	}
+	return a, nil
+}
+
+type tornAuditError struct{}
+
+func (*tornAuditError) Error() string { return "torn last entry" }
+
+// scan calls fn for every entry in order, with the offset just past it,
+// until fn returns false.
+func (a *AuditLog) scan(fn func(e AuditEntry, end int64) bool) error {
+	r := bufio.NewReader(io.NewSectionReader(a.file, 0, 1<<62))
+	var end int64
+	prev := ""
+	for seq := 1; ; seq++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err == io.EOF {
+			return &tornAuditError{}
+		}
+		if err != nil {
+			return err
+		}
+		end += int64(len(line))
+		var e AuditEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("entry %d: %w", seq, err)
+		}
+		if e.Seq != seq || e.Prev != prev || e.Hash != e.hash() {
+			return fmt.Errorf("entry %d does not follow the one before; the log was altered", seq)
+		}
+		prev = e.Hash
+		if !fn(e, end) {
+			return nil
+		}
+	}
+}
+
+// Append numbers e, links it to the last entry and writes it durably.
+func (a *AuditLog) Append(e AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e.Seq, e.Prev = a.seq+1, a.last
+	e.Hash = e.hash()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+	a.seq, a.last = e.Seq, e.Hash
+	return nil
+}
+
+// AuditFilter selects entries; empty fields match anything.
+type AuditFilter struct {
+	Actor     string
+	Outcome   string
+	Method    string
+	Path      string
+	RequestID string
+	From, To  time.Time
+}
+
+func (f AuditFilter) match(e AuditEntry) bool {
+	return (f.Actor == "" || e.Actor == f.Actor) &&
+		(f.Outcome == "" || e.Outcome == f.Outcome) &&
+		(f.Method == "" || e.Method == f.Method) &&
+		(f.Path == "" || strings.HasPrefix(e.Path, f.Path)) &&
+		(f.RequestID == "" || e.RequestID == f.RequestID) &&
+		(f.From.IsZero() || !e.Time.Before(f.From)) &&
+		(f.To.IsZero() || !e.Time.After(f.To))
+}
+
+// Query returns the entries f selects, newest first.
+func (a *AuditLog) Query(f AuditFilter) ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var out []AuditEntry
+	err := a.scan(func(e AuditEntry, _ int64) bool {
+		if f.match(e) {
+			out = append(out, e)
+		}
+		return true
+	})
+	slices.Reverse(out)
+	return out, err
+}
+
+func (a *AuditLog) Close() error {
+	return a.file.Close()
+}
+
+type auditKey struct{}
+
+// auditActor records who made the call being audited, once it is known.
+func auditActor(ctx context.Context, subject, role, tenant string) {
+	if e, ok := ctx.Value(auditKey{}).(*AuditEntry); ok {
+		e.Actor, e.Role, e.Tenant = subject, role, cmp.Or(e.Tenant, tenant)
+	}
+}
+
+// auditClaims records the caller of an authenticated request.
+func auditClaims(ctx context.Context, claims *Claims) {
+	auditActor(ctx, claims.Subject, normalizeRole(claims.Role), claims.Tenant)
+}
+
+// audited reports whether a request could change state: anything but a
+// read, except GraphQL, which only reads.
+func audited(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return !strings.HasSuffix(routeOf(r), "/graphql")
+}
+
+func httpOutcome(status int) string {
+	switch {
+	case status >= 500:
+		return AuditFailed
+	case status >= 400:
+		return AuditRejected
+	}
+	return AuditSuccess
+}
+
+// auditWriter records the status of a response and the start of an error
+// body, for its code.
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+const auditBodyMax = 4096
+
+func (aw *auditWriter) WriteHeader(status int) {
+	if aw.status == 0 {
+		aw.status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *auditWriter) Write(p []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	if aw.status >= 400 && len(aw.body) < auditBodyMax {
+		aw.body = append(aw.body, p[:min(len(p), auditBodyMax-len(aw.body))]...)
+	}
+	return aw.ResponseWriter.Write(p)
+}
+
+func (aw *auditWriter) Flush() {
+	if f, ok := aw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (aw *auditWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// middlewareAudit appends an entry to the audit log for every request that
+// could change state, once it is done. It runs inside the logging
+// middleware, so entries carry the request ID, and outside everything that
+// can refuse a request, so refusals are recorded too.
+func middlewareAudit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if Audit == nil || !audited(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		e := &AuditEntry{
+			RequestID: requestID(r.Context()),
+			Tenant:    mux.Vars(r)["tenant"],
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Route:     routeOf(r),
+			ClientIP:  clientIP(r),
+		}
+		aw := &auditWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), auditKey{}, e)))
+		if aw.status == 0 {
+			aw.status = http.StatusOK
+		}
+		e.Time = time.Now().UTC()
+		e.Status = aw.status
+		e.Outcome = httpOutcome(aw.status)
+		var env apierr.Envelope
+		if json.Unmarshal(aw.body, &env) == nil {
+			e.Code = string(env.Code)
+		}
+		if err := Audit.Append(*e); err != nil {
+			reqLog(r).Error("Error writing audit log", "error", err)
+		}
+	})
+}
+
+// grpcAudit is middlewareAudit for the gRPC calls that change state. It
+// runs before grpcAuth, so calls refused there are recorded too.
+func grpcAudit(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if Audit == nil || info.FullMethod != chainpb.Chain_SubmitCheckout_FullMethodName {
+		return handler(ctx, req)
+	}
+	e := &AuditEntry{RequestID: newRequestID(), Method: "GRPC", Path: info.FullMethod}
+	if p, ok := peer.FromContext(ctx); ok {
+		e.ClientIP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(e.ClientIP); err == nil {
+			e.ClientIP = host
+		}
+	}
+	resp, err := handler(context.WithValue(ctx, auditKey{}, e), req)
+	e.Time = time.Now().UTC()
+	switch code := status.Code(err); code {
+	case codes.OK:
+		e.Outcome = AuditSuccess
+	case codes.Internal, codes.Unknown, codes.Unavailable, codes.DataLoss:
+		e.Outcome, e.Code = AuditFailed, code.String()
+	default:
+		e.Outcome, e.Code = AuditRejected, code.String()
+	}
+	if aerr := Audit.Append(*e); aerr != nil {
+		log.Printf("Error writing audit log: %v", aerr)
+	}
+	return resp, err
+}
+
+// AuditPage is one page of audit entries, newest first.
+type AuditPage struct {
+	Entries []AuditEntry `json:"entries"`
+	Total   int          `json:"total"`
+	Offset  int          `json:"offset"`
+	Limit   int          `json:"limit"`
+}
+
+// getAuditLog answers GET /admin/audit, filtered by the actor, outcome,
+// method, path (a prefix), request_id, from and to query parameters.
+func getAuditLog(w http.ResponseWriter, r *http.Request) {
+	if Audit == nil {
+		writeError(w, r, apierr.New(apierr.NotFound, "the node runs without an audit log"))
+		return
+	}
+	offset, limit, err := parsePage(r)
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.InvalidRequest, err))
+		return
+	}
+	from, to, err := dateRange(r)
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.InvalidRequest, err))
+		return
+	}
+	q := r.URL.Query()
+	f := AuditFilter{
+		Actor:     q.Get("actor"),
+		Outcome:   q.Get("outcome"),
+		Method:    strings.ToUpper(q.Get("method")),
+		Path:      q.Get("path"),
+		RequestID: q.Get("request_id"),
+		From:      from,
+		To:        to,
+	}
+	switch f.Outcome {
+	case "", AuditSuccess, AuditRejected, AuditFailed:
+	default:
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "outcome must be %s, %s or %s", AuditSuccess, AuditRejected, AuditFailed))
+		return
+	}
+	entries, err := Audit.Query(f)
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.Internal, err))
+		return
+	}
+	start := min(offset, len(entries))
+	end := min(start+limit, len(entries))
+	page := AuditPage{Entries: entries[start:end], Total: len(entries), Offset: offset, Limit: limit}
+	if page.Entries == nil {
+		page.Entries = []AuditEntry{}
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	w.Header().Add("Link", pageLinks(r, offset, limit, page.Total))
+	respond(w, r, page)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"blockchain/apierr"
+	"blockchain/chainpb"
+)
+
+var (
+	authEnabled     bool
+	authKeyFile     = "auth.key"
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 7 * 24 * time.Hour
+)
+
+const (
+	tokenAccess  = "access"
+	tokenRefresh = "refresh"
+)
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Claims are carried by both token kinds. The subject is the wallet name the
+// user logged in with, and Tenant the branch its wallet belongs to, if any.
+// Requests made with an API key or an HMAC signature get claims with the key
+// set, carrying its scopes, and no role.
+type Claims struct {
+	Role   string `json:"role"`
+	Kind   string `json:"kind"`
+	Tenant string `json:"tenant,omitempty"`
+	jwt.RegisteredClaims
+
+	key *APIKey
+}
+
+// TokenIssuer signs and checks tokens with an HMAC key kept on disk, so
+// tokens survive a restart. Refresh tokens are single use: each refresh
+// revokes the token it was given.
+type TokenIssuer struct {
+	keyMu sync.RWMutex
+	key   []byte
+	// prev is the key before the last rotation, still accepted for the
+	// tokens it signed.
+	prev []byte
+
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+var Tokens *TokenIssuer
+
+// loopbackAddr reports whether a listen address only accepts connections
+// from this machine. An address with no host listens on every interface.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// warnUnauthenticated logs, at startup, every address that serves the routes
+// changing the chain to anyone who can reach it, because -auth is off.
+func warnUnauthenticated() {
+	if authEnabled {
+		return
+	}
+	for _, addr := range []string{listenAddr, grpcAddr} {
+		if addr != "" && !loopbackAddr(addr) {
+			slog.Warn("-auth is off, so anyone who can reach the node may write to the chain, the catalog, wallets and /admin; start with -auth or listen on a loopback address", "addr", addr)
+		}
+	}
+}
+
+// LoadOrCreateTokenIssuer reads the signing key from src or, without one,
+// from path, creating it on first run.
+func LoadOrCreateTokenIssuer(src, path string) (*TokenIssuer, error) {
+	key, err := loadSecret(src, path)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenIssuer{key: key, revoked: map[string]time.Time{}}, nil
+}
+
+// loadOrCreateSecret reads a hex key of at least 32 bytes from path, or
+// writes a new random one there, readable only by the node's user.
+func loadOrCreateSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key)), 0o600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) < 32 {
+		return nil, fmt.Errorf("%s does not hold a hex key of at least 32 bytes", path)
+	}
+	return key, nil
+}
+
+func (t *TokenIssuer) issue(user, role, tenant, kind string, ttl time.Duration) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := Claims{
+		Role:   role,
+		Kind:   kind,
+		Tenant: tenant,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user,
+			ID:        hex.EncodeToString(id),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+	t.keyMu.RLock()
+	defer t.keyMu.RUnlock()
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(t.key)
+}
+
+// Rotate signs new tokens with key, and reports whether it differs from the
+// key in use. Tokens signed with the key it replaces stay valid until they
+// expire or the key is rotated again.
+func (t *TokenIssuer) Rotate(key []byte) bool {
+	t.keyMu.Lock()
+	defer t.keyMu.Unlock()
+	if bytes.Equal(key, t.key) {
+		return false
+	}
+	t.prev, t.key = t.key, key
+	return true
+}
+
+// TokenPair is what /auth/login and /auth/refresh return.
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+func (t *TokenIssuer) Issue(user, role, tenant string) (TokenPair, error) {
+	access, err := t.issue(user, role, tenant, tokenAccess, accessTokenTTL)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	refresh, err := t.issue(user, role, tenant, tokenRefresh, refreshTokenTTL)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{AccessToken: access, RefreshToken: refresh, TokenType: "Bearer", ExpiresIn: int(accessTokenTTL.Seconds())}, nil
+}
+
+// Parse checks a token's signature, expiry and kind.
+func (t *TokenIssuer) Parse(token, kind string) (*Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		t.keyMu.RLock()
+		defer t.keyMu.RUnlock()
+		if t.prev == nil {
+			return t.key, nil
+		}
+		return jwt.VerificationKeySet{Keys: []jwt.VerificationKey{t.key, t.prev}}, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil || claims.Kind != kind || claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+	return &claims, nil
+}
+
+// Refresh exchanges a refresh token for a new pair and revokes it.
+func (t *TokenIssuer) Refresh(token string) (TokenPair, error) {
+	claims, err := t.Parse(token, tokenRefresh)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	t.mu.Lock()
+	now := time.Now()
+	for id, exp := range t.revoked {
+		if now.After(exp) {
+			delete(t.revoked, id)
+		}
+	}
+	if _, used := t.revoked[claims.ID]; used {
+		t.mu.Unlock()
+		return TokenPair{}, ErrInvalidToken
+	}
+	t.revoked[claims.ID] = claims.ExpiresAt.Time
+	t.mu.Unlock()
+	return t.Issue(claims.Subject, claims.Role, claims.Tenant)
+}
+
+type authContextKey struct{}
+
+// authClaims returns the claims of the request's access token, or nil when
+// authentication is disabled.
+func authClaims(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(authContextKey{}).(*Claims)
+	return claims
+}
+
+func bearerToken(header string) string {
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// writeAuthError sends err, challenging the client to authenticate if it
+// did not.
+func writeAuthError(w http.ResponseWriter, r *http.Request, err *apierr.Error) {
+	if err.Status() == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="library"`)
+	}
+	writeError(w, r, err)
+}
+
+// authenticate accepts either an API key or a bearer access token, the
+// node's own or, with -oidc-issuer, one from the identity provider.
+func authenticate(authorization, apiKey string) (*Claims, error) {
+	if apiKey != "" {
+		k, ok := APIKeys.Check(apiKey)
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+		return &Claims{Kind: "api_key", RegisteredClaims: jwt.RegisteredClaims{Subject: "key:" + k.Name}, key: &k}, nil
+	}
+	token := bearerToken(authorization)
+	claims, err := Tokens.Parse(token, tokenAccess)
+	if err != nil && OIDC != nil && token != "" {
+		return OIDC.Authenticate(token)
+	}
+	return claims, err
+}
+
+// requireAuth rejects requests without a valid access token, API key or
+// HMAC signature when authentication is enabled.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled {
+			next(w, r)
+			return
+		}
+		if r.Header.Get(signatureHeader) != "" {
+			if HMACClients == nil {
+				writeAuthError(w, r, apierr.New(apierr.Unauthenticated, "signed requests are not enabled"))
+				return
+			}
+			c, err := HMACClients.Verify(r)
+			if err != nil {
+				writeAuthError(w, r, apiError(err, apierr.Unauthenticated))
+				return
+			}
+			claims := &Claims{Kind: "hmac", RegisteredClaims: jwt.RegisteredClaims{Subject: "client:" + c.ID}, key: &APIKey{Name: c.ID, Scopes: c.Scopes}}
+			auditClaims(r.Context(), claims)
+			next(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, claims)))
+			return
+		}
+		claims, err := authenticate(r.Header.Get("Authorization"), r.Header.Get("X-API-Key"))
+		if err != nil {
+			writeAuthError(w, r, apierr.New(apierr.Unauthenticated, "authentication required"))
+			return
+		}
+		auditClaims(r.Context(), claims)
+		next(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, claims)))
+	}
+}
+
+// requireRoleUnlessNoWallets lets the first wallet be created without a
+// token, since nobody could log in before it exists.
+func requireRoleUnlessNoWallets(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	authed := requireRole(next, roles...)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if infos, err := Wallets.List(); err == nil && len(infos) == 0 {
+			next(w, r)
+			return
+		}
+		authed(w, r)
+	}
+}
+
+// login checks a wallet name and passphrase and issues tokens carrying the
+// wallet's role.
+func login(w http.ResponseWriter, r *http.Request) {
+	var req walletRequest
+	if err := decodeJSON(r.Body, &req); err != nil || req.Name == "" {
+		writeAuthError(w, r, apierr.New(apierr.InvalidRequest, "invalid login request"))
+		return
+	}
+	auditActor(r.Context(), req.Name, "", "")
+	if _, err := Wallets.Export(req.Name, req.Passphrase); err != nil {
+		writeAuthError(w, r, apierr.New(apierr.Unauthenticated, "invalid name or passphrase"))
+		return
+	}
+	info, err := Wallets.Get(req.Name)
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	pair, err := Tokens.Issue(info.Name, normalizeRole(info.Role), info.Tenant)
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.Internal, err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pair)
+}
+
+func refreshToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := decodeJSON(r.Body, &req); err != nil || req.RefreshToken == "" {
+		writeAuthError(w, r, apierr.New(apierr.InvalidRequest, "invalid refresh request"))
+		return
+	}
+	pair, err := Tokens.Refresh(req.RefreshToken)
+	if err != nil {
+		writeAuthError(w, r, apierr.Wrap(apierr.Unauthenticated, err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pair)
+}
+
+// grpcAuth requires an access token in the "authorization" metadata for
+// calls that change the chain, with the same role rules as POST /tx.
+func grpcAuth(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if !authEnabled || info.FullMethod != chainpb.Chain_SubmitCheckout_FullMethodName {
+		return handler(ctx, req)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token, apiKey string
+	if v := md.Get("authorization"); len(v) > 0 {
+		token = v[0]
+	}
+	if v := md.Get("x-api-key"); len(v) > 0 {
+		apiKey = v[0]
+	}
+	claims, err := authenticate(token, apiKey)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "authentication required")
+	}
+	auditClaims(ctx, claims)
+	if sub, ok := req.(*chainpb.SubmitCheckoutRequest); ok && sub.Checkout != nil {
+		if kind := checkoutFromProto(sub.Checkout).Kind(); !mayRecord(claims, kind) {
+			return nil, status.Errorf(codes.PermissionDenied, "only librarians may submit %s transactions", kind)
+		}
+	}
+	switch {
+	case claims.Tenant != "":
+		return nil, status.Errorf(codes.PermissionDenied, "this token is for tenant %q", claims.Tenant)
+	case claims.key != nil:
+		if !claims.key.allows([]string{RoleMember}) {
+			return nil, status.Error(codes.PermissionDenied, "api key lacks the write scope")
+		}
+	case normalizeRole(claims.Role) == RoleLibrarian:
+	case normalizeRole(claims.Role) == RoleMember:
+		if sub, ok := req.(*chainpb.SubmitCheckoutRequest); ok && memberOf(sub.Checkout.GetUser()) != claims.Subject {
+			return nil, status.Error(codes.PermissionDenied, "members may only act for themselves")
+		}
+	default:
+		return nil, status.Errorf(codes.PermissionDenied, "role %q may not do this", claims.Role)
+	}
+	return handler(context.WithValue(ctx, authContextKey{}, claims), req)
+}
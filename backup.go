@@ -0,0 +1,280 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"blockchain/apierr"
+)
+
+const (
+	backupVersion  = 1
+	backupChain    = "blockchain.json"
+	backupManifest = "manifest.json"
+	maxBackupSize  = 1 << 30
+	// maxBackupUnpacked caps what an archive may unpack to, since its
+	// files are read into memory.
+	maxBackupUnpacked = 2 << 30
+)
+
+var ErrBackupTooLarge = errors.New("backup unpacks to more than 2 GiB")
+
+type BackupManifest struct {
+	Version int               `json:"version"`
+	Created string            `json:"created"`
+	Height  int               `json:"height"`
+	TipHash string            `json:"tip_hash"`
+	Files   map[string]string `json:"files"`
+}
+
+// Replace validates blocks as a complete chain and installs it in place of
+// the current one.
+func (bc *Blockchain) Replace(blocks []*Block) error {
+	if err := bc.checkReplacement(blocks); err != nil {
+		return err
+	}
+	bc.writeMu.Lock()
+	defer bc.writeMu.Unlock()
+	return bc.install(blocks)
+}
+
+// checkReplacement checks that blocks are a valid chain this one may be
+// replaced with.
+func (bc *Blockchain) checkReplacement(blocks []*Block) error {
+	if len(blocks) == 0 {
+		return errors.New("chain is empty")
+	}
+	if err := sameHashAlgorithm(bc.Snapshot()[0], blocks[0]); err != nil {
+		return err
+	}
+	if report := (&Blockchain{Blocks: blocks}).Validate(); !report.Valid {
+		return fmt.Errorf("block %d is invalid: %s", *report.FirstInvalid, report.Reason)
+	}
+	return sameChain(bc.ChainID(), blocks[0].ChainID())
+}
+
+// install swaps in an already validated chain. writeMu must be held, except
+// by the Raft FSM, which applies entries one at a time and may not take it.
+func (bc *Blockchain) install(blocks []*Block) error {
+	if err := bc.store.Replace(blocks); err != nil {
+		return err
+	}
+	bc.mu.Lock()
+	bc.Blocks = blocks
+	bc.resetIndexes()
+	for _, b := range blocks {
+		bc.indexBlock(b)
+	}
+	bc.integrity = IntegrityReport{
+		ValidationReport: ValidationReport{Valid: true, Height: len(blocks)},
+		CheckedAt:        time.Now().UTC().Format(time.RFC3339),
+		Store:            storeKind,
+	}
+	bc.mu.Unlock()
+	bc.saveState()
+	if Books != nil {
+		if err := Books.Apply(blocks...); err != nil {
+			log.Printf("Error updating catalog: %v", err)
+		}
+	}
+	if Search != nil {
+		if err := Search.Rebuild(Books, blocks); err != nil {
+			log.Printf("Error rebuilding search index: %v", err)
+		}
+	}
+	return nil
+}
+
+// backupFiles are the node's data files besides the chain: the catalog,
+// members, saved state, wallets and the rest. Key files are left out, so an
+// archive in the clear does not carry the node's secrets.
+func backupFiles() []string {
+	files := []string{
+		catalogFile, memberFile, statePath(logFile), statePath(chainFile), checkpointFile, apiKeyFile,
+		tenantFile, payloadFile, pseudonymFile, auditFile,
+	}
+	if entries, err := os.ReadDir(walletDir); err == nil {
+		for _, e := range entries {
+			if e.Type().IsRegular() {
+				files = append(files, filepath.Join(walletDir, e.Name()))
+			}
+		}
+	}
+	return files
+}
+
+// backupName is where a data file goes in an archive: under data/, by its
+// path in the data directory.
+func backupName(path string) string {
+	dir := dataDir
+	if dir == "" {
+		dir = "."
+	}
+	if rel, err := filepath.Rel(dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return "data/" + filepath.ToSlash(rel)
+	}
+	return "data/" + filepath.Base(path)
+}
+
+// writeBackup writes a tar.gz holding a manifest, the chain as
+// blockchain.json and the data files the node has written so far.
+func writeBackup(w io.Writer, blocks []*Block) error {
+	chain, err := json.MarshalIndent(Blockchain{Blocks: blocks}, "", "  ")
+	if err != nil {
+		return err
+	}
+	type entry struct {
+		name string
+		data []byte
+	}
+	entries := []entry{{backupChain, chain}}
+	for _, path := range backupFiles() {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{backupName(path), data})
+	}
+	sums := map[string]string{}
+	for _, e := range entries {
+		sum := sha256.Sum256(e.data)
+		sums[e.name] = hex.EncodeToString(sum[:])
+	}
+	tip := blocks[len(blocks)-1]
+	manifest, err := json.MarshalIndent(BackupManifest{
+		Version: backupVersion,
+		Created: time.Now().UTC().Format(time.RFC3339),
+		Height:  tip.Pos,
+		TipHash: tip.Hash,
+		Files:   sums,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, f := range append([]entry{{backupManifest, manifest}}, entries...) {
+		hdr := &tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.data)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// readBackup unpacks a backup archive and checks it against its manifest.
+// Archives that unpack to more than maxBackupUnpacked are refused with
+// ErrBackupTooLarge.
+func readBackup(r io.Reader) (*BackupManifest, []*Block, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("not a gzip archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	files := map[string][]byte{}
+	left := int64(maxBackupUnpacked)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if left -= int64(len(hdr.Name)); hdr.Size > left {
+			return nil, nil, ErrBackupTooLarge
+		}
+		var buf bytes.Buffer
+		n, err := io.Copy(&buf, io.LimitReader(tr, left+1))
+		if err != nil {
+			return nil, nil, err
+		}
+		if n > left {
+			return nil, nil, ErrBackupTooLarge
+		}
+		left -= n
+		files[hdr.Name] = buf.Bytes()
+	}
+
+	var manifest BackupManifest
+	if err := json.Unmarshal(files[backupManifest], &manifest); err != nil {
+		return nil, nil, errors.New("backup has no valid manifest")
+	}
+	if manifest.Version != backupVersion {
+		return nil, nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+	for name, want := range manifest.Files {
+		data, ok := files[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("backup is missing %s", name)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != want {
+			return nil, nil, fmt.Errorf("checksum mismatch for %s", name)
+		}
+	}
+	var chain Blockchain
+	if err := json.Unmarshal(files[backupChain], &chain); err != nil {
+		return nil, nil, fmt.Errorf("decode %s: %w", backupChain, err)
+	}
+	if len(chain.Blocks) == 0 {
+		return nil, nil, errors.New("backup chain is empty")
+	}
+	tip := chain.Blocks[len(chain.Blocks)-1]
+	if tip.Pos != manifest.Height || tip.Hash != manifest.TipHash {
+		return nil, nil, errors.New("backup chain does not match manifest tip")
+	}
+	return &manifest, chain.Blocks, nil
+}
+
+func adminBackup(w http.ResponseWriter, r *http.Request) {
+	blocks := BlockChain.Snapshot()
+	tip := blocks[len(blocks)-1]
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chain-backup-%d.tar.gz"`, tip.Pos))
+	if err := writeBackup(w, blocks); err != nil {
+		reqLog(r).Error("Error writing backup", "error", err)
+	}
+}
+
+func adminRestore(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	manifest, blocks, err := readBackup(http.MaxBytesReader(w, r.Body, maxBackupSize))
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.InvalidRequest))
+		return
+	}
+	if err := BlockChain.Replace(blocks); err != nil {
+		writeError(w, r, apierr.Wrap(apierr.Unprocessable, err))
+		return
+	}
+	reqLog(r).Info("Restored chain from backup", "height", manifest.Height, "created", manifest.Created)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   "restored",
+		"height":   manifest.Height,
+		"tip_hash": manifest.TipHash,
+	})
+}
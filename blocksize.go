@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	maxBlockSize int64 = 8 << 20
+	maxBlockTxs        = 2000
+)
+
+// blockOverhead is the room a block keeps for everything but its
+// transactions: position, hashes, times and the node's signature.
+const blockOverhead = 4 << 10
+
+var (
+	ErrBlockTooLarge = errors.New("block is over the size limit")
+	ErrTxTooLarge    = errors.New("transaction does not fit in a block")
+)
+
+// blockSize is the length of a block's JSON encoding, as it is stored and
+// sent to peers.
+func blockSize(b *Block) int64 {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return 0
+	}
+	return int64(len(data))
+}
+
+func txSize(tx Transaction) int64 {
+	data, err := json.Marshal(tx)
+	if err != nil {
+		return 0
+	}
+	return int64(len(data))
+}
+
+// checkBlockLimits refuses a block with more than -max-block-txs
+// transactions or over -max-block-size bytes. Blocks already stored are not
+// held to it, so lowering the limits never breaks a chain, but a node will
+// neither produce nor accept one, and a peer cannot stall sync with it.
+func checkBlockLimits(b *Block) error {
+	if n := len(b.Transactions); n > maxBlockTxs {
+		return fmt.Errorf("%w: %d transactions, at most %d allowed", ErrBlockTooLarge, n, maxBlockTxs)
+	}
+	if size := blockSize(b); size > maxBlockSize {
+		return fmt.Errorf("%w: %d bytes, at most %d allowed", ErrBlockTooLarge, size, maxBlockSize)
+	}
+	return nil
+}
+
+// checkTxSize refuses a transaction too large for a block of its own.
+func checkTxSize(tx Transaction) error {
+	if size := txSize(tx); size > maxBlockSize-blockOverhead {
+		return fmt.Errorf("%w: %d bytes, at most %d allowed", ErrTxTooLarge, size, maxBlockSize-blockOverhead)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Blocks from version 2 on carry their time in UnixMilli, which the block
+// hash covers; Timestamp repeats it in UTC for people. Older blocks only have
+// Timestamp, a string their producer formatted.
+const blockTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// maxClockSkew is how far ahead of this node's clock a block from a peer, or
+// a date a client sends, may be.
+var maxClockSkew = 2 * time.Minute
+
+var ErrClockSkew = errors.New("block time is too far in the future")
+
+// Time returns when the block was produced, or the zero time for an old
+// block whose timestamp does not parse.
+func (b *Block) Time() time.Time {
+	if b.UnixMilli != 0 {
+		return time.UnixMilli(b.UnixMilli).UTC()
+	}
+	t, err := time.Parse(time.RFC3339, b.Timestamp)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// stamp sets the block's time to now. If the clock has gone back since the
+// previous block, it keeps the previous block's time instead, so block times
+// never decrease.
+func (b *Block) stamp(prev *Block) {
+	now := clock.Now()
+	if prev != nil && now.Before(prev.Time()) {
+		now = prev.Time()
+	}
+	b.setTime(now)
+}
+
+func (b *Block) setTime(t time.Time) {
+	b.UnixMilli = t.UnixMilli()
+	b.Timestamp = time.UnixMilli(b.UnixMilli).UTC().Format(blockTimeLayout)
+}
+
+// checkBlockTime is the version 2 rule for block times: UnixMilli is set,
+// Timestamp says the same, and the block is no older than its predecessor.
+// Migrated blocks keep the times they were produced with, so they are not
+// held to the ordering.
+func checkBlockTime(b, prevBlock *Block) error {
+	if b.UnixMilli <= 0 {
+		return errors.New("block has no time")
+	}
+	if t, err := time.Parse(time.RFC3339, b.Timestamp); err != nil || t.UnixMilli() != b.UnixMilli {
+		return errors.New("timestamp does not match block time")
+	}
+	if b.Migrated == nil && prevBlock != nil && b.Time().Before(prevBlock.Time()) {
+		return fmt.Errorf("block time %s is before the previous block's %s", b.Timestamp, prevBlock.Timestamp)
+	}
+	return nil
+}
+
+// checkClockSkew refuses a block from a peer whose time is more than
+// maxClockSkew ahead of this node's clock.
+func checkClockSkew(b *Block) error {
+	if ahead := b.Time().Sub(clock.Now()); ahead > maxClockSkew {
+		return fmt.Errorf("block %d: %w (%s ahead of this node)", b.Pos, ErrClockSkew, ahead.Round(time.Second))
+	}
+	return nil
+}
+
+// stampCheckout dates a checkout that came without a date with the time the
+// node received it. The member signed it without one, so SigningBytes
+// leaves a stamped date out.
+func stampCheckout(tx *Transaction, now time.Time) {
+	if tx.Kind() == TxCheckout && tx.CheckoutDate == "" {
+		tx.CheckoutDate = now.UTC().Format(time.RFC3339)
+		tx.Stamped = true
+	}
+}
+
+// inFuture reports whether a date a client sent is ahead of this node's
+// clock by more than maxClockSkew. A date without a time may already be
+// today for a client east of UTC, so it gets a day's grace.
+func inFuture(s string, t time.Time) bool {
+	limit := maxClockSkew
+	if len(s) == len(time.DateOnly) {
+		limit += 24 * time.Hour
+	}
+	return t.Sub(clock.Now()) > limit
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Block versions decide how a block and its transactions are encoded for
+// hashing and what else a block of that version must satisfy. Version -1 is
+// the first chain file format: one unsigned checkout per block in Data,
+// hashed as encoding/json output between the position, timestamp and
+// previous hash. Version 0 is the first encoding of blocks holding several
+// transactions: the header fields run together with fmt and
+// transactions as encoding/json output, which changes whenever a field is
+// added to Transaction. Version 1 uses the canonical encoding, which lists
+// every hashed field explicitly. Version 2 adds the block time as Unix
+// milliseconds, which must not go back from one block to the next. New
+// blocks use the current version, and a chain never moves back to an older
+// one.
+const (
+	blockVersionBaseline  = -1
+	blockVersionLegacy    = 0
+	blockVersionCanonical = 1
+	blockVersionTimed     = 2
+	currentBlockVersion   = blockVersionTimed
+)
+
+type blockVersionRules struct {
+	// header returns the bytes the block hash is computed over.
+	header func(b *Block) []byte
+	// leaf returns the bytes a transaction's Merkle leaf is computed over.
+	leaf func(tx Transaction) []byte
+	// validate checks rules specific to the version. prevBlock is nil for
+	// the genesis block.
+	validate func(b, prevBlock *Block) error
+	// unsigned is set for the baseline version, whose blocks have no
+	// producer, signature or Merkle root and whose checkouts are unsigned.
+	unsigned bool
+}
+
+// blockVersions is filled in by init, since the rules themselves hash
+// blocks through it.
+var blockVersions map[int]blockVersionRules
+
+func init() {
+	blockVersions = map[int]blockVersionRules{
+		blockVersionBaseline: {
+			header: func(b *Block) []byte {
+				var data []byte
+				if len(b.Transactions) == 1 {
+					data, _ = json.Marshal(baselineOf(b.Transactions[0]))
+				}
+				return []byte(fmt.Sprintf("%d%s%s%s", b.Pos, b.Timestamp, data, b.Prevhash))
+			},
+			leaf: func(tx Transaction) []byte {
+				data, _ := json.Marshal(baselineOf(tx))
+				return data
+			},
+			validate: func(b, prevBlock *Block) error {
+				return checkBaseline(b)
+			},
+			unsigned: true,
+		},
+		blockVersionLegacy: {
+			header: func(b *Block) []byte {
+				return []byte(fmt.Sprintf("%d%s%s%s%d%d%s", b.Pos, b.Timestamp, b.MerkleRoot, b.Prevhash, b.Nonce, b.Difficulty, b.Producer))
+			},
+			leaf: func(tx Transaction) []byte {
+				data, _ := json.Marshal(tx)
+				return data
+			},
+			validate: func(b, prevBlock *Block) error {
+				if b.Migrated != nil {
+					return errors.New("version 0 block carries a migration record")
+				}
+				if b.UnixMilli != 0 {
+					return errors.New("version 0 block carries a block time")
+				}
+				return nil
+			},
+		},
+		blockVersionCanonical: {
+			header: canonicalHeader,
+			leaf:   canonicalTx,
+			validate: func(b, prevBlock *Block) error {
+				if b.UnixMilli != 0 {
+					return errors.New("version 1 block carries a block time")
+				}
+				return checkOrigin(b, prevBlock)
+			},
+		},
+		blockVersionTimed: {
+			header: canonicalHeader,
+			leaf:   canonicalTx,
+			validate: func(b, prevBlock *Block) error {
+				if err := checkOrigin(b, prevBlock); err != nil {
+					return err
+				}
+				return checkBlockTime(b, prevBlock)
+			},
+		},
+	}
+}
+
+// baselineCheckout is a checkout as the first chain file format held it in
+// a block's Data.
+type baselineCheckout struct {
+	BookId       string `json:"bookid"`
+	User         string `json:"user"`
+	CheckoutDate string `json:"checkout_date"`
+	IsGenesis    bool   `json:"is_genesis"`
+}
+
+// baselineDifficulty is the difficulty every baseline block was mined at.
+const baselineDifficulty = 3
+
+func baselineOf(tx Transaction) baselineCheckout {
+	return baselineCheckout{BookId: tx.BookId, User: tx.User, CheckoutDate: tx.CheckoutDate, IsGenesis: tx.IsGenesis}
+}
+
+// checkBaseline refuses a baseline block carrying anything its hash does
+// not cover, since nothing else vouches for it.
+func checkBaseline(b *Block) error {
+	if len(b.Transactions) != 1 {
+		return fmt.Errorf("baseline block holds %d transactions, not one", len(b.Transactions))
+	}
+	c := baselineOf(b.Transactions[0])
+	if !reflect.DeepEqual(b.Transactions[0], Transaction{BookId: c.BookId, User: c.User, CheckoutDate: c.CheckoutDate, IsGenesis: c.IsGenesis}) {
+		return errors.New("baseline checkout carries fields the block hash does not cover")
+	}
+	if b.MerkleRoot != "" || b.Nonce != 0 || b.Producer != "" || b.Signature != "" || b.UnixMilli != 0 || b.Migrated != nil {
+		return errors.New("baseline block carries fields the block hash does not cover")
+	}
+	if b.Difficulty != baselineDifficulty {
+		return fmt.Errorf("baseline block has difficulty %d, not %d", b.Difficulty, baselineDifficulty)
+	}
+	return nil
+}
+
+// UnmarshalJSON reads blocks in the first chain file format too, with their
+// one checkout in Data, as baseline blocks.
+func (b *Block) UnmarshalJSON(data []byte) error {
+	type block Block
+	var v struct {
+		block
+		Data *baselineCheckout
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*b = Block(v.block)
+	if c := v.Data; c != nil && b.Transactions == nil {
+		b.Transactions = []Transaction{{BookId: c.BookId, User: c.User, CheckoutDate: c.CheckoutDate, IsGenesis: c.IsGenesis}}
+		b.Version = blockVersionBaseline
+		b.Difficulty = baselineDifficulty
+	}
+	return nil
+}
+
+// txHash is the Merkle leaf for a transaction in a block of the given
+// version.
+func txHash(version int, tx Transaction) []byte {
+	return chainSum(blockVersions[version].leaf(tx))
+}
+
+// BlockOrigin is the header a block had before it was migrated to a newer
+// version. The block's transactions and timestamp are unchanged, so the
+// original block can be rebuilt from it and checked as it was produced.
+type BlockOrigin struct {
+	Version    int
+	Hash       string
+	Prevhash   string
+	MerkleRoot string
+	Nonce      int
+	Difficulty int
+	Producer   string
+	Signature  string
+}
+
+func originOf(b *Block) *BlockOrigin {
+	return &BlockOrigin{
+		Version:    b.Version,
+		Hash:       b.Hash,
+		Prevhash:   b.Prevhash,
+		MerkleRoot: b.MerkleRoot,
+		Nonce:      b.Nonce,
+		Difficulty: b.Difficulty,
+		Producer:   b.Producer,
+		Signature:  b.Signature,
+	}
+}
+
+// Original rebuilds a migrated block as it was first produced, or returns
+// the block itself if it was never migrated.
+func (b *Block) Original() *Block {
+	o := b.Migrated
+	if o == nil {
+		return b
+	}
+	orig := &Block{
+		Pos:          b.Pos,
+		Transactions: b.Transactions,
+		Timestamp:    b.Timestamp,
+		Hash:         o.Hash,
+		Prevhash:     o.Prevhash,
+		MerkleRoot:   o.MerkleRoot,
+		Nonce:        o.Nonce,
+		Difficulty:   o.Difficulty,
+		Producer:     o.Producer,
+		Signature:    o.Signature,
+		Version:      o.Version,
+	}
+	if o.Version >= blockVersionTimed {
+		orig.UnixMilli = b.UnixMilli
+	}
+	return orig
+}
+
+// checkOrigin verifies the original block behind a migrated one: its hash,
+// Merkle root, proof of work and producer signature under its own version,
+// and its link to the original of the previous block. A baseline original
+// has no Merkle root or signature and is held to checkBaseline instead.
+func checkOrigin(b, prevBlock *Block) error {
+	o := b.Migrated
+	if o == nil {
+		return nil
+	}
+	if _, ok := blockVersions[o.Version]; !ok || o.Version > b.Version {
+		return fmt.Errorf("migrated from unsupported block version %d", o.Version)
+	}
+	orig := b.Original()
+	if prevBlock == nil && orig.Prevhash != "" {
+		return errors.New("original genesis block has a previous hash")
+	}
+	if prevBlock != nil && orig.Prevhash != prevBlock.Original().Hash {
+		return errors.New("original previous hash does not match preceding block")
+	}
+	unsigned := blockVersions[o.Version].unsigned
+	if unsigned {
+		if err := checkBaseline(orig); err != nil {
+			return fmt.Errorf("original block: %w", err)
+		}
+	} else if orig.MerkleRoot != merkleRoot(orig.Version, orig.Transactions) {
+		return errors.New("original merkle root does not match transactions")
+	}
+	if !orig.ValidateHash(orig.Hash) {
+		return errors.New("original hash does not match block contents")
+	}
+	if !meetsTarget(orig.Hash, orig.Difficulty) {
+		return fmt.Errorf("original hash does not meet difficulty %d", orig.Difficulty)
+	}
+	if unsigned {
+		return nil
+	}
+	if err := orig.verifySignature(); err != nil {
+		return fmt.Errorf("original block: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+)
+
+// canonicalEncoder writes values in a fixed binary form: integers as 8
+// big-endian bytes, strings as a uvarint length and their bytes, booleans and
+// optional-value markers as one byte. Each field is preceded by its number,
+// so a field added later can never be mistaken for one that exists now.
+type canonicalEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *canonicalEncoder) field(n byte) {
+	e.buf.WriteByte(n)
+}
+
+func (e *canonicalEncoder) int(n int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	e.buf.Write(b[:])
+}
+
+func (e *canonicalEncoder) string(s string) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf.Write(b[:binary.PutUvarint(b[:], uint64(len(s)))])
+	e.buf.WriteString(s)
+}
+
+func (e *canonicalEncoder) bool(v bool) {
+	if v {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+// canonicalTx encodes every field of a transaction, including the ones a
+// member does not sign, so the block hash covers them.
+func canonicalTx(tx Transaction) []byte {
+	e := &canonicalEncoder{}
+	e.buf.WriteString("library-chain/tx/1")
+	for i, s := range []string{tx.Type, tx.BookId, tx.User, tx.CheckoutDate, tx.Date, tx.Nonce, tx.DueDate, tx.PublicKey, tx.Signature} {
+		e.field(byte(i + 1))
+		e.string(s)
+	}
+	e.field(10)
+	e.int(tx.Fine)
+	e.field(11)
+	e.int(tx.Amount)
+	e.field(12)
+	e.bool(tx.IsGenesis)
+	e.field(13)
+	e.bool(tx.Chain != nil)
+	if c := tx.Chain; c != nil {
+		e.string(c.ChainID)
+		e.string(c.Network)
+		e.int(int64(c.Protocol))
+	}
+	e.field(14)
+	e.bool(tx.Book != nil)
+	if b := tx.Book; b != nil {
+		e.string(b.Id)
+		e.string(b.Title)
+		e.string(b.Author)
+		e.string(b.PublishDate)
+		e.string(b.ISBN)
+		e.bool(b.Withdrawn)
+	}
+	// Fields added after version 1 are only written when set, so blocks
+	// from before them keep their hashes.
+	if c := tx.Chain; c != nil && c.Hash != "" {
+		e.field(15)
+		e.string(c.Hash)
+	}
+	if a := tx.Anchor; a != nil {
+		e.field(16)
+		e.string(a.Method)
+		e.string(a.Service)
+		e.int(int64(a.Height))
+		e.string(a.TipHash)
+		e.string(a.Receipt)
+		e.string(a.Time)
+	}
+	if tx.Stamped {
+		e.field(17)
+		e.bool(true)
+	}
+	if tx.FromBranch != "" || tx.ToBranch != "" {
+		e.field(18)
+		e.string(tx.FromBranch)
+		e.string(tx.ToBranch)
+	}
+	if b := tx.Book; b != nil && (b.Kind != "" || b.Serial != "") {
+		e.field(19)
+		e.string(b.Kind)
+		e.string(b.Serial)
+	}
+	if len(tx.Data) > 0 {
+		e.field(20)
+		e.string(compactJSON(tx.Data))
+	}
+	if tx.PayloadHash != "" {
+		e.field(21)
+		e.string(tx.PayloadHash)
+	}
+	return e.buf.Bytes()
+}
+
+// compactJSON drops the insignificant space in a JSON payload, which stores
+// and clients may not keep, so its hash does not depend on them.
+func compactJSON(data json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return string(data)
+	}
+	return buf.String()
+}
+
+// canonicalHeader encodes the hashed header fields. The migration record is
+// only written when present, so blocks without one hash as they always have.
+func canonicalHeader(b *Block) []byte {
+	e := &canonicalEncoder{}
+	e.buf.WriteString("library-chain/block/1")
+	e.field(1)
+	e.int(int64(b.Version))
+	e.field(2)
+	e.int(int64(b.Pos))
+	e.field(3)
+	e.string(b.Timestamp)
+	e.field(4)
+	e.string(b.MerkleRoot)
+	e.field(5)
+	e.string(b.Prevhash)
+	e.field(6)
+	e.int(int64(b.Nonce))
+	e.field(7)
+	e.int(int64(b.Difficulty))
+	e.field(8)
+	e.string(b.Producer)
+	if o := b.Migrated; o != nil {
+		e.field(9)
+		e.int(int64(o.Version))
+		e.string(o.Hash)
+		e.string(o.Prevhash)
+		e.string(o.MerkleRoot)
+		e.int(int64(o.Nonce))
+		e.int(int64(o.Difficulty))
+		e.string(o.Producer)
+		e.string(o.Signature)
+	}
+	// Only versions with a block time write it, so older blocks keep their
+	// hashes.
+	if b.Version >= blockVersionTimed {
+		e.field(10)
+		e.int(b.UnixMilli)
+	}
+	return e.buf.Bytes()
+}
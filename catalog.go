@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"blockchain/apierr"
+)
+
+var catalogFile = "catalog.json"
+
+var (
+	ErrBookNotFound  = errors.New("book not found")
+	ErrUnknownBook   = errors.New("book is not in the catalog")
+	ErrBookWithdrawn = errors.New("book has been withdrawn from the catalog")
+)
+
+// Catalog is the registry of books, kept in memory and rewritten atomically
+// to its file on every change. Books are never removed because the chain
+// still refers to them; deleting one marks it withdrawn.
+type Catalog struct {
+	mu    sync.RWMutex
+	path  string
+	books map[string]Book
+	// search is the index that follows the catalog, once there is one.
+	search *SearchIndex
+}
+
+var Books *Catalog
+
+func OpenCatalog(path string) (*Catalog, error) {
+	c := &Catalog{path: path, books: map[string]Book{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var books []Book
+	if err := json.Unmarshal(data, &books); err != nil {
+		return nil, err
+	}
+	for _, b := range books {
+		c.books[b.Id] = b
+	}
+	return c, nil
+}
+
+func (c *Catalog) saveLocked() error {
+	books := make([]Book, 0, len(c.books))
+	for _, b := range c.books {
+		books = append(books, b)
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].Id < books[j].Id })
+	return writeFileAtomic(c.path, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(books)
+	})
+}
+
+// Add stores a new book. It reports false without changing anything if a
+// book with the same ID is already registered.
+func (c *Catalog) Add(b Book) (Book, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.books[b.Id]; ok {
+		return existing, false, nil
+	}
+	c.books[b.Id] = b
+	if err := c.saveLocked(); err != nil {
+		delete(c.books, b.Id)
+		return Book{}, false, err
+	}
+	c.indexBook(b)
+	return b, true, nil
+}
+
+func (c *Catalog) Get(id string) (Book, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	b, ok := c.books[id]
+	if !ok {
+		return Book{}, ErrBookNotFound
+	}
+	return b, nil
+}
+
+func (c *Catalog) List(includeWithdrawn bool) []Book {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make([]Book, 0, len(c.books))
+	for _, b := range c.books {
+		if includeWithdrawn || !b.Withdrawn {
+			out = append(out, b)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Id < out[j].Id })
+	return out
+}
+
+// Update replaces a book's details. The ID never changes, even when the ISBN
+// or publish date it was derived from does, and neither does the kind.
+func (c *Catalog) Update(id string, b Book) (Book, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, ok := c.books[id]
+	if !ok {
+		return Book{}, ErrBookNotFound
+	}
+	b.Id = id
+	b.Kind = old.Kind
+	b.Withdrawn = old.Withdrawn
+	c.books[id] = b
+	if err := c.saveLocked(); err != nil {
+		c.books[id] = old
+		return Book{}, err
+	}
+	c.indexBook(b)
+	return b, nil
+}
+
+func (c *Catalog) Withdraw(id string) (Book, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, ok := c.books[id]
+	if !ok {
+		return Book{}, ErrBookNotFound
+	}
+	b := old
+	b.Withdrawn = true
+	c.books[id] = b
+	if err := c.saveLocked(); err != nil {
+		c.books[id] = old
+		return Book{}, err
+	}
+	c.indexBook(b)
+	return b, nil
+}
+
+// Apply adds books registered in blocks that the catalog does not know yet,
+// such as registrations made on other nodes, and books transferred in from
+// other branches.
+func (c *Catalog) Apply(blocks ...*Block) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var added []Book
+	for _, b := range blocks {
+		for _, tx := range b.Transactions {
+			if typ, ok := txTypes[tx.Kind()]; !ok || !typ.Entry || tx.Book == nil {
+				continue
+			}
+			if _, ok := c.books[tx.BookId]; !ok {
+				c.books[tx.BookId] = *tx.Book
+				added = append(added, *tx.Book)
+			}
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	if err := c.saveLocked(); err != nil {
+		return err
+	}
+	for _, b := range added {
+		c.indexBook(b)
+	}
+	return nil
+}
+
+// bookID derives a book's ID from its ISBN and publish date, and another
+// item's from its kind and serial number. Chains whose genesis records a
+// hash algorithm use it; older chains keep the MD5 IDs their books already
+// have.
+func bookID(bc *Blockchain, book Book) string {
+	key := book.ISBN + "\x00" + book.PublishDate
+	if book.Kind != "" {
+		key = book.Kind + "\x00" + book.Serial
+	}
+	if p := bc.Snapshot()[0].Params(); p == nil || p.Hash == "" {
+		if book.Kind == "" {
+			key = book.ISBN + book.PublishDate
+		}
+		return fmt.Sprintf("%x", md5.Sum([]byte(key)))
+	}
+	sum := chainSum([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// checkCatalog refuses checkouts of books missing from the catalog, with
+// ErrUnknownBook, and of withdrawn ones.
+func checkCatalog(books *Catalog, tx Transaction) error {
+	if tx.Kind() != TxCheckout {
+		return nil
+	}
+	b, err := books.Get(tx.BookId)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnknownBook, tx.BookId)
+	}
+	if b.Withdrawn {
+		return ErrBookWithdrawn
+	}
+	return nil
+}
+
+// listBooks answers GET /books, with optional include_withdrawn and kind.
+func listBooks(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	books := tenantOf(r).books.List(q.Get("include_withdrawn") == "true")
+	if kind := q.Get("kind"); kind != "" {
+		matching := []Book{}
+		for _, b := range books {
+			if b.kindOf() == kind {
+				matching = append(matching, b)
+			}
+		}
+		books = matching
+	}
+	respond(w, r, books)
+}
+
+func getBook(w http.ResponseWriter, r *http.Request) {
+	b, err := tenantOf(r).books.Get(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	respond(w, r, b)
+}
+
+func updateBook(w http.ResponseWriter, r *http.Request) {
+	var book Book
+	if err := decodeJSON(r.Body, &book); err != nil {
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "invalid book data: %w", err))
+		return
+	}
+	t := tenantOf(r)
+	old, err := t.books.Get(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	book.Kind = old.Kind
+	if err := book.validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	b, err := t.books.Update(old.Id, book)
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+func deleteBook(w http.ResponseWriter, r *http.Request) {
+	b, err := tenantOf(r).books.Withdraw(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
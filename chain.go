@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"blockchain/apierr"
+)
+
+var (
+	chainID     = "library-chain"
+	networkName = "devnet"
+)
+
+// protocolVersion is bumped when blocks or the peer protocol change in a way
+// older nodes cannot follow.
+const protocolVersion = 1
+
+const chainHeader = "X-Chain-ID"
+
+var ErrWrongChain = errors.New("chain belongs to a different network")
+
+// ChainParams identify a deployment. They are carried by the genesis
+// transaction, so they are covered by the genesis block's Merkle root and
+// hash, and every later block inherits them through its Prevhash.
+type ChainParams struct {
+	ChainID  string `json:"chain_id"`
+	Network  string `json:"network"`
+	Protocol int    `json:"protocol"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+func localChainParams() *ChainParams {
+	return &ChainParams{ChainID: chainID, Network: networkName, Protocol: protocolVersion, Hash: hashAlgorithm}
+}
+
+// Params returns the chain parameters of a genesis block, or nil for other
+// blocks and for chains created before chain IDs existed.
+func (b *Block) Params() *ChainParams {
+	if b.Pos != 0 || len(b.Transactions) == 0 {
+		return nil
+	}
+	return b.Transactions[0].Chain
+}
+
+func (b *Block) ChainID() string {
+	if p := b.Params(); p != nil {
+		return p.ChainID
+	}
+	return ""
+}
+
+// ChainID is the chain ID recorded in this node's genesis block.
+func (bc *Blockchain) ChainID() string {
+	return bc.Snapshot()[0].ChainID()
+}
+
+func checkChainParams(p *ChainParams) error {
+	if p.ChainID == "" {
+		return errors.New("genesis block has an empty chain ID")
+	}
+	if p.Protocol < 1 || p.Protocol > protocolVersion {
+		return fmt.Errorf("genesis block uses unsupported protocol version %d", p.Protocol)
+	}
+	if p.Hash != "" {
+		return checkHashAlgorithm(p.Hash)
+	}
+	return nil
+}
+
+func sameChain(local, remote string) error {
+	if local != remote {
+		return fmt.Errorf("%w: expected chain %q, got %q", ErrWrongChain, local, remote)
+	}
+	return nil
+}
+
+// requireChainID rejects peer requests from nodes on another chain.
+func requireChainID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := sameChain(BlockChain.ChainID(), r.Header.Get(chainHeader)); err != nil {
+			writeError(w, r, apierr.Wrap(codeWrongChain, err))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func getChainInfo(w http.ResponseWriter, r *http.Request) {
+	genesis := tenantOf(r).chain.Snapshot()[0]
+	info := map[string]any{
+		"chain_id":     genesis.ChainID(),
+		"genesis_hash": genesis.Hash,
+		"protocol":     protocolVersion,
+	}
+	if p := genesis.Params(); p != nil {
+		info["network"] = p.Network
+		info["genesis_protocol"] = p.Protocol
+	}
+	info["hash_algorithm"] = chainHashAlgorithm(genesis)
+	respond(w, r, info)
+}
@@ -0,0 +1,1337 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        v5.29.3
+// source: chainpb/chain.proto
+
+package chainpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type ChainParams struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ChainId       string                 `protobuf:"bytes,1,opt,name=chain_id,json=chainId,proto3" json:"chain_id,omitempty"`
+	Network       string                 `protobuf:"bytes,2,opt,name=network,proto3" json:"network,omitempty"`
+	Protocol      int32                  `protobuf:"varint,3,opt,name=protocol,proto3" json:"protocol,omitempty"`
+	Hash          string                 `protobuf:"bytes,4,opt,name=hash,proto3" json:"hash,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ChainParams) Reset() {
+	*x = ChainParams{}
+	mi := &file_chainpb_chain_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ChainParams) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChainParams) ProtoMessage() {}
+
+func (x *ChainParams) ProtoReflect() protoreflect.Message {
+	mi := &file_chainpb_chain_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChainParams.ProtoReflect.Descriptor instead.
+func (*ChainParams) Descriptor() ([]byte, []int) {
+	return file_chainpb_chain_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ChainParams) GetChainId() string {
+	if x != nil {
+		return x.ChainId
+	}
+	return ""
+}
+
+func (x *ChainParams) GetNetwork() string {
+	if x != nil {
+		return x.Network
+	}
+	return ""
+}
+
+func (x *ChainParams) GetProtocol() int32 {
+	if x != nil {
+		return x.Protocol
+	}
+	return 0
+}
+
+func (x *ChainParams) GetHash() string {
+	if x != nil {
+		return x.Hash
+	}
+	return ""
+}
+
+type BookRecord struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Id          string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Title       string                 `protobuf:"bytes,2,opt,name=title,proto3" json:"title,omitempty"`
+	Author      string                 `protobuf:"bytes,3,opt,name=author,proto3" json:"author,omitempty"`
+	PublishDate string                 `protobuf:"bytes,4,opt,name=publish_date,json=publishDate,proto3" json:"publish_date,omitempty"`
+	Isbn        string                 `protobuf:"bytes,5,opt,name=isbn,proto3" json:"isbn,omitempty"`
+	// kind is empty for books; other items carry a serial instead of an isbn.
+	Kind          string `protobuf:"bytes,6,opt,name=kind,proto3" json:"kind,omitempty"`
+	Serial        string `protobuf:"bytes,7,opt,name=serial,proto3" json:"serial,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BookRecord) Reset() {
+	*x = BookRecord{}
+	mi := &file_chainpb_chain_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BookRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BookRecord) ProtoMessage() {}
+
+func (x *BookRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_chainpb_chain_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BookRecord.ProtoReflect.Descriptor instead.
+func (*BookRecord) Descriptor() ([]byte, []int) {
+	return file_chainpb_chain_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *BookRecord) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *BookRecord) GetTitle() string {
+	if x != nil {
+		return x.Title
+	}
+	return ""
+}
+
+func (x *BookRecord) GetAuthor() string {
+	if x != nil {
+		return x.Author
+	}
+	return ""
+}
+
+func (x *BookRecord) GetPublishDate() string {
+	if x != nil {
+		return x.PublishDate
+	}
+	return ""
+}
+
+func (x *BookRecord) GetIsbn() string {
+	if x != nil {
+		return x.Isbn
+	}
+	return ""
+}
+
+func (x *BookRecord) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
+func (x *BookRecord) GetSerial() string {
+	if x != nil {
+		return x.Serial
+	}
+	return ""
+}
+
+// Checkout is any transaction; type is empty for checkouts.
+type Checkout struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	BookId       string                 `protobuf:"bytes,1,opt,name=book_id,json=bookId,proto3" json:"book_id,omitempty"`
+	User         string                 `protobuf:"bytes,2,opt,name=user,proto3" json:"user,omitempty"`
+	CheckoutDate string                 `protobuf:"bytes,3,opt,name=checkout_date,json=checkoutDate,proto3" json:"checkout_date,omitempty"`
+	IsGenesis    bool                   `protobuf:"varint,4,opt,name=is_genesis,json=isGenesis,proto3" json:"is_genesis,omitempty"`
+	PublicKey    string                 `protobuf:"bytes,5,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	Signature    string                 `protobuf:"bytes,6,opt,name=signature,proto3" json:"signature,omitempty"`
+	Chain        *ChainParams           `protobuf:"bytes,7,opt,name=chain,proto3" json:"chain,omitempty"`
+	Type         string                 `protobuf:"bytes,8,opt,name=type,proto3" json:"type,omitempty"`
+	Book         *BookRecord            `protobuf:"bytes,9,opt,name=book,proto3" json:"book,omitempty"`
+	Date         string                 `protobuf:"bytes,10,opt,name=date,proto3" json:"date,omitempty"`
+	DueDate      string                 `protobuf:"bytes,11,opt,name=due_date,json=dueDate,proto3" json:"due_date,omitempty"`
+	Fine         int64                  `protobuf:"varint,12,opt,name=fine,proto3" json:"fine,omitempty"`
+	Amount       int64                  `protobuf:"varint,13,opt,name=amount,proto3" json:"amount,omitempty"`
+	Nonce        string                 `protobuf:"bytes,14,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Anchor       *AnchorReceipt         `protobuf:"bytes,15,opt,name=anchor,proto3" json:"anchor,omitempty"`
+	// stamped is set when the node dated the checkout on receipt.
+	Stamped bool `protobuf:"varint,16,opt,name=stamped,proto3" json:"stamped,omitempty"`
+	// from_branch and to_branch name the branches of a transfer; empty is
+	// the node's own library.
+	FromBranch string `protobuf:"bytes,17,opt,name=from_branch,json=fromBranch,proto3" json:"from_branch,omitempty"`
+	ToBranch   string `protobuf:"bytes,18,opt,name=to_branch,json=toBranch,proto3" json:"to_branch,omitempty"`
+	// data is the JSON payload of a registered transaction type.
+	Data []byte `protobuf:"bytes,19,opt,name=data,proto3" json:"data,omitempty"`
+	// payload_hash stands for the user, public key and signature, which the
+	// node keeps off the chain under -offchain-payloads.
+	PayloadHash   string `protobuf:"bytes,20,opt,name=payload_hash,json=payloadHash,proto3" json:"payload_hash,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Checkout) Reset() {
+	*x = Checkout{}
+	mi := &file_chainpb_chain_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Checkout) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Checkout) ProtoMessage() {}
+
+func (x *Checkout) ProtoReflect() protoreflect.Message {
+	mi := &file_chainpb_chain_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Checkout.ProtoReflect.Descriptor instead.
+func (*Checkout) Descriptor() ([]byte, []int) {
+	return file_chainpb_chain_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Checkout) GetBookId() string {
+	if x != nil {
+		return x.BookId
+	}
+	return ""
+}
+
+func (x *Checkout) GetUser() string {
+	if x != nil {
+		return x.User
+	}
+	return ""
+}
+
+func (x *Checkout) GetCheckoutDate() string {
+	if x != nil {
+		return x.CheckoutDate
+	}
+	return ""
+}
+
+func (x *Checkout) GetIsGenesis() bool {
+	if x != nil {
+		return x.IsGenesis
+	}
+	return false
+}
+
+func (x *Checkout) GetPublicKey() string {
+	if x != nil {
+		return x.PublicKey
+	}
+	return ""
+}
+
+func (x *Checkout) GetSignature() string {
+	if x != nil {
+		return x.Signature
+	}
+	return ""
+}
+
+func (x *Checkout) GetChain() *ChainParams {
+	if x != nil {
+		return x.Chain
+	}
+	return nil
+}
+
+func (x *Checkout) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Checkout) GetBook() *BookRecord {
+	if x != nil {
+		return x.Book
+	}
+	return nil
+}
+
+func (x *Checkout) GetDate() string {
+	if x != nil {
+		return x.Date
+	}
+	return ""
+}
+
+func (x *Checkout) GetDueDate() string {
+	if x != nil {
+		return x.DueDate
+	}
+	return ""
+}
+
+func (x *Checkout) GetFine() int64 {
+	if x != nil {
+		return x.Fine
+	}
+	return 0
+}
+
+func (x *Checkout) GetAmount() int64 {
+	if x != nil {
+		return x.Amount
+	}
+	return 0
+}
+
+func (x *Checkout) GetNonce() string {
+	if x != nil {
+		return x.Nonce
+	}
+	return ""
+}
+
+func (x *Checkout) GetAnchor() *AnchorReceipt {
+	if x != nil {
+		return x.Anchor
+	}
+	return nil
+}
+
+func (x *Checkout) GetStamped() bool {
+	if x != nil {
+		return x.Stamped
+	}
+	return false
+}
+
+func (x *Checkout) GetFromBranch() string {
+	if x != nil {
+		return x.FromBranch
+	}
+	return ""
+}
+
+func (x *Checkout) GetToBranch() string {
+	if x != nil {
+		return x.ToBranch
+	}
+	return ""
+}
+
+func (x *Checkout) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *Checkout) GetPayloadHash() string {
+	if x != nil {
+		return x.PayloadHash
+	}
+	return ""
+}
+
+type AnchorReceipt struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Method        string                 `protobuf:"bytes,1,opt,name=method,proto3" json:"method,omitempty"`
+	Service       string                 `protobuf:"bytes,2,opt,name=service,proto3" json:"service,omitempty"`
+	Height        int64                  `protobuf:"varint,3,opt,name=height,proto3" json:"height,omitempty"`
+	TipHash       string                 `protobuf:"bytes,4,opt,name=tip_hash,json=tipHash,proto3" json:"tip_hash,omitempty"`
+	Receipt       string                 `protobuf:"bytes,5,opt,name=receipt,proto3" json:"receipt,omitempty"`
+	Time          string                 `protobuf:"bytes,6,opt,name=time,proto3" json:"time,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AnchorReceipt) Reset() {
+	*x = AnchorReceipt{}
+	mi := &file_chainpb_chain_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AnchorReceipt) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AnchorReceipt) ProtoMessage() {}
+
+func (x *AnchorReceipt) ProtoReflect() protoreflect.Message {
+	mi := &file_chainpb_chain_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AnchorReceipt.ProtoReflect.Descriptor instead.
+func (*AnchorReceipt) Descriptor() ([]byte, []int) {
+	return file_chainpb_chain_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *AnchorReceipt) GetMethod() string {
+	if x != nil {
+		return x.Method
+	}
+	return ""
+}
+
+func (x *AnchorReceipt) GetService() string {
+	if x != nil {
+		return x.Service
+	}
+	return ""
+}
+
+func (x *AnchorReceipt) GetHeight() int64 {
+	if x != nil {
+		return x.Height
+	}
+	return 0
+}
+
+func (x *AnchorReceipt) GetTipHash() string {
+	if x != nil {
+		return x.TipHash
+	}
+	return ""
+}
+
+func (x *AnchorReceipt) GetReceipt() string {
+	if x != nil {
+		return x.Receipt
+	}
+	return ""
+}
+
+func (x *AnchorReceipt) GetTime() string {
+	if x != nil {
+		return x.Time
+	}
+	return ""
+}
+
+type Block struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Pos           int64                  `protobuf:"varint,1,opt,name=pos,proto3" json:"pos,omitempty"`
+	Transactions  []*Checkout            `protobuf:"bytes,2,rep,name=transactions,proto3" json:"transactions,omitempty"`
+	Timestamp     string                 `protobuf:"bytes,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Hash          string                 `protobuf:"bytes,4,opt,name=hash,proto3" json:"hash,omitempty"`
+	PrevHash      string                 `protobuf:"bytes,5,opt,name=prev_hash,json=prevHash,proto3" json:"prev_hash,omitempty"`
+	MerkleRoot    string                 `protobuf:"bytes,6,opt,name=merkle_root,json=merkleRoot,proto3" json:"merkle_root,omitempty"`
+	Nonce         int64                  `protobuf:"varint,7,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Difficulty    int32                  `protobuf:"varint,8,opt,name=difficulty,proto3" json:"difficulty,omitempty"`
+	Producer      string                 `protobuf:"bytes,9,opt,name=producer,proto3" json:"producer,omitempty"`
+	Signature     string                 `protobuf:"bytes,10,opt,name=signature,proto3" json:"signature,omitempty"`
+	Version       int32                  `protobuf:"varint,11,opt,name=version,proto3" json:"version,omitempty"`
+	UnixMilli     int64                  `protobuf:"varint,12,opt,name=unix_milli,json=unixMilli,proto3" json:"unix_milli,omitempty"`
+	Migrated      *BlockOrigin           `protobuf:"bytes,13,opt,name=migrated,proto3" json:"migrated,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Block) Reset() {
+	*x = Block{}
+	mi := &file_chainpb_chain_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Block) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Block) ProtoMessage() {}
+
+func (x *Block) ProtoReflect() protoreflect.Message {
+	mi := &file_chainpb_chain_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Block.ProtoReflect.Descriptor instead.
+func (*Block) Descriptor() ([]byte, []int) {
+	return file_chainpb_chain_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Block) GetPos() int64 {
+	if x != nil {
+		return x.Pos
+	}
+	return 0
+}
+
+func (x *Block) GetTransactions() []*Checkout {
+	if x != nil {
+		return x.Transactions
+	}
+	return nil
+}
+
+func (x *Block) GetTimestamp() string {
+	if x != nil {
+		return x.Timestamp
+	}
+	return ""
+}
+
+func (x *Block) GetHash() string {
+	if x != nil {
+		return x.Hash
+	}
+	return ""
+}
+
+func (x *Block) GetPrevHash() string {
+	if x != nil {
+		return x.PrevHash
+	}
+	return ""
+}
+
+func (x *Block) GetMerkleRoot() string {
+	if x != nil {
+		return x.MerkleRoot
+	}
+	return ""
+}
+
+func (x *Block) GetNonce() int64 {
+	if x != nil {
+		return x.Nonce
+	}
+	return 0
+}
+
+func (x *Block) GetDifficulty() int32 {
+	if x != nil {
+		return x.Difficulty
+	}
+	return 0
+}
+
+func (x *Block) GetProducer() string {
+	if x != nil {
+		return x.Producer
+	}
+	return ""
+}
+
+func (x *Block) GetSignature() string {
+	if x != nil {
+		return x.Signature
+	}
+	return ""
+}
+
+func (x *Block) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *Block) GetUnixMilli() int64 {
+	if x != nil {
+		return x.UnixMilli
+	}
+	return 0
+}
+
+func (x *Block) GetMigrated() *BlockOrigin {
+	if x != nil {
+		return x.Migrated
+	}
+	return nil
+}
+
+// BlockOrigin is the header a block had before it was migrated to a newer
+// block version.
+type BlockOrigin struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Version       int32                  `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	Hash          string                 `protobuf:"bytes,2,opt,name=hash,proto3" json:"hash,omitempty"`
+	PrevHash      string                 `protobuf:"bytes,3,opt,name=prev_hash,json=prevHash,proto3" json:"prev_hash,omitempty"`
+	MerkleRoot    string                 `protobuf:"bytes,4,opt,name=merkle_root,json=merkleRoot,proto3" json:"merkle_root,omitempty"`
+	Nonce         int64                  `protobuf:"varint,5,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Difficulty    int32                  `protobuf:"varint,6,opt,name=difficulty,proto3" json:"difficulty,omitempty"`
+	Producer      string                 `protobuf:"bytes,7,opt,name=producer,proto3" json:"producer,omitempty"`
+	Signature     string                 `protobuf:"bytes,8,opt,name=signature,proto3" json:"signature,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BlockOrigin) Reset() {
+	*x = BlockOrigin{}
+	mi := &file_chainpb_chain_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BlockOrigin) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlockOrigin) ProtoMessage() {}
+
+func (x *BlockOrigin) ProtoReflect() protoreflect.Message {
+	mi := &file_chainpb_chain_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlockOrigin.ProtoReflect.Descriptor instead.
+func (*BlockOrigin) Descriptor() ([]byte, []int) {
+	return file_chainpb_chain_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *BlockOrigin) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *BlockOrigin) GetHash() string {
+	if x != nil {
+		return x.Hash
+	}
+	return ""
+}
+
+func (x *BlockOrigin) GetPrevHash() string {
+	if x != nil {
+		return x.PrevHash
+	}
+	return ""
+}
+
+func (x *BlockOrigin) GetMerkleRoot() string {
+	if x != nil {
+		return x.MerkleRoot
+	}
+	return ""
+}
+
+func (x *BlockOrigin) GetNonce() int64 {
+	if x != nil {
+		return x.Nonce
+	}
+	return 0
+}
+
+func (x *BlockOrigin) GetDifficulty() int32 {
+	if x != nil {
+		return x.Difficulty
+	}
+	return 0
+}
+
+func (x *BlockOrigin) GetProducer() string {
+	if x != nil {
+		return x.Producer
+	}
+	return ""
+}
+
+func (x *BlockOrigin) GetSignature() string {
+	if x != nil {
+		return x.Signature
+	}
+	return ""
+}
+
+// BlockPage is a page of the chain, as GET / returns it.
+type BlockPage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Blocks        []*Block               `protobuf:"bytes,1,rep,name=blocks,proto3" json:"blocks,omitempty"`
+	Total         int64                  `protobuf:"varint,2,opt,name=total,proto3" json:"total,omitempty"`
+	Offset        int64                  `protobuf:"varint,3,opt,name=offset,proto3" json:"offset,omitempty"`
+	Limit         int64                  `protobuf:"varint,4,opt,name=limit,proto3" json:"limit,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BlockPage) Reset() {
+	*x = BlockPage{}
+	mi := &file_chainpb_chain_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BlockPage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlockPage) ProtoMessage() {}
+
+func (x *BlockPage) ProtoReflect() protoreflect.Message {
+	mi := &file_chainpb_chain_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlockPage.ProtoReflect.Descriptor instead.
+func (*BlockPage) Descriptor() ([]byte, []int) {
+	return file_chainpb_chain_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *BlockPage) GetBlocks() []*Block {
+	if x != nil {
+		return x.Blocks
+	}
+	return nil
+}
+
+func (x *BlockPage) GetTotal() int64 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *BlockPage) GetOffset() int64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *BlockPage) GetLimit() int64 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+// BlockList is a run of blocks, as GET /blocks returns it.
+type BlockList struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Blocks        []*Block               `protobuf:"bytes,1,rep,name=blocks,proto3" json:"blocks,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BlockList) Reset() {
+	*x = BlockList{}
+	mi := &file_chainpb_chain_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BlockList) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BlockList) ProtoMessage() {}
+
+func (x *BlockList) ProtoReflect() protoreflect.Message {
+	mi := &file_chainpb_chain_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BlockList.ProtoReflect.Descriptor instead.
+func (*BlockList) Descriptor() ([]byte, []int) {
+	return file_chainpb_chain_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *BlockList) GetBlocks() []*Block {
+	if x != nil {
+		return x.Blocks
+	}
+	return nil
+}
+
+type GetChainRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetChainRequest) Reset() {
+	*x = GetChainRequest{}
+	mi := &file_chainpb_chain_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetChainRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetChainRequest) ProtoMessage() {}
+
+func (x *GetChainRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_chainpb_chain_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetChainRequest.ProtoReflect.Descriptor instead.
+func (*GetChainRequest) Descriptor() ([]byte, []int) {
+	return file_chainpb_chain_proto_rawDescGZIP(), []int{8}
+}
+
+type GetChainResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ChainId       string                 `protobuf:"bytes,1,opt,name=chain_id,json=chainId,proto3" json:"chain_id,omitempty"`
+	Blocks        []*Block               `protobuf:"bytes,2,rep,name=blocks,proto3" json:"blocks,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetChainResponse) Reset() {
+	*x = GetChainResponse{}
+	mi := &file_chainpb_chain_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetChainResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetChainResponse) ProtoMessage() {}
+
+func (x *GetChainResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_chainpb_chain_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetChainResponse.ProtoReflect.Descriptor instead.
+func (*GetChainResponse) Descriptor() ([]byte, []int) {
+	return file_chainpb_chain_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *GetChainResponse) GetChainId() string {
+	if x != nil {
+		return x.ChainId
+	}
+	return ""
+}
+
+func (x *GetChainResponse) GetBlocks() []*Block {
+	if x != nil {
+		return x.Blocks
+	}
+	return nil
+}
+
+type GetBlockRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Key:
+	//
+	//	*GetBlockRequest_Pos
+	//	*GetBlockRequest_Hash
+	Key           isGetBlockRequest_Key `protobuf_oneof:"key"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetBlockRequest) Reset() {
+	*x = GetBlockRequest{}
+	mi := &file_chainpb_chain_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetBlockRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetBlockRequest) ProtoMessage() {}
+
+func (x *GetBlockRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_chainpb_chain_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetBlockRequest.ProtoReflect.Descriptor instead.
+func (*GetBlockRequest) Descriptor() ([]byte, []int) {
+	return file_chainpb_chain_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *GetBlockRequest) GetKey() isGetBlockRequest_Key {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+func (x *GetBlockRequest) GetPos() int64 {
+	if x != nil {
+		if x, ok := x.Key.(*GetBlockRequest_Pos); ok {
+			return x.Pos
+		}
+	}
+	return 0
+}
+
+func (x *GetBlockRequest) GetHash() string {
+	if x != nil {
+		if x, ok := x.Key.(*GetBlockRequest_Hash); ok {
+			return x.Hash
+		}
+	}
+	return ""
+}
+
+type isGetBlockRequest_Key interface {
+	isGetBlockRequest_Key()
+}
+
+type GetBlockRequest_Pos struct {
+	Pos int64 `protobuf:"varint,1,opt,name=pos,proto3,oneof"`
+}
+
+type GetBlockRequest_Hash struct {
+	Hash string `protobuf:"bytes,2,opt,name=hash,proto3,oneof"`
+}
+
+func (*GetBlockRequest_Pos) isGetBlockRequest_Key() {}
+
+func (*GetBlockRequest_Hash) isGetBlockRequest_Key() {}
+
+type SubmitCheckoutRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Checkout      *Checkout              `protobuf:"bytes,1,opt,name=checkout,proto3" json:"checkout,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SubmitCheckoutRequest) Reset() {
+	*x = SubmitCheckoutRequest{}
+	mi := &file_chainpb_chain_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SubmitCheckoutRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubmitCheckoutRequest) ProtoMessage() {}
+
+func (x *SubmitCheckoutRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_chainpb_chain_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubmitCheckoutRequest.ProtoReflect.Descriptor instead.
+func (*SubmitCheckoutRequest) Descriptor() ([]byte, []int) {
+	return file_chainpb_chain_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *SubmitCheckoutRequest) GetCheckout() *Checkout {
+	if x != nil {
+		return x.Checkout
+	}
+	return nil
+}
+
+type SubmitCheckoutResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	Pending       int32                  `protobuf:"varint,2,opt,name=pending,proto3" json:"pending,omitempty"`
+	Id            string                 `protobuf:"bytes,3,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SubmitCheckoutResponse) Reset() {
+	*x = SubmitCheckoutResponse{}
+	mi := &file_chainpb_chain_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SubmitCheckoutResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubmitCheckoutResponse) ProtoMessage() {}
+
+func (x *SubmitCheckoutResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_chainpb_chain_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubmitCheckoutResponse.ProtoReflect.Descriptor instead.
+func (*SubmitCheckoutResponse) Descriptor() ([]byte, []int) {
+	return file_chainpb_chain_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *SubmitCheckoutResponse) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *SubmitCheckoutResponse) GetPending() int32 {
+	if x != nil {
+		return x.Pending
+	}
+	return 0
+}
+
+func (x *SubmitCheckoutResponse) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+type StreamBlocksRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	FromPos       int64                  `protobuf:"varint,1,opt,name=from_pos,json=fromPos,proto3" json:"from_pos,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamBlocksRequest) Reset() {
+	*x = StreamBlocksRequest{}
+	mi := &file_chainpb_chain_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamBlocksRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamBlocksRequest) ProtoMessage() {}
+
+func (x *StreamBlocksRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_chainpb_chain_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamBlocksRequest.ProtoReflect.Descriptor instead.
+func (*StreamBlocksRequest) Descriptor() ([]byte, []int) {
+	return file_chainpb_chain_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *StreamBlocksRequest) GetFromPos() int64 {
+	if x != nil {
+		return x.FromPos
+	}
+	return 0
+}
+
+var File_chainpb_chain_proto protoreflect.FileDescriptor
+
+const file_chainpb_chain_proto_rawDesc = "" +
+	"\n" +
+	"\x13chainpb/chain.proto\x12\x10library.chain.v1\"r\n" +
+	"\vChainParams\x12\x19\n" +
+	"\bchain_id\x18\x01 \x01(\tR\achainId\x12\x18\n" +
+	"\anetwork\x18\x02 \x01(\tR\anetwork\x12\x1a\n" +
+	"\bprotocol\x18\x03 \x01(\x05R\bprotocol\x12\x12\n" +
+	"\x04hash\x18\x04 \x01(\tR\x04hash\"\xad\x01\n" +
+	"\n" +
+	"BookRecord\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x14\n" +
+	"\x05title\x18\x02 \x01(\tR\x05title\x12\x16\n" +
+	"\x06author\x18\x03 \x01(\tR\x06author\x12!\n" +
+	"\fpublish_date\x18\x04 \x01(\tR\vpublishDate\x12\x12\n" +
+	"\x04isbn\x18\x05 \x01(\tR\x04isbn\x12\x12\n" +
+	"\x04kind\x18\x06 \x01(\tR\x04kind\x12\x16\n" +
+	"\x06serial\x18\a \x01(\tR\x06serial\"\xec\x04\n" +
+	"\bCheckout\x12\x17\n" +
+	"\abook_id\x18\x01 \x01(\tR\x06bookId\x12\x12\n" +
+	"\x04user\x18\x02 \x01(\tR\x04user\x12#\n" +
+	"\rcheckout_date\x18\x03 \x01(\tR\fcheckoutDate\x12\x1d\n" +
+	"\n" +
+	"is_genesis\x18\x04 \x01(\bR\tisGenesis\x12\x1d\n" +
+	"\n" +
+	"public_key\x18\x05 \x01(\tR\tpublicKey\x12\x1c\n" +
+	"\tsignature\x18\x06 \x01(\tR\tsignature\x123\n" +
+	"\x05chain\x18\a \x01(\v2\x1d.library.chain.v1.ChainParamsR\x05chain\x12\x12\n" +
+	"\x04type\x18\b \x01(\tR\x04type\x120\n" +
+	"\x04book\x18\t \x01(\v2\x1c.library.chain.v1.BookRecordR\x04book\x12\x12\n" +
+	"\x04date\x18\n" +
+	" \x01(\tR\x04date\x12\x19\n" +
+	"\bdue_date\x18\v \x01(\tR\adueDate\x12\x12\n" +
+	"\x04fine\x18\f \x01(\x03R\x04fine\x12\x16\n" +
+	"\x06amount\x18\r \x01(\x03R\x06amount\x12\x14\n" +
+	"\x05nonce\x18\x0e \x01(\tR\x05nonce\x127\n" +
+	"\x06anchor\x18\x0f \x01(\v2\x1f.library.chain.v1.AnchorReceiptR\x06anchor\x12\x18\n" +
+	"\astamped\x18\x10 \x01(\bR\astamped\x12\x1f\n" +
+	"\vfrom_branch\x18\x11 \x01(\tR\n" +
+	"fromBranch\x12\x1b\n" +
+	"\tto_branch\x18\x12 \x01(\tR\btoBranch\x12\x12\n" +
+	"\x04data\x18\x13 \x01(\fR\x04data\x12!\n" +
+	"\fpayload_hash\x18\x14 \x01(\tR\vpayloadHash\"\xa2\x01\n" +
+	"\rAnchorReceipt\x12\x16\n" +
+	"\x06method\x18\x01 \x01(\tR\x06method\x12\x18\n" +
+	"\aservice\x18\x02 \x01(\tR\aservice\x12\x16\n" +
+	"\x06height\x18\x03 \x01(\x03R\x06height\x12\x19\n" +
+	"\btip_hash\x18\x04 \x01(\tR\atipHash\x12\x18\n" +
+	"\areceipt\x18\x05 \x01(\tR\areceipt\x12\x12\n" +
+	"\x04time\x18\x06 \x01(\tR\x04time\"\xad\x03\n" +
+	"\x05Block\x12\x10\n" +
+	"\x03pos\x18\x01 \x01(\x03R\x03pos\x12>\n" +
+	"\ftransactions\x18\x02 \x03(\v2\x1a.library.chain.v1.CheckoutR\ftransactions\x12\x1c\n" +
+	"\ttimestamp\x18\x03 \x01(\tR\ttimestamp\x12\x12\n" +
+	"\x04hash\x18\x04 \x01(\tR\x04hash\x12\x1b\n" +
+	"\tprev_hash\x18\x05 \x01(\tR\bprevHash\x12\x1f\n" +
+	"\vmerkle_root\x18\x06 \x01(\tR\n" +
+	"merkleRoot\x12\x14\n" +
+	"\x05nonce\x18\a \x01(\x03R\x05nonce\x12\x1e\n" +
+	"\n" +
+	"difficulty\x18\b \x01(\x05R\n" +
+	"difficulty\x12\x1a\n" +
+	"\bproducer\x18\t \x01(\tR\bproducer\x12\x1c\n" +
+	"\tsignature\x18\n" +
+	" \x01(\tR\tsignature\x12\x18\n" +
+	"\aversion\x18\v \x01(\x05R\aversion\x12\x1d\n" +
+	"\n" +
+	"unix_milli\x18\f \x01(\x03R\tunixMilli\x129\n" +
+	"\bmigrated\x18\r \x01(\v2\x1d.library.chain.v1.BlockOriginR\bmigrated\"\xe9\x01\n" +
+	"\vBlockOrigin\x12\x18\n" +
+	"\aversion\x18\x01 \x01(\x05R\aversion\x12\x12\n" +
+	"\x04hash\x18\x02 \x01(\tR\x04hash\x12\x1b\n" +
+	"\tprev_hash\x18\x03 \x01(\tR\bprevHash\x12\x1f\n" +
+	"\vmerkle_root\x18\x04 \x01(\tR\n" +
+	"merkleRoot\x12\x14\n" +
+	"\x05nonce\x18\x05 \x01(\x03R\x05nonce\x12\x1e\n" +
+	"\n" +
+	"difficulty\x18\x06 \x01(\x05R\n" +
+	"difficulty\x12\x1a\n" +
+	"\bproducer\x18\a \x01(\tR\bproducer\x12\x1c\n" +
+	"\tsignature\x18\b \x01(\tR\tsignature\"\x80\x01\n" +
+	"\tBlockPage\x12/\n" +
+	"\x06blocks\x18\x01 \x03(\v2\x17.library.chain.v1.BlockR\x06blocks\x12\x14\n" +
+	"\x05total\x18\x02 \x01(\x03R\x05total\x12\x16\n" +
+	"\x06offset\x18\x03 \x01(\x03R\x06offset\x12\x14\n" +
+	"\x05limit\x18\x04 \x01(\x03R\x05limit\"<\n" +
+	"\tBlockList\x12/\n" +
+	"\x06blocks\x18\x01 \x03(\v2\x17.library.chain.v1.BlockR\x06blocks\"\x11\n" +
+	"\x0fGetChainRequest\"^\n" +
+	"\x10GetChainResponse\x12\x19\n" +
+	"\bchain_id\x18\x01 \x01(\tR\achainId\x12/\n" +
+	"\x06blocks\x18\x02 \x03(\v2\x17.library.chain.v1.BlockR\x06blocks\"B\n" +
+	"\x0fGetBlockRequest\x12\x12\n" +
+	"\x03pos\x18\x01 \x01(\x03H\x00R\x03pos\x12\x14\n" +
+	"\x04hash\x18\x02 \x01(\tH\x00R\x04hashB\x05\n" +
+	"\x03key\"O\n" +
+	"\x15SubmitCheckoutRequest\x126\n" +
+	"\bcheckout\x18\x01 \x01(\v2\x1a.library.chain.v1.CheckoutR\bcheckout\"Z\n" +
+	"\x16SubmitCheckoutResponse\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\x12\x18\n" +
+	"\apending\x18\x02 \x01(\x05R\apending\x12\x0e\n" +
+	"\x02id\x18\x03 \x01(\tR\x02id\"0\n" +
+	"\x13StreamBlocksRequest\x12\x19\n" +
+	"\bfrom_pos\x18\x01 \x01(\x03R\afromPos2\xd9\x02\n" +
+	"\x05Chain\x12Q\n" +
+	"\bGetChain\x12!.library.chain.v1.GetChainRequest\x1a\".library.chain.v1.GetChainResponse\x12F\n" +
+	"\bGetBlock\x12!.library.chain.v1.GetBlockRequest\x1a\x17.library.chain.v1.Block\x12c\n" +
+	"\x0eSubmitCheckout\x12'.library.chain.v1.SubmitCheckoutRequest\x1a(.library.chain.v1.SubmitCheckoutResponse\x12P\n" +
+	"\fStreamBlocks\x12%.library.chain.v1.StreamBlocksRequest\x1a\x17.library.chain.v1.Block0\x01B\x14Z\x12blockchain/chainpbb\x06proto3"
+
+var (
+	file_chainpb_chain_proto_rawDescOnce sync.Once
+	file_chainpb_chain_proto_rawDescData []byte
+)
+
+func file_chainpb_chain_proto_rawDescGZIP() []byte {
+	file_chainpb_chain_proto_rawDescOnce.Do(func() {
+		file_chainpb_chain_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_chainpb_chain_proto_rawDesc), len(file_chainpb_chain_proto_rawDesc)))
+	})
+	return file_chainpb_chain_proto_rawDescData
+}
+
+var file_chainpb_chain_proto_msgTypes = make([]protoimpl.MessageInfo, 14)
+var file_chainpb_chain_proto_goTypes = []any{
+	(*ChainParams)(nil),            // 0: library.chain.v1.ChainParams
+	(*BookRecord)(nil),             // 1: library.chain.v1.BookRecord
+	(*Checkout)(nil),               // 2: library.chain.v1.Checkout
+	(*AnchorReceipt)(nil),          // 3: library.chain.v1.AnchorReceipt
+	(*Block)(nil),                  // 4: library.chain.v1.Block
+	(*BlockOrigin)(nil),            // 5: library.chain.v1.BlockOrigin
+	(*BlockPage)(nil),              // 6: library.chain.v1.BlockPage
+	(*BlockList)(nil),              // 7: library.chain.v1.BlockList
+	(*GetChainRequest)(nil),        // 8: library.chain.v1.GetChainRequest
+	(*GetChainResponse)(nil),       // 9: library.chain.v1.GetChainResponse
+	(*GetBlockRequest)(nil),        // 10: library.chain.v1.GetBlockRequest
+	(*SubmitCheckoutRequest)(nil),  // 11: library.chain.v1.SubmitCheckoutRequest
+	(*SubmitCheckoutResponse)(nil), // 12: library.chain.v1.SubmitCheckoutResponse
+	(*StreamBlocksRequest)(nil),    // 13: library.chain.v1.StreamBlocksRequest
+}
+var file_chainpb_chain_proto_depIdxs = []int32{
+	0,  // 0: library.chain.v1.Checkout.chain:type_name -> library.chain.v1.ChainParams
+	1,  // 1: library.chain.v1.Checkout.book:type_name -> library.chain.v1.BookRecord
+	3,  // 2: library.chain.v1.Checkout.anchor:type_name -> library.chain.v1.AnchorReceipt
+	2,  // 3: library.chain.v1.Block.transactions:type_name -> library.chain.v1.Checkout
+	5,  // 4: library.chain.v1.Block.migrated:type_name -> library.chain.v1.BlockOrigin
+	4,  // 5: library.chain.v1.BlockPage.blocks:type_name -> library.chain.v1.Block
+	4,  // 6: library.chain.v1.BlockList.blocks:type_name -> library.chain.v1.Block
+	4,  // 7: library.chain.v1.GetChainResponse.blocks:type_name -> library.chain.v1.Block
+	2,  // 8: library.chain.v1.SubmitCheckoutRequest.checkout:type_name -> library.chain.v1.Checkout
+	8,  // 9: library.chain.v1.Chain.GetChain:input_type -> library.chain.v1.GetChainRequest
+	10, // 10: library.chain.v1.Chain.GetBlock:input_type -> library.chain.v1.GetBlockRequest
+	11, // 11: library.chain.v1.Chain.SubmitCheckout:input_type -> library.chain.v1.SubmitCheckoutRequest
+	13, // 12: library.chain.v1.Chain.StreamBlocks:input_type -> library.chain.v1.StreamBlocksRequest
+	9,  // 13: library.chain.v1.Chain.GetChain:output_type -> library.chain.v1.GetChainResponse
+	4,  // 14: library.chain.v1.Chain.GetBlock:output_type -> library.chain.v1.Block
+	12, // 15: library.chain.v1.Chain.SubmitCheckout:output_type -> library.chain.v1.SubmitCheckoutResponse
+	4,  // 16: library.chain.v1.Chain.StreamBlocks:output_type -> library.chain.v1.Block
+	13, // [13:17] is the sub-list for method output_type
+	9,  // [9:13] is the sub-list for method input_type
+	9,  // [9:9] is the sub-list for extension type_name
+	9,  // [9:9] is the sub-list for extension extendee
+	0,  // [0:9] is the sub-list for field type_name
+}
+
+func init() { file_chainpb_chain_proto_init() }
+func file_chainpb_chain_proto_init() {
+	if File_chainpb_chain_proto != nil {
+		return
+	}
+	file_chainpb_chain_proto_msgTypes[10].OneofWrappers = []any{
+		(*GetBlockRequest_Pos)(nil),
+		(*GetBlockRequest_Hash)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_chainpb_chain_proto_rawDesc), len(file_chainpb_chain_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   14,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_chainpb_chain_proto_goTypes,
+		DependencyIndexes: file_chainpb_chain_proto_depIdxs,
+		MessageInfos:      file_chainpb_chain_proto_msgTypes,
+	}.Build()
+	File_chainpb_chain_proto = out.File
+	file_chainpb_chain_proto_goTypes = nil
+	file_chainpb_chain_proto_depIdxs = nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	checkpointFile     = "checkpoints.json"
+	checkpointInterval = 100
+)
+
+// Checkpoint records the chain tip and a digest of the library state at a
+// height, signed by the node that appended the block. Validation can start
+// from a checkpoint this node signed instead of from genesis.
+type Checkpoint struct {
+	Height    int    `json:"height"`
+	TipHash   string `json:"tip_hash"`
+	StateRoot string `json:"state_root"`
+	Created   string `json:"created"`
+	Producer  string `json:"producer"`
+	Signature string `json:"signature"`
+}
+
+// signingBytes is the canonical encoding of everything but the signature.
+func (cp *Checkpoint) signingBytes() []byte {
+	e := &canonicalEncoder{}
+	e.buf.WriteString("library-chain/checkpoint/1")
+	e.field(1)
+	e.int(int64(cp.Height))
+	for i, s := range []string{cp.TipHash, cp.StateRoot, cp.Created, cp.Producer} {
+		e.field(byte(i + 2))
+		e.string(s)
+	}
+	return e.buf.Bytes()
+}
+
+func (cp *Checkpoint) sign(key ed25519.PrivateKey) {
+	cp.Producer = hex.EncodeToString(key.Public().(ed25519.PublicKey))
+	cp.Signature = hex.EncodeToString(ed25519.Sign(key, cp.signingBytes()))
+}
+
+func (cp *Checkpoint) verifySignature() error {
+	pub, err := hex.DecodeString(cp.Producer)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("invalid checkpoint producer key")
+	}
+	sig, err := hex.DecodeString(cp.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(pub), cp.signingBytes(), sig) {
+		return errors.New("invalid checkpoint signature")
+	}
+	return nil
+}
+
+// stateRoot digests a state snapshot with the chain's hash algorithm. Map
+// entries are encoded in key order so equal states give equal roots.
+func stateRoot(snap *StateSnapshot) string {
+	e := &canonicalEncoder{}
+	e.buf.WriteString("library-chain/state/1")
+	e.field(1)
+	for _, id := range sortedKeys(snap.Loans) {
+		l := snap.Loans[id]
+		e.string(id)
+		e.string(l.User)
+		e.string(l.CheckoutDate)
+		e.string(l.DueDate)
+		e.int(int64(l.Renewals))
+		e.int(int64(l.Block))
+	}
+	e.field(2)
+	for _, id := range sortedKeys(snap.Holds) {
+		e.string(id)
+		e.int(int64(len(snap.Holds[id])))
+		for _, h := range snap.Holds[id] {
+			e.string(h.User)
+			e.string(h.Date)
+			e.int(int64(h.Block))
+		}
+	}
+	e.field(3)
+	for _, user := range sortedKeys(snap.Fines) {
+		e.string(user)
+		e.int(snap.Fines[user])
+	}
+	if len(snap.Locations) > 0 {
+		e.field(4)
+		for _, id := range sortedKeys(snap.Locations) {
+			e.string(id)
+			e.string(snap.Locations[id])
+		}
+	}
+	if len(snap.Kinds) > 0 {
+		e.field(5)
+		for _, id := range sortedKeys(snap.Kinds) {
+			e.string(id)
+			e.string(snap.Kinds[id])
+		}
+	}
+	if len(snap.Records) > 0 {
+		e.field(6)
+		for _, typ := range sortedKeys(snap.Records) {
+			e.string(typ)
+			for _, id := range sortedKeys(snap.Records[typ]) {
+				e.string(id)
+				e.string(compactJSON(snap.Records[typ][id]))
+			}
+		}
+	}
+	return hex.EncodeToString(chainSum(e.buf.Bytes()))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CheckpointLog is the checkpoint history, kept in a JSON file in the order
+// the checkpoints were made.
+type CheckpointLog struct {
+	mu   sync.Mutex
+	path string
+	list []Checkpoint
+}
+
+var Checkpoints *CheckpointLog
+
+func OpenCheckpoints(path string) (*CheckpointLog, error) {
+	c := &CheckpointLog{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.list); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CheckpointLog) Add(cp Checkpoint) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.list = append(c.list, cp)
+	return writeFileAtomic(c.path, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(c.list)
+	})
+}
+
+func (c *CheckpointLog) List() []Checkpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]Checkpoint, len(c.list))
+	copy(out, c.list)
+	return out
+}
+
+// trusted returns the newest checkpoint signed by this node whose tip is
+// still on the chain, or nil. Checkpoints from a branch that was replaced
+// no longer match and are passed over.
+func (c *CheckpointLog) trusted(blocks []*Block) *Checkpoint {
+	list := c.List()
+	for i := len(list) - 1; i >= 0; i-- {
+		cp := list[i]
+		if cp.Producer != nodePublicKey() || cp.verifySignature() != nil {
+			continue
+		}
+		if cp.Height < len(blocks) && blocks[cp.Height].Hash == cp.TipHash {
+			return &cp
+		}
+	}
+	return nil
+}
+
+// checkpoint records a checkpoint when block lands on the interval. It runs
+// from appendBlock, so the state describes exactly this block.
+func (bc *Blockchain) checkpoint(block *Block) {
+	if Checkpoints == nil || checkpointInterval <= 0 || block.Pos == 0 || block.Pos%checkpointInterval != 0 {
+		return
+	}
+	bc.mu.RLock()
+	snap := bc.state.snapshot()
+	bc.mu.RUnlock()
+	cp := Checkpoint{
+		Height:    snap.Height,
+		TipHash:   snap.TipHash,
+		StateRoot: stateRoot(snap),
+		Created:   time.Now().UTC().Format(time.RFC3339),
+	}
+	cp.sign(NodeKey)
+	if err := Checkpoints.Add(cp); err != nil {
+		log.Printf("Error saving checkpoint at block %d: %v", cp.Height, err)
+		return
+	}
+	log.Printf("Checkpoint at block %d", cp.Height)
+}
+
+func getCheckpoints(w http.ResponseWriter, r *http.Request) {
+	list := []Checkpoint{}
+	if Checkpoints != nil {
+		list = Checkpoints.List()
+	}
+	respond(w, r, list)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"blockchain/config"
+)
+
+// rootCommand is the chain CLI. Commands parse their own flags with the
+// flag package, so the node flags keep their single-dash form and can come
+// from a config file or LIBRARY_* variables; run a command with -help to
+// list them. Without a command, chain serves as before.
+func rootCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:   "chain",
+		Short: "Library lending blockchain node and tools",
+		Long: `chain runs a library lending blockchain node, and works on its data offline.
+
+Without a command it runs "serve". The offline commands open the same store,
+chosen by -store, -data-dir and the other node flags, and need the node to be
+stopped, since only one process may use a data directory.`,
+		Args:               cobra.ArbitraryArgs,
+		DisableFlagParsing: true,
+		SilenceUsage:       true,
+		SilenceErrors:      true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runNode(args)
+		},
+	}
+	root.AddCommand(
+		&cobra.Command{
+			Use:                "serve [flags]",
+			Short:              "Run the node and its HTTP API",
+			DisableFlagParsing: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return runNode(args)
+			},
+		},
+		&cobra.Command{
+			Use:                "verify [flags]",
+			Short:              "Verify every stored block and print the integrity report",
+			DisableFlagParsing: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return runVerify(cmd.OutOrStdout(), args)
+			},
+		},
+		&cobra.Command{
+			Use:                "inspect [-height N | -block-hash H] [flags]",
+			Short:              "Print one block, the tip by default",
+			DisableFlagParsing: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return runInspect(cmd.OutOrStdout(), args)
+			},
+		},
+		&cobra.Command{
+			Use:                "export [-format csv|json] [-o file] [flags]",
+			Short:              "Write the chain's transactions as CSV or the whole chain as JSON",
+			DisableFlagParsing: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return runExport(cmd.OutOrStdout(), args)
+			},
+		},
+		&cobra.Command{
+			Use:                "import [-replace] [flags] FILE",
+			Short:              "Load a chain from a JSON chain file or a backup archive",
+			DisableFlagParsing: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return runImport(args)
+			},
+		},
+		&cobra.Command{
+			Use:                "rekey [flags]",
+			Short:              "Rewrite the chain files with -encryption-key, after a key rotation",
+			DisableFlagParsing: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return runRekey(args)
+			},
+		},
+		&cobra.Command{
+			Use:                "pow [-bits N] TXID",
+			Short:              "Solve the proof of work a node with -client-pow-bits asks for",
+			DisableFlagParsing: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return runPoW(cmd.OutOrStdout(), args)
+			},
+		},
+		&cobra.Command{
+			Use:                "explore [flags]",
+			Short:              "Browse and search the chain in a terminal UI",
+			DisableFlagParsing: true,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return runExplore(args)
+			},
+		},
+	)
+	return root
+}
+
+// commandFlags returns a flag set holding the node flags, for a command to
+// add its own to.
+func commandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("chain "+name, flag.ContinueOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	return fs
+}
+
+// prepare parses a command's flags with the config file and environment,
+// and sets up logging and the data directory.
+func prepare(fs *flag.FlagSet, args []string) error {
+	if err := config.Load(fs, args, "LIBRARY_", "config"); err != nil {
+		return err
+	}
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	if err := setupClock(); err != nil {
+		return err
+	}
+	if err := useDataDir(); err != nil {
+		return fmt.Errorf("create data directory: %w", err)
+	}
+	if err := lockDataDir(); err != nil {
+		return fmt.Errorf("lock data directory: %w", err)
+	}
+	if err := loadDataKeys(); err != nil {
+		return err
+	}
+	if err := loadFieldKeys(); err != nil {
+		return err
+	}
+	if difficulty < 0 || difficulty > 64 {
+		return fmt.Errorf("invalid difficulty %d", difficulty)
+	}
+	if chainID == "" {
+		return errors.New("-chain-id must not be empty")
+	}
+	if maxBodySize <= 0 || maxJSONDepth <= 0 {
+		return errors.New("-max-body-size and -max-json-depth must be positive")
+	}
+	if maxBlockSize <= blockOverhead || maxBlockTxs <= 0 {
+		return fmt.Errorf("-max-block-size must be over %d bytes and -max-block-txs positive", blockOverhead)
+	}
+	if clientPoWBits < 0 || clientPoWBits > 32 {
+		return fmt.Errorf("invalid -client-pow-bits %d; use 0 to 32", clientPoWBits)
+	}
+	kinds, err := parseAssetKinds(assetKindsSpec)
+	if err != nil {
+		return err
+	}
+	assetKinds = kinds
+	return useHashAlgorithm(hashAlgorithm)
+}
+
+// loadChain opens the configured store and loads BlockChain from it. An
+// empty store gets a new genesis block only if create is set.
+func loadChain(create bool) (Store, error) {
+	store, err := openStore(storeKind)
+	if err != nil {
+		return nil, fmt.Errorf("open %s store: %w", storeKind, err)
+	}
+	genesis, err := store.GetByPos(0)
+	switch {
+	case err == nil:
+		if algo := chainHashAlgorithm(genesis); algo != hashAlgorithm {
+			log.Printf("Stored chain hashes blocks with %s", algo)
+			useHashAlgorithm(algo)
+		}
+	case errors.Is(err, ErrNotFound) && !create:
+		store.Close()
+		return nil, fmt.Errorf("the %s store holds no chain", storeKind)
+	case !errors.Is(err, ErrNotFound):
+		store.Close()
+		return nil, err
+	}
+	if BlockChain, err = NewBlockChain(store); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("load blockchain: %w", err)
+	}
+	switch id := BlockChain.ChainID(); {
+	case id == "":
+		log.Printf("Warning: stored chain predates chain IDs and only syncs with other legacy nodes")
+	case id != chainID:
+		store.Close()
+		return nil, fmt.Errorf("stored chain has chain ID %q, but this node is configured for %q", id, chainID)
+	}
+	return store, nil
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// runVerify prints the integrity report of the stored chain and fails if
+// any block is invalid.
+func runVerify(out io.Writer, args []string) error {
+	if err := prepare(commandFlags("verify"), args); err != nil {
+		return err
+	}
+	store, err := loadChain(false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	report := BlockChain.Integrity()
+	if report.Checkpoint != nil {
+		// Startup took the snapshot's blocks as valid; verify does not.
+		report = BlockChain.checkIntegrity()
+	}
+	if err := writeJSON(out, report); err != nil {
+		return err
+	}
+	if !report.Valid {
+		return fmt.Errorf("block %d is invalid: %s", *report.FirstInvalid, report.Reason)
+	}
+	return nil
+}
+
+// runInspect prints a block by height or hash, with whether it is valid.
+func runInspect(out io.Writer, args []string) error {
+	fs := commandFlags("inspect")
+	height := fs.Int("height", -1, "height of the block to print (default the tip)")
+	hash := fs.String("block-hash", "", "hash of the block to print")
+	if err := prepare(fs, args); err != nil {
+		return err
+	}
+	store, err := loadChain(false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	blocks := BlockChain.Snapshot()
+	block := blocks[len(blocks)-1]
+	switch {
+	case *hash != "":
+		block = BlockChain.BlockByHash(*hash)
+	case *height >= 0:
+		block = BlockChain.BlockAt(*height)
+	}
+	if block == nil {
+		return fmt.Errorf("block not found; the tip is at height %d", len(blocks)-1)
+	}
+	var prev *Block
+	if block.Pos > 0 {
+		prev = blocks[block.Pos-1]
+	}
+	status := "valid"
+	if err := checkBlock(block, prev); err != nil {
+		status = err.Error()
+	}
+	return writeJSON(out, struct {
+		*Block
+		Validation string `json:"validation"`
+	}{block, status})
+}
+
+var exportColumns = []string{"height", "block_hash", "block_time", "tx_id", "type", "book_id", "user", "checkout_date", "due_date", "fine", "amount"}
+
+// runExport writes every transaction as a CSV row, or the chain in the
+// blockchain.json format.
+func runExport(out io.Writer, args []string) error {
+	fs := commandFlags("export")
+	format := fs.String("format", "csv", "output format: csv (one row per transaction) or json (the whole chain)")
+	output := fs.String("o", "", "file to write (default standard output)")
+	if err := prepare(fs, args); err != nil {
+		return err
+	}
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("unknown export format %q", *format)
+	}
+	store, err := loadChain(false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	blocks := BlockChain.Snapshot()
+	if *format == "json" {
+		return writeJSON(out, Blockchain{Blocks: blocks})
+	}
+	cw := csv.NewWriter(out)
+	cw.Write(exportColumns)
+	for _, b := range blocks {
+		for _, tx := range b.Transactions {
+			if tx.IsGenesis {
+				continue
+			}
+			cw.Write([]string{
+				strconv.Itoa(b.Pos), b.Hash, b.Timestamp, tx.ID(), tx.Kind(), tx.BookId, tx.User,
+				tx.CheckoutDate, tx.DueDate, strconv.FormatInt(tx.Fine, 10), strconv.FormatInt(tx.Amount, 10),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// runImport loads a chain from a blockchain.json-style file or a backup
+// archive into an empty store, or with -replace in place of the stored one.
+// The chain is validated either way.
+func runImport(args []string) error {
+	fs := commandFlags("import")
+	replace := fs.Bool("replace", false, "replace a chain that is already stored")
+	if err := prepare(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: chain import [-replace] [flags] FILE")
+	}
+	path := fs.Arg(0)
+	blocks, err := readChainImport(path)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+	if len(blocks) == 0 {
+		return fmt.Errorf("%s holds no blocks", path)
+	}
+	store, err := openStore(storeKind)
+	if err != nil {
+		return fmt.Errorf("open %s store: %w", storeKind, err)
+	}
+	_, err = store.Tip()
+	switch {
+	case err == nil:
+		store.Close()
+		if !*replace {
+			return fmt.Errorf("the %s store already holds a chain; use -replace to overwrite it", storeKind)
+		}
+		if store, err = loadChain(false); err != nil {
+			return err
+		}
+		defer store.Close()
+		if err := BlockChain.Replace(blocks); err != nil {
+			return err
+		}
+	case !errors.Is(err, ErrNotFound):
+		store.Close()
+		return err
+	default:
+		defer store.Close()
+		if id := blocks[0].ChainID(); id != "" && id != chainID {
+			return fmt.Errorf("chain in %s has chain ID %q, but this node is configured for %q", path, id, chainID)
+		}
+		if err := useHashAlgorithm(chainHashAlgorithm(blocks[0])); err != nil {
+			return err
+		}
+		if report := (&Blockchain{Blocks: blocks}).Validate(); !report.Valid {
+			return fmt.Errorf("block %d is invalid: %s", *report.FirstInvalid, report.Reason)
+		}
+		if err := store.Replace(blocks); err != nil {
+			return err
+		}
+	}
+	log.Printf("Imported %d blocks from %s into the %s store", len(blocks), path, storeKind)
+	return nil
+}
+
+// readChainImport reads a backup archive (.tar.gz or .tgz) or a chain file.
+func readChainImport(path string) ([]*Block, error) {
+	if strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz") {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		_, blocks, err := readBackup(f)
+		return blocks, err
+	}
+	return readChainFile(path)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"blockchain/apierr"
+)
+
+// Clock tells the time. Block creation, due dates, fines and the overdue
+// report read it through clock rather than calling time.Now, so the lending
+// rules can be run against a FakeClock.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// FakeClock is a Clock that only moves when it is set or advanced. It is
+// safe for concurrent use.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set moves the clock to t, which may be earlier than its current time.
+func (c *FakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// Advance moves the clock forward by d and returns the new time.
+func (c *FakeClock) Advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+var clock Clock = realClock{}
+
+// fakeClockStart, when set, runs the node on a FakeClock starting at that
+// RFC 3339 time, for dry runs and simulations.
+var fakeClockStart string
+
+func setupClock() error {
+	if fakeClockStart == "" {
+		clock = realClock{}
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, fakeClockStart)
+	if err != nil {
+		return fmt.Errorf("invalid -fake-clock %q: want an RFC 3339 time", fakeClockStart)
+	}
+	clock = NewFakeClock(t)
+	return nil
+}
+
+func writeClock(w http.ResponseWriter, r *http.Request) {
+	_, fake := clock.(*FakeClock)
+	respond(w, r, map[string]any{"now": clock.Now().UTC().Format(time.RFC3339Nano), "fake": fake})
+}
+
+func getClock(w http.ResponseWriter, r *http.Request) {
+	writeClock(w, r)
+}
+
+// setClock sets or advances a fake clock: {"time": "2026-01-01T00:00:00Z"}
+// or {"advance": "72h"}.
+func setClock(w http.ResponseWriter, r *http.Request) {
+	fc, ok := clock.(*FakeClock)
+	if !ok {
+		writeError(w, r, apierr.New(apierr.NotFound, "the node is not running on a fake clock"))
+		return
+	}
+	var req struct {
+		Time    string `json:"time"`
+		Advance string `json:"advance"`
+	}
+	if err := decodeJSON(r.Body, &req); err != nil || (req.Time == "") == (req.Advance == "") {
+		writeError(w, r, apierr.New(apierr.InvalidRequest, "send either time or advance"))
+		return
+	}
+	if req.Time != "" {
+		t, err := time.Parse(time.RFC3339, req.Time)
+		if err != nil {
+			writeError(w, r, apierr.New(apierr.InvalidRequest, "time must be an RFC 3339 time"))
+			return
+		}
+		fc.Set(t)
+	} else {
+		d, err := time.ParseDuration(req.Advance)
+		if err != nil || d < 0 {
+			writeError(w, r, apierr.New(apierr.InvalidRequest, "advance must be a non-negative duration such as 72h"))
+			return
+		}
+		fc.Advance(d)
+	}
+	reqLog(r).Info("Fake clock moved", "now", fc.Now())
+	writeClock(w, r)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressMinSize is the smallest body worth compressing; anything shorter
+// is sent as it is.
+const compressMinSize = 1024
+
+// compressor is a pooled gzip or brotli writer.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// compressors are the encodings offered, most preferred first, with pools
+// of their writers.
+var compressors = []struct {
+	name string
+	pool *sync.Pool
+}{
+	{"br", &sync.Pool{New: func() any { return brotli.NewWriterLevel(nil, 5) }}},
+	{"gzip", &sync.Pool{New: func() any { return gzip.NewWriter(nil) }}},
+}
+
+// compressed compresses the response with gzip or brotli when the request's
+// Accept-Encoding allows it. It is for large, frequently polled responses
+// such as pages of the chain and reports. Error responses are left alone,
+// as the logging middleware adds the request ID to them.
+func compressed(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		name, pool := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if pool == nil {
+			next(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, name: name, pool: pool}
+		defer cw.Close()
+		next(cw, r)
+	}
+}
+
+// acceptedEncoding picks the encoding Accept-Encoding gives the highest
+// q-value, preferring brotli on a tie, or returns a nil pool for none.
+func acceptedEncoding(header string) (string, *sync.Pool) {
+	best, bestQ := -1, 0.0
+	for i, c := range compressors {
+		if q := encodingQ(header, c.name); q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+	if best < 0 {
+		return "", nil
+	}
+	return compressors[best].name, compressors[best].pool
+}
+
+// encodingQ is the q-value Accept-Encoding gives coding, directly or
+// through "*".
+func encodingQ(header, coding string) float64 {
+	q, exact := 0.0, false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != coding && (name != "*" || exact) {
+			continue
+		}
+		pq := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				pq = f
+			}
+		}
+		q, exact = pq, name == coding
+	}
+	return q
+}
+
+// compressWriter holds back the start of a response until it knows the body
+// is at least compressMinSize, then sends the rest through the compressor.
+type compressWriter struct {
+	http.ResponseWriter
+	name   string
+	pool   *sync.Pool
+	enc    compressor
+	status int
+	buf    []byte
+	// plain is set once the response is known to go out uncompressed.
+	plain bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+	if status >= 300 || status == http.StatusNoContent || cw.Header().Get("Content-Encoding") != "" {
+		cw.plain = true
+		cw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case cw.plain:
+		return cw.ResponseWriter.Write(p)
+	case cw.enc != nil:
+		return cw.enc.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= compressMinSize {
+		if err := cw.start(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start sends the headers for a compressed response and what was held back.
+func (cw *compressWriter) start() error {
+	h := cw.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", cw.name)
+	cw.ResponseWriter.WriteHeader(cw.status)
+	cw.enc = cw.pool.Get().(compressor)
+	cw.enc.Reset(cw.ResponseWriter)
+	_, err := cw.enc.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+// Flush starts compressing whatever has been written, since a streamed
+// response will not wait to reach compressMinSize.
+func (cw *compressWriter) Flush() {
+	if cw.status == 0 {
+		return
+	}
+	if !cw.plain && cw.enc == nil && cw.start() != nil {
+		return
+	}
+	if cw.enc != nil && cw.enc.Flush() != nil {
+		return
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the compressed stream, or sends a short body as it is.
+func (cw *compressWriter) Close() error {
+	switch {
+	case cw.enc != nil:
+		err := cw.enc.Close()
+		cw.enc.Reset(nil)
+		cw.pool.Put(cw.enc)
+		cw.enc = nil
+		return err
+	case !cw.plain && cw.status != 0:
+		cw.plain = true
+		cw.ResponseWriter.WriteHeader(cw.status)
+		_, err := cw.ResponseWriter.Write(cw.buf)
+		return err
+	}
+	return nil
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
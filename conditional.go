@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// chainNotModified labels a response that depends only on the chain with
+// validators taken from the tip block: a weak ETag of its hash and
+// Last-Modified from its time. If the request's If-None-Match, or failing
+// that If-Modified-Since, shows the client already has this version, it
+// answers 304 and returns true.
+func chainNotModified(w http.ResponseWriter, r *http.Request) bool {
+	tip := tenantOf(r).chain.Tip()
+	modified := tip.Time()
+	h := w.Header()
+	h.Set("ETag", `W/"`+tip.Hash+`"`)
+	h.Set("Cache-Control", "no-cache")
+	if !modified.IsZero() {
+		h.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatches(inm, tip.Hash) {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err != nil || modified.IsZero() || modified.Truncate(time.Second).After(since) {
+			return false
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches compares If-None-Match with an entity tag the weak way, as
+// RFC 9110 asks for GET: W/"x" and "x" are the same tag.
+func etagMatches(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == `"`+tag+`"` {
+			return true
+		}
+	}
+	return false
+}
+
+// chainConditional answers conditional GETs for a handler whose response
+// depends only on the chain, without running it when nothing has changed.
+func chainConditional(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if chainNotModified(w, r) {
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,123 @@
+// Package config fills a flag.FlagSet from a configuration file and the
+// environment as well as the command line, so every flag can also be set in
+// a file or a variable.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Load parses args into fs and then sets every flag not given on the command
+// line from, in order of precedence, the environment variable envPrefix
+// followed by the flag name in upper case with dashes as underscores (so
+// -cors-origins is LIBRARY_CORS_ORIGINS), and the file named by the
+// configFlag flag or its environment variable. Command-line flags always
+// win.
+func Load(fs *flag.FlagSet, args []string, envPrefix, configFlag string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	values := map[string]string{}
+	path := fs.Lookup(configFlag).Value.String()
+	if !given[configFlag] {
+		if v, ok := os.LookupEnv(envName(envPrefix, configFlag)); ok {
+			path = v
+		}
+	}
+	if path != "" {
+		file, err := ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for name, v := range file {
+			if fs.Lookup(name) == nil {
+				return fmt.Errorf("%s: unknown setting %q", path, name)
+			}
+			values[name] = v
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envName(envPrefix, f.Name)); ok {
+			values[f.Name] = v
+		}
+	})
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if given[name] || name == configFlag {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %v", values[name], name, err)
+		}
+	}
+	return nil
+}
+
+func envName(prefix, flagName string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// ReadFile reads a YAML (.yaml, .yml) or TOML (.toml) file into flag values.
+// Tables nest with dashes, so a "cors" table holding "origins" sets
+// cors-origins; underscores in keys are read as dashes and lists are joined
+// with commas.
+func ReadFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	default:
+		return nil, fmt.Errorf("%s: unsupported config format %q, use .yaml or .toml", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	values := map[string]string{}
+	flatten("", doc, values)
+	return values, nil
+}
+
+func flatten(prefix string, doc map[string]any, out map[string]string) {
+	for k, v := range doc {
+		name := strings.ReplaceAll(strings.ToLower(k), "_", "-")
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+		switch v := v.(type) {
+		case map[string]any:
+			flatten(name, v, out)
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			out[name] = strings.Join(items, ",")
+		case nil:
+			out[name] = ""
+		default:
+			out[name] = fmt.Sprint(v)
+		}
+	}
+}
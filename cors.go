@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	corsOrigins     = envString("CORS_ORIGINS", "*")
+	corsMethods     = envString("CORS_METHODS", "GET, POST, PUT, DELETE, OPTIONS")
+	corsHeaders     = envString("CORS_HEADERS", "Content-Type, Authorization, X-API-Key, X-Client-ID, X-Timestamp, X-Signature, X-Request-ID, Idempotency-Key, API-Version, X-PoW")
+	corsCredentials = os.Getenv("CORS_CREDENTIALS") == "true"
+	corsMaxAge      = envInt("CORS_MAX_AGE", 0)
+)
+
+func envString(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+// originMatches reports whether origin is allowed by pattern. A pattern is
+// "*", an exact origin such as "https://library.example.org", or one with a
+// "*" in the host such as "https://*.example.org", which matches any
+// subdomain but not the bare domain.
+func originMatches(pattern, origin string) bool {
+	if pattern == "*" || pattern == origin {
+		return true
+	}
+	prefix, suffix, ok := strings.Cut(pattern, "*")
+	if !ok || len(origin) <= len(prefix)+len(suffix) {
+		return false
+	}
+	if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	sub := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(sub, "/:@")
+}
+
+// checkCORS refuses -cors-credentials with a "*" origin, which would let any
+// site make requests with a member's cookies or credentials and read the
+// answers.
+func checkCORS() error {
+	if !corsCredentials {
+		return nil
+	}
+	for _, p := range strings.Split(corsOrigins, ",") {
+		if strings.TrimSpace(p) == "*" {
+			return errors.New("-cors-credentials needs -cors-origins to list the allowed origins, not \"*\"")
+		}
+	}
+	return nil
+}
+
+func allowedOrigin(origin string) bool {
+	for _, p := range strings.Split(corsOrigins, ",") {
+		if originMatches(strings.TrimSpace(p), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// middlewareCORS applies the configured CORS policy. With a wildcard origin
+// and no credentials every site gets "*"; otherwise an allowed request
+// origin is echoed back.
+func middlewareCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		switch {
+		case corsOrigins == "*" && !corsCredentials:
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		case origin != "" && allowedOrigin(origin):
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+			if corsCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+		w.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+		if r.Method == "OPTIONS" {
+			if corsMaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
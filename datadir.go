@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	configFile string
+	dataDir    string
+)
+
+// useDataDir places the node's relative data files under -data-dir,
+// creating it if needed. Inputs such as TLS certificates are left relative
+// to the working directory.
+func useDataDir() error {
+	if dataDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return err
+	}
+	for _, p := range []*string{
+		&logFile, &chainFile, &boltFile, &sqliteFile, &nodeKeyFile, &catalogFile, &walletDir,
+		&raftDir, &checkpointFile, &authKeyFile, &apiKeyFile, &autocertCache, &tenantFile, &tenantDir, &memberFile,
+		&pseudonymKeyFile, &pseudonymFile, &payloadFile, &auditFile,
+	} {
+		if !filepath.IsAbs(*p) {
+			*p = filepath.Join(dataDir, *p)
+		}
+	}
+	return nil
+}
+
+var errLocked = errors.New("locked by another process")
+
+// lockFile keeps the locked file reachable; if it were collected, its
+// finalizer would close it and drop the lock.
+var lockFile *os.File
+
+// lockDataDir takes an exclusive lock on the LOCK file in the data directory
+// (the working directory without -data-dir), so a second node started on the
+// same files fails instead of overwriting the first one's writes. The lock
+// goes away with the process, however it exits.
+func lockDataDir() error {
+	path := filepath.Join(dataDir, "LOCK")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := tryLock(f); err != nil {
+		defer f.Close()
+		if errors.Is(err, errLocked) {
+			owner, _ := os.ReadFile(path)
+			if pid := strings.TrimSpace(string(owner)); pid != "" {
+				return fmt.Errorf("%s is in use by another node (pid %s)", path, pid)
+			}
+			return fmt.Errorf("%s is in use by another node", path)
+		}
+		return err
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	lockFile = f
+	return nil
+}
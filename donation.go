@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// TxDonation records that a member donated an item in the catalog. It is
+// signed by the donor, and the state keeps one donation record per item.
+const TxDonation = "donation"
+
+var ErrAlreadyDonated = errors.New("item's donation is already recorded")
+
+// DonationData is the payload of a donation. Value is an estimate in cents.
+type DonationData struct {
+	Condition string `json:"condition,omitempty"`
+	Value     int64  `json:"value,omitempty"`
+}
+
+// DonationRecord is what the state keeps about a donated item.
+type DonationRecord struct {
+	Donor string `json:"donor"`
+	Date  string `json:"date"`
+	DonationData
+}
+
+func init() {
+	registerTxType(&TxType{
+		Name: TxDonation, Event: "book.donated", Book: true, User: true,
+		Decode: decodeDonation,
+		Fields: bookTxFields,
+		Check: func(s *LibraryState, tx Transaction) error {
+			if _, ok := s.record(TxDonation, tx.BookId); ok {
+				return ErrAlreadyDonated
+			}
+			return nil
+		},
+		Apply: func(s *LibraryState, tx Transaction, pos int, blockTime string) {
+			rec := DonationRecord{Donor: tx.User, Date: recordDate(tx, blockTime)}
+			if data, err := decodeDonation(tx.Data); err == nil {
+				rec.DonationData = data.(DonationData)
+			}
+			s.putRecord(TxDonation, tx.BookId, rec)
+		},
+	})
+}
+
+// decodeDonation accepts an empty payload, for a donation with nothing more
+// to say.
+func decodeDonation(raw json.RawMessage) (any, error) {
+	var d DonationData
+	if len(raw) > 0 {
+		if err := decodeStrict(raw, &d); err != nil {
+			return nil, err
+		}
+	}
+	if d.Value < 0 {
+		return nil, errors.New("value must not be negative")
+	}
+	return d, nil
+}
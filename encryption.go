@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	encryptionKey     string
+	encryptionOldKeys string
+)
+
+// sealedMagic starts every sealed payload. JSON never starts with it, so
+// payloads written before -encryption-key was set can still be told apart
+// and read.
+const sealedMagic = "LCE\x01"
+
+var (
+	ErrNoDataKey  = errors.New("data is encrypted; start the node with -encryption-key")
+	ErrUnknownKey = errors.New("data is encrypted with a key that is neither -encryption-key nor in -encryption-old-keys")
+)
+
+// DataKey is an AES-256 key the chain files are sealed with. Its ID, written
+// in the clear with each sealed payload, is derived from the key, so the
+// keyring can find the key a payload needs without storing anything else.
+type DataKey struct {
+	ID   string
+	aead cipher.AEAD
+}
+
+func newDataKey(key []byte) (*DataKey, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key is %d bytes, not 32", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(append([]byte("library-chain/key-id\x00"), key...))
+	return &DataKey{ID: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+// Keyring holds the key new data is sealed with, if any, and the keys data
+// sealed before a rotation may still need.
+type Keyring struct {
+	current *DataKey
+	keys    map[string]*DataKey
+}
+
+// dataKeys is the keyring of -encryption-key and -encryption-old-keys. The
+// zero keyring writes in the clear.
+var dataKeys = &Keyring{}
+
+// newKeyring fetches the current key from src, if any, and the keys before
+// it from the comma-separated oldSrcs.
+func newKeyring(src, oldSrcs string) (*Keyring, error) {
+	ring := &Keyring{keys: map[string]*DataKey{}}
+	if src != "" {
+		k, err := fetchDataKey(src)
+		if err != nil {
+			return nil, err
+		}
+		ring.current = k
+		ring.keys[k.ID] = k
+	}
+	for _, old := range strings.Split(oldSrcs, ",") {
+		if old = strings.TrimSpace(old); old == "" {
+			continue
+		}
+		k, err := fetchDataKey(old)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", old, err)
+		}
+		ring.keys[k.ID] = k
+	}
+	return ring, nil
+}
+
+// loadDataKeys fetches the keys named by -encryption-key and
+// -encryption-old-keys. Only the log store, the default, is encrypted.
+func loadDataKeys() error {
+	ring, err := newKeyring(encryptionKey, encryptionOldKeys)
+	if err != nil {
+		return fmt.Errorf("-encryption-key: %w", err)
+	}
+	if ring.current != nil && storeKind != "log" {
+		return fmt.Errorf("-encryption-key needs the log store, not %q; encrypt a database store with the database's own means", storeKind)
+	}
+	dataKeys = ring
+	if ring.current != nil {
+		log.Printf("Encrypting chain data with key %s", ring.current.ID)
+	}
+	return nil
+}
+
+// fetchDataKey reads a 32-byte key from a secret source (see fetchSecret),
+// such as a KMS decrypting a wrapped key. Keys are never given on the command
+// line, where other users could read them.
+func fetchDataKey(src string) (*DataKey, error) {
+	key, err := fetchKey(src, 32)
+	if err != nil {
+		return nil, err
+	}
+	return newDataKey(key)
+}
+
+// Encrypted reports whether new data is sealed.
+func (ring *Keyring) Encrypted() bool {
+	return ring.current != nil
+}
+
+// Seal encrypts plain with the current key, as
+//
+//	[magic][1-byte key ID length][key ID][nonce][AES-GCM ciphertext]
+//
+// with the magic and key ID authenticated too. Without a current key plain is
+// returned as it is.
+func (ring *Keyring) Seal(plain []byte) ([]byte, error) {
+	k := ring.current
+	if k == nil {
+		return plain, nil
+	}
+	header := append([]byte(sealedMagic), byte(len(k.ID)))
+	header = append(header, k.ID...)
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(bytes.Clone(header), nonce...)
+	return k.aead.Seal(out, nonce, plain, header), nil
+}
+
+// Open decrypts data sealed with any key of the ring. Data that was never
+// sealed is returned as it is.
+func (ring *Keyring) Open(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(sealedMagic)) {
+		return data, nil
+	}
+	rest := data[len(sealedMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return nil, errors.New("sealed data is truncated")
+	}
+	id := string(rest[1 : 1+rest[0]])
+	header := data[:len(sealedMagic)+1+len(id)]
+	rest = rest[1+len(id):]
+	if len(ring.keys) == 0 {
+		return nil, fmt.Errorf("%w (key %s)", ErrNoDataKey, id)
+	}
+	k, ok := ring.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	if len(rest) < k.aead.NonceSize() {
+		return nil, errors.New("sealed data is truncated")
+	}
+	nonce, ciphertext := rest[:k.aead.NonceSize()], rest[k.aead.NonceSize():]
+	plain, err := k.aead.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt with key %s: %w", id, err)
+	}
+	return plain, nil
+}
+
+// runRekey rewrites the log stores of the node and its branches with the
+// current key, so keys in -encryption-old-keys can be retired afterwards.
+// Without -encryption-key it writes them in the clear.
+func runRekey(args []string) error {
+	if err := prepare(commandFlags("rekey"), args); err != nil {
+		return err
+	}
+	if storeKind != "log" {
+		return fmt.Errorf("only the log store is encrypted, not %q", storeKind)
+	}
+	paths := []string{logFile}
+	branches, err := filepath.Glob(filepath.Join(tenantDir, "*", "chain.log"))
+	if err != nil {
+		return err
+	}
+	for _, path := range append(paths, branches...) {
+		if !fileExists(path) {
+			continue
+		}
+		store, err := NewLogStore(path, FsyncAlways, 0)
+		if err != nil {
+			return err
+		}
+		err = store.Rekey()
+		if cerr := store.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("rekey %s: %w", path, err)
+		}
+		log.Printf("Rewrote %s", path)
+	}
+	return nil
+}
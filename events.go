@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"blockchain/apierr"
+)
+
+const (
+	eventBlockAdded       = "block.added"
+	eventBookRegistered   = "book.registered"
+	eventCheckoutRejected = "checkout.rejected"
+
+	// rejectionHistory is how many checkout rejections are kept for clients
+	// resuming with Last-Event-ID. Block events are replayed from the chain.
+	rejectionHistory = 256
+	eventKeepAlive   = 30 * time.Second
+)
+
+// eventID orders events on /events. Events from a block have the block's
+// position, with seq 0 for block.added and 1+i for its transaction i.
+// A rejection has the position of the tip when it happened and a seq after
+// that block's transactions, so it sorts between the two blocks.
+type eventID struct {
+	pos, seq int
+}
+
+func (id eventID) String() string { return fmt.Sprintf("%d.%d", id.pos, id.seq) }
+
+func (id eventID) after(o eventID) bool {
+	return id.pos > o.pos || id.pos == o.pos && id.seq > o.seq
+}
+
+func parseEventID(s string) (eventID, error) {
+	var id eventID
+	if _, err := fmt.Sscanf(s, "%d.%d", &id.pos, &id.seq); err != nil || id.pos < 0 || id.seq < 0 {
+		return eventID{}, fmt.Errorf("invalid event ID %q", s)
+	}
+	return id, nil
+}
+
+type serverEvent struct {
+	id   eventID
+	typ  string
+	data any
+}
+
+// CheckoutRejection is the data of a checkout.rejected event.
+type CheckoutRejection struct {
+	ID     string `json:"id"`
+	BookId string `json:"bookid"`
+	User   string `json:"user"`
+	Reason string `json:"reason"`
+	Time   string `json:"time"`
+}
+
+// BookRegistration is the data of a book.registered event.
+type BookRegistration struct {
+	Pos       int    `json:"pos"`
+	BlockHash string `json:"block_hash"`
+	ID        string `json:"id"`
+	Book      *Book  `json:"book"`
+}
+
+// Rejections carries checkout.rejected events as they happen, and keeps the
+// latest for replay.
+var Rejections = newFeed[serverEvent]()
+
+var rejections struct {
+	sync.Mutex
+	recent  []serverEvent
+	tipHash string
+	seq     int
+}
+
+// noteRejected records that a checkout submission was refused.
+func noteRejected(tx Transaction, err error) {
+	if tx.Kind() != TxCheckout || BlockChain == nil {
+		return
+	}
+	tip := BlockChain.Tip()
+	rejections.Lock()
+	if rejections.tipHash != tip.Hash {
+		rejections.tipHash, rejections.seq = tip.Hash, len(tip.Transactions)
+	}
+	rejections.seq++
+	ev := serverEvent{
+		id:  eventID{tip.Pos, rejections.seq},
+		typ: eventCheckoutRejected,
+		data: CheckoutRejection{
+			ID: tx.ID(), BookId: tx.BookId, User: tx.User, Reason: err.Error(),
+			Time: time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	rejections.recent = append(rejections.recent, ev)
+	if len(rejections.recent) > rejectionHistory {
+		rejections.recent = rejections.recent[len(rejections.recent)-rejectionHistory:]
+	}
+	rejections.Unlock()
+	Rejections.publish(ev)
+}
+
+// latestEventID returns the ID of the newest event so far.
+func latestEventID() eventID {
+	tip := BlockChain.Tip()
+	rejections.Lock()
+	defer rejections.Unlock()
+	if rejections.tipHash == tip.Hash {
+		return eventID{tip.Pos, rejections.seq}
+	}
+	return eventID{tip.Pos, len(tip.Transactions)}
+}
+
+// recentRejections returns the kept rejections after id at block pos.
+func recentRejections(pos int, id eventID) []serverEvent {
+	rejections.Lock()
+	defer rejections.Unlock()
+	var out []serverEvent
+	for _, ev := range rejections.recent {
+		if ev.id.pos == pos && ev.id.after(id) {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+// blockEvents returns the events of block b.
+func blockEvents(b *Block) []serverEvent {
+	events := []serverEvent{{id: eventID{b.Pos, 0}, typ: eventBlockAdded, data: b}}
+	for i, tx := range b.Transactions {
+		if tx.Kind() == TxBookRegistered && !tx.IsGenesis {
+			events = append(events, serverEvent{
+				id:   eventID{b.Pos, i + 1},
+				typ:  eventBookRegistered,
+				data: BookRegistration{Pos: b.Pos, BlockHash: b.Hash, ID: tx.ID(), Book: tx.Book},
+			})
+		}
+	}
+	return events
+}
+
+// streamEvents serves server-sent events: block.added for each block
+// appended, book.registered for each book in it, and checkout.rejected for
+// refused checkouts. A client reconnecting with Last-Event-ID gets the
+// events it missed: block events from the chain, rejections only while the
+// node still holds them.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, apierr.New(apierr.Internal, "streaming unsupported"))
+		return
+	}
+	last := latestEventID()
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		id, err := parseEventID(v)
+		if err != nil {
+			writeError(w, r, apierr.Wrap(apierr.InvalidRequest, err))
+			return
+		}
+		last = id
+	}
+	blocks, cancelBlocks := NewBlocks.Subscribe()
+	defer cancelBlocks()
+	rejected, cancelRejected := Rejections.Subscribe()
+	defer cancelRejected()
+	quit, untrack := trackStream()
+	defer untrack()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	send := func(ev serverEvent) error {
+		data, err := json.Marshal(ev.data)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", ev.id, ev.typ, data); err != nil {
+			return err
+		}
+		last = ev.id
+		return nil
+	}
+	// catchUp sends the events after last from the chain and the kept
+	// rejections, in order, up to the tip.
+	catchUp := func() error {
+		snapshot := BlockChain.Snapshot()
+		for pos := last.pos; pos < len(snapshot); pos++ {
+			for _, ev := range blockEvents(snapshot[pos]) {
+				if ev.id.after(last) {
+					if err := send(ev); err != nil {
+						return err
+					}
+				}
+			}
+			for _, ev := range recentRejections(pos, last) {
+				if err := send(ev); err != nil {
+					return err
+				}
+			}
+		}
+		flusher.Flush()
+		return nil
+	}
+	if err := catchUp(); err != nil {
+		return
+	}
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-quit:
+			return
+		case <-blocks:
+		case <-rejected:
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		if err := catchUp(); err != nil {
+			return
+		}
+	}
+}
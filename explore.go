@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+var (
+	exploreTitle    = lipgloss.NewStyle().Bold(true)
+	exploreSelected = lipgloss.NewStyle().Reverse(true)
+	exploreInvalid  = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))
+	exploreValid    = lipgloss.NewStyle().Foreground(lipgloss.Color("10"))
+	exploreHelp     = lipgloss.NewStyle().Faint(true)
+)
+
+type exploreView int
+
+const (
+	viewBlocks exploreView = iota
+	viewBlock
+	viewSearch
+	viewResults
+)
+
+// explorer is the bubbletea model behind "chain explore": a list of blocks,
+// a page per block, and search by book ID or user.
+type explorer struct {
+	blocks  []*Block
+	status  []string // "" for a valid block, else why it is invalid
+	view    exploreView
+	back    exploreView
+	cursor  int // selected block
+	txs     int // first transaction shown on a block page
+	query   string
+	results []TxEvent
+	rcursor int
+	height  int
+}
+
+func newExplorer(bc *Blockchain) *explorer {
+	m := &explorer{blocks: bc.Snapshot(), height: 24}
+	m.status = make([]string, len(m.blocks))
+	var prev *Block
+	for i, b := range m.blocks {
+		if err := checkBlock(b, prev); err != nil {
+			m.status[i] = err.Error()
+		}
+		prev = b
+	}
+	m.cursor = len(m.blocks) - 1
+	return m
+}
+
+func (m *explorer) Init() tea.Cmd { return nil }
+
+// page is how many list rows fit under the header and above the help line.
+func (m *explorer) page() int {
+	return max(m.height-4, 1)
+}
+
+func (m *explorer) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		if msg.Height > 0 {
+			m.height = msg.Height
+		}
+	case tea.KeyMsg:
+		if msg.String() == "ctrl+c" {
+			return m, tea.Quit
+		}
+		if m.view == viewSearch {
+			m.updateSearch(msg)
+			return m, nil
+		}
+		switch msg.String() {
+		case "q":
+			return m, tea.Quit
+		case "/":
+			m.back, m.view, m.query = m.view, viewSearch, ""
+		case "esc", "backspace", "left", "h":
+			switch m.view {
+			case viewBlock:
+				m.view = m.back
+			case viewResults:
+				m.view = viewBlocks
+			}
+		case "enter", "right", "l":
+			switch m.view {
+			case viewBlocks:
+				m.back, m.view, m.txs = viewBlocks, viewBlock, 0
+			case viewResults:
+				if len(m.results) > 0 {
+					m.cursor = m.results[m.rcursor].BlockPos
+					m.back, m.view, m.txs = viewResults, viewBlock, 0
+				}
+			}
+		default:
+			m.move(msg.String())
+		}
+	}
+	return m, nil
+}
+
+func (m *explorer) updateSearch(msg tea.KeyMsg) {
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.view = m.back
+	case tea.KeyEnter:
+		m.search()
+	case tea.KeyBackspace:
+		if m.query != "" {
+			m.query = m.query[:len(m.query)-1]
+		}
+	case tea.KeyRunes, tea.KeySpace:
+		m.query += string(msg.Runes)
+	}
+}
+
+// search lists the transactions of the book or user named by the query,
+// which may be prefixed with "book:" or "user:" to pick one.
+func (m *explorer) search() {
+	q := strings.TrimSpace(m.query)
+	kind, key, ok := strings.Cut(q, ":")
+	if !ok {
+		kind, key = "", q
+	}
+	m.results = nil
+	if kind == "" || kind == "book" {
+		m.results = append(m.results, BlockChain.BookHistory(key)...)
+	}
+	if kind == "" || kind == "user" {
+		m.results = append(m.results, BlockChain.UserCheckouts(key)...)
+	}
+	m.rcursor = 0
+	m.view = viewResults
+}
+
+func (m *explorer) move(key string) {
+	cursor, n := &m.cursor, len(m.blocks)
+	switch m.view {
+	case viewResults:
+		cursor, n = &m.rcursor, len(m.results)
+	case viewBlock:
+		cursor, n = &m.txs, len(m.blocks[m.cursor].Transactions)
+	}
+	switch key {
+	case "up", "k":
+		*cursor--
+	case "down", "j":
+		*cursor++
+	case "pgup", "b":
+		*cursor -= m.page()
+	case "pgdown", "f", " ":
+		*cursor += m.page()
+	case "home", "g":
+		*cursor = 0
+	case "end", "G":
+		*cursor = n - 1
+	}
+	*cursor = min(max(*cursor, 0), max(n-1, 0))
+}
+
+func (m *explorer) View() string {
+	var sb strings.Builder
+	switch m.view {
+	case viewBlocks:
+		m.viewBlocks(&sb)
+	case viewBlock:
+		m.viewBlock(&sb)
+	case viewSearch:
+		fmt.Fprintf(&sb, "%s\n\nSearch (book ID or user, or book:<id> / user:<name>): %s█\n",
+			exploreTitle.Render("Search"), m.query)
+		sb.WriteString(exploreHelp.Render("enter search • esc cancel"))
+	case viewResults:
+		m.viewResults(&sb)
+	}
+	return sb.String()
+}
+
+func (m *explorer) blockStatus(i int) string {
+	if m.status[i] == "" {
+		return exploreValid.Render("valid")
+	}
+	return exploreInvalid.Render("INVALID: " + m.status[i])
+}
+
+// window returns the range of rows to show so that cursor stays visible.
+func (m *explorer) window(cursor, n int) (int, int) {
+	start := max(min(cursor-m.page()/2, n-m.page()), 0)
+	return start, min(start+m.page(), n)
+}
+
+func (m *explorer) viewBlocks(sb *strings.Builder) {
+	invalid := 0
+	for _, s := range m.status {
+		if s != "" {
+			invalid++
+		}
+	}
+	fmt.Fprintf(sb, "%s  %d blocks, %d invalid\n\n", exploreTitle.Render("Library chain"), len(m.blocks), invalid)
+	start, end := m.window(m.cursor, len(m.blocks))
+	for i := start; i < end; i++ {
+		b := m.blocks[i]
+		line := fmt.Sprintf("%6d  %s  %.16s  %3d txs  ", b.Pos, b.Timestamp, b.Hash, len(b.Transactions))
+		if i == m.cursor {
+			line = exploreSelected.Render(line)
+		}
+		sb.WriteString(line + m.blockStatus(i) + "\n")
+	}
+	sb.WriteString("\n" + exploreHelp.Render("↑/↓ move • pgup/pgdn page • g/G first/last • enter open • / search • q quit"))
+}
+
+func (m *explorer) viewBlock(sb *strings.Builder) {
+	b := m.blocks[m.cursor]
+	fmt.Fprintf(sb, "%s  %s\n", exploreTitle.Render(fmt.Sprintf("Block %d", b.Pos)), m.blockStatus(m.cursor))
+	fmt.Fprintf(sb, "hash %s\nprev %s\nmerkle %s\ntime %s  version %d  difficulty %d  nonce %d\nproducer %.16s\n\n",
+		b.Hash, b.Prevhash, b.MerkleRoot, b.Timestamp, b.Version, b.Difficulty, b.Nonce, b.Producer)
+	page := max(m.page()-6, 1)
+	end := min(m.txs+page, len(b.Transactions))
+	for i := m.txs; i < end; i++ {
+		tx := b.Transactions[i]
+		if tx.IsGenesis {
+			fmt.Fprintf(sb, "%4d  genesis\n", i)
+			continue
+		}
+		fmt.Fprintf(sb, "%4d  %-16s book %-34s user %-16s %s\n", i, tx.Kind(), tx.BookId, tx.User, txDate(tx))
+	}
+	sb.WriteString("\n" + exploreHelp.Render("↑/↓ scroll transactions • esc back • / search • q quit"))
+}
+
+func (m *explorer) viewResults(sb *strings.Builder) {
+	fmt.Fprintf(sb, "%s  %d transactions for %q\n\n", exploreTitle.Render("Search"), len(m.results), m.query)
+	start, end := m.window(m.rcursor, len(m.results))
+	for i := start; i < end; i++ {
+		ev := m.results[i]
+		line := fmt.Sprintf("block %6d  %-16s book %-34s user %-16s %s", ev.BlockPos, ev.Kind(), ev.BookId, ev.User, txDate(ev.Transaction))
+		if i == m.rcursor {
+			line = exploreSelected.Render(line)
+		}
+		sb.WriteString(line + "\n")
+	}
+	sb.WriteString("\n" + exploreHelp.Render("↑/↓ move • enter open block • esc back • / search • q quit"))
+}
+
+func txDate(tx Transaction) string {
+	if tx.Date != "" {
+		return tx.Date
+	}
+	return tx.CheckoutDate
+}
+
+// runExplore opens the terminal block explorer on the stored chain.
+func runExplore(args []string) error {
+	if err := prepare(commandFlags("explore"), args); err != nil {
+		return err
+	}
+	store, err := loadChain(false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	_, err = tea.NewProgram(newExplorer(BlockChain), tea.WithAltScreen()).Run()
+	return err
+}
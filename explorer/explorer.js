@@ -0,0 +1,186 @@
+const pageSize = 25;
+const rows = document.getElementById("blocks");
+const banner = document.getElementById("integrity");
+let offset = 0;
+
+// Staff sign in through the node's identity provider. The callback sends the
+// browser back with the node's tokens in the URL fragment; they are kept for
+// the tab only.
+const session = {
+  get access() { return sessionStorage.getItem("access_token"); },
+  get refresh() { return sessionStorage.getItem("refresh_token"); },
+  save(pair) {
+    sessionStorage.setItem("access_token", pair.access_token);
+    sessionStorage.setItem("refresh_token", pair.refresh_token);
+  },
+  clear() {
+    sessionStorage.removeItem("access_token");
+    sessionStorage.removeItem("refresh_token");
+  },
+  claims() {
+    try {
+      return JSON.parse(atob(this.access.split(".")[1].replace(/-/g, "+").replace(/_/g, "/")));
+    } catch {
+      return null;
+    }
+  },
+};
+
+function takeTokens() {
+  const params = new URLSearchParams(location.hash.slice(1));
+  if (params.get("access_token")) {
+    session.save(Object.fromEntries(params));
+    history.replaceState(null, "", location.pathname + location.search);
+  }
+}
+
+// authFetch sends the access token, refreshing it once if it has expired.
+async function authFetch(url, options = {}) {
+  const send = () => fetch(url, { ...options, headers: { ...options.headers, Authorization: `Bearer ${session.access}` } });
+  let res = await send();
+  if (res.status === 401 && session.refresh) {
+    const r = await fetch("/api/v1/auth/refresh", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ refresh_token: session.refresh }),
+    });
+    if (!r.ok) {
+      session.clear();
+      showSession();
+      return res;
+    }
+    session.save(await r.json());
+    res = await send();
+  }
+  return res;
+}
+
+async function showSession() {
+  const claims = session.access && session.claims();
+  const signedIn = Boolean(claims);
+  document.getElementById("user").textContent = signedIn ? `Signed in as ${claims.sub} (${claims.role})` : "";
+  document.getElementById("signout").hidden = !signedIn;
+  document.getElementById("recheck").hidden = !signedIn || !["librarian", "auditor", "staff"].includes(claims.role);
+  if (!signedIn) {
+    const res = await fetch("/api/v1/auth/oidc");
+    document.getElementById("signin").hidden = !res.ok;
+    document.getElementById("session").hidden = !res.ok;
+    return;
+  }
+  document.getElementById("signin").hidden = true;
+  document.getElementById("session").hidden = false;
+}
+
+function text(tag, value, className) {
+  const el = document.createElement(tag);
+  el.textContent = value;
+  if (className) el.className = className;
+  return el;
+}
+
+function txKind(tx) {
+  return tx.is_genesis ? "genesis" : tx.type || "checkout";
+}
+
+function showIntegrity(report) {
+  if (report.valid) {
+    banner.className = "banner ok";
+    banner.textContent = `Chain verified: all ${report.height} blocks are valid (checked ${report.checked_at}).`;
+  } else {
+    banner.className = "banner bad";
+    banner.textContent = `Chain failed its integrity check at block ${report.first_invalid}: ${report.reason}. ` +
+      "New blocks are refused until it is repaired.";
+  }
+}
+
+function details(b) {
+  const tr = document.createElement("tr");
+  tr.className = "details";
+  const td = document.createElement("td");
+  td.colSpan = 5;
+  const dl = document.createElement("dl");
+  const fields = [
+    ["Hash", b.Hash], ["Previous hash", b.Prevhash || "none"], ["Merkle root", b.MerkleRoot || "-"],
+    ["Version", b.Version], ["Difficulty", b.Difficulty], ["Nonce", b.Nonce], ["Producer", b.Producer || "-"],
+  ];
+  if (!b.valid) fields.push(["Validation", b.reason]);
+  for (const [label, value] of fields) {
+    dl.append(text("dt", label), text("dd", value, label === "Validation" ? "error" : ""));
+  }
+  td.append(dl);
+  const txs = document.createElement("table");
+  const head = document.createElement("tr");
+  for (const h of ["#", "Type", "Book", "User", "Date", "Due", "Fine / amount"]) head.append(text("th", h));
+  txs.append(head);
+  (b.Transactions || []).forEach((tx, i) => {
+    const row = document.createElement("tr");
+    row.append(
+      text("td", i), text("td", txKind(tx)),
+      text("td", tx.is_genesis ? "-" : tx.book ? `${tx.bookid} (${tx.book.title})` : tx.bookid || "-"),
+      text("td", tx.user || "-"), text("td", tx.date || tx.checkout_date || "-"),
+      text("td", tx.due_date || "-"), text("td", tx.fine || tx.amount || "-"),
+    );
+    txs.append(row);
+  });
+  td.append(txs);
+  tr.append(td);
+  return tr;
+}
+
+async function load() {
+  const res = await fetch(`api/blocks?offset=${offset}&limit=${pageSize}`);
+  const page = await res.json();
+  if (!res.ok) {
+    banner.className = "banner bad";
+    banner.textContent = page.message;
+    return;
+  }
+  showIntegrity(page.integrity);
+  rows.replaceChildren();
+  for (const b of page.blocks) {
+    const tr = document.createElement("tr");
+    tr.className = b.valid ? "block" : "block invalid";
+    tr.append(
+      text("td", b.Pos), text("td", b.Timestamp), text("td", b.Hash.slice(0, 20) + "…", "hash"),
+      text("td", (b.Transactions || []).length),
+      text("td", b.valid ? "valid" : b.reason, b.valid ? "valid" : "error"),
+    );
+    let open = null;
+    tr.addEventListener("click", () => {
+      if (open) {
+        open.remove();
+        open = null;
+      } else {
+        open = details(b);
+        tr.after(open);
+      }
+    });
+    rows.append(tr);
+  }
+  const newest = page.total - 1 - offset;
+  document.getElementById("range").textContent = page.blocks.length
+    ? `Blocks ${newest} – ${newest - page.blocks.length + 1} of ${page.total}` : "No blocks";
+  document.getElementById("newer").disabled = offset === 0;
+  document.getElementById("older").disabled = offset + page.blocks.length >= page.total;
+}
+
+document.getElementById("newer").addEventListener("click", () => { offset = Math.max(offset - pageSize, 0); load(); });
+document.getElementById("older").addEventListener("click", () => { offset += pageSize; load(); });
+document.getElementById("refresh").addEventListener("click", load);
+document.getElementById("signin").addEventListener("click", () => {
+  location.href = `/api/v1/auth/oidc/login?return_to=${encodeURIComponent(location.pathname)}`;
+});
+document.getElementById("signout").addEventListener("click", () => { session.clear(); showSession(); });
+document.getElementById("recheck").addEventListener("click", async () => {
+  const res = await authFetch("/api/v1/admin/integrity", { method: "POST" });
+  const body = await res.json();
+  if (res.ok) {
+    showIntegrity(body);
+  } else {
+    banner.className = "banner bad";
+    banner.textContent = body.message;
+  }
+});
+takeTokens();
+showSession();
+load();
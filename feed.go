@@ -0,0 +1,41 @@
+package main
+
+import "sync"
+
+// Feed fans out events to subscribers. Sends never block the publisher: a
+// subscriber that falls behind misses notifications and should catch up
+// from the source, such as Snapshot for blocks.
+type Feed[T any] struct {
+	mu   sync.Mutex
+	subs map[chan T]struct{}
+}
+
+func newFeed[T any]() *Feed[T] {
+	return &Feed[T]{subs: map[chan T]struct{}{}}
+}
+
+// NewBlocks carries blocks as they are appended to the local chain.
+var NewBlocks = newFeed[*Block]()
+
+func (f *Feed[T]) Subscribe() (<-chan T, func()) {
+	ch := make(chan T, 16)
+	f.mu.Lock()
+	f.subs[ch] = struct{}{}
+	f.mu.Unlock()
+	return ch, func() {
+		f.mu.Lock()
+		delete(f.subs, ch)
+		f.mu.Unlock()
+	}
+}
+
+func (f *Feed[T]) publish(v T) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- v:
+		default:
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"blockchain/apierr"
+)
+
+var (
+	fieldKey     string
+	fieldOldKeys string
+)
+
+// sealedUserPrefix starts a user the node encrypted under -field-key.
+const sealedUserPrefix = "enc:"
+
+// fieldAAD binds sealed values to the field they were sealed for.
+var fieldAAD = []byte("library-chain/field/user/1")
+
+var (
+	ErrSealedUser  = errors.New("users starting with enc: are encrypted by the node")
+	ErrSealedField = errors.New("field is encrypted with a key this node does not hold")
+)
+
+// fieldKeys is the keyring of -field-key and -field-old-keys, which encrypts
+// the user of each new transaction before it goes into a block.
+var fieldKeys = &Keyring{}
+
+// loadFieldKeys fetches the keys named by -field-key and -field-old-keys.
+func loadFieldKeys() error {
+	ring, err := newKeyring(fieldKey, fieldOldKeys)
+	if err != nil {
+		return fmt.Errorf("-field-key: %w", err)
+	}
+	fieldKeys = ring
+	if ring.current != nil {
+		log.Printf("Encrypting users on the chain with key %s", ring.current.ID)
+	}
+	return nil
+}
+
+// sealField encrypts a value by envelope encryption: under a data key of its
+// own, which is in turn sealed with the current field key, as
+//
+//	enc:<sealed data key>.<nonce and ciphertext>
+//
+// both in unpadded base64url. Only the small data key depends on the field
+// key, and the value never repeats on the chain, so equal users cannot be
+// told apart.
+func sealField(plain string) (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	wrapped, err := fieldKeys.Seal(key)
+	if err != nil {
+		return "", err
+	}
+	dk, err := newDataKey(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, dk.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := dk.aead.Seal(nonce, nonce, []byte(plain), fieldAAD)
+	enc := base64.RawURLEncoding
+	return sealedUserPrefix + enc.EncodeToString(wrapped) + "." + enc.EncodeToString(sealed), nil
+}
+
+// openField decrypts a value sealed by sealField. Other values are returned
+// as they are.
+func openField(v string) (string, error) {
+	rest, ok := strings.CutPrefix(v, sealedUserPrefix)
+	if !ok {
+		return v, nil
+	}
+	enc := base64.RawURLEncoding
+	w, s, ok := strings.Cut(rest, ".")
+	wrapped, err1 := enc.DecodeString(w)
+	sealed, err2 := enc.DecodeString(s)
+	if !ok || err1 != nil || err2 != nil || !bytes.HasPrefix(wrapped, []byte(sealedMagic)) {
+		return "", errors.New("malformed encrypted field")
+	}
+	key, err := fieldKeys.Open(wrapped)
+	if errors.Is(err, ErrNoDataKey) || errors.Is(err, ErrUnknownKey) {
+		return "", ErrSealedField
+	}
+	if err != nil {
+		return "", err
+	}
+	dk, err := newDataKey(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < dk.aead.NonceSize() {
+		return "", errors.New("malformed encrypted field")
+	}
+	plain, err := dk.aead.Open(nil, sealed[:dk.aead.NonceSize()], sealed[dk.aead.NonceSize():], fieldAAD)
+	if err != nil {
+		return "", fmt.Errorf("decrypt field: %w", err)
+	}
+	return string(plain), nil
+}
+
+// sealUsers encrypts the user of each transaction, returning the
+// transactions as the block will hold them. The signature still covers the
+// user in the clear, so checking it needs the field key.
+func sealUsers(txs []Transaction) ([]Transaction, error) {
+	out := make([]Transaction, len(txs))
+	for i, tx := range txs {
+		if !tx.IsGenesis && tx.User != "" {
+			user, err := sealField(tx.User)
+			if err != nil {
+				return nil, err
+			}
+			tx.User = user
+		}
+		out[i] = tx
+	}
+	return out, nil
+}
+
+// decrypted is a copy of b with its users decrypted wherever the node holds
+// the key. Users it cannot decrypt are left as they are on the chain.
+func decrypted(b *Block) *Block {
+	plain := *b
+	plain.Transactions = make([]Transaction, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		if user, err := openField(tx.User); err == nil {
+			tx.User = user
+		}
+		plain.Transactions[i] = tx
+	}
+	return &plain
+}
+
+// getDecryptedBlockByHash answers GET /blocks/{hash}/decrypted for staff.
+func getDecryptedBlockByHash(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	writeDecryptedBlock(w, r, tenantOf(r).chain.BlockByHash(hash), fmt.Sprintf("no block with hash %s", hash))
+}
+
+// getDecryptedBlockByHeight answers GET /blocks/height/{n}/decrypted for
+// staff.
+func getDecryptedBlockByHeight(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(mux.Vars(r)["n"])
+	if err != nil {
+		writeError(w, r, apierr.New(apierr.InvalidRequest, "height must be an integer"))
+		return
+	}
+	writeDecryptedBlock(w, r, tenantOf(r).chain.BlockAt(n), fmt.Sprintf("no block at height %d", n))
+}
+
+// staffWhenSealed gates a route that shows users as the node decrypted them
+// to librarians and auditors while the node holds field keys, so the users it
+// encrypts on the chain are not served in the clear to anyone who asks.
+func staffWhenSealed(next http.HandlerFunc) http.HandlerFunc {
+	staff := requireRole(next, RoleLibrarian, RoleAuditor)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(fieldKeys.keys) == 0 {
+			next(w, r)
+			return
+		}
+		staff(w, r)
+	}
+}
+
+func writeDecryptedBlock(w http.ResponseWriter, r *http.Request, block *Block, missing string) {
+	if len(fieldKeys.keys) == 0 {
+		writeError(w, r, apierr.New(apierr.NotFound, "the node does not run with -field-key"))
+		return
+	}
+	if block == nil {
+		writeError(w, r, apierr.New(codeBlockNotFound, missing))
+		return
+	}
+	reqLog(r).Info("Decrypted block", "height", block.Pos)
+	respond(w, r, decrypted(block))
+}
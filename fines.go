@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// FineStatement is a member's outstanding balance with the late returns and
+// payments that make it up. Amounts are in cents.
+type FineStatement struct {
+	User        string    `json:"user"`
+	Outstanding int64     `json:"outstanding"`
+	Fines       []TxEvent `json:"fines"`
+	Payments    []TxEvent `json:"payments"`
+}
+
+func getUserFines(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+	chain := tenantOf(r).chain
+	statement := FineStatement{User: user, Outstanding: chain.Fines(user), Fines: []TxEvent{}, Payments: []TxEvent{}}
+	for _, ev := range chain.UserCheckouts(user) {
+		switch {
+		case ev.Kind() == TxReturn && ev.Fine > 0:
+			statement.Fines = append(statement.Fines, ev)
+		case ev.Kind() == TxPayment:
+			statement.Payments = append(statement.Payments, ev)
+		}
+	}
+	respond(w, r, statement)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// tryLock is a no-op where flock is unavailable.
+func tryLock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+)
+
+// maxForkLead is how many blocks a peer's chain may run past the local one
+// for ResolveFork to fetch it; a peer further ahead is synced from instead.
+const maxForkLead = 10000
+
+// chainWork is the expected number of hashes it took to mine blocks: each
+// leading zero hex digit of difficulty multiplies a block's work by 16.
+func chainWork(blocks []*Block) *big.Int {
+	work := new(big.Int)
+	for _, b := range blocks {
+		work.Add(work, new(big.Int).Lsh(big.NewInt(1), uint(4*max(b.Difficulty, 0))))
+	}
+	return work
+}
+
+// betterChain reports whether candidate should replace current: the chain
+// with more cumulative work wins, and between chains of equal work the lower
+// tip hash wins, so a peer cannot win with many cheap blocks.
+func betterChain(candidate, current []*Block) bool {
+	if c := chainWork(candidate).Cmp(chainWork(current)); c != 0 {
+		return c > 0
+	}
+	return candidate[len(candidate)-1].Hash < current[len(current)-1].Hash
+}
+
+func forkPoint(a, b []*Block) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i].Hash == b[i].Hash {
+		i++
+	}
+	return i
+}
+
+// ResolveFork fetches the peer's chain and switches to it if it is valid,
+// shares our genesis block and wins under betterChain. Its blocks past the
+// fork point must meet this node's difficulty, block limits and state rules,
+// and the fork may not reach back past the newest trusted checkpoint. Local
+// blocks past the fork point are rolled back and their transactions returned
+// to the mempool unless the new chain already contains them.
+func (bc *Blockchain) ResolveFork(src BlockSource) error {
+	candidate, err := fetchChain(src, bc.Height()+maxForkLead)
+	if err != nil {
+		return err
+	}
+	if len(candidate) == 0 {
+		return nil
+	}
+	if report := (&Blockchain{Blocks: candidate}).Validate(); !report.Valid {
+		return errors.New("peer chain is invalid: " + report.Reason)
+	}
+	if err := checkClockSkew(candidate[len(candidate)-1]); err != nil {
+		return err
+	}
+
+	bc.writeMu.Lock()
+	defer bc.writeMu.Unlock()
+	current := bc.Snapshot()
+	if candidate[0].Hash != current[0].Hash {
+		return errors.New("peer chain has a different genesis block")
+	}
+	fork := forkPoint(current, candidate)
+	if Checkpoints != nil {
+		if cp := Checkpoints.trusted(current); cp != nil && fork <= cp.Height {
+			return fmt.Errorf("peer chain forks at block %d, before the checkpoint at block %d", fork, cp.Height)
+		}
+	}
+	for _, b := range candidate[fork:] {
+		if b.Difficulty < difficulty {
+			return fmt.Errorf("block %d of peer chain: difficulty %d below required %d", b.Pos, b.Difficulty, difficulty)
+		}
+		if err := checkBlockLimits(b); err != nil {
+			return fmt.Errorf("block %d of peer chain: %w", b.Pos, err)
+		}
+	}
+	if !betterChain(candidate, current) {
+		return nil
+	}
+	if err := bc.checkForkState(candidate, fork); err != nil {
+		return err
+	}
+	orphaned := current[fork:]
+	if err := bc.install(candidate); err != nil {
+		return err
+	}
+	log.Printf("Switched to chain from %s: rolled back %d blocks, applied %d", src, len(orphaned), len(candidate)-fork)
+
+	included := map[string]bool{}
+	for _, b := range candidate[fork:] {
+		for _, tx := range b.Transactions {
+			included[tx.ID()] = true
+		}
+	}
+	requeued := 0
+	for _, b := range orphaned {
+		for _, tx := range b.Transactions {
+			if !included[tx.ID()] {
+				Mempool.Add(tx)
+				requeued++
+			}
+		}
+	}
+	if requeued > 0 {
+		log.Printf("Returned %d transactions from orphaned blocks to the mempool", requeued)
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"sort"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/relay"
+)
+
+const graphqlSchema = `
+schema {
+	query: Query
+}
+
+type Query {
+	blocks(from: Int, to: Int, producer: String): [Block!]!
+	block(pos: Int, hash: String): Block
+	transactions(bookId: String, user: String): [Transaction!]!
+	books: [Book!]!
+	book(id: String!): Book
+	users: [User!]!
+	user(name: String!): User
+}
+
+type Block {
+	pos: Int!
+	timestamp: String!
+	hash: String!
+	prevHash: String!
+	merkleRoot: String!
+	nonce: Int!
+	difficulty: Int!
+	producer: String!
+	transactions: [Transaction!]!
+}
+
+type Transaction {
+	type: String!
+	bookId: String!
+	user: String!
+	checkoutDate: String!
+	publicKey: String!
+	block: Block!
+	book: Book!
+	holder: User
+}
+
+type Book {
+	id: String!
+	currentHolder: User
+	history: [Transaction!]!
+}
+
+type User {
+	name: String!
+	checkouts: [Transaction!]!
+	holding: [Book!]!
+}
+`
+
+// chainIndex is built from one chain snapshot per top-level field, so the
+// nested fields under it all see the same chain. Current holders come from
+// the library state rather than the blocks.
+type chainIndex struct {
+	blocks []*Block
+	state  *StateSnapshot
+	byBook map[string][]*txResolver
+	byUser map[string][]*txResolver
+}
+
+func newChainIndex(blocks []*Block, state *StateSnapshot) *chainIndex {
+	idx := &chainIndex{blocks: blocks, state: state, byBook: map[string][]*txResolver{}, byUser: map[string][]*txResolver{}}
+	for _, b := range blocks {
+		for _, tx := range b.Transactions {
+			if tx.IsGenesis {
+				continue
+			}
+			t := &txResolver{idx: idx, block: b, tx: tx}
+			if tx.BookId != "" {
+				idx.byBook[tx.BookId] = append(idx.byBook[tx.BookId], t)
+			}
+			if tx.User != "" {
+				idx.byUser[tx.User] = append(idx.byUser[tx.User], t)
+			}
+		}
+	}
+	return idx
+}
+
+// holder is the user who has a book checked out, or "" if it is available.
+func (idx *chainIndex) holder(bookID string) string {
+	return idx.state.Loans[bookID].User
+}
+
+type queryResolver struct{}
+
+func (*queryResolver) index() *chainIndex {
+	blocks, state := BlockChain.View()
+	return newChainIndex(blocks, state)
+}
+
+func (q *queryResolver) Blocks(args struct {
+	From     *int32
+	To       *int32
+	Producer *string
+}) []*blockResolver {
+	idx := q.index()
+	var out []*blockResolver
+	for _, b := range idx.blocks {
+		if args.From != nil && b.Pos < int(*args.From) {
+			continue
+		}
+		if args.To != nil && b.Pos > int(*args.To) {
+			continue
+		}
+		if args.Producer != nil && b.Producer != *args.Producer {
+			continue
+		}
+		out = append(out, &blockResolver{idx: idx, b: b})
+	}
+	return out
+}
+
+func (q *queryResolver) Block(args struct {
+	Pos  *int32
+	Hash *string
+}) *blockResolver {
+	idx := q.index()
+	for _, b := range idx.blocks {
+		if (args.Pos != nil && b.Pos == int(*args.Pos)) || (args.Hash != nil && b.Hash == *args.Hash) {
+			return &blockResolver{idx: idx, b: b}
+		}
+	}
+	return nil
+}
+
+func (q *queryResolver) Transactions(args struct {
+	BookId *string
+	User   *string
+}) []*txResolver {
+	idx := q.index()
+	var out []*txResolver
+	for _, b := range idx.blocks {
+		for _, tx := range b.Transactions {
+			if tx.IsGenesis {
+				continue
+			}
+			if args.BookId != nil && tx.BookId != *args.BookId {
+				continue
+			}
+			if args.User != nil && tx.User != *args.User {
+				continue
+			}
+			out = append(out, &txResolver{idx: idx, block: b, tx: tx})
+		}
+	}
+	return out
+}
+
+func (q *queryResolver) Books() []*bookResolver {
+	idx := q.index()
+	out := make([]*bookResolver, 0, len(idx.byBook))
+	for id := range idx.byBook {
+		out = append(out, &bookResolver{idx: idx, id: id})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out
+}
+
+func (q *queryResolver) Book(args struct{ Id string }) *bookResolver {
+	idx := q.index()
+	if _, ok := idx.byBook[args.Id]; !ok {
+		return nil
+	}
+	return &bookResolver{idx: idx, id: args.Id}
+}
+
+func (q *queryResolver) Users() []*userResolver {
+	idx := q.index()
+	out := make([]*userResolver, 0, len(idx.byUser))
+	for name := range idx.byUser {
+		out = append(out, &userResolver{idx: idx, name: name})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
+
+func (q *queryResolver) User(args struct{ Name string }) *userResolver {
+	idx := q.index()
+	if _, ok := idx.byUser[args.Name]; !ok {
+		return nil
+	}
+	return &userResolver{idx: idx, name: args.Name}
+}
+
+type blockResolver struct {
+	idx *chainIndex
+	b   *Block
+}
+
+func (r *blockResolver) Pos() int32         { return int32(r.b.Pos) }
+func (r *blockResolver) Timestamp() string  { return r.b.Timestamp }
+func (r *blockResolver) Hash() string       { return r.b.Hash }
+func (r *blockResolver) PrevHash() string   { return r.b.Prevhash }
+func (r *blockResolver) MerkleRoot() string { return r.b.MerkleRoot }
+func (r *blockResolver) Nonce() int32       { return int32(r.b.Nonce) }
+func (r *blockResolver) Difficulty() int32  { return int32(r.b.Difficulty) }
+func (r *blockResolver) Producer() string   { return r.b.Producer }
+
+func (r *blockResolver) Transactions() []*txResolver {
+	var out []*txResolver
+	for _, tx := range r.b.Transactions {
+		if !tx.IsGenesis {
+			out = append(out, &txResolver{idx: r.idx, block: r.b, tx: tx})
+		}
+	}
+	return out
+}
+
+type txResolver struct {
+	idx   *chainIndex
+	block *Block
+	tx    Transaction
+}
+
+func (r *txResolver) Type() string         { return r.tx.Kind() }
+func (r *txResolver) BookId() string       { return r.tx.BookId }
+func (r *txResolver) User() string         { return r.tx.User }
+func (r *txResolver) CheckoutDate() string { return r.tx.CheckoutDate }
+func (r *txResolver) PublicKey() string    { return r.tx.PublicKey }
+
+func (r *txResolver) Block() *blockResolver {
+	return &blockResolver{idx: r.idx, b: r.block}
+}
+
+func (r *txResolver) Book() *bookResolver {
+	return &bookResolver{idx: r.idx, id: r.tx.BookId}
+}
+
+func (r *txResolver) Holder() *userResolver {
+	if r.tx.User == "" {
+		return nil
+	}
+	return &userResolver{idx: r.idx, name: r.tx.User}
+}
+
+type bookResolver struct {
+	idx *chainIndex
+	id  string
+}
+
+func (r *bookResolver) Id() string { return r.id }
+
+func (r *bookResolver) CurrentHolder() *userResolver {
+	name := r.idx.holder(r.id)
+	if name == "" {
+		return nil
+	}
+	return &userResolver{idx: r.idx, name: name}
+}
+
+func (r *bookResolver) History() []*txResolver {
+	return r.idx.byBook[r.id]
+}
+
+type userResolver struct {
+	idx  *chainIndex
+	name string
+}
+
+func (r *userResolver) Name() string { return r.name }
+
+func (r *userResolver) Checkouts() []*txResolver {
+	return r.idx.byUser[r.name]
+}
+
+// Holding lists the books this user has checked out, by book id.
+func (r *userResolver) Holding() []*bookResolver {
+	var out []*bookResolver
+	for id, loan := range r.idx.state.Loans {
+		if loan.User == r.name {
+			out = append(out, &bookResolver{idx: r.idx, id: id})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out
+}
+
+func graphqlHandler() *relay.Handler {
+	return &relay.Handler{Schema: graphql.MustParseSchema(graphqlSchema, &queryResolver{})}
+}
@@ -0,0 +1,204 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative chainpb/chain.proto
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"blockchain/chainpb"
+)
+
+var grpcAddr string
+
+// grpcServer serves the chainpb.Chain service on top of the same chain and
+// mempool as the HTTP handlers.
+type grpcServer struct {
+	chainpb.UnimplementedChainServer
+}
+
+func startGRPC(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(grpcAudit, grpcAuth))
+	chainpb.RegisterChainServer(srv, &grpcServer{})
+	log.Printf("gRPC listening on %s", addr)
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			log.Printf("gRPC server stopped: %v", err)
+		}
+	}()
+	onShutdown(func(ctx context.Context) error {
+		stopped := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			srv.Stop()
+		}
+		return nil
+	})
+	return nil
+}
+
+func (grpcServer) GetChain(ctx context.Context, req *chainpb.GetChainRequest) (*chainpb.GetChainResponse, error) {
+	if err := BlockChain.Refresh(); err != nil {
+		log.Printf("Error refreshing chain: %v", err)
+	}
+	blocks := BlockChain.Snapshot()
+	resp := &chainpb.GetChainResponse{ChainId: blocks[0].ChainID()}
+	for _, b := range blocks {
+		resp.Blocks = append(resp.Blocks, blockToProto(b))
+	}
+	return resp, nil
+}
+
+func (grpcServer) GetBlock(ctx context.Context, req *chainpb.GetBlockRequest) (*chainpb.Block, error) {
+	var block *Block
+	var err error
+	switch key := req.Key.(type) {
+	case *chainpb.GetBlockRequest_Pos:
+		block, err = BlockChain.store.GetByPos(int(key.Pos))
+	case *chainpb.GetBlockRequest_Hash:
+		block, err = BlockChain.store.GetByHash(key.Hash)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "pos or hash is required")
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil, status.Error(codes.NotFound, "block not found")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return blockToProto(block), nil
+}
+
+func (grpcServer) SubmitCheckout(ctx context.Context, req *chainpb.SubmitCheckoutRequest) (*chainpb.SubmitCheckoutResponse, error) {
+	if req.Checkout == nil {
+		return nil, status.Error(codes.InvalidArgument, "checkout is required")
+	}
+	if Consensus != nil && !Consensus.IsLeader() {
+		return nil, status.Errorf(codes.FailedPrecondition, "not the raft leader; submit to %s", Consensus.leaderURL())
+	}
+	tx := checkoutFromProto(req.Checkout)
+	if err := grpcPoW(ctx, tx); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	n, err := queueTx(homeTenant, tx)
+	if errors.Is(err, ErrDuplicateTx) {
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	}
+	if errors.Is(err, ErrChainInvalid) {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if isConflict(err) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &chainpb.SubmitCheckoutResponse{Status: "transaction queued", Pending: int32(n), Id: tx.ID()}, nil
+}
+
+// StreamBlocks replays the chain from the requested position and then
+// follows the block feed. Every notification re-reads the snapshot from the
+// last sent position, so blocks a slow stream missed are still sent in order.
+func (grpcServer) StreamBlocks(req *chainpb.StreamBlocksRequest, stream grpc.ServerStreamingServer[chainpb.Block]) error {
+	feed, cancel := NewBlocks.Subscribe()
+	defer cancel()
+	next := max(int(req.FromPos), 0)
+	for {
+		blocks := BlockChain.Snapshot()
+		for ; next < len(blocks); next++ {
+			if err := stream.Send(blockToProto(blocks[next])); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-feed:
+		}
+	}
+}
+
+func blockToProto(b *Block) *chainpb.Block {
+	pb := &chainpb.Block{
+		Pos:        int64(b.Pos),
+		Timestamp:  b.Timestamp,
+		Hash:       b.Hash,
+		PrevHash:   b.Prevhash,
+		MerkleRoot: b.MerkleRoot,
+		Nonce:      int64(b.Nonce),
+		Difficulty: int32(b.Difficulty),
+		Producer:   b.Producer,
+		Signature:  b.Signature,
+		Version:    int32(b.Version),
+		UnixMilli:  b.UnixMilli,
+	}
+	if o := b.Migrated; o != nil {
+		pb.Migrated = &chainpb.BlockOrigin{Version: int32(o.Version), Hash: o.Hash, PrevHash: o.Prevhash, MerkleRoot: o.MerkleRoot, Nonce: int64(o.Nonce), Difficulty: int32(o.Difficulty), Producer: o.Producer, Signature: o.Signature}
+	}
+	for _, tx := range b.Transactions {
+		pb.Transactions = append(pb.Transactions, checkoutToProto(tx))
+	}
+	return pb
+}
+
+func checkoutToProto(tx Transaction) *chainpb.Checkout {
+	pb := &chainpb.Checkout{
+		Type:         tx.Type,
+		BookId:       tx.BookId,
+		User:         tx.User,
+		CheckoutDate: tx.CheckoutDate,
+		Stamped:      tx.Stamped,
+		Date:         tx.Date,
+		DueDate:      tx.DueDate,
+		Fine:         tx.Fine,
+		Amount:       tx.Amount,
+		Nonce:        tx.Nonce,
+		IsGenesis:    tx.IsGenesis,
+		PublicKey:    tx.PublicKey,
+		Signature:    tx.Signature,
+		FromBranch:   tx.FromBranch,
+		ToBranch:     tx.ToBranch,
+		Data:         tx.Data,
+		PayloadHash:  tx.PayloadHash,
+	}
+	if tx.Chain != nil {
+		pb.Chain = &chainpb.ChainParams{ChainId: tx.Chain.ChainID, Network: tx.Chain.Network, Protocol: int32(tx.Chain.Protocol), Hash: tx.Chain.Hash}
+	}
+	if tx.Book != nil {
+		pb.Book = &chainpb.BookRecord{Id: tx.Book.Id, Title: tx.Book.Title, Author: tx.Book.Author, PublishDate: tx.Book.PublishDate, Isbn: tx.Book.ISBN, Kind: tx.Book.Kind, Serial: tx.Book.Serial}
+	}
+	if a := tx.Anchor; a != nil {
+		pb.Anchor = &chainpb.AnchorReceipt{Method: a.Method, Service: a.Service, Height: int64(a.Height), TipHash: a.TipHash, Receipt: a.Receipt, Time: a.Time}
+	}
+	return pb
+}
+
+func checkoutFromProto(pb *chainpb.Checkout) Transaction {
+	return Transaction{
+		Type:         pb.Type,
+		BookId:       pb.BookId,
+		User:         pb.User,
+		CheckoutDate: pb.CheckoutDate,
+		Date:         pb.Date,
+		Amount:       pb.Amount,
+		Nonce:        pb.Nonce,
+		PublicKey:    pb.PublicKey,
+		Signature:    pb.Signature,
+		Data:         pb.Data,
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha3"
+	"fmt"
+	"sort"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// hashAlgorithm is the hash a new genesis block records for its chain.
+// Block hashes and Merkle trees use the algorithm recorded by the stored
+// chain; chains from before it was recorded use SHA-256.
+var hashAlgorithm = "sha256"
+
+const defaultHashAlgorithm = "sha256"
+
+var hashAlgorithms = map[string]func([]byte) []byte{
+	"sha256": func(data []byte) []byte {
+		sum := sha256.Sum256(data)
+		return sum[:]
+	},
+	"double-sha256": func(data []byte) []byte {
+		first := sha256.Sum256(data)
+		sum := sha256.Sum256(first[:])
+		return sum[:]
+	},
+	"sha3-256": func(data []byte) []byte {
+		sum := sha3.Sum256(data)
+		return sum[:]
+	},
+	"blake2b-256": func(data []byte) []byte {
+		sum := blake2b.Sum256(data)
+		return sum[:]
+	},
+}
+
+// chainSum hashes block headers and Merkle nodes with the chain's algorithm.
+var chainSum = hashAlgorithms[defaultHashAlgorithm]
+
+func hashAlgorithmNames() []string {
+	names := make([]string, 0, len(hashAlgorithms))
+	for name := range hashAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkHashAlgorithm(name string) error {
+	if _, ok := hashAlgorithms[name]; !ok {
+		return fmt.Errorf("unknown hash algorithm %q (want one of %v)", name, hashAlgorithmNames())
+	}
+	return nil
+}
+
+// chainHashAlgorithm returns the algorithm a genesis block records.
+func chainHashAlgorithm(genesis *Block) string {
+	if p := genesis.Params(); p != nil && p.Hash != "" {
+		return p.Hash
+	}
+	return defaultHashAlgorithm
+}
+
+// useHashAlgorithm switches block hashing to the named algorithm.
+func useHashAlgorithm(name string) error {
+	if err := checkHashAlgorithm(name); err != nil {
+		return err
+	}
+	chainSum = hashAlgorithms[name]
+	return nil
+}
+
+// sameHashAlgorithm rejects a chain that hashes its blocks differently from
+// this node's, since none of its hashes would check out here.
+func sameHashAlgorithm(local, remote *Block) error {
+	if l, r := chainHashAlgorithm(local), chainHashAlgorithm(remote); l != r {
+		return fmt.Errorf("%w: expected hash algorithm %s, got %s", ErrWrongChain, l, r)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// livenessTimeout is how long /livez waits for the chain lock before
+// reporting the node as stuck.
+const livenessTimeout = 2 * time.Second
+
+// HealthStatus is the body of every health endpoint.
+type HealthStatus struct {
+	Status        string            `json:"status"`
+	Height        int               `json:"height"`
+	LastBlockTime string            `json:"last_block_time,omitempty"`
+	Checks        map[string]string `json:"checks,omitempty"`
+}
+
+// validated caches the readiness validation for one tip, so probes only
+// re-check the chain after it has grown.
+var validated struct {
+	mu     sync.Mutex
+	tip    string
+	report ValidationReport
+}
+
+func writeHealth(w http.ResponseWriter, status HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+func chainStatus(status string) HealthStatus {
+	tip := BlockChain.Tip()
+	return HealthStatus{Status: status, Height: BlockChain.Height(), LastBlockTime: tip.Timestamp}
+}
+
+// healthz answers as long as the process is serving HTTP, and fails while
+// the chain loaded at startup is known to be invalid.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	status := chainStatus("ok")
+	if report := BlockChain.Integrity(); !report.Valid {
+		status.Status = "unavailable"
+		status.Checks = map[string]string{"integrity": fmt.Sprintf("block %d: %s", *report.FirstInvalid, report.Reason)}
+	}
+	writeHealth(w, status)
+}
+
+// livez fails when the chain lock cannot be taken in time, which means a
+// writer is stuck and the process should be restarted.
+func livez(w http.ResponseWriter, r *http.Request) {
+	done := make(chan HealthStatus, 1)
+	go func() { done <- chainStatus("ok") }()
+	select {
+	case status := <-done:
+		writeHealth(w, status)
+	case <-time.After(livenessTimeout):
+		writeHealth(w, HealthStatus{Status: "unavailable", Checks: map[string]string{"chain": "lock not acquired within " + livenessTimeout.String()}})
+	}
+}
+
+// readyz reports whether the node should receive traffic: the storage
+// backend answers and agrees with the loaded chain, and the chain is valid
+// from the newest trusted checkpoint.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	status := chainStatus("ok")
+	status.Checks = map[string]string{"storage": "ok", "chain": "ok"}
+	tip := BlockChain.Tip()
+	stored, err := BlockChain.store.Tip()
+	switch {
+	case err != nil:
+		status.Checks["storage"] = err.Error()
+	case stored.Pos < tip.Pos:
+		status.Checks["storage"] = "stored chain is behind the loaded chain"
+	}
+	validated.mu.Lock()
+	if validated.tip != tip.Hash {
+		validated.report = BlockChain.ValidateFromCheckpoint()
+		validated.tip = tip.Hash
+	}
+	report := validated.report
+	validated.mu.Unlock()
+	if !report.Valid {
+		status.Checks["chain"] = report.Reason
+	}
+	if err := BlockChain.intact(); err != nil {
+		status.Checks["integrity"] = err.Error()
+	}
+	if Consensus != nil {
+		if err := Consensus.fsm.Failed(); err != nil {
+			status.Checks["raft"] = err.Error()
+		}
+	}
+	if shuttingDown.Load() {
+		status.Checks["node"] = "shutting down"
+	}
+	for _, c := range status.Checks {
+		if c != "ok" {
+			status.Status = "unavailable"
+		}
+	}
+	if status.Status != "ok" {
+		reqLog(r).Warn("Not ready", "checks", status.Checks)
+	}
+	writeHealth(w, status)
+}
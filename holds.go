@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"blockchain/apierr"
+)
+
+func getHolds(w http.ResponseWriter, r *http.Request) {
+	respond(w, r, tenantOf(r).chain.Holds(mux.Vars(r)["id"]))
+}
+
+func placeHold(w http.ResponseWriter, r *http.Request) {
+	submitBookTx(w, r, TxReserve, "hold placed")
+}
+
+func cancelHold(w http.ResponseWriter, r *http.Request) {
+	submitBookTx(w, r, TxCancelHold, "hold cancelled")
+}
+
+func renewLoan(w http.ResponseWriter, r *http.Request) {
+	submitBookTx(w, r, TxRenew, "loan renewed")
+}
+
+// submitBookTx adds a signed transaction of the given kind for the book in
+// the URL and replies with the book's loan and hold queue.
+func submitBookTx(w http.ResponseWriter, r *http.Request, kind, done string) {
+	id := mux.Vars(r)["id"]
+	t := tenantOf(r)
+	w.Header().Set("Content-Type", "application/json")
+	var tx Transaction
+	if err := decodeJSON(r.Body, &tx); err != nil {
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "invalid payload: %w", err))
+		return
+	}
+	if tx.Kind() != kind || tx.BookId != id {
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "expected a %s transaction for book %s", kind, id))
+		return
+	}
+	if err := tx.validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := checkDuplicate(t, tx); err != nil {
+		writeError(w, r, apiError(err, apierr.Conflict))
+		return
+	}
+	if err := checkSubmission(t, tx); err != nil {
+		writeError(w, r, apiError(err, apierr.Conflict))
+		return
+	}
+	t.chain.applyPolicy(&tx)
+	if _, err := t.chain.AddBlock(r.Context(), tx); err != nil {
+		writeError(w, r, txError(err))
+		return
+	}
+	resp := map[string]any{"status": done, "id": tx.ID(), "holds": t.chain.Holds(id)}
+	if loan, ok := t.chain.Loan(id); ok {
+		resp["loan"] = loan
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"blockchain/apierr"
+)
+
+const idempotencyHeader = "Idempotency-Key"
+
+// idempotencyTTL is how long a response is replayed for retries that send
+// the same Idempotency-Key.
+var idempotencyTTL = 24 * time.Hour
+
+type idempotentResponse struct {
+	bodyHash    [32]byte
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// IdempotencyCache remembers the first response to each Idempotency-Key.
+// Keys are scoped to the tenant, the request path and the caller, so two
+// clients that happen to pick the same key do not see each other's
+// responses.
+type IdempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+}
+
+var Idempotency = &IdempotencyCache{entries: map[string]*idempotentResponse{}}
+
+// begin claims a key for a request body. It returns the stored entry if the
+// key was already used, or nil if the caller now owns the key.
+func (c *IdempotencyCache) begin(key string, bodyHash [32]byte) *idempotentResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, e := range c.entries {
+		if e.done && now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	if e, ok := c.entries[key]; ok {
+		entry := *e
+		return &entry
+	}
+	c.entries[key] = &idempotentResponse{bodyHash: bodyHash}
+	return nil
+}
+
+// finish stores the response for a key, or releases the key if the request
+// failed on the server side and may be retried.
+func (c *IdempotencyCache) finish(key string, rec *responseRecorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rec.status >= 500 {
+		delete(c.entries, key)
+		return
+	}
+	e := c.entries[key]
+	e.done = true
+	e.status = rec.status
+	e.contentType = rec.Header().Get("Content-Type")
+	e.body = rec.body.Bytes()
+	e.expires = time.Now().Add(idempotencyTTL)
+}
+
+// responseRecorder passes a response through while keeping a copy.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotent replays the stored response when a request repeats an
+// Idempotency-Key. Reusing a key with a different body is refused with 422,
+// and a retry that arrives while the first request is still running gets
+// 409. Requests without the header are passed through.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, apierr.New(apierr.InvalidRequest, "could not read request body"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var caller string
+		if claims := authClaims(r.Context()); claims != nil {
+			caller = claims.Subject
+		}
+		scoped := strings.Join([]string{tenantOf(r).ID, r.URL.Path, caller, key}, "\x00")
+		sum := sha256.Sum256(body)
+
+		prev := Idempotency.begin(scoped, sum)
+		if prev == nil {
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next(rec, r)
+			Idempotency.finish(scoped, rec)
+			return
+		}
+		switch {
+		case prev.bodyHash != sum:
+			writeError(w, r, apierr.New(apierr.Unprocessable, "idempotency key was used with a different request body"))
+		case !prev.done:
+			writeError(w, r, apierr.New(apierr.Conflict, "a request with this idempotency key is still in progress"))
+		default:
+			if prev.contentType != "" {
+				w.Header().Set("Content-Type", prev.contentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(prev.status)
+			w.Write(prev.body)
+		}
+	}
+}
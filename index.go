@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"blockchain/apierr"
+)
+
+// TxEvent is a transaction together with the block that recorded it.
+type TxEvent struct {
+	Transaction
+	ID        string `json:"id"`
+	BlockPos  int    `json:"block"`
+	BlockHash string `json:"block_hash"`
+	Timestamp string `json:"timestamp"`
+}
+
+// resetIndexes empties the lookup indexes. mu must be held for writing.
+func (bc *Blockchain) resetIndexes() {
+	bc.byHash = map[string]*Block{}
+	bc.byBook = map[string][]TxEvent{}
+	bc.byUser = map[string][]TxEvent{}
+	bc.byTxID = map[string]int{}
+	bc.byTime = nil
+	bc.anchors = nil
+	bc.state = newLibraryState()
+}
+
+// indexBlock adds a block to the lookup indexes. Blocks are indexed in chain
+// order, so every per-key list stays chronological. mu must be held for
+// writing.
+func (bc *Blockchain) indexBlock(b *Block) {
+	bc.byHash[b.Hash] = b
+	latest := b.Time().UnixMilli()
+	if n := len(bc.byTime); n > 0 {
+		latest = max(latest, bc.byTime[n-1])
+	}
+	bc.byTime = append(bc.byTime, latest)
+	bc.state.Apply(b)
+	for _, tx := range b.Transactions {
+		if tx.IsGenesis {
+			continue
+		}
+		tx = tx.attached()
+		ev := TxEvent{Transaction: tx, ID: tx.ID(), BlockPos: b.Pos, BlockHash: b.Hash, Timestamp: b.Timestamp}
+		bc.byTxID[ev.ID] = b.Pos
+		if tx.BookId != "" {
+			bc.byBook[tx.BookId] = append(bc.byBook[tx.BookId], ev)
+		}
+		if tx.User != "" {
+			bc.byUser[tx.User] = append(bc.byUser[tx.User], ev)
+		}
+		if tx.Kind() == TxAnchor {
+			bc.anchors = append(bc.anchors, ev)
+		}
+	}
+}
+
+// IndexStats answers POST /admin/reindex.
+type IndexStats struct {
+	Height       int   `json:"height"`
+	Transactions int   `json:"transactions"`
+	Books        int   `json:"books"`
+	Users        int   `json:"users"`
+	DurationMS   int64 `json:"duration_ms"`
+}
+
+func (bc *Blockchain) indexStats() IndexStats {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return IndexStats{Height: len(bc.Blocks), Transactions: len(bc.byTxID), Books: len(bc.byBook), Users: len(bc.byUser)}
+}
+
+// adminReindex rebuilds the lookup indexes and the library state of the
+// request's chain from its blocks. They are kept up to date as blocks are
+// appended, so this is only needed if they are suspected to have drifted.
+func adminReindex(w http.ResponseWriter, r *http.Request) {
+	bc := tenantOf(r).chain
+	start := time.Now()
+	bc.reindex()
+	stats := bc.indexStats()
+	stats.DurationMS = time.Since(start).Milliseconds()
+	reqLog(r).Info("Rebuilt indexes", "height", stats.Height, "transactions", stats.Transactions, "duration_ms", stats.DurationMS)
+	respond(w, r, stats)
+}
+
+// FirstAfter returns the height of the first block produced after t, or the
+// chain's height if there is none. byTime holds the latest block time up to
+// each height, which never decreases even where old blocks' times do, so it
+// can be searched.
+func (bc *Blockchain) FirstAfter(t time.Time) int {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	ms := t.UnixMilli()
+	return sort.Search(len(bc.byTime), func(i int) bool { return bc.byTime[i] > ms })
+}
+
+// BookHistory returns every transaction for a book, oldest first.
+func (bc *Blockchain) BookHistory(id string) []TxEvent {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	events := bc.byBook[id]
+	return events[:len(events):len(events)]
+}
+
+// UserCheckouts returns every transaction by a user, oldest first.
+func (bc *Blockchain) UserCheckouts(user string) []TxEvent {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	events := bc.byUser[user]
+	return events[:len(events):len(events)]
+}
+
+// parseDate accepts a plain date or an RFC 3339 timestamp.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// dateRange reads the optional from and to query parameters. Both bounds
+// are inclusive; a plain to date covers that whole day.
+func dateRange(r *http.Request) (from, to time.Time, err error) {
+	q := r.URL.Query()
+	if v := q.Get("from"); v != "" {
+		if from, err = parseDate(v); err != nil {
+			return from, to, fmt.Errorf("invalid from date %q", v)
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = parseDate(v); err != nil {
+			return from, to, fmt.Errorf("invalid to date %q", v)
+		}
+		if _, err := time.Parse(time.DateOnly, v); err == nil {
+			to = to.Add(24*time.Hour - time.Nanosecond)
+		}
+	}
+	return from, to, nil
+}
+
+func getBookHistory(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	events := tenantOf(r).chain.BookHistory(id)
+	if len(events) == 0 {
+		writeError(w, r, apierr.New(apierr.NotFound, "no history for book "+id))
+		return
+	}
+	respond(w, r, events)
+}
+
+func getUserCheckouts(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+	from, to, err := dateRange(r)
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.InvalidRequest, err))
+		return
+	}
+	events := tenantOf(r).chain.UserCheckouts(user)
+	if len(events) == 0 {
+		writeError(w, r, apierr.New(apierr.NotFound, "no checkouts for user "+user))
+		return
+	}
+	out := []TxEvent{}
+	for _, ev := range events {
+		if !from.IsZero() || !to.IsZero() {
+			date, err := parseDate(ev.CheckoutDate)
+			if err != nil || (!from.IsZero() && date.Before(from)) || (!to.IsZero() && date.After(to)) {
+				continue
+			}
+		}
+		out = append(out, ev)
+	}
+	respond(w, r, out)
+}
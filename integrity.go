@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ErrChainInvalid is returned for writes while the loaded chain fails its
+// integrity check.
+var ErrChainInvalid = errors.New("chain failed its integrity check; see /admin/integrity")
+
+// IntegrityReport is the result of verifying every stored block, from its
+// hash and signature to its link to the block before it.
+type IntegrityReport struct {
+	ValidationReport
+	CheckedAt    string `json:"checked_at"`
+	DurationMS   int64  `json:"duration_ms"`
+	Store        string `json:"store"`
+	StoredHash   string `json:"stored_hash,omitempty"`
+	ComputedHash string `json:"computed_hash,omitempty"`
+}
+
+// VerifyProgress reports how far the integrity check under way has got.
+type VerifyProgress struct {
+	Running   bool   `json:"running"`
+	Checked   int64  `json:"checked"`
+	Total     int    `json:"total"`
+	StartedAt string `json:"started_at,omitempty"`
+}
+
+// verifyRun is an integrity check under way.
+type verifyRun struct {
+	checked atomic.Int64
+	total   int
+	start   time.Time
+}
+
+// verifyLogInterval is how often a long integrity check logs its progress.
+const verifyLogInterval = 5 * time.Second
+
+// checkIntegrity verifies the whole loaded chain and records the result.
+func (bc *Blockchain) checkIntegrity() IntegrityReport {
+	return bc.checkIntegrityFrom(nil)
+}
+
+// checkIntegrityFrom is checkIntegrity taking the blocks up to cp as valid,
+// as on startup for those a store's snapshot vouches for.
+// While it fails, the node serves reads but refuses new blocks.
+func (bc *Blockchain) checkIntegrityFrom(cp *Checkpoint) IntegrityReport {
+	start := time.Now()
+	blocks := bc.Snapshot()
+	run := &verifyRun{total: len(blocks), start: start}
+	if cp != nil {
+		run.total -= cp.Height + 1
+	}
+	bc.verifying.Store(run)
+	done := make(chan struct{})
+	go run.logProgress(done)
+	report := IntegrityReport{
+		ValidationReport: validateBlocksProgress(blocks, cp, &run.checked),
+		CheckedAt:        start.UTC().Format(time.RFC3339),
+		Store:            storeKind,
+	}
+	close(done)
+	bc.verifying.Store(nil)
+	report.DurationMS = time.Since(start).Milliseconds()
+	if !report.Valid {
+		b := blocks[*report.FirstInvalid]
+		report.StoredHash = b.Hash
+		report.ComputedHash = b.calculateHash()
+		log.Printf("Integrity check failed at block %d: %s; refusing writes", *report.FirstInvalid, report.Reason)
+	}
+	bc.mu.Lock()
+	bc.integrity = report
+	bc.mu.Unlock()
+	publishValidation(ValidationEvent{Source: "integrity", Valid: report.Valid, Pos: report.FirstInvalid, Hash: report.StoredHash, Reason: report.Reason})
+	return report
+}
+
+func (run *verifyRun) logProgress(done <-chan struct{}) {
+	ticker := time.NewTicker(verifyLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			log.Printf("Verified %d of %d blocks", run.checked.Load(), run.total)
+		case <-done:
+			return
+		}
+	}
+}
+
+// Progress reports the integrity check under way, if there is one.
+func (bc *Blockchain) Progress() VerifyProgress {
+	run := bc.verifying.Load()
+	if run == nil {
+		return VerifyProgress{}
+	}
+	return VerifyProgress{Running: true, Checked: run.checked.Load(), Total: run.total, StartedAt: run.start.UTC().Format(time.RFC3339)}
+}
+
+// Integrity returns the result of the last integrity check.
+func (bc *Blockchain) Integrity() IntegrityReport {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.integrity
+}
+
+// intact returns ErrChainInvalid, with the reason, if the last integrity
+// check failed.
+func (bc *Blockchain) intact() error {
+	report := bc.Integrity()
+	if report.Valid {
+		return nil
+	}
+	return fmt.Errorf("%w (block %d: %s)", ErrChainInvalid, *report.FirstInvalid, report.Reason)
+}
+
+// getIntegrity serves the last integrity report; POST runs the check again,
+// for example after the chain file was repaired by hand.
+func getIntegrity(w http.ResponseWriter, r *http.Request) {
+	report := BlockChain.Integrity()
+	if r.Method == http.MethodPost {
+		report = BlockChain.checkIntegrity()
+	}
+	respond(w, r, report)
+}
+
+// getIntegrityProgress serves the progress of a POST /admin/integrity
+// still running.
+func getIntegrityProgress(w http.ResponseWriter, r *http.Request) {
+	respond(w, r, BlockChain.Progress())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// TxWriteOff takes an item out of circulation for good because it was
+	// lost, damaged or stolen. When a borrower lost it, the write-off names
+	// them and ends their loan.
+	TxWriteOff = "write_off"
+	// TxInventoryAudit records whether a stocktake found an item, and where.
+	TxInventoryAudit = "inventory_audit"
+)
+
+var ErrWrittenOff = errors.New("item has been written off")
+
+// writeOffReasons are the reasons an item may be written off for.
+var writeOffReasons = map[string]bool{"lost": true, "damaged": true, "stolen": true}
+
+// WriteOffData is the payload of a write-off.
+type WriteOffData struct {
+	Reason string `json:"reason"`
+	Note   string `json:"note,omitempty"`
+}
+
+// WriteOffRecord is what the state keeps about a written-off item.
+type WriteOffRecord struct {
+	Date string `json:"date"`
+	User string `json:"user,omitempty"`
+	WriteOffData
+}
+
+// AuditData is the payload of an inventory audit.
+type AuditData struct {
+	Found bool   `json:"found"`
+	Shelf string `json:"shelf,omitempty"`
+}
+
+// AuditRecord is the state's record of an item's latest audit.
+type AuditRecord struct {
+	Date string `json:"date"`
+	AuditData
+}
+
+func init() {
+	registerTxType(&TxType{
+		Name: TxWriteOff, Event: "item.written_off", Book: true, Librarian: true,
+		Decode: decodeWriteOff,
+		Fields: inventoryFields,
+		Check:  (*LibraryState).checkWriteOff,
+		Apply: func(s *LibraryState, tx Transaction, pos int, blockTime string) {
+			rec := WriteOffRecord{Date: recordDate(tx, blockTime), User: tx.User}
+			if data, err := decodeWriteOff(tx.Data); err == nil {
+				rec.WriteOffData = data.(WriteOffData)
+			}
+			s.endLoan(tx.BookId, tx.Date, blockTime)
+			delete(s.holds, tx.BookId)
+			s.putRecord(TxWriteOff, tx.BookId, rec)
+		},
+	})
+	registerTxType(&TxType{
+		Name: TxInventoryAudit, Event: "item.audited", Book: true, Librarian: true,
+		Decode: decodeAudit,
+		Fields: func(t Transaction) error {
+			if t.User != "" {
+				return errors.New("inventory_audit carries a user")
+			}
+			return inventoryFields(t)
+		},
+		Apply: func(s *LibraryState, tx Transaction, pos int, blockTime string) {
+			rec := AuditRecord{Date: recordDate(tx, blockTime)}
+			if data, err := decodeAudit(tx.Data); err == nil {
+				rec.AuditData = data.(AuditData)
+			}
+			s.putRecord(TxInventoryAudit, tx.BookId, rec)
+		},
+	})
+}
+
+func decodeWriteOff(raw json.RawMessage) (any, error) {
+	var d WriteOffData
+	if err := decodeStrict(raw, &d); err != nil {
+		return nil, err
+	}
+	if !writeOffReasons[d.Reason] {
+		return nil, fmt.Errorf("reason must be lost, damaged or stolen, not %q", d.Reason)
+	}
+	return d, nil
+}
+
+func decodeAudit(raw json.RawMessage) (any, error) {
+	var d AuditData
+	if err := decodeStrict(raw, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// inventoryFields checks a librarian's transaction about an item.
+func inventoryFields(t Transaction) error {
+	if t.BookId == "" {
+		return fmt.Errorf("%s needs an item", t.Kind())
+	}
+	if t.Book != nil || t.CheckoutDate != "" {
+		return fmt.Errorf("%s carries checkout fields", t.Kind())
+	}
+	return nil
+}
+
+// writtenOff reports whether an item has been written off.
+func (s *LibraryState) writtenOff(bookID string) bool {
+	_, ok := s.record(TxWriteOff, bookID)
+	return ok
+}
+
+// checkWriteOff refuses to write an item off twice, and to write off an item
+// on loan other than as lost by its borrower.
+func (s *LibraryState) checkWriteOff(tx Transaction) error {
+	if s.writtenOff(tx.BookId) {
+		return ErrWrittenOff
+	}
+	loan, ok := s.loans[tx.BookId]
+	switch {
+	case ok && tx.User == "":
+		return ErrCheckedOut
+	case ok && loan.User != tx.User:
+		return ErrNotHolder
+	case !ok && tx.User != "":
+		return ErrNotHolder
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+// Package keys manages Ed25519 keypairs for library members and staff.
+// Private keys are stored on disk encrypted with a passphrase-derived key.
+package keys
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	ErrNotFound      = errors.New("key not found")
+	ErrExists        = errors.New("key already exists")
+	ErrBadPassphrase = errors.New("wrong passphrase")
+	ErrInvalidName   = errors.New("key name must be 1-64 letters, digits, '-', '_' or '.'")
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+type KeyInfo struct {
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	Tenant    string `json:"tenant,omitempty"`
+	PublicKey string `json:"public_key"`
+	Created   string `json:"created"`
+}
+
+type keyFile struct {
+	KeyInfo
+	Salt       string `json:"salt"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+type Keystore struct {
+	dir string
+}
+
+func NewKeystore(dir string) (*Keystore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &Keystore{dir: dir}, nil
+}
+
+func (ks *Keystore) path(name string) string {
+	return filepath.Join(ks.dir, name+".json")
+}
+
+// Generate creates a wallet with a new key. A wallet with a tenant belongs
+// to that library branch only.
+func (ks *Keystore) Generate(name, role, tenant, passphrase string) (KeyInfo, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	return ks.Import(name, role, tenant, passphrase, priv, pub)
+}
+
+func (ks *Keystore) Import(name, role, tenant, passphrase string, priv ed25519.PrivateKey, pub ed25519.PublicKey) (KeyInfo, error) {
+	if !validName.MatchString(name) {
+		return KeyInfo{}, ErrInvalidName
+	}
+	if _, err := os.Stat(ks.path(name)); err == nil {
+		return KeyInfo{}, ErrExists
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return KeyInfo{}, err
+	}
+	gcm, err := newGCM(passphrase, salt)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return KeyInfo{}, err
+	}
+
+	kf := keyFile{
+		KeyInfo: KeyInfo{
+			Name:      name,
+			Role:      role,
+			Tenant:    tenant,
+			PublicKey: hex.EncodeToString(pub),
+			Created:   time.Now().UTC().Format(time.RFC3339),
+		},
+		Salt:       hex.EncodeToString(salt),
+		Nonce:      hex.EncodeToString(nonce),
+		Ciphertext: hex.EncodeToString(gcm.Seal(nil, nonce, priv.Seed(), []byte(name))),
+	}
+	data, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	if err := os.WriteFile(ks.path(name), data, 0o600); err != nil {
+		return KeyInfo{}, err
+	}
+	return kf.KeyInfo, nil
+}
+
+func (ks *Keystore) read(name string) (*keyFile, error) {
+	if !validName.MatchString(name) {
+		return nil, ErrInvalidName
+	}
+	data, err := os.ReadFile(ks.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var kf keyFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("decode key %s: %w", name, err)
+	}
+	return &kf, nil
+}
+
+func (ks *Keystore) Get(name string) (KeyInfo, error) {
+	kf, err := ks.read(name)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	return kf.KeyInfo, nil
+}
+
+func (ks *Keystore) List() ([]KeyInfo, error) {
+	matches, err := filepath.Glob(filepath.Join(ks.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	infos := []KeyInfo{}
+	for _, m := range matches {
+		name := filepath.Base(m)
+		kf, err := ks.read(name[:len(name)-len(".json")])
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, kf.KeyInfo)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// Export decrypts and returns the private key stored under name.
+func (ks *Keystore) Export(name, passphrase string) (ed25519.PrivateKey, error) {
+	kf, err := ks.read(name)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := hex.DecodeString(kf.Salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(kf.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := hex.DecodeString(kf.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := gcm.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func newGCM(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"blockchain/apierr"
+)
+
+var (
+	maxBodySize  int64 = 1 << 20
+	maxJSONDepth       = 32
+)
+
+// bodyLimits overrides -max-body-size for the operations that take more: a
+// backup archive, or a peer's block, which may be as large as
+// -max-block-size. The limits are read per request, after the flags and the
+// config file have set them.
+var bodyLimits = map[string]func() int64{
+	"adminRestore": func() int64 { return maxBackupSize },
+	"receiveBlock": func() int64 { return maxBlockSize },
+}
+
+// middlewareBodyLimit refuses request bodies over -max-body-size with 413
+// and JSON bodies nested deeper than -max-json-depth with 400, before
+// anything else reads them. JSON bodies are read here and handed on from
+// memory; others, such as a backup archive, are only capped, and the
+// handler streaming them fails once it reads past the limit.
+func middlewareBodyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limit, streamed := maxBodySize, false
+		if route, _, err := findRoute(r); err == nil {
+			if l, ok := bodyLimits[route.Operation.OperationID]; ok {
+				limit = l()
+			}
+			if body := route.Operation.RequestBody; body != nil && body.Value.Content.Get("application/json") == nil {
+				streamed = true
+			}
+		}
+		if r.ContentLength > limit {
+			writeError(w, r, apierr.Errorf(codeBodyTooLarge, "request body is over %d bytes", limit))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		if streamed {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, apiError(err, apierr.InvalidRequest))
+			return
+		}
+		if jsonDepth(body, maxJSONDepth) > maxJSONDepth {
+			writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "JSON is nested more than %d deep", maxJSONDepth))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// jsonDepth is how deeply objects and arrays nest in data, counting no
+// further than past limit. It does not check that data is valid JSON.
+func jsonDepth(data []byte, limit int) int {
+	depth, deepest := 0, 0
+	inString, escaped := false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			if depth++; depth > deepest {
+				if deepest = depth; deepest > limit {
+					return deepest
+				}
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return deepest
+}
+
+// decodeJSON decodes a request body into v strictly: a field v does not
+// have, or anything after the value, is an error, so nothing the node would
+// not check can ride along into a block.
+func decodeJSON(body io.Reader, v any) error {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after the JSON value")
+	}
+	return nil
+}
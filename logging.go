@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	logFormat = "text"
+	logLevel  = "info"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID limits which incoming X-Request-ID values are kept, so a
+// client cannot inject arbitrary text into the logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// setupLogging makes slog the default logger. Calls to the log package go
+// through it too, at info level.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q", logLevel)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch logFormat {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %q", logFormat)
+	}
+	slog.SetDefault(slog.New(h))
+	log.SetFlags(0)
+	return nil
+}
+
+type requestIDKey struct{}
+
+// requestID returns the ID the logging middleware gave the request.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// reqLog is the default logger with the request's ID attached.
+func reqLog(r *http.Request) *slog.Logger {
+	if id := requestID(r.Context()); id != "" {
+		return slog.With("request_id", id)
+	}
+	return slog.Default()
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusWriter records the status of a response. Error responses are held
+// back so the request ID can be added to their JSON body.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	size    int
+	errBody *bytes.Buffer
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status != 0 {
+		return
+	}
+	sw.status = status
+	if status >= 400 {
+		sw.errBody = &bytes.Buffer{}
+		return
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if sw.errBody != nil {
+		return sw.errBody.Write(p)
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	sw.size += n
+	return n, err
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok && sw.errBody == nil {
+		f.Flush()
+	}
+}
+
+// Hijack lets WebSocket upgrades take over the connection.
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	if sw.status == 0 {
+		sw.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// finish sends a held-back error response, with "request_id" added when the
+// body is a JSON object, which is then labelled as JSON.
+func (sw *statusWriter) finish(id string) {
+	if sw.errBody == nil {
+		return
+	}
+	body := sw.errBody.Bytes()
+	var obj map[string]any
+	if json.Unmarshal(body, &obj) == nil && obj != nil {
+		obj["request_id"] = id
+		if b, err := json.Marshal(obj); err == nil {
+			body = append(b, '\n')
+			sw.Header().Set("Content-Type", "application/json")
+		}
+	}
+	sw.ResponseWriter.WriteHeader(sw.status)
+	n, _ := sw.ResponseWriter.Write(body)
+	sw.size += n
+}
+
+// middlewareLogging gives every request an ID, echoed in X-Request-ID, and
+// logs one line per request once it is done.
+func middlewareLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+		sw.finish(id)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		route := routeOf(r)
+		observeRequest(route, r.Method, sw.status, time.Since(start))
+		level := slog.LevelInfo
+		if sw.status >= 500 {
+			level = slog.LevelError
+		}
+		slog.Log(r.Context(), level, "request",
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"status", sw.status,
+			"bytes", sw.size,
+			"latency_ms", float64(time.Since(start).Microseconds())/1000,
+			"client_ip", clientIP(r),
+		)
+	})
+}
+
+// routeOf is the path template of the route r matched, or its path.
+func routeOf(r *http.Request) string {
+	if cr := mux.CurrentRoute(r); cr != nil {
+		if tpl, err := cr.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return r.URL.Path
+}
+
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"blockchain/apierr"
+)
+
+// BlockAt returns the block at height n, or nil.
+func (bc *Blockchain) BlockAt(n int) *Block {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if n < 0 || n >= len(bc.Blocks) {
+		return nil
+	}
+	return bc.Blocks[n]
+}
+
+// BlockByHash returns the block with the given hash, or nil.
+func (bc *Blockchain) BlockByHash(hash string) *Block {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.byHash[hash]
+}
+
+func writeBlockLookup(w http.ResponseWriter, r *http.Request, block *Block, missing string) {
+	if block == nil {
+		writeError(w, r, apierr.New(codeBlockNotFound, missing))
+		return
+	}
+	respond(w, r, block)
+}
+
+func getBlockByHash(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	writeBlockLookup(w, r, tenantOf(r).chain.BlockByHash(hash), fmt.Sprintf("no block with hash %s", hash))
+}
+
+func getBlockByHeight(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(mux.Vars(r)["n"])
+	if err != nil {
+		writeError(w, r, apierr.New(apierr.InvalidRequest, "height must be an integer"))
+		return
+	}
+	writeBlockLookup(w, r, tenantOf(r).chain.BlockAt(n), fmt.Sprintf("no block at height %d", n))
+}
@@ -1,26 +1,44 @@
 package main
 
 import (
-	"crypto/md5"
-	"crypto/sha256"
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"blockchain/apierr"
+	"blockchain/keys"
 )
 
 type Block struct {
-	Pos       int
-	Data      BookCheckout
-	Timestamp string
-	Hash      string
-	Prevhash  string
+	Pos          int
+	Transactions []Transaction
+	Timestamp    string
+	UnixMilli    int64 `json:",omitempty"`
+	Hash         string
+	Prevhash     string
+	MerkleRoot   string
+	Nonce        int
+	Difficulty   int
+	Producer     string
+	Signature    string
+	Version      int
+	Migrated     *BlockOrigin `json:",omitempty"`
 }
 
 type Book struct {
@@ -29,228 +47,875 @@ type Book struct {
 	Author      string `json:"author"`
 	PublishDate string `json:"publish_date"`
 	ISBN        string `json:"isbn"`
+	Withdrawn   bool   `json:"withdrawn,omitempty"`
+	// Kind is empty for books. Other kinds of item carry a Serial instead of
+	// an ISBN.
+	Kind   string `json:"kind,omitempty"`
+	Serial string `json:"serial,omitempty"`
 }
 
-type BookCheckout struct {
-	BookId       string `json:"bookid"`
-	User         string `json:"user"`
-	CheckoutDate string `json:"checkout_date"`
-	IsGenesis    bool   `json:"is_genesis"`
+// Transaction is one entry in a block. Type says what kind of event it
+// records; an empty Type is a checkout, which keeps transactions signed
+// before types existed valid.
+type Transaction struct {
+	Type         string         `json:"type,omitempty"`
+	BookId       string         `json:"bookid"`
+	User         string         `json:"user"`
+	CheckoutDate string         `json:"checkout_date"`
+	Stamped      bool           `json:"stamped,omitempty"`
+	Date         string         `json:"date,omitempty"`
+	Nonce        string         `json:"nonce,omitempty"`
+	DueDate      string         `json:"due_date,omitempty"`
+	Fine         int64          `json:"fine,omitempty"`
+	Amount       int64          `json:"amount,omitempty"`
+	IsGenesis    bool           `json:"is_genesis"`
+	PublicKey    string         `json:"public_key,omitempty"`
+	Signature    string         `json:"signature,omitempty"`
+	Chain        *ChainParams   `json:"chain,omitempty"`
+	Book         *Book          `json:"book,omitempty"`
+	Anchor       *AnchorReceipt `json:"anchor,omitempty"`
+	FromBranch   string         `json:"from_branch,omitempty"`
+	ToBranch     string         `json:"to_branch,omitempty"`
+	// Data is the payload of a type registered with a decoder.
+	Data json.RawMessage `json:"data,omitempty"`
+	// PayloadHash, under -offchain-payloads, stands for the user, public key
+	// and signature, which the node keeps off the chain.
+	PayloadHash string `json:"payload_hash,omitempty"`
 }
 
+// Blockchain is safe for concurrent use. Writers are serialized by writeMu
+// and only hold mu while swapping in the new block, so readers are never
+// blocked by mining. Blocks doubles as the height index; the other indexes
+// are kept in step with it by indexBlock.
 type Blockchain struct {
-	Blocks []*Block `json:"blocks"`
+	Blocks    []*Block `json:"blocks"`
+	byHash    map[string]*Block
+	byBook    map[string][]TxEvent
+	byUser    map[string][]TxEvent
+	byTxID    map[string]int
+	byTime    []int64
+	anchors   []TxEvent
+	state     *LibraryState
+	store     Store
+	integrity IntegrityReport
+	verifying atomic.Pointer[verifyRun]
+	mu        sync.RWMutex
+	writeMu   sync.Mutex
+	// branch is the tenant a branch chain belongs to; it is nil for the
+	// node's own chain.
+	branch *Tenant
 }
 
 var BlockChain *Blockchain
-const (
-	chainFile  = "blockchain.json"
-	difficulty = 3
-)
+
+var difficulty = 3
+
+var listenAddr = ":3000"
+
+func (b *Block) calculateHash() string {
+	rules, ok := blockVersions[b.Version]
+	if !ok {
+		return ""
+	}
+	return hex.EncodeToString(chainSum(rules.header(b)))
+}
 
 func (b *Block) generateHash() {
-	bytes, _ := json.Marshal(b.Data)
-	data := fmt.Sprintf("%d%s%s%s", b.Pos, b.Timestamp, string(bytes), b.Prevhash)
-	hash := sha256.New()
-	hash.Write([]byte(data))
-	b.Hash = hex.EncodeToString(hash.Sum(nil))
+	b.Hash = b.calculateHash()
 }
 
 func (b *Block) mineBlock() {
-	target := strings.Repeat("0", difficulty)
-	for {
+	b.Difficulty = difficulty
+	target := strings.Repeat("0", b.Difficulty)
+	for b.Nonce = 0; ; b.Nonce++ {
 		b.generateHash()
 		if strings.HasPrefix(b.Hash, target) {
 			break
 		}
-		b.Timestamp = time.Now().Format(time.RFC3339Nano)
 	}
 }
 
-func CreateBlock(prevBlock *Block, checkoutitem BookCheckout) *Block {
+func meetsTarget(hash string, diff int) bool {
+	return strings.HasPrefix(hash, strings.Repeat("0", diff))
+}
+
+func CreateBlock(prevBlock *Block, txs []Transaction) *Block {
 	block := &Block{}
+	block.Version = currentBlockVersion
 	block.Pos = prevBlock.Pos + 1
-	block.Timestamp = time.Now().Format(time.RFC3339)
+	block.stamp(prevBlock)
 	block.Prevhash = prevBlock.Hash
-	block.Data = checkoutitem
+	block.Transactions = txs
+	block.MerkleRoot = merkleRoot(block.Version, txs)
+	block.Producer = nodePublicKey()
 	block.mineBlock()
+	block.sign(NodeKey)
 	return block
 }
 
-func (bc *Blockchain) AddBlock(data BookCheckout) {
-	prevBlock := bc.Blocks[len(bc.Blocks)-1]
-	block := CreateBlock(prevBlock, data)
-	if validBlock(block, prevBlock) {
-		bc.Blocks = append(bc.Blocks, block)
-		saveBlockchain(bc)
+func (bc *Blockchain) AddBlock(ctx context.Context, txs ...Transaction) (*Block, error) {
+	ctx, span := tracer.Start(ctx, "AddBlock", trace.WithAttributes(attribute.Int("txs", len(txs))))
+	defer span.End()
+	if err := bc.intact(); err != nil {
+		return nil, err
+	}
+	for _, tx := range txs {
+		if err := tx.Verify(); err != nil {
+			return nil, err
+		}
+	}
+	onChain := txs
+	if offchainPayloads {
+		var err error
+		if onChain, err = detachPayloads(txs); err != nil {
+			return nil, err
+		}
+	}
+	if fieldKeys.Encrypted() {
+		var err error
+		if onChain, err = sealUsers(onChain); err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	bc.writeMu.Lock()
+	defer bc.writeMu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if err := bc.refresh(); err != nil {
+			return nil, err
+		}
+		for i, err := range bc.checkBatch(txs) {
+			if err != nil {
+				return nil, fmt.Errorf("transaction %d: %w", i, err)
+			}
+		}
+		prevBlock := bc.Tip()
+		_, mine := tracer.Start(ctx, "CreateBlock")
+		block := CreateBlock(prevBlock, onChain)
+		mine.End()
+		if err := checkBlockLimits(block); err != nil {
+			return nil, err
+		}
+		if !validBlock(block, prevBlock) {
+			return nil, errors.New("block failed validation")
+		}
+		if Consensus != nil && bc.branch == nil {
+			if err := Consensus.Commit(block); err != nil {
+				return nil, err
+			}
+			return block, nil
+		}
+		err := storeAppend(ctx, bc.store, block)
+		if errors.Is(err, ErrTipMoved) && attempt < 3 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		bc.appendBlock(block)
+		blockCreation.Observe(time.Since(start).Seconds())
+		span.SetAttributes(attribute.Int("block.pos", block.Pos))
+		if bc.branch == nil {
+			announceBlock(block)
+		}
+		return block, nil
 	}
 }
 
-func validBlock(block, prevBlock *Block) bool {
-	if prevBlock.Hash != block.Prevhash {
-		return false
+func (bc *Blockchain) appendBlock(block *Block) {
+	bc.mu.Lock()
+	bc.Blocks = append(bc.Blocks, block)
+	bc.indexBlock(block)
+	bc.mu.Unlock()
+	blocksAdded.Inc()
+	if block.Pos%stateSaveInterval == 0 {
+		bc.saveState()
 	}
-	if !block.ValidateHash(block.Hash) {
-		return false
+	if t := bc.branch; t != nil {
+		if err := t.books.Apply(block); err != nil {
+			log.Printf("Error updating catalog of tenant %s from block %d: %v", t.ID, block.Pos, err)
+		}
+		t.search.IndexBlock(block)
+		return
 	}
-	if prevBlock.Pos+1 != block.Pos {
-		return false
+	bc.checkpoint(block)
+	NewBlocks.publish(block)
+	if Books != nil {
+		if err := Books.Apply(block); err != nil {
+			log.Printf("Error updating catalog from block %d: %v", block.Pos, err)
+		}
 	}
-	if !strings.HasPrefix(block.Hash, strings.Repeat("0", difficulty)) {
-		return false
+	if Search != nil {
+		Search.IndexBlock(block)
 	}
-	return true
 }
 
-func (b *Block) ValidateHash(hash string) bool {
-	b.generateHash()
-	return b.Hash == hash
+// Snapshot returns the blocks as of now. Blocks are never modified once
+// appended, so the returned slice stays consistent while the chain grows.
+func (bc *Blockchain) Snapshot() []*Block {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.Blocks[:len(bc.Blocks):len(bc.Blocks)]
 }
 
-func GenesisBlock() *Block {
-	genesis := &Block{
-		Pos:       0,
-		Timestamp: time.Now().Format(time.RFC3339),
-		Data:      BookCheckout{IsGenesis: true},
-		Prevhash:  "",
-	}
-	genesis.mineBlock()
-	return genesis
+func (bc *Blockchain) Tip() *Block {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.Blocks[len(bc.Blocks)-1]
 }
 
-func NewBlockChain() *Blockchain {
-	bc := &Blockchain{}
-	if fileExists(chainFile) {
-		loaded := loadBlockchain()
-		if loaded != nil && len(loaded.Blocks) > 0 {
-			return loaded
-		}
-	}
-	bc.Blocks = []*Block{GenesisBlock()}
-	saveBlockchain(bc)
-	return bc
+func (bc *Blockchain) Height() int {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return len(bc.Blocks)
 }
 
-func saveBlockchain(bc *Blockchain) {
-	tmp := chainFile + ".tmp"
+// Refresh appends blocks written to the store by other processes sharing it.
+func (bc *Blockchain) Refresh() error {
+	bc.writeMu.Lock()
+	defer bc.writeMu.Unlock()
+	return bc.refresh()
+}
 
-	file, err := os.Create(tmp)
-	if err != nil {
-		log.Printf("Error creating temp blockchain file: %v", err)
-		return
-	}
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(bc); err != nil {
-		log.Printf("Error encoding blockchain: %v", err)
-		file.Close()
-		return
+func (bc *Blockchain) refresh() error {
+	for {
+		block, err := bc.store.GetByPos(bc.Height())
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		bc.appendBlock(block)
 	}
-	file.Close()
+}
 
-	if _, err := os.Stat(chainFile); err == nil {
-		os.Remove(chainFile)
+func validBlock(block, prevBlock *Block) bool {
+	if block.Difficulty < difficulty {
+		return false
 	}
+	return checkBlock(block, prevBlock) == nil
+}
+
+func (b *Block) ValidateHash(hash string) bool {
+	return b.calculateHash() == hash
+}
 
-	if err := os.Rename(tmp, chainFile); err != nil {
-		log.Printf("Error renaming blockchain file: %v", err)
+func GenesisBlock() *Block {
+	genesis := &Block{
+		Pos:          0,
+		Transactions: []Transaction{{IsGenesis: true, Chain: localChainParams()}},
+		Prevhash:     "",
+		Version:      currentBlockVersion,
 	}
+	genesis.stamp(nil)
+	genesis.MerkleRoot = merkleRoot(genesis.Version, genesis.Transactions)
+	genesis.Producer = nodePublicKey()
+	genesis.mineBlock()
+	genesis.sign(NodeKey)
+	return genesis
 }
 
-func loadBlockchain() *Blockchain {
-	data, err := os.ReadFile(chainFile)
-	if err != nil {
-		log.Printf("Error reading chain file: %v", err)
+func NewBlockChain(store Store) (*Blockchain, error) {
+	bc := &Blockchain{store: store}
+	bc.resetIndexes()
+	bc.loadState()
+	err := store.Iterate(func(b *Block) error {
+		bc.Blocks = append(bc.Blocks, b)
+		bc.indexBlock(b)
 		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	var bc Blockchain
-	if err := json.Unmarshal(data, &bc); err != nil {
-		log.Printf("Error unmarshalling chain: %v", err)
-		return nil
+	if len(bc.Blocks) > 0 {
+		bc.checkIntegrityFrom(snapshotCheckpoint(store))
+		bc.saveState()
+		return bc, nil
+	}
+	genesis := GenesisBlock()
+	if err := storeAppend(context.Background(), store, genesis); err != nil {
+		return nil, err
 	}
-	return &bc
+	bc.Blocks = []*Block{genesis}
+	bc.indexBlock(genesis)
+	bc.checkIntegrity()
+	bc.saveState()
+	return bc, nil
 }
 
-func fileExists(name string) bool {
-	_, err := os.Stat(name)
-	return err == nil
+type BlockPage struct {
+	Blocks []*Block `json:"blocks"`
+	Total  int      `json:"total"`
+	Offset int      `json:"offset"`
+	Limit  int      `json:"limit"`
 }
 
 func getBlockChain(w http.ResponseWriter, r *http.Request) {
-	jbytes, err := json.MarshalIndent(BlockChain.Blocks, "", "  ")
+	offset, limit, err := parsePage(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(err)
+		writeError(w, r, apierr.Wrap(apierr.InvalidRequest, err))
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jbytes)
+	chain := tenantOf(r).chain
+	if err := chain.Refresh(); err != nil {
+		reqLog(r).Error("Error refreshing chain", "error", err)
+	}
+	if chainNotModified(w, r) {
+		return
+	}
+	blocks := chain.Snapshot()
+	start := min(offset, len(blocks))
+	end := min(start+limit, len(blocks))
+	page := BlockPage{Blocks: blocks[start:end], Total: len(blocks), Offset: offset, Limit: limit}
+	mt, err := responseType(r, page)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	switch mt {
+	case mediaJSON:
+		// JSON stays indented for people.
+		w.Header().Add("Link", pageLinks(r, offset, limit, page.Total))
+		err = streamBlockPage(w, page)
+	case mediaNDJSON:
+		// NDJSON runs to the tip unless a limit is given: it is never held in
+		// memory, so there is no need to page it.
+		if !r.URL.Query().Has("limit") {
+			page.Blocks = blocks[start:]
+		}
+		err = streamNDJSON(w, page.Blocks)
+	default:
+		w.Header().Add("Link", pageLinks(r, offset, limit, page.Total))
+		if err := writeResponse(w, mt, page); err != nil {
+			writeError(w, r, err)
+		}
+		return
+	}
+	// The status is out by now, so a failure can only cut the stream short.
+	if err != nil {
+		reqLog(r).Warn("Error streaming chain", "error", err)
+	}
 }
 
 func writeBlock(w http.ResponseWriter, r *http.Request) {
-	var checkoutitem BookCheckout
-		if err := json.NewDecoder(r.Body).Decode(&checkoutitem); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("Could not decode block: %v", err)
-		w.Write([]byte(`{"error":"invalid payload"}`))
+	t := tenantOf(r)
+	var checkoutitem Transaction
+		if err := decodeJSON(r.Body, &checkoutitem); err != nil {
+		reqLog(r).Warn("Could not decode block", "error", err)
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "invalid payload: %w", err))
 		return
 	}
 
-	BlockChain.AddBlock(checkoutitem)
+	checkoutitem.IsGenesis = false
+	if err := checkoutitem.validate(); err != nil {
+		t.noteRejected(checkoutitem, err)
+		writeError(w, r, err)
+		return
+	}
+	if err := checkoutitem.checkFields(); err != nil {
+		t.noteRejected(checkoutitem, err)
+		writeError(w, r, txError(err))
+		return
+	}
+	if err := checkTxSize(checkoutitem); err != nil {
+		t.noteRejected(checkoutitem, err)
+		writeError(w, r, txError(err))
+		return
+	}
+	if err := checkDuplicate(t, checkoutitem); err != nil {
+		t.noteRejected(checkoutitem, err)
+		writeError(w, r, apiError(err, apierr.Conflict))
+		return
+	}
+	if err := checkSubmission(t, checkoutitem); err != nil {
+		t.noteRejected(checkoutitem, err)
+		writeError(w, r, apiError(err, apierr.Conflict))
+		return
+	}
+	t.chain.applyPolicy(&checkoutitem)
+	if _, err := t.chain.AddBlock(r.Context(), checkoutitem); err != nil {
+		t.noteRejected(checkoutitem, err)
+		writeError(w, r, txError(err))
+		return
+	}
 
+	resp := map[string]any{"status": "block added", "id": checkoutitem.ID()}
+	if checkoutitem.Kind() == TxReturn {
+		if checkoutitem.Fine > 0 {
+			resp["fine"] = checkoutitem.Fine
+		}
+		if holds := t.chain.Holds(checkoutitem.BookId); len(holds) > 0 {
+			resp["next_hold"] = holds[0].User
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "block added",
-	})
+	json.NewEncoder(w).Encode(resp)
 }
 
-func isDuplicate(bc *Blockchain, data BookCheckout) bool {
-	for _, block := range bc.Blocks {
-		if block.Data == data {
-			return true
-		}
-	}
-	return false
+func isDuplicate(bc *Blockchain, data Transaction) bool {
+	_, ok := bc.TxBlock(data.ID())
+	return ok
 }
 
 
 func newBook(w http.ResponseWriter, r *http.Request) {
 	var book Book
-	if err := json.NewDecoder(r.Body).Decode(&book); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "invalid book data"})
+	if err := decodeJSON(r.Body, &book); err != nil {
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "invalid book data: %w", err))
+		return
+	}
+	if book.Kind == KindBook {
+		book.Kind = ""
+	}
+	if err := book.validate(); err != nil {
+		writeError(w, r, err)
 		return
 	}
-	h := md5.New()
-	io.WriteString(h, book.ISBN+book.PublishDate)
-	book.Id = fmt.Sprintf("%x", h.Sum(nil))
+	t := tenantOf(r)
+	book.Id = bookID(t.chain, book)
+	book.Withdrawn = false
 
+	book, added, err := t.books.Add(book)
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	if added {
+		if _, err := queueTx(t, bookRegistration(book)); err != nil {
+			reqLog(r).Error("Error queueing book registration", "book", book.Id, "error", err)
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
+	if added {
+		w.WriteHeader(http.StatusCreated)
+	}
 	json.NewEncoder(w).Encode(book)
 }
 
-func middlewareCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
 }
 
 func main() {
-	BlockChain = NewBlockChain()
+	flag.IntVar(&difficulty, "difficulty", envInt("CHAIN_DIFFICULTY", difficulty), "number of leading zero hex digits required in a block hash")
+	flag.StringVar(&storeKind, "store", storeKind, "storage backend: log, json, bolt, sqlite or postgres")
+	flag.StringVar(&logFile, "log-file", logFile, "append-only block log used by the log store")
+	flag.StringVar(&fsyncPolicy, "fsync", fsyncPolicy, "when the log store fsyncs: always, interval or never")
+	flag.DurationVar(&fsyncInterval, "fsync-interval", fsyncInterval, "fsync period for -fsync interval")
+	flag.StringVar(&encryptionKey, "encryption-key", encryptionKey, "where to get the AES-256 key the log store's files are encrypted with: a secret source such as env:NAME or vault:PATH#FIELD (empty stores them in the clear)")
+	flag.StringVar(&encryptionOldKeys, "encryption-old-keys", encryptionOldKeys, "comma-separated sources of earlier keys, to read data not yet rewritten by chain rekey")
+	flag.DurationVar(&snapshotInterval, "snapshot-interval", snapshotInterval, "how often to snapshot the chain (0 disables)")
+	flag.StringVar(&chainFile, "chain-file", chainFile, "chain file used by the json store and imported by other stores")
+	flag.StringVar(&boltFile, "bolt-file", boltFile, "database file used by the bolt store")
+	flag.StringVar(&sqliteFile, "sqlite-file", sqliteFile, "database file used by the sqlite store")
+	flag.StringVar(&postgresDSN, "postgres-dsn", postgresDSN, "connection string used by the postgres store (pool size via pool_max_conns)")
+	flag.StringVar(&nodeKeyFile, "node-key", nodeKeyFile, "file holding this node's identity key, created on first run")
+	flag.StringVar(&nodeKeySource, "node-key-source", nodeKeySource, "read the node key from env:NAME, file:PATH, cmd:COMMAND, vault:PATH#FIELD or aws-kms:SOURCE instead of -node-key")
+	flag.StringVar(&catalogFile, "catalog-file", catalogFile, "file holding the book catalog")
+	flag.StringVar(&memberFile, "member-file", memberFile, "file holding the member registry")
+	flag.BoolVar(&pseudonymize, "pseudonymize", pseudonymize, "accept only pseudonyms from POST /pseudonyms as users in new transactions, so blocks hold no member IDs")
+	flag.StringVar(&pseudonymKeyFile, "pseudonym-key", pseudonymKeyFile, "file holding the key pseudonyms are derived with, created on first run")
+	flag.StringVar(&pseudonymKeySource, "pseudonym-key-source", pseudonymKeySource, "read the pseudonym key from a secret source, as for -node-key-source, instead of -pseudonym-key")
+	flag.StringVar(&pseudonymFile, "pseudonym-file", pseudonymFile, "file mapping pseudonyms back to members")
+	flag.BoolVar(&offchainPayloads, "offchain-payloads", offchainPayloads, "keep the user, key and signature of new transactions off the chain, with only their hash in the block, so they can be redacted")
+	flag.StringVar(&payloadFile, "payload-file", payloadFile, "file holding the off-chain transaction payloads")
+	flag.StringVar(&auditFile, "audit-file", auditFile, "append-only log of every API call that could change state, refused or not (empty disables it)")
+	flag.StringVar(&fieldKey, "field-key", fieldKey, "where to get the AES-256 key users in new blocks are encrypted with: a secret source such as env:NAME or vault:PATH#FIELD (empty leaves them in the clear)")
+	flag.StringVar(&fieldOldKeys, "field-old-keys", fieldOldKeys, "comma-separated sources of earlier -field-key keys, still needed to read the blocks they encrypted")
+	flag.StringVar(&walletDir, "wallet-dir", walletDir, "directory holding encrypted wallet keys")
+	flag.StringVar(&chainID, "chain-id", chainID, "chain ID written into a new genesis block; peers on another chain are refused")
+	flag.StringVar(&networkName, "network", networkName, "network name written into a new genesis block")
+	flag.StringVar(&hashAlgorithm, "hash", hashAlgorithm, "block hash algorithm written into a new genesis block: sha256, double-sha256, sha3-256 or blake2b-256")
+	flag.StringVar(&configFile, "config", configFile, "YAML or TOML file of settings named like these flags; flags and LIBRARY_* variables override it")
+	flag.StringVar(&dataDir, "data-dir", dataDir, "directory for the chain, keys and other node files given as relative paths")
+	flag.StringVar(&listenAddr, "addr", listenAddr, "address the HTTP server listens on")
+	flag.StringVar(&logFormat, "log-format", logFormat, "log output format: text or json")
+	flag.StringVar(&logLevel, "log-level", logLevel, "minimum log level: debug, info, warn or error")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "how long to wait for in-flight requests and pending writes on SIGTERM")
+	flag.StringVar(&tlsCertFile, "tls-cert", tlsCertFile, "TLS certificate file; with -tls-key the API is served over HTTPS")
+	flag.StringVar(&tlsKeyFile, "tls-key", tlsKeyFile, "TLS private key file")
+	flag.StringVar(&autocertDomains, "autocert", autocertDomains, "comma-separated domains to serve over HTTPS with Let's Encrypt certificates")
+	flag.StringVar(&autocertCache, "autocert-cache", autocertCache, "directory caching Let's Encrypt certificates")
+	flag.StringVar(&autocertEmail, "autocert-email", autocertEmail, "contact email for the Let's Encrypt account")
+	flag.StringVar(&redirectAddr, "redirect-addr", redirectAddr, "address of a plain HTTP listener that redirects to HTTPS, e.g. :80")
+	flag.StringVar(&peerCAFile, "peer-ca", peerCAFile, "consortium CA certificate; peers must present a client certificate it issued")
+	flag.StringVar(&peerCertFile, "peer-cert", peerCertFile, "this branch's certificate from the consortium CA, presented to peers")
+	flag.StringVar(&peerKeyFile, "peer-key", peerKeyFile, "private key for -peer-cert")
+	flag.StringVar(&corsOrigins, "cors-origins", corsOrigins, "comma-separated origins allowed by CORS; \"*\" or patterns like https://*.example.org (env CORS_ORIGINS)")
+	flag.StringVar(&corsMethods, "cors-methods", corsMethods, "methods allowed by CORS (env CORS_METHODS)")
+	flag.StringVar(&corsHeaders, "cors-headers", corsHeaders, "request headers allowed by CORS (env CORS_HEADERS)")
+	flag.BoolVar(&corsCredentials, "cors-credentials", corsCredentials, "allow credentialed CORS requests (env CORS_CREDENTIALS=true)")
+	flag.IntVar(&corsMaxAge, "cors-max-age", corsMaxAge, "seconds browsers may cache a CORS preflight, 0 to omit (env CORS_MAX_AGE)")
+	flag.StringVar(&grpcAddr, "grpc-addr", grpcAddr, "address for the gRPC API, e.g. :50051 (empty disables it)")
+	flag.StringVar(&advertiseURL, "advertise", advertiseURL, "URL peers use to reach this node, e.g. http://10.0.0.5:3000")
+	flag.StringVar(&bootstrap, "peers", bootstrap, "comma-separated peer URLs to register with and sync from at startup")
+	flag.DurationVar(&syncInterval, "sync-interval", syncInterval, "how often to pull missing blocks from peers")
+	flag.BoolVar(&p2pEnabled, "p2p", p2pEnabled, "propagate blocks and transactions over libp2p gossipsub")
+	flag.StringVar(&p2pListen, "p2p-listen", p2pListen, "libp2p listen multiaddr")
+	flag.StringVar(&p2pPeers, "p2p-peers", p2pPeers, "comma-separated libp2p peer multiaddrs to connect to")
+	flag.BoolVar(&p2pMDNS, "p2p-mdns", p2pMDNS, "discover libp2p peers on the local network with mDNS")
+	flag.StringVar(&consensusMode, "consensus", consensusMode, "consensus mode: pow (peer sync) or raft")
+	flag.StringVar(&raftID, "raft-id", raftID, "unique server ID in raft mode")
+	flag.StringVar(&raftAddr, "raft-addr", raftAddr, "TCP address for raft traffic")
+	flag.StringVar(&raftDir, "raft-dir", raftDir, "directory for the raft log and snapshots")
+	flag.BoolVar(&raftBootstrap, "raft-bootstrap", raftBootstrap, "bootstrap a new raft cluster with this node as its first member")
+	flag.StringVar(&raftJoin, "raft-join", raftJoin, "HTTP URL of a raft member to join")
+	flag.StringVar(&raftJoinKey, "raft-join-key", raftJoinKey, "secret source (env:NAME, file:PATH, ...) of a librarian API key to join with when the cluster runs without -peer-ca")
+	flag.IntVar(&loanDays, "loan-days", loanDays, "loan period in days")
+	flag.IntVar(&maxRenewals, "max-renewals", maxRenewals, "how many times a loan may be renewed")
+	flag.Int64Var(&finePerDay, "fine-per-day", finePerDay, "fine in cents for each day a book is returned late")
+	flag.StringVar(&assetKindsSpec, "asset-kinds", assetKindsSpec, "kinds of item lent besides books, as comma-separated name:loan-days:max-renewals:fine-per-day")
+	flag.StringVar(&loanRulesFile, "loan-rules", loanRulesFile, "YAML file of lending rules checked when a checkout is accepted, reloaded on SIGHUP (empty disables them)")
+	flag.DurationVar(&idempotencyTTL, "idempotency-ttl", idempotencyTTL, "how long responses are replayed for a repeated Idempotency-Key")
+	flag.DurationVar(&overdueScanInterval, "overdue-scan-interval", overdueScanInterval, "how often to rebuild the overdue report in the background (0 builds it per request)")
+	flag.DurationVar(&blockInterval, "block-interval", blockInterval, "how often pending transactions are packaged into a block")
+	flag.IntVar(&checkpointInterval, "checkpoint-interval", checkpointInterval, "sign a checkpoint every N blocks (0 disables)")
+	flag.StringVar(&checkpointFile, "checkpoint-file", checkpointFile, "file holding the checkpoint history")
+	flag.StringVar(&anchorMethod, "anchor", anchorMethod, "publish the tip hash externally: ethereum or rfc3161 (empty disables it)")
+	flag.StringVar(&anchorURL, "anchor-url", anchorURL, "Ethereum JSON-RPC endpoint or RFC 3161 time-stamp service URL")
+	flag.StringVar(&anchorFrom, "anchor-from", anchorFrom, "unlocked Ethereum account that sends anchor transactions")
+	flag.DurationVar(&anchorInterval, "anchor-interval", anchorInterval, "how often the tip hash is anchored")
+	flag.StringVar(&publishURL, "publish", publishURL, "publish blocks and domain events to kafka://brokers/topic or nats://servers/subject (empty disables it)")
+	flag.BoolVar(&authEnabled, "auth", authEnabled, "require a bearer token from /auth/login on routes that change the chain")
+	flag.StringVar(&authKeyFile, "auth-key", authKeyFile, "file holding the token signing key, created on first run")
+	flag.StringVar(&authKeySource, "auth-key-source", authKeySource, "read the token signing key from a secret source, as for -node-key-source, instead of -auth-key")
+	flag.StringVar(&apiKeyFile, "api-key-file", apiKeyFile, "file holding hashed API keys")
+	flag.StringVar(&hmacClientsFile, "hmac-clients", hmacClientsFile, "JSON file of clients allowed to sign requests with X-Signature (empty disables it)")
+	flag.StringVar(&hmacClientsSource, "hmac-clients-source", hmacClientsSource, "read the HMAC client list from a secret source, as for -node-key-source, instead of -hmac-clients")
+	flag.DurationVar(&secretRefresh, "secret-refresh", secretRefresh, "how often to reread the token signing key and HMAC clients from their sources (0 reads them once)")
+	flag.StringVar(&fakeClockStart, "fake-clock", fakeClockStart, "run on a simulated clock frozen at this RFC 3339 time, moved with POST /admin/clock (for dry runs)")
+	flag.DurationVar(&maxClockSkew, "max-clock-skew", maxClockSkew, "how far ahead of this node's clock a peer's block or a client's date may be")
+	flag.DurationVar(&hmacWindow, "hmac-window", hmacWindow, "how far X-Timestamp may be from now on signed requests")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", oidcIssuer, "OpenID Connect issuer URL staff may log in with, e.g. https://keycloak.example.org/realms/library (empty disables it)")
+	flag.StringVar(&oidcClientID, "oidc-client-id", oidcClientID, "client ID the node is registered with at the OIDC issuer")
+	flag.StringVar(&oidcClientSecret, "oidc-client-secret", oidcClientSecret, "client secret for the OIDC issuer (empty for a public client)")
+	flag.StringVar(&oidcRedirectURL, "oidc-redirect-url", oidcRedirectURL, "URL of /api/v1/auth/oidc/callback as the issuer knows it (default from the request's host)")
+	flag.StringVar(&oidcGroupsClaim, "oidc-groups-claim", oidcGroupsClaim, "claim in the issuer's tokens holding the user's groups")
+	flag.StringVar(&oidcUsernameClaim, "oidc-username-claim", oidcUsernameClaim, "claim in the issuer's tokens naming the user")
+	flag.StringVar(&oidcRoles, "oidc-roles", oidcRoles, "comma-separated group=role pairs giving OIDC users their role, e.g. library-staff=librarian")
+	flag.StringVar(&oidcDefaultRole, "oidc-default-role", oidcDefaultRole, "role of OIDC users in none of the -oidc-roles groups (empty refuses them)")
+	flag.DurationVar(&accessTokenTTL, "access-token-ttl", accessTokenTTL, "lifetime of access tokens")
+	flag.DurationVar(&refreshTokenTTL, "refresh-token-ttl", refreshTokenTTL, "lifetime of refresh tokens")
+	flag.BoolVar(&repairAndExit, "repair", repairAndExit, "cut the stored chain at its first invalid block, write a repair report and exit")
+	flag.BoolVar(&repairRehash, "repair-rehash", repairRehash, "with -repair, rebuild the blocks after the damage instead of dropping them")
+	flag.StringVar(&repairReport, "repair-report", repairReport, "file for the -repair report (default repair-<time>.json in the data directory)")
+	flag.StringVar(&legacyAPISunset, "legacy-api-sunset", legacyAPISunset, "date (YYYY-MM-DD) sent in the Sunset header of the deprecated unversioned routes; empty leaves it out")
+	flag.Int64Var(&maxBodySize, "max-body-size", maxBodySize, "largest request body in bytes; restoring a backup and receiving a peer's block allow more")
+	flag.IntVar(&clientPoWBits, "client-pow-bits", clientPoWBits, "leading zero bits of the proof of work clients other than staff must attach to transactions (0 asks for none)")
+	flag.IntVar(&verifyWorkers, "verify-workers", verifyWorkers, "goroutines checking blocks when the chain is verified (0 for one per CPU)")
+	flag.Int64Var(&maxBlockSize, "max-block-size", maxBlockSize, "largest block in bytes, as JSON, this node produces or accepts from peers")
+	flag.IntVar(&maxBlockTxs, "max-block-txs", maxBlockTxs, "most transactions in a block this node produces or accepts from peers")
+	flag.IntVar(&maxJSONDepth, "max-json-depth", maxJSONDepth, "deepest nesting of objects and arrays allowed in a JSON request body")
+	flag.BoolVar(&validateResponses, "openapi-validate-responses", validateResponses, "log responses that do not match the OpenAPI spec")
+	flag.BoolVar(&migrateAndExit, "migrate", migrateAndExit, "upgrade the stored chain to the latest block version and exit")
+	if err := rootCommand().Execute(); err != nil && !errors.Is(err, flag.ErrHelp) {
+		log.Fatal(err)
+	}
+}
+
+// apiV1Routes registers version 1 of the API on r: the library routes for
+// the node's own library, for the tenant a token is bound to, and under
+// /tenants/{tenant} for any branch, then the routes that run the node.
+func apiV1Routes(r *mux.Router) {
+	r.HandleFunc("/tenants", requireRole(listTenants, RoleLibrarian, RoleAuditor)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/tenants", requireRole(createTenant, RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/tenants/{tenant}", requireRole(getTenant, RoleLibrarian, RoleAuditor)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/tenants/{tenant}", requireRole(deleteTenant, RoleLibrarian)).Methods("DELETE", "OPTIONS")
+	branch := r.PathPrefix("/tenants/{tenant}").Subrouter()
+	branch.Use(withTenant)
+	libraryRoutes(branch)
+	library := r.NewRoute().Subrouter()
+	library.Use(withTenant)
+	libraryRoutes(library)
+	r.HandleFunc("/auth/login", login).Methods("POST", "OPTIONS")
+	r.HandleFunc("/auth/refresh", refreshToken).Methods("POST", "OPTIONS")
+	r.HandleFunc("/auth/oidc", oidcInfo).Methods("GET", "OPTIONS")
+	r.HandleFunc("/auth/oidc/login", oidcLoginStart).Methods("GET")
+	r.HandleFunc("/auth/oidc/callback", oidcCallback).Methods("GET")
+	r.HandleFunc("/ws", streamWS).Methods("GET")
+	r.HandleFunc("/events", streamEvents).Methods("GET")
+	r.HandleFunc("/graphql", staffWhenSealed(graphqlHandler().ServeHTTP)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/checkpoints", getCheckpoints).Methods("GET", "OPTIONS")
+	r.HandleFunc("/anchors", getAnchors).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/integrity", requireRole(getIntegrity, RoleLibrarian, RoleAuditor)).Methods("GET", "POST", "OPTIONS")
+	r.HandleFunc("/admin/integrity/progress", requireRole(getIntegrityProgress, RoleLibrarian, RoleAuditor)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/repair", requireRole(adminRepair, RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/snapshot", requireRole(adminSnapshot, RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/compact", requireRole(adminCompact, RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/backup", requireRole(adminBackup, RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/restore", requireRole(adminRestore, RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/clock", requireRole(getClock, RoleLibrarian, RoleAuditor)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/clock", requireRole(setClock, RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/loan-rules", requireRole(getLoanRules, RoleLibrarian, RoleAuditor)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/loan-rules", requireRole(adminReloadLoanRules, RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/redact", requireRole(adminRedact, RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/transfers/finish", requireRole(forwardToLeader(adminFinishTransfers), RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/reindex", requireRole(adminReindex, RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/payloads/{hash}", requireRole(getPayload, RoleLibrarian, RoleAuditor)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/audit", requireRole(getAuditLog, RoleLibrarian, RoleAuditor)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/pseudonyms", requireSelf(registerPseudonym)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/pseudonyms/{pseudonym}", requireRole(resolvePseudonym, RoleLibrarian, RoleAuditor)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/apikeys", requireRole(listAPIKeys, RoleLibrarian)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/apikeys", requireRole(createAPIKey, RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/apikeys/{id}/rotate", requireRole(rotateAPIKey, RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/apikeys/{id}", requireRole(revokeAPIKey, RoleLibrarian)).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/wallet", listWallets).Methods("GET", "OPTIONS")
+	r.HandleFunc("/wallet", requireRoleUnlessNoWallets(createWallet, RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/wallet/{name}", getWallet).Methods("GET", "OPTIONS")
+	r.HandleFunc("/wallet/{name}/export", exportWallet).Methods("POST", "OPTIONS")
+	r.HandleFunc("/peers", listPeers).Methods("GET", "OPTIONS")
+	r.HandleFunc("/peers", requirePeerCert(requireChainID(registerPeer))).Methods("POST", "OPTIONS")
+	r.HandleFunc("/peers/blocks", requirePeerCert(requireChainID(receiveBlock))).Methods("POST", "OPTIONS")
+	r.HandleFunc("/raft", raftStatus).Methods("GET", "OPTIONS")
+	r.HandleFunc("/raft/join", requirePeerAuth(requireChainID(raftJoinHandler))).Methods("POST", "OPTIONS")
+}
+
+// libraryRoutes registers the routes that serve one library's chain,
+// catalog and state, which handlers find with tenantOf.
+func libraryRoutes(r *mux.Router) {
+	r.HandleFunc("/", compressed(getBlockChain)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/", requireSelf(requirePoW(forwardToLeader(idempotent(writeBlock))))).Methods("POST", "OPTIONS")
+	r.HandleFunc("/new", requireRole(forwardToLeader(idempotent(newBook)), RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/books", listBooks).Methods("GET", "OPTIONS")
+	r.HandleFunc("/asset-kinds", getAssetKinds).Methods("GET", "OPTIONS")
+	r.HandleFunc("/search", search).Methods("GET", "OPTIONS")
+	r.HandleFunc("/books/{id}", getBook).Methods("GET", "OPTIONS")
+	r.HandleFunc("/books/{id}", requireRole(updateBook, RoleLibrarian)).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/books/{id}", requireRole(deleteBook, RoleLibrarian)).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/books/{id}/history", staffWhenSealed(getBookHistory)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/books/{id}/status", staffWhenSealed(getBookStatus)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/books/{id}/location", getBookLocation).Methods("GET", "OPTIONS")
+	r.HandleFunc("/books/{id}/transfer", requireRole(forwardToLeader(transferBook), RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/books/{id}/holds", staffWhenSealed(getHolds)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/books/{id}/holds", requireSelf(requirePoW(forwardToLeader(placeHold)))).Methods("POST", "OPTIONS")
+	r.HandleFunc("/books/{id}/holds", requireSelf(requirePoW(forwardToLeader(cancelHold)))).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/books/{id}/renew", requireSelf(requirePoW(forwardToLeader(renewLoan)))).Methods("POST", "OPTIONS")
+	r.HandleFunc("/members", requireRole(listMembers, RoleLibrarian, RoleAuditor)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/members", requireRole(registerMember, RoleLibrarian)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/members/{id}", requireRole(getMember, RoleLibrarian, RoleAuditor)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/members/{id}", requireRole(updateMember, RoleLibrarian)).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/users/{user}/checkouts", staffWhenSealed(getUserCheckouts)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/users/{user}/fines", staffWhenSealed(getUserFines)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/stats", requireRole(getStats, RoleLibrarian, RoleAuditor)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/reports/overdue", requireRole(compressed(getOverdueReport), RoleLibrarian, RoleAuditor)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/state", staffWhenSealed(compressed(chainConditional(getState)))).Methods("GET", "OPTIONS")
+	r.HandleFunc("/chain", getChainInfo).Methods("GET", "OPTIONS")
+	r.HandleFunc("/validate", requireRole(validateChain, RoleLibrarian, RoleAuditor)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/blocks", compressed(chainConditional(getBlocks))).Methods("GET", "OPTIONS")
+	r.HandleFunc("/blocks/height/{n}", chainConditional(getBlockByHeight)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/blocks/height/{n}/decrypted", requireRole(getDecryptedBlockByHeight, RoleLibrarian, RoleAuditor)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/blocks/{hash}", chainConditional(getBlockByHash)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/blocks/{hash}/decrypted", requireRole(getDecryptedBlockByHash, RoleLibrarian, RoleAuditor)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/proofs/verify", verifyProof).Methods("POST", "OPTIONS")
+	r.HandleFunc("/proofs/{txid}", getProof).Methods("GET", "OPTIONS")
+	r.HandleFunc("/tx", getPendingTx).Methods("GET", "OPTIONS")
+	r.HandleFunc("/tx", requireSelf(requirePoW(forwardToLeader(submitTx)))).Methods("POST", "OPTIONS")
+}
+
+// runNode runs the node and its HTTP API until it is stopped: the serve
+// command, and what chain does without a command.
+func runNode(args []string) error {
+	if err := prepare(commandFlags("serve"), args); err != nil {
+		return err
+	}
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Error setting up tracing: %v", err)
+	}
+	onShutdown(shutdownTracing)
+	if err := setupPeerTLS(); err != nil {
+		log.Fatalf("Error configuring peer TLS: %v", err)
+	}
+	if err := checkCORS(); err != nil {
+		log.Fatalf("Error configuring CORS: %v", err)
+	}
+	warnUnauthenticated()
+
+	if NodeKey, err = loadNodeKey(); err != nil {
+		log.Fatalf("Error loading node key: %v", err)
+	}
+	log.Printf("Node identity %s", nodePublicKey())
+	if Wallets, err = keys.NewKeystore(walletDir); err != nil {
+		log.Fatalf("Error opening wallet directory: %v", err)
+	}
+	if Tokens, err = LoadOrCreateTokenIssuer(authKeySource, authKeyFile); err != nil {
+		log.Fatalf("Error loading auth key: %v", err)
+	}
+	if APIKeys, err = OpenAPIKeys(apiKeyFile); err != nil {
+		log.Fatalf("Error opening API keys: %v", err)
+	}
+	if oidcIssuer != "" {
+		if OIDC, err = NewOIDCProvider(); err != nil {
+			log.Fatalf("Error configuring OIDC: %v", err)
+		}
+	}
+	if hmacClientsFile != "" || hmacClientsSource != "" {
+		if HMACClients, err = LoadHMACClients(hmacClientsSource, hmacClientsFile, hmacWindow); err != nil {
+			log.Fatalf("Error loading HMAC clients: %v", err)
+		}
+	}
+	if secretRefresh > 0 {
+		go refreshSecrets(secretRefresh)
+	}
+	if loanRulesFile != "" {
+		if _, err := reloadLoanRules(); err != nil {
+			log.Fatalf("Error loading loan rules: %v", err)
+		}
+		go watchLoanRules()
+	}
+	if Books, err = OpenCatalog(catalogFile); err != nil {
+		log.Fatalf("Error opening book catalog: %v", err)
+	}
+	if Members, err = OpenMembers(memberFile); err != nil {
+		log.Fatalf("Error opening member registry: %v", err)
+	}
+	if Payloads, err = OpenPayloads(payloadFile); err != nil {
+		log.Fatalf("Error opening payload store: %v", err)
+	}
+	if auditFile != "" {
+		if Audit, err = OpenAuditLog(auditFile); err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+		onShutdown(func(context.Context) error { return Audit.Close() })
+	}
+	if pseudonymize {
+		if Pseudonyms, err = OpenPseudonyms(pseudonymFile, pseudonymKeySource, pseudonymKeyFile); err != nil {
+			log.Fatalf("Error opening pseudonym table: %v", err)
+		}
+	}
+	if Checkpoints, err = OpenCheckpoints(checkpointFile); err != nil {
+		log.Fatalf("Error opening checkpoint history: %v", err)
+	}
+
+	outboxEnabled = publishURL != ""
+	store, err := loadChain(true)
+	if err != nil {
+		return err
+	}
+	if err := Books.Apply(BlockChain.Snapshot()...); err != nil {
+		log.Fatalf("Error updating catalog from chain: %v", err)
+	}
+	if migrateAndExit {
+		if err := migrateChain(BlockChain); err != nil {
+			log.Fatalf("Error migrating chain: %v", err)
+		}
+		return store.Close()
+	}
+	if repairAndExit {
+		report, err := BlockChain.Repair(repairRehash, repairReport)
+		if err != nil {
+			log.Fatalf("Error repairing chain: %v", err)
+		}
+		if report.FirstInvalid == nil {
+			log.Printf("Chain is valid; nothing to repair")
+		}
+		return store.Close()
+	}
+	if Search, err = NewSearchIndex(Books, BlockChain.Snapshot()); err != nil {
+		log.Fatalf("Error building search index: %v", err)
+	}
+	homeTenant = &Tenant{chain: BlockChain, books: Books, members: Members, search: Search, pool: Mempool}
+	// Taking the write lock waits for a block being written and keeps any
+	// later writer from reaching the closed store.
+	onShutdown(func(context.Context) error {
+		BlockChain.writeMu.Lock()
+		BlockChain.saveState()
+		return store.Close()
+	})
+	if publishURL != "" {
+		if err := startPublisher(store); err != nil {
+			log.Fatalf("Error starting event publisher: %v", err)
+		}
+	}
+	onShutdown(startBlockProducer(homeTenant, blockInterval))
+	if Tenants, err = OpenTenants(tenantFile); err != nil {
+		log.Fatalf("Error opening tenants: %v", err)
+	}
+	onShutdown(Tenants.Close)
+	if consensusMode != "raft" {
+		for _, f := range finishTransfers(context.Background()) {
+			if f.Error != "" {
+				log.Printf("Error finishing transfer %s of book %s to %s: %s", f.ID, f.BookId, branchName(f.To), f.Error)
+				continue
+			}
+			log.Printf("Finished transfer %s of book %s to %s", f.ID, f.BookId, branchName(f.To))
+		}
+	}
+	if overdueScanInterval > 0 {
+		go overdueScanLoop(overdueScanInterval)
+	}
+	if anchorMethod != "" {
+		a, err := newAnchorer(anchorMethod, anchorURL, anchorFrom)
+		if err != nil {
+			log.Fatalf("Error configuring anchoring: %v", err)
+		}
+		go anchorLoop(a, anchorInterval)
+	}
+	if c, ok := store.(Compactor); ok && snapshotInterval > 0 {
+		go snapshotLoop(c, snapshotInterval)
+	}
+
+	if err := loadOpenAPI(); err != nil {
+		log.Fatalf("Error loading OpenAPI spec: %v", err)
+	}
 	r := mux.NewRouter()
+	r.Use(otelmux.Middleware("library-chain"))
+	if validateResponses {
+		r.Use(middlewareOpenAPIResponses)
+	}
+	r.Use(middlewareLogging)
+	r.Use(middlewareAudit)
+	r.Use(middlewareBodyLimit)
 	r.Use(middlewareCORS)
+	r.Use(middlewareOpenAPI)
+
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	r.HandleFunc("/healthz", healthz).Methods("GET")
+	r.HandleFunc("/livez", livez).Methods("GET")
+	r.HandleFunc("/readyz", readyz).Methods("GET")
+	r.HandleFunc("/explorer/api/blocks", compressed(getExplorerBlocks)).Methods("GET", "OPTIONS")
+	r.Handle("/explorer", http.RedirectHandler("/explorer/", http.StatusMovedPermanently)).Methods("GET")
+	r.PathPrefix("/explorer/").Handler(explorerHandler()).Methods("GET")
+	r.HandleFunc("/openapi.json", getOpenAPI).Methods("GET", "OPTIONS")
+	r.Handle("/docs", http.RedirectHandler("/docs/", http.StatusMovedPermanently)).Methods("GET")
+	r.PathPrefix("/docs/").Handler(docsHandler()).Methods("GET")
+	if err := mountAPI(r); err != nil {
+		log.Fatalf("Error mounting API routes: %v", err)
+	}
+
+	switch consensusMode {
+	case "pow":
+		go startPeers()
+		if p2pEnabled {
+			if Gossip, err = startGossip(context.Background()); err != nil {
+				log.Fatalf("Error starting libp2p: %v", err)
+			}
+		}
+	case "raft":
+		if Consensus, err = startRaft(BlockChain); err != nil {
+			log.Fatalf("Error starting raft: %v", err)
+		}
+	default:
+		log.Fatalf("unknown consensus mode %q", consensusMode)
+	}
 
-	r.HandleFunc("/", getBlockChain).Methods("GET", "OPTIONS")
-	r.HandleFunc("/", writeBlock).Methods("POST", "OPTIONS")
-	r.HandleFunc("/new", newBook).Methods("POST", "OPTIONS")
+	if grpcAddr != "" {
+		if err := startGRPC(grpcAddr); err != nil {
+			log.Fatalf("Error starting gRPC server: %v", err)
+		}
+	}
 
-	log.Println("Listening on port 3000")
-	log.Fatal(http.ListenAndServe(":3000", r))
+	srv := &http.Server{Addr: listenAddr, Handler: r}
+	srv.RegisterOnShutdown(closeStreams)
+	if err := runServer(srv); err != nil {
+		return err
+	}
+	log.Printf("Shut down cleanly")
+	return nil
 }
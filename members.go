@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"blockchain/apierr"
+)
+
+var memberFile = "members.json"
+
+// Member statuses. A suspended member keeps what they have out but may not
+// borrow, renew or place holds.
+const (
+	MemberActive    = "active"
+	MemberSuspended = "suspended"
+)
+
+const (
+	maxNameLen         = 200
+	maxEmailLen        = 254
+	maxMembershipIDLen = 64
+)
+
+var (
+	ErrMemberNotFound  = errors.New("member not found")
+	ErrMemberExists    = errors.New("member is already registered")
+	ErrUnknownMember   = errors.New("user is not a registered member")
+	ErrMemberSuspended = errors.New("member is suspended")
+)
+
+// Member is a registered library member. Transactions name members by ID,
+// which the registry assigns and which never changes; the membership ID is
+// the number on the member's card.
+type Member struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Email        string `json:"email,omitempty"`
+	MembershipID string `json:"membership_id"`
+	Status       string `json:"status"`
+	Created      string `json:"created"`
+}
+
+// MemberRegistry is a library's members, kept in memory and rewritten
+// atomically to its file on every change, like the catalog. Members are
+// suspended rather than removed because the chain still refers to them.
+type MemberRegistry struct {
+	mu      sync.RWMutex
+	path    string
+	members map[string]Member
+}
+
+var Members *MemberRegistry
+
+func OpenMembers(path string) (*MemberRegistry, error) {
+	reg := &MemberRegistry{path: path, members: map[string]Member{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return reg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var members []Member
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, err
+	}
+	for _, m := range members {
+		reg.members[m.ID] = m
+	}
+	return reg, nil
+}
+
+func (reg *MemberRegistry) saveLocked() error {
+	return writeFileAtomic(reg.path, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(reg.listLocked())
+	})
+}
+
+func (reg *MemberRegistry) listLocked() []Member {
+	out := make([]Member, 0, len(reg.members))
+	for _, m := range reg.members {
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Add registers a member. Without an ID the member gets a new one; an ID may
+// be given to register a user the chain already names.
+func (reg *MemberRegistry) Add(m Member) (Member, error) {
+	if m.ID == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return Member{}, err
+		}
+		m.ID = "m-" + hex.EncodeToString(id)
+	}
+	if m.Status == "" {
+		m.Status = MemberActive
+	}
+	m.Created = clock.Now().UTC().Format(time.RFC3339)
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.members[m.ID]; ok {
+		return Member{}, fmt.Errorf("%w: %s", ErrMemberExists, m.ID)
+	}
+	if err := reg.checkCardLocked(m); err != nil {
+		return Member{}, err
+	}
+	reg.members[m.ID] = m
+	if err := reg.saveLocked(); err != nil {
+		delete(reg.members, m.ID)
+		return Member{}, err
+	}
+	return m, nil
+}
+
+// checkCardLocked refuses a membership ID another member already has.
+func (reg *MemberRegistry) checkCardLocked(m Member) error {
+	for _, other := range reg.members {
+		if other.ID != m.ID && other.MembershipID == m.MembershipID {
+			return fmt.Errorf("%w: membership ID %s belongs to %s", ErrMemberExists, m.MembershipID, other.ID)
+		}
+	}
+	return nil
+}
+
+func (reg *MemberRegistry) Get(id string) (Member, error) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	m, ok := reg.members[id]
+	if !ok {
+		return Member{}, ErrMemberNotFound
+	}
+	return m, nil
+}
+
+// List returns the members, with status only those with that status.
+func (reg *MemberRegistry) List(status string) []Member {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	out := reg.listLocked()
+	if status == "" {
+		return out
+	}
+	kept := out[:0]
+	for _, m := range out {
+		if m.Status == status {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// Update replaces a member's details and status. The ID and registration
+// time never change.
+func (reg *MemberRegistry) Update(id string, m Member) (Member, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	old, ok := reg.members[id]
+	if !ok {
+		return Member{}, ErrMemberNotFound
+	}
+	m.ID = id
+	m.Created = old.Created
+	if m.Status == "" {
+		m.Status = old.Status
+	}
+	if err := reg.checkCardLocked(m); err != nil {
+		return Member{}, err
+	}
+	reg.members[id] = m
+	if err := reg.saveLocked(); err != nil {
+		reg.members[id] = old
+		return Member{}, err
+	}
+	return m, nil
+}
+
+// validate checks a member sent to the registry.
+func (m Member) validate() error {
+	var f apierr.Fields
+	if m.ID != "" && !validMemberID(m.ID) {
+		f.Add("id", "must be at most %d characters with no spaces", maxUserLen)
+	}
+	checkText(&f, "name", m.Name, maxNameLen)
+	checkText(&f, "membership_id", m.MembershipID, maxMembershipIDLen)
+	if m.Email != "" {
+		if a, err := mail.ParseAddress(m.Email); err != nil || a.Address != m.Email || len(m.Email) > maxEmailLen {
+			f.Add("email", "must be an email address")
+		}
+	}
+	switch m.Status {
+	case "", MemberActive, MemberSuspended:
+	default:
+		f.Add("status", "must be %s or %s", MemberActive, MemberSuspended)
+	}
+	return f.Err()
+}
+
+func validMemberID(id string) bool {
+	if len(id) > maxUserLen {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r == '/' || r == 0x7f {
+			return false
+		}
+	}
+	return id != ""
+}
+
+// checkMember refuses a checkout, renewal, hold or donation for anyone but a
+// registered member, and the first three for a suspended one. Returns,
+// cancelled holds and payments may still name users from before the
+// registry, so what they have out can be settled.
+func checkMember(members *MemberRegistry, tx Transaction) error {
+	switch tx.Kind() {
+	case TxCheckout, TxRenew, TxReserve, TxDonation:
+	default:
+		return nil
+	}
+	m, err := members.Get(memberOf(tx.User))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnknownMember, tx.User)
+	}
+	if m.Status == MemberSuspended && tx.Kind() != TxDonation {
+		return fmt.Errorf("%w: %s", ErrMemberSuspended, m.ID)
+	}
+	return nil
+}
+
+func listMembers(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", MemberActive, MemberSuspended:
+	default:
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "status must be %s or %s", MemberActive, MemberSuspended))
+		return
+	}
+	respond(w, r, tenantOf(r).members.List(status))
+}
+
+func getMember(w http.ResponseWriter, r *http.Request) {
+	m, err := tenantOf(r).members.Get(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	respond(w, r, m)
+}
+
+func registerMember(w http.ResponseWriter, r *http.Request) {
+	var m Member
+	if err := decodeJSON(r.Body, &m); err != nil {
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "invalid member data: %w", err))
+		return
+	}
+	if err := m.validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	m, err := tenantOf(r).members.Add(m)
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
+
+func updateMember(w http.ResponseWriter, r *http.Request) {
+	var m Member
+	if err := decodeJSON(r.Body, &m); err != nil {
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "invalid member data: %w", err))
+		return
+	}
+	m.ID = ""
+	if err := m.validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	m, err := tenantOf(r).members.Update(mux.Vars(r)["id"], m)
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
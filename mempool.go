@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"blockchain/apierr"
+)
+
+type TxPool struct {
+	mu      sync.Mutex
+	pending []Transaction
+}
+
+var Mempool = &TxPool{}
+
+var blockInterval = 10 * time.Second
+
+// Add queues a transaction unless one with the same ID is already pending.
+func (p *TxPool) Add(tx Transaction) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.indexOf(tx.ID()) < 0 {
+		p.pending = append(p.pending, tx)
+	}
+	return len(p.pending)
+}
+
+func (p *TxPool) indexOf(id string) int {
+	for i, tx := range p.pending {
+		if tx.ID() == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Has reports whether a transaction with the given ID is pending.
+func (p *TxPool) Has(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.indexOf(id) >= 0
+}
+
+// RemoveIncluded drops pending transactions that a block from another node
+// already contains.
+func (p *TxPool) RemoveIncluded(txs []Transaction) {
+	included := map[string]bool{}
+	for _, tx := range txs {
+		included[tx.ID()] = true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	kept := p.pending[:0]
+	for _, tx := range p.pending {
+		if !included[tx.ID()] {
+			kept = append(kept, tx)
+		}
+	}
+	p.pending = kept
+}
+
+func (p *TxPool) Pending() []Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]Transaction, len(p.pending))
+	copy(out, p.pending)
+	return out
+}
+
+// Take removes and returns the oldest pending transactions that fit in one
+// block: at most maxTxs of them, and no more than maxBytes between them
+// unless the first alone is larger. The rest stay queued for the next block.
+func (p *TxPool) Take(maxTxs int, maxBytes int64) []Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n, size := 0, int64(0)
+	for n < len(p.pending) && n < maxTxs {
+		s := txSize(p.pending[n])
+		if n > 0 && size+s > maxBytes {
+			break
+		}
+		size += s
+		n++
+	}
+	txs := p.pending[:n:n]
+	p.pending = append([]Transaction(nil), p.pending[n:]...)
+	return txs
+}
+
+// startBlockProducer mines t's pool into blocks every interval. The
+// function it returns stops it, mining whatever is still pending so that it
+// goes in before the store is closed.
+func startBlockProducer(t *Tenant, interval time.Duration) func(context.Context) error {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		produceBlocks(t, interval, stop)
+		close(done)
+	}()
+	var once sync.Once
+	return func(ctx context.Context) error {
+		once.Do(func() { close(stop) })
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func produceBlocks(t *Tenant, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			produceBlock(t)
+		case <-stop:
+			produceBlock(t)
+			return
+		}
+	}
+}
+
+// produceBlock mines t's pool into as many blocks as it takes to empty it,
+// each within -max-block-txs and -max-block-size.
+func produceBlock(t *Tenant) {
+	for {
+		taken := t.pool.Take(maxBlockTxs, maxBlockSize-blockOverhead)
+		if len(taken) == 0 {
+			return
+		}
+		txs := dropConflicts(t.chain, taken)
+		if len(txs) == 0 {
+			continue
+		}
+		block, err := t.chain.AddBlock(context.Background(), txs...)
+		if err != nil {
+			log.Printf("Could not produce block: %v", err)
+			return
+		}
+		if t.ID != "" {
+			log.Printf("Produced block %d with %d transactions for tenant %s", block.Pos, len(txs), t.ID)
+			continue
+		}
+		log.Printf("Produced block %d with %d transactions", block.Pos, len(txs))
+	}
+}
+
+// dropConflicts removes transactions that contradict the chain state or an
+// earlier transaction in the batch, such as a second checkout of one book.
+func dropConflicts(bc *Blockchain, txs []Transaction) []Transaction {
+	errs := bc.checkBatch(txs)
+	kept := txs[:0]
+	for i, tx := range txs {
+		if errs[i] != nil {
+			log.Printf("Dropping %s of book %s by %s: %v", tx.Kind(), tx.BookId, tx.User, errs[i])
+			continue
+		}
+		kept = append(kept, tx)
+	}
+	return kept
+}
+
+// queueTx verifies a client transaction and adds it to t's mempool. It
+// returns the number of pending transactions.
+func queueTx(t *Tenant, tx Transaction) (n int, err error) {
+	defer func() {
+		if err != nil {
+			t.noteRejected(tx, err)
+		}
+	}()
+	if err := t.chain.intact(); err != nil {
+		return 0, err
+	}
+	tx.IsGenesis = false
+	tx.Chain = nil
+	if err := tx.validate(); err != nil {
+		return 0, err
+	}
+	if err := tx.checkFields(); err != nil {
+		return 0, err
+	}
+	if err := checkTxSize(tx); err != nil {
+		return 0, err
+	}
+	if err := tx.Verify(); err != nil {
+		return 0, err
+	}
+	if err := checkDuplicate(t, tx); err != nil {
+		return 0, err
+	}
+	if err := checkSubmission(t, tx); err != nil {
+		return 0, err
+	}
+	t.chain.applyPolicy(&tx)
+	n = t.pool.Add(tx)
+	if Gossip != nil && t.ID == "" {
+		Gossip.PublishTx(tx)
+	}
+	return n, nil
+}
+
+func submitTx(w http.ResponseWriter, r *http.Request) {
+	var tx Transaction
+	if err := decodeJSON(r.Body, &tx); err != nil {
+		reqLog(r).Warn("Could not decode transaction", "error", err)
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "invalid payload: %w", err))
+		return
+	}
+	n, err := queueTx(tenantOf(r), tx)
+	if err != nil {
+		writeError(w, r, txError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "transaction queued",
+		"id":      tx.ID(),
+		"pending": n,
+	})
+}
+
+func getPendingTx(w http.ResponseWriter, r *http.Request) {
+	respond(w, r, tenantOf(r).pool.Pending())
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/hex"
+)
+
+func hashPair(left, right []byte) []byte {
+	return chainSum(append(append([]byte{}, left...), right...))
+}
+
+// merkleLevels returns every level of the Merkle tree over txs, leaves first.
+// Odd levels are padded by duplicating their last node.
+func merkleLevels(version int, txs []Transaction) [][][]byte {
+	if len(txs) == 0 {
+		return nil
+	}
+	level := make([][]byte, len(txs))
+	for i, tx := range txs {
+		level[i] = txHash(version, tx)
+	}
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([][]byte, 0, len(level)/2)
+		for i := 0; i < len(level); i += 2 {
+			next = append(next, hashPair(level[i], level[i+1]))
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+func merkleRoot(version int, txs []Transaction) string {
+	levels := merkleLevels(version, txs)
+	if levels == nil {
+		return ""
+	}
+	return hex.EncodeToString(levels[len(levels)-1][0])
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	blocksAdded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "library_blocks_added_total",
+		Help: "Blocks appended to the local chain, whether produced here or received.",
+	})
+	blockCreation = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "library_block_creation_seconds",
+		Help:    "Time for AddBlock to check, mine and store a block.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+	validationFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "library_validation_failures_total",
+		Help: "Blocks that failed validation, from any source.",
+	})
+	storeWrite = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "library_store_write_seconds",
+		Help:    "Time to append a block to the storage backend.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "library_http_request_duration_seconds",
+		Help:    "HTTP request durations by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+	eventsPublished = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "library_events_published_total",
+		Help: "Events from the outbox acknowledged by the -publish broker.",
+	})
+	publishErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "library_event_publish_errors_total",
+		Help: "Failed attempts to publish a batch of outbox events.",
+	})
+	wsClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "library_websocket_clients",
+		Help: "Open /ws connections.",
+	})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "library_chain_height",
+		Help: "Number of blocks in the local chain, including genesis.",
+	}, func() float64 {
+		if BlockChain == nil {
+			return 0
+		}
+		return float64(BlockChain.Height())
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "library_last_block_timestamp_seconds",
+		Help: "Unix time of the tip block, for alerting when the chain stops growing.",
+	}, func() float64 {
+		if BlockChain == nil {
+			return 0
+		}
+		t := BlockChain.Tip().Time()
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.UnixMilli()) / 1000
+	})
+}
+
+// storeAppend appends block to s and records how long it took.
+func storeAppend(ctx context.Context, s Store, block *Block) error {
+	_, span := tracer.Start(ctx, "store.Append", trace.WithAttributes(
+		attribute.String("store", storeKind),
+		attribute.Int("block.pos", block.Pos),
+	))
+	defer span.End()
+	start := time.Now()
+	err := s.Append(block)
+	storeWrite.Observe(time.Since(start).Seconds())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+func observeRequest(route, method string, status int, d time.Duration) {
+	httpDuration.WithLabelValues(route, method, strconv.Itoa(status)).Observe(d.Seconds())
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+var migrateAndExit bool
+
+// migrateBlocks rewrites a chain so every block uses the current version.
+// Blocks are kept as they are up to the first one that is older; from there
+// on each block is re-hashed, re-linked, re-mined and signed by this node,
+// and keeps its original header in Migrated so it stays verifiable. It
+// returns the new chain and the number of rewritten blocks.
+func migrateBlocks(blocks []*Block) ([]*Block, int) {
+	out := make([]*Block, len(blocks))
+	var prev *Block
+	rewritten := 0
+	for i, b := range blocks {
+		if rewritten == 0 && b.Version == currentBlockVersion {
+			out[i], prev = b, b
+			continue
+		}
+		nb := *b
+		if nb.Migrated == nil {
+			nb.Migrated = originOf(b)
+		}
+		nb.Version = currentBlockVersion
+		if nb.UnixMilli == 0 {
+			nb.UnixMilli = b.Time().UnixMilli()
+		}
+		nb.Prevhash = ""
+		if prev != nil {
+			nb.Prevhash = prev.Hash
+		}
+		nb.MerkleRoot = merkleRoot(nb.Version, nb.Transactions)
+		nb.Producer = nodePublicKey()
+		nb.mineBlock()
+		nb.sign(NodeKey)
+		out[i], prev = &nb, &nb
+		rewritten++
+	}
+	return out, rewritten
+}
+
+// migrateChain upgrades the stored chain to the current block version. The
+// chain as it was is written to a backup archive first.
+func migrateChain(bc *Blockchain) error {
+	blocks := bc.Snapshot()
+	migrated, n := migrateBlocks(blocks)
+	if n == 0 {
+		log.Printf("Chain is already at block version %d", currentBlockVersion)
+		return nil
+	}
+	tip := blocks[len(blocks)-1]
+	backup := fmt.Sprintf("chain-backup-%d-v%d.tar.gz", tip.Pos, tip.Version)
+	f, err := os.Create(backup)
+	if err != nil {
+		return err
+	}
+	err = writeBackup(f, blocks)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", backup, err)
+	}
+	if err := bc.Replace(migrated); err != nil {
+		return err
+	}
+	log.Printf("Migrated %d blocks to version %d; the previous chain is in %s", n, currentBlockVersion, backup)
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+	"google.golang.org/protobuf/proto"
+
+	"blockchain/apierr"
+	"blockchain/chainpb"
+)
+
+// Media types GET endpoints answer with. JSON is the default; machine
+// consumers can ask for MessagePack, for protobuf where the response has a
+// form in chainpb, or for the chain as newline-delimited JSON.
+const (
+	mediaJSON     = "application/json"
+	mediaMsgPack  = "application/msgpack"
+	mediaProtobuf = "application/x-protobuf"
+	mediaNDJSON   = "application/x-ndjson"
+)
+
+// mediaAliases are other names clients use for the binary formats.
+var mediaAliases = map[string]string{
+	"application/x-msgpack":   mediaMsgPack,
+	"application/vnd.msgpack": mediaMsgPack,
+	"application/protobuf":    mediaProtobuf,
+	"application/ndjson":      mediaNDJSON,
+	"application/jsonl":       mediaNDJSON,
+}
+
+// msgpackHandle encodes structs by their json tags, so MessagePack responses
+// have the same keys as JSON ones, and uses the current MessagePack spec.
+var msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+
+// respond sends v with the status 200 in the format the request's Accept
+// header asks for.
+func respond(w http.ResponseWriter, r *http.Request, v any) {
+	mt, err := responseType(r, v)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := writeResponse(w, mt, v); err != nil {
+		writeError(w, r, err)
+	}
+}
+
+// responseType picks the media type to send v in. Accept's q-values decide,
+// and JSON wins ties. A request that accepts none of the types gets JSON,
+// unless it asked for protobuf and v has no protobuf form.
+func responseType(r *http.Request, v any) (string, error) {
+	accept := r.Header.Get("Accept")
+	offers := responseOffers(v)
+	best, bestQ := mediaJSON, 0.0
+	for _, offer := range offers {
+		if q := acceptQ(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	if bestQ == 0 && !hasProtoForm(v) && acceptQ(accept, mediaProtobuf) > 0 {
+		return "", apierr.New(apierr.NotAcceptable, "this response has no protobuf form").
+			WithDetails(map[string][]string{"available": offers})
+	}
+	return best, nil
+}
+
+// responseOffers lists the media types v can be sent in, the default first.
+// Only a page of the chain is streamed as NDJSON.
+func responseOffers(v any) []string {
+	offers := []string{mediaJSON, mediaMsgPack}
+	if hasProtoForm(v) {
+		offers = append(offers, mediaProtobuf)
+	}
+	if _, ok := v.(BlockPage); ok {
+		offers = append(offers, mediaNDJSON)
+	}
+	return offers
+}
+
+// acceptQ is the quality the Accept header gives mt, taken from the most
+// specific media range that matches it. An empty header accepts anything.
+// Vendor types such as application/vnd.library-chain.v1+json count as JSON.
+func acceptQ(accept, mt string) float64 {
+	if strings.TrimSpace(accept) == "" {
+		return 1
+	}
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		rng, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if alias, ok := mediaAliases[rng]; ok {
+			rng = alias
+		}
+		if strings.HasSuffix(rng, "+json") {
+			rng = mediaJSON
+		}
+		var s int
+		switch {
+		case rng == mt:
+			s = 2
+		case rng == "*/*":
+			s = 0
+		case strings.HasSuffix(rng, "/*") && strings.HasPrefix(mt, strings.TrimSuffix(rng, "*")):
+			s = 1
+		default:
+			continue
+		}
+		rq := 1.0
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				rq = f
+			}
+		}
+		if s > specificity || (s == specificity && rq > q) {
+			q, specificity = rq, s
+		}
+	}
+	return q
+}
+
+// writeResponse sends v as mt with the status 200. It encodes before
+// writing, so an error leaves the response untouched.
+func writeResponse(w http.ResponseWriter, mt string, v any) error {
+	var data []byte
+	switch mt {
+	case mediaNDJSON:
+		return streamNDJSON(w, v.(BlockPage).Blocks)
+	case mediaMsgPack:
+		if err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(v); err != nil {
+			return apierr.Wrap(apierr.Internal, err)
+		}
+	case mediaProtobuf:
+		var err error
+		if data, err = proto.Marshal(protoForm(v)); err != nil {
+			return apierr.Wrap(apierr.Internal, err)
+		}
+	default:
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(v); err != nil {
+			return apierr.Wrap(apierr.Internal, err)
+		}
+		data = buf.Bytes()
+	}
+	w.Header().Set("Content-Type", mt)
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+	return nil
+}
+
+// hasProtoForm reports whether protoForm can convert v.
+func hasProtoForm(v any) bool {
+	switch v.(type) {
+	case *Block, []*Block, BlockPage:
+		return true
+	}
+	return false
+}
+
+// protoForm converts the responses that have a message in chainpb.
+func protoForm(v any) proto.Message {
+	switch v := v.(type) {
+	case *Block:
+		return blockToProto(v)
+	case []*Block:
+		return &chainpb.BlockList{Blocks: blocksToProto(v)}
+	case BlockPage:
+		return &chainpb.BlockPage{Blocks: blocksToProto(v.Blocks), Total: int64(v.Total), Offset: int64(v.Offset), Limit: int64(v.Limit)}
+	}
+	return nil
+}
+
+func blocksToProto(blocks []*Block) []*chainpb.Block {
+	out := make([]*chainpb.Block, len(blocks))
+	for i, b := range blocks {
+		out[i] = blockToProto(b)
+	}
+	return out
+}
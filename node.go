@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+)
+
+var (
+	NodeKey     ed25519.PrivateKey
+	nodeKeyFile = "node.key"
+)
+
+func nodePublicKey() string {
+	return hex.EncodeToString(NodeKey.Public().(ed25519.PublicKey))
+}
+
+// sign signs the mined block hash. The producer key is part of the hash, so
+// Producer must be set before mining.
+func (b *Block) sign(priv ed25519.PrivateKey) {
+	hash, _ := hex.DecodeString(b.Hash)
+	b.Signature = hex.EncodeToString(ed25519.Sign(priv, hash))
+}
+
+func (b *Block) verifySignature() error {
+	if b.Producer == "" || b.Signature == "" {
+		return errors.New("block is not signed")
+	}
+	pub, err := hex.DecodeString(b.Producer)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("invalid producer public key")
+	}
+	hash, err := hex.DecodeString(b.Hash)
+	if err != nil {
+		return errors.New("invalid block hash")
+	}
+	sig, err := hex.DecodeString(b.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(pub), hash, sig) {
+		return errors.New("invalid block signature")
+	}
+	return nil
+}
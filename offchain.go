@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"blockchain/apierr"
+)
+
+var (
+	offchainPayloads bool
+	payloadFile      = "payloads.json"
+)
+
+// redactedPrefix starts the user that stands in for one whose payload was
+// erased, followed by the start of the payload hash.
+const redactedPrefix = "redacted:"
+
+var (
+	ErrRedacted        = errors.New("transaction's personal data was redacted")
+	ErrPayloadMismatch = errors.New("stored payload does not match its hash")
+	ErrPayloadHash     = errors.New("payload_hash is set only by the node")
+	ErrMemberActive    = errors.New("member still has loans, holds or fines")
+)
+
+// Payload is the personal part of a transaction, which under
+// -offchain-payloads is kept out of the block: the user, and the key and
+// signature that would let anyone holding the rest of the transaction test
+// guesses at the user. The block carries only the payload's hash. The salt
+// makes the hash useless for guessing too, and once the payload is erased
+// nothing on the chain leads back to the user.
+type Payload struct {
+	Salt      string `json:"salt"`
+	User      string `json:"user"`
+	PublicKey string `json:"public_key"`
+	Signature string `json:"signature"`
+}
+
+// hash is the payload hash the block carries, over the payload's canonical
+// encoding.
+func (p Payload) hash() string {
+	e := &canonicalEncoder{}
+	e.buf.WriteString("library-chain/payload/1")
+	for i, s := range []string{p.Salt, p.User, p.PublicKey, p.Signature} {
+		e.field(byte(i + 1))
+		e.string(s)
+	}
+	sum := sha256.Sum256(e.buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// PayloadStore holds the payloads of detached transactions by hash, in
+// memory and rewritten atomically to its file, readable only by the node's
+// user, on every change. Unlike the blocks, it may be edited: erasing a
+// payload redacts the transaction without touching any block hash.
+type PayloadStore struct {
+	mu       sync.RWMutex
+	path     string
+	payloads map[string]Payload
+}
+
+var Payloads *PayloadStore
+
+func OpenPayloads(path string) (*PayloadStore, error) {
+	ps := &PayloadStore{path: path, payloads: map[string]Payload{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ps, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &ps.payloads); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+func (ps *PayloadStore) saveLocked() error {
+	return writeFileAtomic(ps.path, func(f *os.File) error {
+		if err := f.Chmod(0o600); err != nil {
+			return err
+		}
+		return json.NewEncoder(f).Encode(ps.payloads)
+	})
+}
+
+// Get returns the payload with the given hash, checking it still matches.
+func (ps *PayloadStore) Get(hash string) (Payload, error) {
+	ps.mu.RLock()
+	p, ok := ps.payloads[hash]
+	ps.mu.RUnlock()
+	if !ok {
+		return Payload{}, ErrRedacted
+	}
+	if p.hash() != hash {
+		return Payload{}, fmt.Errorf("%w: %s", ErrPayloadMismatch, hash)
+	}
+	return p, nil
+}
+
+// Redact erases every payload whose user is user, or a pseudonym of user,
+// and returns how many it erased.
+func (ps *PayloadStore) Redact(user string) (int, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	erased := map[string]Payload{}
+	for h, p := range ps.payloads {
+		if p.User == user || memberOf(p.User) == user {
+			erased[h] = p
+			delete(ps.payloads, h)
+		}
+	}
+	if len(erased) == 0 {
+		return 0, nil
+	}
+	if err := ps.saveLocked(); err != nil {
+		for h, p := range erased {
+			ps.payloads[h] = p
+		}
+		return 0, err
+	}
+	return len(erased), nil
+}
+
+// detachPayloads moves the personal part of each transaction naming a user
+// into the store, returning the transactions as the block will hold them.
+// The store is written before the block, so a block never refers to a
+// payload that was not kept.
+func detachPayloads(txs []Transaction) ([]Transaction, error) {
+	out := make([]Transaction, len(txs))
+	added := map[string]Payload{}
+	for i, tx := range txs {
+		if tx.IsGenesis || tx.User == "" {
+			out[i] = tx
+			continue
+		}
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		p := Payload{Salt: hex.EncodeToString(salt), User: tx.User, PublicKey: tx.PublicKey, Signature: tx.Signature}
+		h := p.hash()
+		added[h] = p
+		tx.User, tx.PublicKey, tx.Signature = "", "", ""
+		tx.PayloadHash = h
+		out[i] = tx
+	}
+	if len(added) == 0 {
+		return out, nil
+	}
+	Payloads.mu.Lock()
+	defer Payloads.mu.Unlock()
+	for h, p := range added {
+		Payloads.payloads[h] = p
+	}
+	if err := Payloads.saveLocked(); err != nil {
+		for h := range added {
+			delete(Payloads.payloads, h)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// attach returns a transaction as its member signed it: a detached one with
+// its payload put back, and an encrypted user decrypted. It returns
+// ErrRedacted when the node does not hold the payload, because it was erased
+// or because another node produced the block, and ErrSealedField when it
+// does not hold the key the user was encrypted with.
+func (tx Transaction) attach() (Transaction, error) {
+	if tx.PayloadHash != "" {
+		if Payloads == nil {
+			return tx, ErrRedacted
+		}
+		p, err := Payloads.Get(tx.PayloadHash)
+		if err != nil {
+			return tx, err
+		}
+		tx.User, tx.PublicKey, tx.Signature = p.User, p.PublicKey, p.Signature
+	}
+	user, err := openField(tx.User)
+	if err != nil {
+		return tx, err
+	}
+	tx.User = user
+	return tx, nil
+}
+
+// attached is tx as its member signed it or, where the payload is not held,
+// with a user standing in for the one that was redacted. A user the node
+// cannot decrypt is left encrypted.
+func (tx Transaction) attached() Transaction {
+	full, err := tx.attach()
+	if err != nil && tx.PayloadHash != "" {
+		full.User = redactedPrefix + tx.PayloadHash[:min(16, len(tx.PayloadHash))]
+	}
+	return full
+}
+
+// verifyOnChain checks the signature of a transaction in a block. A detached
+// or encrypted transaction is checked as its member signed it; one whose
+// payload or key the node does not hold is vouched for by the block hash,
+// which covers its payload hash or encrypted user.
+func (tx Transaction) verifyOnChain() error {
+	full, err := tx.attach()
+	if errors.Is(err, ErrRedacted) || errors.Is(err, ErrSealedField) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	full.PayloadHash = ""
+	return full.Verify()
+}
+
+// involves reports whether user, or the member a pseudonym stands for, has
+// a loan, a hold or an unpaid fine.
+func (s *LibraryState) involves(user string) bool {
+	is := func(u string) bool { return u == user || memberOf(u) == user }
+	for _, loan := range s.loans {
+		if is(loan.User) {
+			return true
+		}
+	}
+	for _, queue := range s.holds {
+		for _, h := range queue {
+			if is(h.User) {
+				return true
+			}
+		}
+	}
+	for u, owed := range s.fines {
+		if owed > 0 && is(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// Involves reports whether user has anything outstanding on the chain.
+func (bc *Blockchain) Involves(user string) bool {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.state.involves(user)
+}
+
+// reindex rebuilds the indexes and state from the blocks, after payloads
+// they refer to were erased or on POST /admin/reindex.
+func (bc *Blockchain) reindex() {
+	bc.mu.Lock()
+	bc.resetIndexes()
+	for _, b := range bc.Blocks {
+		bc.indexBlock(b)
+	}
+	bc.mu.Unlock()
+	bc.saveState()
+}
+
+// allTenants is the node's own library and every branch.
+func allTenants() []*Tenant {
+	out := []*Tenant{homeTenant}
+	if Tenants != nil {
+		out = append(out, Tenants.List()...)
+	}
+	return out
+}
+
+// Redaction answers POST /admin/redact.
+type Redaction struct {
+	User     string `json:"user"`
+	Redacted int    `json:"redacted"`
+}
+
+// adminRedact erases a member's payloads on request, for every chain of the
+// node. Members with anything outstanding are refused, since the state must
+// still know who has what.
+func adminRedact(w http.ResponseWriter, r *http.Request) {
+	var req Redaction
+	if err := decodeJSON(r.Body, &req); err != nil || req.User == "" {
+		writeError(w, r, apierr.New(apierr.InvalidRequest, "invalid redaction request"))
+		return
+	}
+	for _, t := range allTenants() {
+		if t.chain.Involves(req.User) {
+			writeError(w, r, apiError(fmt.Errorf("%w: %s", ErrMemberActive, req.User), apierr.Internal))
+			return
+		}
+	}
+	n, err := Payloads.Redact(req.User)
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.Internal, err))
+		return
+	}
+	if n > 0 {
+		for _, t := range allTenants() {
+			t.chain.reindex()
+			if t.search == nil {
+				continue
+			}
+			if err := t.search.Rebuild(t.books, t.chain.Snapshot()); err != nil {
+				reqLog(r).Error("Error rebuilding search index", "tenant", t.ID, "error", err)
+			}
+		}
+	}
+	reqLog(r).Info("Redacted personal data", "payloads", n)
+	respond(w, r, Redaction{User: req.User, Redacted: n})
+}
+
+// getPayload answers GET /admin/payloads/{hash} for staff.
+func getPayload(w http.ResponseWriter, r *http.Request) {
+	p, err := Payloads.Get(mux.Vars(r)["hash"])
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	respond(w, r, p)
+}
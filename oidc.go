@@ -0,0 +1,531 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"blockchain/apierr"
+)
+
+var (
+	oidcIssuer        string
+	oidcClientID      string
+	oidcClientSecret  string
+	oidcRedirectURL   string
+	oidcGroupsClaim   = "groups"
+	oidcUsernameClaim = "preferred_username"
+	oidcRoles         string
+	oidcDefaultRole   string
+	oidcLoginTTL      = 10 * time.Minute
+	oidcClient        = &http.Client{Timeout: 10 * time.Second}
+)
+
+// oidcStateCookie binds a login to the browser that started it.
+const oidcStateCookie = "oidc_state"
+
+var (
+	ErrOIDCUnavailable = errors.New("identity provider is unavailable")
+	ErrNoMappedGroup   = errors.New("none of the user's groups has a role")
+)
+
+// oidcAlgorithms are the signing algorithms accepted on tokens from the
+// identity provider. HMAC ones are not, since the provider's keys are public.
+var oidcAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// rolePriority ranks roles for users whose groups map to several: the most
+// powerful wins.
+var rolePriority = []string{RoleLibrarian, RoleAuditor, RoleMember}
+
+// OIDCProvider lets staff log in with an external identity provider such as
+// Keycloak or Google Workspace. The explorer logs in with the authorization
+// code flow and gets the node's own tokens, and clients may instead send a
+// token from the provider itself as the bearer token. Either way the user's
+// groups decide their role.
+type OIDCProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	groupsClaim  string
+	userClaim    string
+	roles        map[string]string
+	defaultRole  string
+
+	mu        sync.Mutex
+	config    *oidcConfig
+	keys      map[string]crypto.PublicKey
+	keysFetch time.Time
+	logins    map[string]oidcLogin
+}
+
+var OIDC *OIDCProvider
+
+// oidcConfig is the part of the provider's discovery document the node uses.
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin is a code flow the node started and has not seen come back.
+type oidcLogin struct {
+	verifier string
+	nonce    string
+	returnTo string
+	expires  time.Time
+}
+
+// NewOIDCProvider checks the -oidc flags. The provider itself is not
+// contacted until the first login or token, so the node starts while it is
+// down.
+func NewOIDCProvider() (*OIDCProvider, error) {
+	if oidcClientID == "" {
+		return nil, errors.New("-oidc-issuer needs -oidc-client-id")
+	}
+	if oidcDefaultRole != "" && !validRole(oidcDefaultRole) {
+		return nil, fmt.Errorf("-oidc-default-role: unknown role %q", oidcDefaultRole)
+	}
+	p := &OIDCProvider{
+		issuer:       strings.TrimSuffix(oidcIssuer, "/"),
+		clientID:     oidcClientID,
+		clientSecret: oidcClientSecret,
+		redirectURL:  oidcRedirectURL,
+		groupsClaim:  oidcGroupsClaim,
+		userClaim:    oidcUsernameClaim,
+		roles:        map[string]string{},
+		defaultRole:  normalizeRole(oidcDefaultRole),
+		logins:       map[string]oidcLogin{},
+	}
+	for _, pair := range strings.Split(oidcRoles, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		if !ok || group == "" || !validRole(role) {
+			return nil, fmt.Errorf("-oidc-roles: %q is not group=role with role librarian, member or auditor", pair)
+		}
+		p.roles[group] = normalizeRole(role)
+	}
+	if len(p.roles) == 0 && p.defaultRole == "" {
+		return nil, errors.New("-oidc-issuer needs -oidc-roles or -oidc-default-role, or nobody could log in")
+	}
+	return p, nil
+}
+
+// discover fetches the provider's discovery document once and keeps it.
+func (p *OIDCProvider) discover() (*oidcConfig, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.config != nil {
+		return p.config, nil
+	}
+	var c oidcConfig
+	if err := getJSON(p.issuer+"/.well-known/openid-configuration", &c); err != nil {
+		return nil, fmt.Errorf("%w: discovery: %v", ErrOIDCUnavailable, err)
+	}
+	if strings.TrimSuffix(c.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("%w: discovery names issuer %q", ErrOIDCUnavailable, c.Issuer)
+	}
+	if c.AuthorizationEndpoint == "" || c.TokenEndpoint == "" || c.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: discovery document lacks endpoints", ErrOIDCUnavailable)
+	}
+	p.config = &c
+	return p.config, nil
+}
+
+func getJSON(u string, v any) error {
+	resp, err := oidcClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// key returns the provider's signing key with the given ID. The key set is
+// fetched again for an ID it does not hold, since providers rotate keys, but
+// at most once a minute so forged IDs cannot make the node hammer it.
+func (p *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	c, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.keysFetch) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	p.keysFetch = time.Now()
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(c.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("%w: keys: %v", ErrOIDCUnavailable, err)
+	}
+	p.keys = map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if k, err := jwk.publicKey(); err == nil {
+			p.keys[jwk.Kid] = k
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// jsonWebKey is an RSA or EC public key from the provider's key set.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curve, ok := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		x, err1 := b64(k.X)
+		y, err2 := b64(k.Y)
+		if err1 != nil || err2 != nil || len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC key")
+		}
+		return ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// verify checks a token the provider signed for this client: its signature,
+// issuer, expiry and audience. A token is for the client if its audience
+// names it or, as with Keycloak's access tokens, its authorized party does.
+func (p *OIDCProvider) verify(token string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(kid)
+	}, jwt.WithValidMethods(oidcAlgorithms), jwt.WithIssuer(p.issuer), jwt.WithExpirationRequired(), jwt.WithLeeway(time.Minute))
+	if err != nil {
+		if errors.Is(err, ErrOIDCUnavailable) {
+			return nil, ErrOIDCUnavailable
+		}
+		return nil, ErrInvalidToken
+	}
+	aud, _ := claims.GetAudience()
+	if azp, _ := claims["azp"].(string); !slices.Contains(aud, p.clientID) && azp != p.clientID {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// roleOf maps a user's groups to a role. The groups claim may be a list, as
+// Keycloak sends, or a single string such as Google's hosted domain "hd".
+func (p *OIDCProvider) roleOf(claims jwt.MapClaims) (string, error) {
+	var groups []string
+	switch v := claims[p.groupsClaim].(type) {
+	case string:
+		groups = []string{v}
+	case []any:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	best := -1
+	for _, g := range groups {
+		if i := slices.Index(rolePriority, p.roles[g]); i >= 0 && (best < 0 || i < best) {
+			best = i
+		}
+	}
+	switch {
+	case best >= 0:
+		return rolePriority[best], nil
+	case p.defaultRole != "":
+		return p.defaultRole, nil
+	}
+	return "", ErrNoMappedGroup
+}
+
+// userOf is the name a provider's user acts under: the username claim,
+// falling back to the email address and then the subject, as
+// "oidc:<issuer>#<name>". The prefix keeps the provider's "alice" from
+// acting for the wallet or member "alice" on the chain.
+func (p *OIDCProvider) userOf(claims jwt.MapClaims) string {
+	for _, c := range []string{p.userClaim, "email", "sub"} {
+		if s, _ := claims[c].(string); s != "" {
+			return "oidc:" + p.issuer + "#" + s
+		}
+	}
+	return ""
+}
+
+// Authenticate turns a token from the provider into the node's claims.
+func (p *OIDCProvider) Authenticate(token string) (*Claims, error) {
+	claims, err := p.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	user := p.userOf(claims)
+	role, err := p.roleOf(claims)
+	if err != nil || user == "" {
+		return nil, ErrInvalidToken
+	}
+	return &Claims{Role: role, Kind: tokenAccess, RegisteredClaims: jwt.RegisteredClaims{Subject: user, Issuer: p.issuer}}, nil
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// safeReturn keeps a login's return path on this node, so the login cannot be
+// used to send a user's tokens elsewhere.
+func safeReturn(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.ContainsAny(path, "\\#") {
+		return "/explorer/"
+	}
+	return path
+}
+
+// redirectFor is -oidc-redirect-url or, without it, the callback on the host
+// the request came to.
+func (p *OIDCProvider) redirectFor(r *http.Request) string {
+	if p.redirectURL != "" {
+		return p.redirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/api/v1/auth/oidc/callback"
+}
+
+// OIDCInfo answers GET /auth/oidc, so the explorer knows to offer a login.
+type OIDCInfo struct {
+	Issuer   string `json:"issuer"`
+	LoginURL string `json:"login_url"`
+}
+
+func oidcInfo(w http.ResponseWriter, r *http.Request) {
+	if OIDC == nil {
+		writeError(w, r, apierr.New(apierr.NotFound, "the node has no -oidc-issuer"))
+		return
+	}
+	respond(w, r, OIDCInfo{Issuer: OIDC.issuer, LoginURL: "/api/v1/auth/oidc/login"})
+}
+
+// oidcLoginStart sends the browser to the provider with a fresh state, nonce
+// and PKCE challenge, kept until the provider sends it back.
+func oidcLoginStart(w http.ResponseWriter, r *http.Request) {
+	if OIDC == nil {
+		writeError(w, r, apierr.New(apierr.NotFound, "the node has no -oidc-issuer"))
+		return
+	}
+	c, err := OIDC.discover()
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	var login oidcLogin
+	state, err := randomString(24)
+	if err == nil {
+		login.verifier, err = randomString(32)
+	}
+	if err == nil {
+		login.nonce, err = randomString(24)
+	}
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.Internal, err))
+		return
+	}
+	login.returnTo = safeReturn(r.URL.Query().Get("return_to"))
+	login.expires = time.Now().Add(oidcLoginTTL)
+	OIDC.mu.Lock()
+	for s, l := range OIDC.logins {
+		if time.Now().After(l.expires) {
+			delete(OIDC.logins, s)
+		}
+	}
+	OIDC.logins[state] = login
+	OIDC.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(login.verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {OIDC.clientID},
+		"redirect_uri":          {OIDC.redirectFor(r)},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: oidcStateCookie, Value: state, Path: "/", MaxAge: int(oidcLoginTTL.Seconds()),
+		HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode,
+	})
+	sep := "?"
+	if strings.Contains(c.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, c.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// oidcCallback finishes a login: it exchanges the code for the user's ID
+// token, checks it, and sends the browser back with the node's own tokens in
+// the URL fragment, which never reaches a server.
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if OIDC == nil {
+		writeError(w, r, apierr.New(apierr.NotFound, "the node has no -oidc-issuer"))
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		writeAuthError(w, r, apierr.Errorf(apierr.Unauthenticated, "the identity provider refused the login: %s", e))
+		return
+	}
+	state := q.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if state == "" || err != nil || cookie.Value != state {
+		writeAuthError(w, r, apierr.New(apierr.Unauthenticated, "login state does not match this browser"))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1})
+	OIDC.mu.Lock()
+	login, ok := OIDC.logins[state]
+	delete(OIDC.logins, state)
+	OIDC.mu.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		writeAuthError(w, r, apierr.New(apierr.Unauthenticated, "login expired; start again"))
+		return
+	}
+
+	idToken, err := OIDC.exchange(r, q.Get("code"), login.verifier)
+	if err != nil {
+		writeAuthError(w, r, apiError(err, apierr.Unauthenticated))
+		return
+	}
+	claims, err := OIDC.verify(idToken)
+	if err != nil {
+		writeAuthError(w, r, apiError(err, apierr.Unauthenticated))
+		return
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != login.nonce {
+		writeAuthError(w, r, apierr.New(apierr.Unauthenticated, "ID token nonce does not match the login"))
+		return
+	}
+	user := OIDC.userOf(claims)
+	role, err := OIDC.roleOf(claims)
+	if err != nil {
+		writeAuthError(w, r, apierr.Errorf(apierr.Forbidden, "%s: %v", user, err))
+		return
+	}
+	pair, err := Tokens.Issue(user, role, "")
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.Internal, err))
+		return
+	}
+	reqLog(r).Info("OIDC login", "user", user, "role", role)
+	fragment := url.Values{
+		"access_token":  {pair.AccessToken},
+		"refresh_token": {pair.RefreshToken},
+		"token_type":    {pair.TokenType},
+		"expires_in":    {fmt.Sprint(pair.ExpiresIn)},
+	}
+	http.Redirect(w, r, login.returnTo+"#"+fragment.Encode(), http.StatusFound)
+}
+
+// exchange redeems an authorization code at the token endpoint and returns
+// the ID token.
+func (p *OIDCProvider) exchange(r *http.Request, code, verifier string) (string, error) {
+	if code == "" {
+		return "", apierr.New(apierr.InvalidRequest, "callback has no code")
+	}
+	c, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectFor(r)},
+		"client_id":     {p.clientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, c.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrOIDCUnavailable, err)
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil || resp.StatusCode != http.StatusOK {
+		return "", apierr.Errorf(apierr.Unauthenticated, "the identity provider refused the code: %s", tok.Error)
+	}
+	if tok.IDToken == "" {
+		return "", apierr.New(apierr.Unauthenticated, "the identity provider sent no ID token")
+	}
+	return tok.IDToken, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/swaggest/swgui/v5emb"
+
+	"blockchain/apierr"
+)
+
+// openapiSpec describes the HTTP API. Requests to the routes it covers are
+// validated against it before they reach their handlers.
+//
+//go:embed openapi.yaml
+var openapiSpec []byte
+
+// validateResponses makes the node check its own responses against the spec
+// too, logging any that do not match. It is meant for development and tests.
+var validateResponses bool
+
+var (
+	apiDoc    *openapi3.T
+	apiRouter routers.Router
+	apiJSON   []byte
+)
+
+// unvalidatedResponses are operations whose responses are streams, which
+// cannot be buffered for validation.
+var unvalidatedResponses = map[string]bool{
+	"streamEvents": true,
+	"streamWS":     true,
+}
+
+func init() {
+	openapi3filter.RegisterBodyDecoder("application/gzip", openapi3filter.FileBodyDecoder)
+}
+
+// loadOpenAPI parses and checks the embedded spec.
+func loadOpenAPI() error {
+	doc, err := openapi3.NewLoader().LoadFromData(openapiSpec)
+	if err != nil {
+		return err
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return err
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	apiDoc, apiRouter, apiJSON = doc, router, data
+	return nil
+}
+
+func getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(apiJSON)
+}
+
+// docsHandler serves Swagger UI for the spec at /docs/.
+func docsHandler() http.Handler {
+	return v5emb.New(apiDoc.Info.Title, "/openapi.json", "/docs/")
+}
+
+// middlewareOpenAPI rejects requests that do not match the spec with a 400
+// before they reach a handler. Routes the spec does not cover are passed
+// through. Handlers decode JSON bodies whatever their Content-Type says, so
+// bodies of JSON operations are checked as JSON too.
+func middlewareOpenAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route, params, err := findRoute(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		input := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: params,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				AuthenticationFunc:  openapi3filter.NoopAuthenticationFunc,
+				SkipSettingDefaults: true,
+			},
+		}
+		if body := route.Operation.RequestBody; body != nil && body.Value.Content.Get("application/json") != nil {
+			if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+				input.Request = r.Clone(r.Context())
+				input.Request.Header.Set("Content-Type", "application/json")
+			}
+		} else {
+			input.Options.ExcludeRequestBody = true
+		}
+		err = openapi3filter.ValidateRequest(r.Context(), input)
+		// Validation reads the body and leaves a fresh reader in its place.
+		r.Body = input.Request.Body
+		if err != nil {
+			writeError(w, r, apierr.New(apierr.InvalidRequest, requestDetail(err)))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tenantPath matches the /tenants/{tenant} prefix of a branch's library
+// routes, which the spec describes once, without it.
+var tenantPath = regexp.MustCompile(`^(/api/v[0-9]+)?/tenants/([^/]+)(/.*)$`)
+
+// findRoute looks up the operation r is for, taking a branch's library
+// route as the route it serves. Paths under an unknown tenant are no
+// operation's.
+func findRoute(r *http.Request) (*routers.Route, map[string]string, error) {
+	if m := tenantPath.FindStringSubmatch(r.URL.Path); m != nil {
+		if _, err := Tenants.Get(m[2]); err != nil {
+			return nil, nil, err
+		}
+		r = r.Clone(r.Context())
+		r.URL.Path, r.URL.RawPath = m[1]+m[3], ""
+	}
+	return apiRouter.FindRoute(r)
+}
+
+// middlewareOpenAPIResponses logs responses that do not match the spec. It
+// wraps the logging middleware so it sees responses as clients do.
+func middlewareOpenAPIResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, params, err := findRoute(r)
+		if err != nil || r.Method == http.MethodOptions || unvalidatedResponses[route.Operation.OperationID] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		// A 406 comes from negotiation, not the operation.
+		if rec.status == http.StatusNotAcceptable {
+			return
+		}
+		// The spec describes the JSON form; MessagePack, protobuf and NDJSON
+		// responses carry the same data, and compressed ones cannot be read.
+		if mt, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type")); mt == mediaMsgPack || mt == mediaProtobuf || mt == mediaNDJSON || w.Header().Get("Content-Encoding") != "" {
+			return
+		}
+		err = openapi3filter.ValidateResponse(r.Context(), &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: &openapi3filter.RequestValidationInput{
+				Request:    r,
+				PathParams: params,
+				Route:      route,
+			},
+			Status:  rec.status,
+			Header:  w.Header(),
+			Body:    io.NopCloser(&rec.body),
+			Options: &openapi3filter.Options{IncludeResponseStatus: true},
+		})
+		if err != nil {
+			slog.Warn("Response does not match the OpenAPI spec",
+				"request_id", w.Header().Get(requestIDHeader),
+				"operation", route.Operation.OperationID,
+				"status", rec.status,
+				"err", validationDetail(err),
+			)
+		}
+	})
+}
+
+// validationDetail explains a validation error in one line, without the
+// schema dump kin-openapi appends.
+func validationDetail(err error) string {
+	var se *openapi3.SchemaError
+	if errors.As(err, &se) {
+		ptr := se.JSONPointer()
+		// Report what failed inside an allOf rather than the allOf itself.
+		for inner := se; inner.Origin != nil && errors.As(inner.Origin, &inner); {
+			se = inner
+			if p := se.JSONPointer(); len(p) > 0 {
+				ptr = p
+			}
+		}
+		if len(ptr) > 0 {
+			return strings.Join(ptr, ".") + ": " + se.Reason
+		}
+		return se.Reason
+	}
+	var re *openapi3filter.RequestError
+	if errors.As(err, &re) && re.Err != nil {
+		return re.Err.Error()
+	}
+	return err.Error()
+}
+
+// requestDetail says which part of the request failed validation.
+func requestDetail(err error) string {
+	var re *openapi3filter.RequestError
+	if errors.As(err, &re) {
+		switch {
+		case re.Parameter != nil:
+			return "parameter " + re.Parameter.Name + ": " + validationDetail(err)
+		case re.RequestBody != nil:
+			return "body: " + validationDetail(err)
+		}
+	}
+	return validationDetail(err)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+)
+
+var (
+	p2pEnabled bool
+	p2pListen  = "/ip4/0.0.0.0/tcp/0"
+	p2pPeers   string
+	p2pMDNS    = true
+)
+
+const p2pMDNSTag = "library-chain"
+
+// Gossip is set when the libp2p transport is enabled.
+var Gossip *GossipNode
+
+// GossipNode propagates blocks and pending transactions over gossipsub
+// topics scoped to this chain, and serves block ranges to peers that fall
+// behind over a request/response stream.
+type GossipNode struct {
+	ctx    context.Context
+	host   host.Host
+	blocks *pubsub.Topic
+	txs    *pubsub.Topic
+}
+
+// chainTopic and syncProtocol include the chain ID, so nodes on different
+// chains never exchange gossip or serve each other blocks.
+func chainTopic(kind string) string {
+	return fmt.Sprintf("library-chain/%s/%s", BlockChain.ChainID(), kind)
+}
+
+func syncProtocol() protocol.ID {
+	return protocol.ID(fmt.Sprintf("/library-chain/%s/blocks/%d.0.0", BlockChain.ChainID(), protocolVersion))
+}
+
+func startGossip(ctx context.Context) (*GossipNode, error) {
+	key, err := crypto.UnmarshalEd25519PrivateKey(NodeKey)
+	if err != nil {
+		return nil, err
+	}
+	h, err := libp2p.New(libp2p.ListenAddrStrings(p2pListen), libp2p.Identity(key))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		cancel()
+		h.Close()
+		return nil, err
+	}
+	g := &GossipNode{ctx: ctx, host: h}
+	if g.blocks, err = ps.Join(chainTopic("blocks")); err != nil {
+		cancel()
+		h.Close()
+		return nil, err
+	}
+	if g.txs, err = ps.Join(chainTopic("txs")); err != nil {
+		cancel()
+		h.Close()
+		return nil, err
+	}
+	blockSub, err := g.blocks.Subscribe()
+	if err != nil {
+		cancel()
+		h.Close()
+		return nil, err
+	}
+	txSub, err := g.txs.Subscribe()
+	if err != nil {
+		cancel()
+		h.Close()
+		return nil, err
+	}
+	h.SetStreamHandler(syncProtocol(), g.serveBlocks)
+	go g.readBlocks(blockSub)
+	go g.readTxs(txSub)
+
+	for _, addr := range h.Addrs() {
+		log.Printf("libp2p listening on %s/p2p/%s", addr, h.ID())
+	}
+	for _, raw := range strings.Split(p2pPeers, ",") {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		info, err := peer.AddrInfoFromString(strings.TrimSpace(raw))
+		if err != nil {
+			log.Printf("Skipping libp2p peer %q: %v", raw, err)
+			continue
+		}
+		g.HandlePeerFound(*info)
+	}
+	if p2pMDNS {
+		if err := mdns.NewMdnsService(h, p2pMDNSTag, g).Start(); err != nil {
+			log.Printf("Error starting mDNS discovery: %v", err)
+		}
+	}
+	onShutdown(func(context.Context) error {
+		cancel()
+		return h.Close()
+	})
+	return g, nil
+}
+
+// HandlePeerFound connects to peers discovered via mDNS or configuration.
+func (g *GossipNode) HandlePeerFound(info peer.AddrInfo) {
+	if info.ID == g.host.ID() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(g.ctx, 10*time.Second)
+	defer cancel()
+	if err := g.host.Connect(ctx, info); err != nil {
+		log.Printf("Error connecting to libp2p peer %s: %v", info.ID, err)
+		return
+	}
+	log.Printf("Connected to libp2p peer %s", info.ID)
+	src := p2pPeer{g: g, id: info.ID}
+	if err := BlockChain.adoptChain(src); err != nil {
+		log.Printf("Error fetching chain from %s: %v", src, err)
+	}
+	if _, err := BlockChain.SyncFrom(src); err != nil {
+		log.Printf("Error syncing from %s: %v", src, err)
+	}
+}
+
+func (g *GossipNode) PublishBlock(block *Block) {
+	g.publish(g.blocks, block)
+}
+
+func (g *GossipNode) PublishTx(tx Transaction) {
+	g.publish(g.txs, tx)
+}
+
+func (g *GossipNode) publish(topic *pubsub.Topic, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if err := topic.Publish(g.ctx, data); err != nil {
+		log.Printf("Error publishing to %s: %v", topic.String(), err)
+	}
+}
+
+func (g *GossipNode) readBlocks(sub *pubsub.Subscription) {
+	for {
+		msg, err := sub.Next(g.ctx)
+		if err != nil {
+			return
+		}
+		if msg.ReceivedFrom == g.host.ID() {
+			continue
+		}
+		var block Block
+		if err := json.Unmarshal(msg.Data, &block); err != nil {
+			continue
+		}
+		src := p2pPeer{g: g, id: msg.ReceivedFrom}
+		err = BlockChain.AcceptBlock(g.ctx, &block)
+		switch {
+		case errors.Is(err, ErrBlockOutOfOrder):
+			if _, err := BlockChain.SyncFrom(src); err != nil {
+				log.Printf("Error syncing from %s: %v", src, err)
+			}
+		case errors.Is(err, ErrFork):
+			if err := BlockChain.ResolveFork(src); err != nil {
+				log.Printf("Error resolving fork with %s: %v", src, err)
+			}
+		case err != nil && !errors.Is(err, ErrKnownBlock):
+			log.Printf("Rejected block %d from %s: %v", block.Pos, src, err)
+		}
+	}
+}
+
+func (g *GossipNode) readTxs(sub *pubsub.Subscription) {
+	for {
+		msg, err := sub.Next(g.ctx)
+		if err != nil {
+			return
+		}
+		if msg.ReceivedFrom == g.host.ID() {
+			continue
+		}
+		var tx Transaction
+		if err := json.Unmarshal(msg.Data, &tx); err != nil || tx.IsGenesis {
+			continue
+		}
+		if err := tx.Verify(); err != nil || checkTxSize(tx) != nil {
+			continue
+		}
+		Mempool.Add(tx)
+	}
+}
+
+type blockRangeRequest struct {
+	From int `json:"from"`
+}
+
+func (g *GossipNode) serveBlocks(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(30 * time.Second))
+	var req blockRangeRequest
+	if err := json.NewDecoder(bufio.NewReader(s)).Decode(&req); err != nil {
+		s.Reset()
+		return
+	}
+	blocks := BlockChain.Snapshot()
+	from := min(max(req.From, 0), len(blocks))
+	end := min(from+maxBlocksFetch, len(blocks))
+	json.NewEncoder(s).Encode(blocks[from:end])
+}
+
+// p2pPeer fetches blocks from a libp2p peer over the sync protocol.
+type p2pPeer struct {
+	g  *GossipNode
+	id peer.ID
+}
+
+func (p p2pPeer) String() string {
+	return "libp2p:" + p.id.String()
+}
+
+func (p p2pPeer) FetchBlocks(from int) ([]*Block, error) {
+	ctx, cancel := context.WithTimeout(p.g.ctx, 30*time.Second)
+	defer cancel()
+	s, err := p.g.host.NewStream(ctx, p.id, syncProtocol())
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := json.NewEncoder(s).Encode(blockRangeRequest{From: from}); err != nil {
+		return nil, err
+	}
+	s.CloseWrite()
+	var blocks []*Block
+	if err := json.NewDecoder(s).Decode(&blocks); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
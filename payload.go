@@ -0,0 +1,185 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"blockchain/apierr"
+)
+
+// Limits on the fields clients send. A block cannot be changed once mined,
+// so payloads are checked before anything reaches the chain or the catalog.
+const (
+	maxTitleLen  = 300
+	maxAuthorLen = 200
+	maxBookIDLen = 64
+	maxUserLen   = 128
+	maxNonceLen  = 128
+)
+
+// validate checks an item sent to the catalog. Books need a title, author,
+// publish date (YYYY-MM-DD) and a valid ISBN-10 or ISBN-13; items of other
+// kinds need a title and a serial number, and have no ISBN.
+func (b Book) validate() error {
+	var f apierr.Fields
+	b.addFieldErrors(&f, "")
+	return f.Err()
+}
+
+func (b Book) addFieldErrors(f *apierr.Fields, prefix string) {
+	checkText(f, prefix+"title", b.Title, maxTitleLen)
+	if b.kindOf() != KindBook {
+		b.addAssetFieldErrors(f, prefix)
+		return
+	}
+	checkText(f, prefix+"author", b.Author, maxAuthorLen)
+	switch {
+	case b.PublishDate == "":
+		f.Add(prefix+"publish_date", "is required")
+	default:
+		if _, err := time.Parse(time.DateOnly, b.PublishDate); err != nil {
+			f.Add(prefix+"publish_date", "must be a date as YYYY-MM-DD")
+		}
+	}
+	switch {
+	case b.ISBN == "":
+		f.Add(prefix+"isbn", "is required")
+	case !validISBN(b.ISBN):
+		f.Add(prefix+"isbn", "must be an ISBN-10 or ISBN-13 with a valid check digit")
+	}
+	if b.Serial != "" {
+		f.Add(prefix+"serial", "is only for items other than books")
+	}
+}
+
+// addAssetFieldErrors checks an item that is not a book. Its author (a
+// maker, say) and publish date are optional.
+func (b Book) addAssetFieldErrors(f *apierr.Fields, prefix string) {
+	if !knownKind(b.Kind) {
+		f.Add(prefix+"kind", "must be one of %s", strings.Join(kindNames(), ", "))
+	}
+	checkText(f, prefix+"serial", b.Serial, maxSerialLen)
+	if utf8.RuneCountInString(b.Author) > maxAuthorLen {
+		f.Add(prefix+"author", "must be at most %d characters", maxAuthorLen)
+	}
+	if b.PublishDate != "" {
+		if _, err := time.Parse(time.DateOnly, b.PublishDate); err != nil {
+			f.Add(prefix+"publish_date", "must be a date as YYYY-MM-DD")
+		}
+	}
+	if b.ISBN != "" {
+		f.Add(prefix+"isbn", "is only for books")
+	}
+}
+
+// validate checks the fields of a transaction a client submitted, reporting
+// each one that is missing, too long or badly formatted. checkFields still
+// decides whether the combination makes sense for the type. Types only the
+// node records pass only when the node key signed them, as it does the
+// registrations POST /new queues.
+func (t Transaction) validate() error {
+	var f apierr.Fields
+	needBook, needUser := true, true
+	typ, ok := txTypes[t.Kind()]
+	switch {
+	case !ok:
+		f.Add("type", "unknown transaction type %q", t.Type)
+	case typ.NodeOnly != "" && (NodeKey == nil || t.PublicKey != nodePublicKey()):
+		f.Add("type", "%s", typ.NodeOnly)
+	default:
+		needBook, needUser = typ.Book, typ.User
+	}
+	switch {
+	case needBook && t.BookId == "":
+		f.Add("bookid", "is required")
+	case len(t.BookId) > maxBookIDLen:
+		f.Add("bookid", "must be at most %d bytes", maxBookIDLen)
+	}
+	switch {
+	case needUser && strings.TrimSpace(t.User) == "":
+		f.Add("user", "is required")
+	case utf8.RuneCountInString(t.User) > maxUserLen:
+		f.Add("user", "must be at most %d characters", maxUserLen)
+	}
+	checkDate(&f, "checkout_date", t.CheckoutDate, true)
+	checkDate(&f, "date", t.Date, true)
+	checkDate(&f, "due_date", t.DueDate, false)
+	if t.Stamped {
+		f.Add("stamped", "is set by the node")
+	}
+	if len(t.Nonce) > maxNonceLen {
+		f.Add("nonce", "must be at most %d bytes", maxNonceLen)
+	}
+	if t.Book != nil {
+		t.Book.addFieldErrors(&f, "book.")
+	}
+	if ok {
+		if _, err := t.decodeData(typ); err != nil {
+			f.Add("data", "%v", err)
+		}
+	}
+	return f.Err()
+}
+
+// checkText requires a non-blank value of at most max characters.
+func checkText(f *apierr.Fields, field, v string, max int) {
+	switch {
+	case strings.TrimSpace(v) == "":
+		f.Add(field, "is required")
+	case utf8.RuneCountInString(v) > max:
+		f.Add(field, "must be at most %d characters", max)
+	}
+}
+
+// checkDate accepts an empty value or one parseDate understands, which with
+// past may not be in the future.
+func checkDate(f *apierr.Fields, field, v string, past bool) {
+	if v == "" {
+		return
+	}
+	t, err := parseDate(v)
+	switch {
+	case err != nil:
+		f.Add(field, "must be a date as YYYY-MM-DD or RFC 3339")
+	case past && inFuture(v, t):
+		f.Add(field, "must not be in the future")
+	}
+}
+
+// validISBN reports whether s is an ISBN-10 or ISBN-13 with a correct check
+// digit. Hyphens and spaces between the digits are ignored.
+func validISBN(s string) bool {
+	digits := strings.NewReplacer("-", "", " ", "").Replace(s)
+	switch len(digits) {
+	case 10:
+		sum := 0
+		for i, c := range digits {
+			var d int
+			switch {
+			case c >= '0' && c <= '9':
+				d = int(c - '0')
+			case (c == 'X' || c == 'x') && i == 9:
+				d = 10
+			default:
+				return false
+			}
+			sum += d * (10 - i)
+		}
+		return sum%11 == 0
+	case 13:
+		sum := 0
+		for i, c := range digits {
+			if c < '0' || c > '9' {
+				return false
+			}
+			d := int(c - '0')
+			if i%2 == 1 {
+				d *= 3
+			}
+			sum += d
+		}
+		return sum%10 == 0
+	}
+	return false
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"blockchain/apierr"
+)
+
+var (
+	advertiseURL string
+	bootstrap    string
+	syncInterval = 30 * time.Second
+	peerClient   = &http.Client{Timeout: 10 * time.Second}
+)
+
+const (
+	peerHeader     = "X-Peer-URL"
+	maxBlocksFetch = 500
+)
+
+var (
+	ErrBlockOutOfOrder = errors.New("block does not extend the local tip")
+	ErrKnownBlock      = errors.New("block already in chain")
+	ErrFork            = errors.New("block conflicts with the local chain")
+)
+
+type Peer struct {
+	URL      string    `json:"url"`
+	Height   int       `json:"height"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type PeerSet struct {
+	mu    sync.RWMutex
+	peers map[string]*Peer
+}
+
+var Peers = &PeerSet{peers: map[string]*Peer{}}
+
+func normalizePeerURL(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid peer url %q", raw)
+	}
+	return strings.TrimRight(u.String(), "/"), nil
+}
+
+func (ps *PeerSet) Add(raw string) (string, error) {
+	u, err := normalizePeerURL(raw)
+	if err != nil {
+		return "", err
+	}
+	if u == advertiseURL {
+		return "", errors.New("cannot add self as peer")
+	}
+	if peerCAs != nil && !strings.HasPrefix(u, "https://") {
+		return "", fmt.Errorf("peer %s must use https when peer certificates are required", u)
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.peers[u]; !ok {
+		ps.peers[u] = &Peer{URL: u}
+		log.Printf("Added peer %s", u)
+	}
+	return u, nil
+}
+
+// known returns raw as a registered peer's URL, if it is one.
+func (ps *PeerSet) known(raw string) (string, bool) {
+	u, err := normalizePeerURL(raw)
+	if err != nil {
+		return "", false
+	}
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	_, ok := ps.peers[u]
+	return u, ok
+}
+
+func (ps *PeerSet) seen(u string, height int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if p, ok := ps.peers[u]; ok {
+		p.LastSeen = time.Now().UTC()
+		if height > p.Height {
+			p.Height = height
+		}
+	}
+}
+
+func (ps *PeerSet) List() []Peer {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	out := make([]Peer, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].URL < out[j].URL })
+	return out
+}
+
+func newPeerRequest(method, u string, body any) (*http.Request, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, u, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(chainHeader, BlockChain.ChainID())
+	if advertiseURL != "" {
+		req.Header.Set(peerHeader, advertiseURL)
+	}
+	return req, nil
+}
+
+// announceBlock sends a block this node produced to its HTTP peers and, if
+// enabled, the libp2p gossip topic.
+func announceBlock(block *Block) {
+	Peers.Broadcast(block)
+	if Gossip != nil {
+		Gossip.PublishBlock(block)
+	}
+}
+
+// Broadcast pushes block to every known peer in the background.
+func (ps *PeerSet) Broadcast(block *Block) {
+	for _, p := range ps.List() {
+		go func(u string) {
+			req, err := newPeerRequest("POST", u+"/peers/blocks", block)
+			if err != nil {
+				return
+			}
+			resp, err := peerClient.Do(req)
+			if err != nil {
+				log.Printf("Error sending block %d to %s: %v", block.Pos, u, err)
+				return
+			}
+			resp.Body.Close()
+		}(p.URL)
+	}
+}
+
+// Announce registers this node with a peer.
+func (ps *PeerSet) Announce(u string) error {
+	if advertiseURL == "" {
+		return nil
+	}
+	req, err := newPeerRequest("POST", u+"/peers", map[string]string{"url": advertiseURL})
+	if err != nil {
+		return err
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("peer %s refused registration: %s", u, resp.Status)
+	}
+	return nil
+}
+
+// BlockSource is a remote node that blocks can be pulled from.
+type BlockSource interface {
+	FetchBlocks(from int) ([]*Block, error)
+	String() string
+}
+
+// httpPeer is a peer reached through its HTTP API.
+type httpPeer string
+
+func (p httpPeer) String() string {
+	return string(p)
+}
+
+func (p httpPeer) FetchBlocks(from int) ([]*Block, error) {
+	peer := string(p)
+	req, err := newPeerRequest("GET", fmt.Sprintf("%s/blocks?from=%d&limit=%d", peer, from, maxBlocksFetch), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch blocks from %s: %s", peer, resp.Status)
+	}
+	if err := sameChain(BlockChain.ChainID(), resp.Header.Get(chainHeader)); err != nil {
+		return nil, fmt.Errorf("fetch blocks from %s: %w", peer, err)
+	}
+	var blocks []*Block
+	if err := json.NewDecoder(resp.Body).Decode(&blocks); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// fetchChain pulls the peer's whole chain, giving up once it holds more
+// than limit blocks so a peer cannot exhaust memory with an endless one.
+func fetchChain(src BlockSource, limit int) ([]*Block, error) {
+	var chain []*Block
+	for {
+		blocks, err := src.FetchBlocks(len(chain))
+		if err != nil {
+			return nil, err
+		}
+		if len(blocks) == 0 {
+			return chain, nil
+		}
+		chain = append(chain, blocks...)
+		if len(chain) > limit {
+			return nil, fmt.Errorf("chain from %s is longer than %d blocks", src, limit)
+		}
+	}
+}
+
+// adoptChain replaces a fresh chain, holding only this node's own genesis
+// block, with the start of the peer's chain so both nodes share a genesis;
+// the callers sync the rest from there.
+func (bc *Blockchain) adoptChain(src BlockSource) error {
+	if bc.Height() != 1 {
+		return nil
+	}
+	chain, err := src.FetchBlocks(0)
+	if err != nil {
+		return err
+	}
+	if len(chain) == 0 || chain[0] != nil && chain[0].Hash == bc.Tip().Hash {
+		return nil
+	}
+	if err := bc.Replace(chain); err != nil {
+		return err
+	}
+	log.Printf("Adopted chain of %d blocks from %s", len(chain), src)
+	return nil
+}
+
+// SyncFrom pulls and applies every block the peer has beyond the local tip.
+func (bc *Blockchain) SyncFrom(src BlockSource) (int, error) {
+	ctx, span := tracer.Start(context.Background(), "SyncFrom", trace.WithAttributes(attribute.String("peer", src.String())))
+	defer span.End()
+	added := 0
+	defer func() { span.SetAttributes(attribute.Int("blocks", added)) }()
+	for {
+		_, fetch := tracer.Start(ctx, "FetchBlocks")
+		blocks, err := src.FetchBlocks(bc.Height())
+		fetch.End()
+		if err != nil {
+			return added, err
+		}
+		if len(blocks) == 0 {
+			return added, nil
+		}
+		from := bc.Height()
+		for i, b := range blocks {
+			err := bc.AcceptBlock(ctx, b)
+			if errors.Is(err, ErrFork) {
+				return added, bc.ResolveFork(src)
+			}
+			if err != nil {
+				return added, fmt.Errorf("block %d from %s: %w", from+i, src, err)
+			}
+			added++
+		}
+		Peers.seen(src.String(), bc.Height())
+	}
+}
+
+// AcceptBlock appends a block produced by another node.
+func (bc *Blockchain) AcceptBlock(ctx context.Context, block *Block) error {
+	if block == nil {
+		return errors.New("missing block")
+	}
+	if block.Pos < 0 {
+		return fmt.Errorf("invalid block position %d", block.Pos)
+	}
+	if err := bc.intact(); err != nil {
+		return err
+	}
+	bc.writeMu.Lock()
+	defer bc.writeMu.Unlock()
+	prev := bc.Tip()
+	if block.Pos <= prev.Pos {
+		if bc.Snapshot()[block.Pos].Hash == block.Hash {
+			return ErrKnownBlock
+		}
+		return ErrFork
+	}
+	if block.Pos != prev.Pos+1 {
+		return ErrBlockOutOfOrder
+	}
+	if block.Prevhash != prev.Hash {
+		return ErrFork
+	}
+	err := checkBlockLimits(block)
+	if err == nil && block.Version == blockVersionBaseline {
+		err = errors.New("unsigned baseline blocks are only read from a chain file")
+	}
+	if err == nil {
+		err = checkBlock(block, prev)
+	}
+	if err == nil && block.Difficulty < difficulty {
+		err = fmt.Errorf("block difficulty %d below required %d", block.Difficulty, difficulty)
+	}
+	if err == nil {
+		err = checkClockSkew(block)
+	}
+	if err == nil {
+		err = bc.checkPeerBlock(block)
+	}
+	if err != nil {
+		publishValidation(ValidationEvent{Source: "peer", Pos: &block.Pos, Hash: block.Hash, Reason: err.Error()})
+		return err
+	}
+	if err := storeAppend(ctx, bc.store, block); err != nil {
+		return err
+	}
+	bc.appendBlock(block)
+	Mempool.RemoveIncluded(block.Transactions)
+	return nil
+}
+
+func syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, p := range Peers.List() {
+			if n, err := BlockChain.SyncFrom(httpPeer(p.URL)); err != nil {
+				log.Printf("Error syncing from %s: %v", p.URL, err)
+			} else if n > 0 {
+				log.Printf("Synced %d blocks from %s", n, p.URL)
+			}
+		}
+	}
+}
+
+func startPeers() {
+	for _, raw := range strings.Split(bootstrap, ",") {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		u, err := Peers.Add(raw)
+		if err != nil {
+			log.Printf("Skipping bootstrap peer: %v", err)
+			continue
+		}
+		if err := Peers.Announce(u); err != nil {
+			log.Printf("Error announcing to %s: %v", u, err)
+		}
+		if err := BlockChain.adoptChain(httpPeer(u)); err != nil {
+			log.Printf("Error fetching chain from %s: %v", u, err)
+		}
+		if n, err := BlockChain.SyncFrom(httpPeer(u)); err != nil {
+			log.Printf("Error syncing from %s: %v", u, err)
+		} else if n > 0 {
+			log.Printf("Synced %d blocks from %s", n, u)
+		}
+	}
+	go syncLoop(syncInterval)
+}
+
+// senderPeer is the peer named by a request's X-Peer-URL header, which the
+// node may fetch blocks from, or "". A peer holding a consortium certificate
+// is added on first contact. Without -peer-ca anyone can send the header, so
+// only peers already registered are taken from it, and the node is never
+// made to fetch from a URL a request picked.
+func senderPeer(r *http.Request) string {
+	raw := r.Header.Get(peerHeader)
+	if raw == "" {
+		return ""
+	}
+	if peerCAs != nil {
+		u, err := Peers.Add(raw)
+		if err != nil {
+			return ""
+		}
+		return u
+	}
+	if u, ok := Peers.known(raw); ok {
+		return u
+	}
+	return ""
+}
+
+func listPeers(w http.ResponseWriter, r *http.Request) {
+	respond(w, r, Peers.List())
+}
+
+func registerPeer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "invalid peer: %w", err))
+		return
+	}
+	u, err := Peers.Add(req.URL)
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.InvalidRequest, err))
+		return
+	}
+	logger := reqLog(r)
+	go func() {
+		if _, err := BlockChain.SyncFrom(httpPeer(u)); err != nil {
+			logger.Error("Error syncing from new peer", "peer", u, "error", err)
+		}
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{"status": "peer added", "peers": Peers.List()})
+}
+
+// receiveBlock handles a block broadcast by a peer. A block further ahead
+// than the next position means this node is behind, so it syncs from the
+// sender instead.
+func receiveBlock(w http.ResponseWriter, r *http.Request) {
+	var block Block
+	if err := decodeJSON(r.Body, &block); err != nil {
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "invalid block: %w", err))
+		return
+	}
+	sender := senderPeer(r)
+	if sender != "" {
+		Peers.seen(sender, block.Pos+1)
+	}
+	err := BlockChain.AcceptBlock(r.Context(), &block)
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"status": "block accepted"})
+	case errors.Is(err, ErrKnownBlock):
+		json.NewEncoder(w).Encode(map[string]string{"status": "block already known"})
+	case errors.Is(err, ErrFork):
+		if sender != "" {
+			go func() {
+				if err := BlockChain.ResolveFork(httpPeer(sender)); err != nil {
+					log.Printf("Error resolving fork with %s: %v", sender, err)
+				}
+			}()
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"status": "fork detected", "height": strconv.Itoa(BlockChain.Height())})
+	case errors.Is(err, ErrBlockOutOfOrder):
+		if sender != "" {
+			go func() {
+				if _, err := BlockChain.SyncFrom(httpPeer(sender)); err != nil {
+					log.Printf("Error syncing from %s: %v", sender, err)
+				}
+			}()
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"status": "block not at tip", "height": strconv.Itoa(BlockChain.Height())})
+	default:
+		writeError(w, r, apierr.Wrap(apierr.Unprocessable, err))
+	}
+}
+
+// getBlocks returns a run of blocks starting at from, a height or a block
+// hash, or at the first block produced after since. When more follow, a
+// Link with rel="next" names the next run by the hash it starts at.
+func getBlocks(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 || limit > maxBlocksFetch {
+		limit = maxBlocksFetch
+	}
+	chain := tenantOf(r).chain
+	var from int
+	switch v := q.Get("from"); {
+	case q.Has("since") && v != "":
+		writeError(w, r, apierr.New(apierr.InvalidRequest, "send either from or since"))
+		return
+	case q.Has("since"):
+		t, err := parseDate(q.Get("since"))
+		if err != nil {
+			writeError(w, r, apierr.New(apierr.InvalidRequest, "since must be a date as YYYY-MM-DD or RFC 3339"))
+			return
+		}
+		from = chain.FirstAfter(t)
+	default:
+		if n, err := strconv.Atoi(v); err == nil || v == "" {
+			from = n
+		} else if b := chain.BlockByHash(v); b != nil {
+			from = b.Pos
+		} else {
+			writeError(w, r, apierr.Errorf(codeBlockNotFound, "no block %s on the chain", v))
+			return
+		}
+	}
+	blocks := chain.Snapshot()
+	if from < 0 {
+		from = 0
+	}
+	if from > len(blocks) {
+		from = len(blocks)
+	}
+	end := from + limit
+	if end > len(blocks) {
+		end = len(blocks)
+	}
+	if end < len(blocks) {
+		next := *r.URL
+		nq := next.Query()
+		nq.Del("since")
+		nq.Set("from", blocks[end].Hash)
+		nq.Set("limit", strconv.Itoa(limit))
+		next.RawQuery = nq.Encode()
+		w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+	}
+	w.Header().Set(chainHeader, blocks[0].ChainID())
+	respond(w, r, blocks[from:end])
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"blockchain/apierr"
+)
+
+var (
+	peerCAFile   string
+	peerCertFile string
+	peerKeyFile  string
+)
+
+// peerCAs holds the consortium CA when peer authentication is on. Peers must
+// then present a client certificate it issued, and this node only talks to
+// peers over HTTPS with a server certificate it issued.
+var peerCAs *x509.CertPool
+
+// setupPeerTLS loads the consortium CA and this branch's certificate and
+// switches peerClient to mutual TLS.
+func setupPeerTLS() error {
+	if peerCAFile == "" {
+		if peerCertFile != "" || peerKeyFile != "" {
+			return errors.New("-peer-cert and -peer-key need -peer-ca")
+		}
+		return nil
+	}
+	if peerCertFile == "" || peerKeyFile == "" {
+		return errors.New("-peer-ca needs -peer-cert and -peer-key")
+	}
+	if tlsCertFile == "" && autocertDomains == "" {
+		return errors.New("-peer-ca needs the API served over TLS")
+	}
+	pem, err := os.ReadFile(peerCAFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates in %s", peerCAFile)
+	}
+	cert, err := tls.LoadX509KeyPair(peerCertFile, peerKeyFile)
+	if err != nil {
+		return err
+	}
+	peerCAs = pool
+	peerClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{
+				RootCAs:      pool,
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS12,
+			},
+		},
+	}
+	return nil
+}
+
+// peerBranch is the common name on the verified client certificate, or ""
+// if the request did not present one.
+func peerBranch(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// requirePeerAuth guards node-to-node requests that change who is in the
+// cluster. Under -peer-ca the consortium certificate admits a peer; without
+// it the request needs a librarian credential, and with -auth off as well it
+// is refused, since anyone who can reach the node could otherwise join.
+func requirePeerAuth(next http.HandlerFunc) http.HandlerFunc {
+	staff := requireRole(next, RoleLibrarian)
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case peerCAs != nil:
+			requirePeerCert(next)(w, r)
+		case !authEnabled:
+			writeError(w, r, apierr.New(apierr.Forbidden, "this node needs -peer-ca or -auth to admit peers"))
+		default:
+			staff(w, r)
+		}
+	}
+}
+
+// requirePeerCert rejects node-to-node requests without a client
+// certificate from the consortium CA when peer authentication is on.
+func requirePeerCert(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if peerCAs != nil && peerBranch(r) == "" {
+			writeError(w, r, apierr.New(apierr.Forbidden, "peer certificate required"))
+			return
+		}
+		next(w, r)
+	}
+}
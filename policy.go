@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"blockchain/apierr"
+)
+
+var (
+	ErrLoanLimit     = errors.New("member has reached their loan limit")
+	ErrAgeRestricted = errors.New("member is too young to borrow this item")
+)
+
+// loanRulesFile is the YAML file of -loan-rules, empty for none.
+var loanRulesFile string
+
+// LoanRules are the lending rules of -loan-rules. They are checked when a
+// node accepts a checkout or renewal, not when it takes blocks from peers,
+// so they can be changed, and reloaded with SIGHUP or POST /admin/loan-rules,
+// without making the chain invalid.
+type LoanRules struct {
+	// MaxLoans is how many items a member may have out at once; 0 is no
+	// limit.
+	MaxLoans int `yaml:"max_loans" json:"max_loans,omitempty"`
+	// Kinds overrides the policy of each kind, "book" included.
+	Kinds map[string]KindRules `yaml:"kinds" json:"kinds,omitempty"`
+	// Members holds what the rules know about members, by name.
+	Members map[string]MemberRules `yaml:"members" json:"members,omitempty"`
+}
+
+// KindRules are the rules for one kind of item. Unset fields keep the kind's
+// policy from -loan-days and the like or -asset-kinds.
+type KindRules struct {
+	LoanDays    *int   `yaml:"loan_days" json:"loan_days,omitempty"`
+	MaxRenewals *int   `yaml:"max_renewals" json:"max_renewals,omitempty"`
+	FinePerDay  *int64 `yaml:"fine_per_day" json:"fine_per_day,omitempty"`
+	// MaxLoans is how many items of the kind a member may have out at once.
+	MaxLoans int `yaml:"max_loans" json:"max_loans,omitempty"`
+	// MinAge is the age a member must be to borrow the kind. Members whose
+	// birth date the rules do not give are not held to it.
+	MinAge int `yaml:"min_age" json:"min_age,omitempty"`
+}
+
+// MemberRules are the rules for one member.
+type MemberRules struct {
+	BirthDate string `yaml:"birth_date" json:"birth_date,omitempty"`
+	// MaxLoans replaces the overall limit for the member.
+	MaxLoans int `yaml:"max_loans" json:"max_loans,omitempty"`
+}
+
+// activeRules are the rules in force, swapped whole on a reload.
+var activeRules atomic.Pointer[LoanRules]
+
+func currentRules() *LoanRules {
+	if rules := activeRules.Load(); rules != nil {
+		return rules
+	}
+	return &LoanRules{}
+}
+
+// loadLoanRules reads and checks a rules file.
+func loadLoanRules(path string) (*LoanRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules LoanRules
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&rules); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := rules.check(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &rules, nil
+}
+
+func (rules *LoanRules) check() error {
+	if rules.MaxLoans < 0 {
+		return errors.New("max_loans must not be negative")
+	}
+	for name, k := range rules.Kinds {
+		if name != KindBook && !knownKind(name) {
+			return fmt.Errorf("unknown kind %q", name)
+		}
+		switch {
+		case k.LoanDays != nil && *k.LoanDays < 1:
+			return fmt.Errorf("%s: loan_days must be at least 1", name)
+		case k.MaxRenewals != nil && *k.MaxRenewals < 0, k.FinePerDay != nil && *k.FinePerDay < 0,
+			k.MaxLoans < 0, k.MinAge < 0:
+			return fmt.Errorf("%s: limits must not be negative", name)
+		}
+	}
+	for name, m := range rules.Members {
+		if m.MaxLoans < 0 {
+			return fmt.Errorf("member %s: max_loans must not be negative", name)
+		}
+		if m.BirthDate != "" {
+			if _, err := time.Parse(time.DateOnly, m.BirthDate); err != nil {
+				return fmt.Errorf("member %s: birth_date must be YYYY-MM-DD", name)
+			}
+		}
+	}
+	return nil
+}
+
+// reloadLoanRules rereads -loan-rules, keeping the rules in force if the file
+// is no longer valid.
+func reloadLoanRules() (*LoanRules, error) {
+	rules, err := loadLoanRules(loanRulesFile)
+	if err != nil {
+		return nil, err
+	}
+	activeRules.Store(rules)
+	return rules, nil
+}
+
+// watchLoanRules reloads the rules whenever the node gets SIGHUP.
+func watchLoanRules() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if _, err := reloadLoanRules(); err != nil {
+			log.Printf("Keeping the loan rules in force: %v", err)
+			continue
+		}
+		log.Printf("Reloaded loan rules from %s", loanRulesFile)
+	}
+}
+
+// overrides applies the rules for a kind to its policy.
+func (rules *LoanRules) overrides(p AssetKind) AssetKind {
+	k, ok := rules.Kinds[p.Name]
+	if !ok {
+		return p
+	}
+	if k.LoanDays != nil {
+		p.LoanDays = *k.LoanDays
+	}
+	if k.MaxRenewals != nil {
+		p.MaxRenewals = *k.MaxRenewals
+	}
+	if k.FinePerDay != nil {
+		p.FinePerDay = *k.FinePerDay
+	}
+	return p
+}
+
+// checkLoanRules refuses a checkout the rules do not allow: one past the
+// member's overall or per-kind loan limit, or of a kind the member is too
+// young for.
+func (s *LibraryState) checkLoanRules(tx Transaction, now time.Time) error {
+	if tx.Kind() != TxCheckout {
+		return nil
+	}
+	rules := currentRules()
+	kind := s.kinds[tx.BookId]
+	k := rules.Kinds[(Book{Kind: kind}).kindOf()]
+	member := rules.Members[memberOf(tx.User)]
+
+	limit := rules.MaxLoans
+	if member.MaxLoans > 0 {
+		limit = member.MaxLoans
+	}
+	if limit > 0 || k.MaxLoans > 0 {
+		var all, ofKind int
+		for _, loan := range s.loans {
+			if loan.User == tx.User {
+				all++
+				if loan.Kind == kind {
+					ofKind++
+				}
+			}
+		}
+		if limit > 0 && all >= limit {
+			return fmt.Errorf("%w of %d", ErrLoanLimit, limit)
+		}
+		if k.MaxLoans > 0 && ofKind >= k.MaxLoans {
+			return fmt.Errorf("%w of %d for %s", ErrLoanLimit, k.MaxLoans, (Book{Kind: kind}).kindOf())
+		}
+	}
+
+	if k.MinAge > 0 && member.BirthDate != "" {
+		born, _ := time.Parse(time.DateOnly, member.BirthDate)
+		if at, err := parseDate(tx.CheckoutDate); err == nil {
+			now = at
+		}
+		if ageOn(born, now) < k.MinAge {
+			return fmt.Errorf("%w: %s needs a member of %d or over", ErrAgeRestricted, (Book{Kind: kind}).kindOf(), k.MinAge)
+		}
+	}
+	return nil
+}
+
+// ageOn returns the age in whole years on day t of someone born on born.
+func ageOn(born, t time.Time) int {
+	t = t.UTC()
+	age := t.Year() - born.Year()
+	if t.Month() < born.Month() || (t.Month() == born.Month() && t.Day() < born.Day()) {
+		age--
+	}
+	return age
+}
+
+// LoanRulesInfo answers GET /admin/loan-rules.
+type LoanRulesInfo struct {
+	File  string     `json:"file"`
+	Rules *LoanRules `json:"rules"`
+}
+
+func getLoanRules(w http.ResponseWriter, r *http.Request) {
+	respond(w, r, LoanRulesInfo{File: loanRulesFile, Rules: currentRules()})
+}
+
+// adminReloadLoanRules answers POST /admin/loan-rules by rereading the file.
+func adminReloadLoanRules(w http.ResponseWriter, r *http.Request) {
+	if loanRulesFile == "" {
+		writeError(w, r, apierr.New(apierr.InvalidRequest, "the node has no -loan-rules file"))
+		return
+	}
+	rules, err := reloadLoanRules()
+	if err != nil {
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "the rules in force are kept: %v", err))
+		return
+	}
+	reqLog(r).Info("Reloaded loan rules", "file", loanRulesFile)
+	respond(w, r, LoanRulesInfo{File: loanRulesFile, Rules: rules})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"strconv"
+
+	"google.golang.org/grpc/metadata"
+
+	"blockchain/apierr"
+)
+
+// clientPoWBits is how many leading zero bits a client's proof of work must
+// reach. Zero accepts transactions without one.
+var clientPoWBits int
+
+const powHeader = "X-PoW"
+
+var (
+	ErrPoWRequired = errors.New("transactions need a proof of work in X-PoW")
+	ErrPoWInvalid  = errors.New("proof of work falls short of the difficulty")
+)
+
+// powHash is what a client searches nonces for: SHA-256 over a domain tag,
+// the transaction's ID and the nonce. The ID is the hash of the payload the
+// member signed, so the work cannot be reused for another transaction, and
+// one already spent is refused as a duplicate.
+func powHash(txID, nonce string) [sha256.Size]byte {
+	return sha256.Sum256([]byte("library-chain/pow/1\x00" + txID + "\x00" + nonce))
+}
+
+func leadingZeroBits(sum []byte) int {
+	n := 0
+	for _, b := range sum {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// checkPoW checks the nonce a client solved for a transaction, when the
+// node asks for one.
+func checkPoW(txID, nonce string) error {
+	switch {
+	case clientPoWBits == 0:
+		return nil
+	case nonce == "":
+		return ErrPoWRequired
+	case len(nonce) > 64:
+		return ErrPoWInvalid
+	}
+	sum := powHash(txID, nonce)
+	if leadingZeroBits(sum[:]) < clientPoWBits {
+		return ErrPoWInvalid
+	}
+	return nil
+}
+
+// solvePoW counts up from zero to the first nonce for txID with at least n
+// leading zero bits. Each extra bit doubles the expected work.
+func solvePoW(txID string, n int) string {
+	for i := 0; ; i++ {
+		nonce := strconv.Itoa(i)
+		if sum := powHash(txID, nonce); leadingZeroBits(sum[:]) >= n {
+			return nonce
+		}
+	}
+}
+
+// powExempt reports whether a caller is trusted to submit without a proof
+// of work: a librarian, or an integration with an API key or HMAC secret.
+func powExempt(claims *Claims) bool {
+	return claims != nil && (claims.key != nil || normalizeRole(claims.Role) == RoleLibrarian)
+}
+
+func powError(err error) *apierr.Error {
+	return apierr.Wrap(codePoWRequired, err).WithDetails(map[string]int{"bits": clientPoWBits})
+}
+
+// requirePoW wraps a route taking a signed transaction and, under
+// -client-pow-bits, refuses it without a proof of work in X-PoW. It runs
+// before the signature is checked, so a flood of junk costs its sender more
+// than the node. The body is read and put back for next.
+func requirePoW(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if clientPoWBits == 0 || powExempt(authClaims(r.Context())) {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, apiError(err, apierr.InvalidRequest))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var tx Transaction
+		if json.Unmarshal(body, &tx) != nil {
+			// Leave the decoding error to next.
+			next(w, r)
+			return
+		}
+		if err := checkPoW(tx.ID(), r.Header.Get(powHeader)); err != nil {
+			writeError(w, r, powError(err))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// grpcPoW is requirePoW for SubmitCheckout, with the nonce in the x-pow
+// metadata.
+func grpcPoW(ctx context.Context, tx Transaction) error {
+	if clientPoWBits == 0 || powExempt(authClaims(ctx)) {
+		return nil
+	}
+	var nonce string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("x-pow"); len(v) > 0 {
+			nonce = v[0]
+		}
+	}
+	if err := checkPoW(tx.ID(), nonce); err != nil {
+		return fmt.Errorf("%w (%d bits)", err, clientPoWBits)
+	}
+	return nil
+}
+
+// runPoW solves the proof of work for a transaction ID, for clients
+// scripting submissions to a node that asks for one.
+func runPoW(out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("chain pow", flag.ContinueOnError)
+	n := fs.Int("bits", 20, "leading zero bits the node asks for")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *n < 0 || *n > 256 {
+		return errors.New("usage: chain pow [-bits N] TXID")
+	}
+	_, err := fmt.Fprintln(out, solvePoW(fs.Arg(0), *n))
+	return err
+}
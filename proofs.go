@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"blockchain/apierr"
+)
+
+// ProofStep is one sibling on the path from a leaf to the Merkle root.
+// Side says whether the sibling is hashed on the left or the right.
+type ProofStep struct {
+	Hash string `json:"hash"`
+	Side string `json:"side"`
+}
+
+// MerkleProof shows that a transaction is included in a block. Everything
+// needed to check it is in the proof itself: the leaf is recomputed from the
+// transaction and hashed up the path with the chain's hash algorithm, and
+// the result must equal the Merkle root in the block header.
+type MerkleProof struct {
+	TxID          string      `json:"tx_id"`
+	Transaction   Transaction `json:"transaction"`
+	Block         int         `json:"block"`
+	BlockHash     string      `json:"block_hash"`
+	BlockVersion  int         `json:"block_version"`
+	HashAlgorithm string      `json:"hash_algorithm"`
+	MerkleRoot    string      `json:"merkle_root"`
+	Index         int         `json:"index"`
+	Leaf          string      `json:"leaf"`
+	Path          []ProofStep `json:"path"`
+}
+
+// merklePath returns the siblings from leaf i up to the root.
+func merklePath(levels [][][]byte, i int) []ProofStep {
+	path := []ProofStep{}
+	for _, level := range levels[:len(levels)-1] {
+		sibling, side := i+1, "right"
+		if i%2 == 1 {
+			sibling, side = i-1, "left"
+		}
+		if sibling >= len(level) {
+			sibling = i
+		}
+		path = append(path, ProofStep{Hash: hex.EncodeToString(level[sibling]), Side: side})
+		i /= 2
+	}
+	return path
+}
+
+// Proof builds the inclusion proof for a transaction on the chain.
+func (bc *Blockchain) Proof(txID string) (*MerkleProof, bool) {
+	pos, ok := bc.TxBlock(txID)
+	if !ok {
+		return nil, false
+	}
+	block := bc.BlockAt(pos)
+	if blockVersions[block.Version].unsigned {
+		// Baseline blocks have no Merkle tree to prove against.
+		return nil, false
+	}
+	for i, tx := range block.Transactions {
+		if tx.ID() != txID {
+			continue
+		}
+		levels := merkleLevels(block.Version, block.Transactions)
+		return &MerkleProof{
+			TxID:          txID,
+			Transaction:   tx,
+			Block:         block.Pos,
+			BlockHash:     block.Hash,
+			BlockVersion:  block.Version,
+			HashAlgorithm: chainHashAlgorithm(bc.BlockAt(0)),
+			MerkleRoot:    block.MerkleRoot,
+			Index:         i,
+			Leaf:          hex.EncodeToString(levels[0][i]),
+			Path:          merklePath(levels, i),
+		}, true
+	}
+	return nil, false
+}
+
+// VerifyProof checks a proof on its own, without the chain: the transaction
+// must hash to the leaf and the path must lead to the Merkle root.
+func VerifyProof(p *MerkleProof) error {
+	sum, ok := hashAlgorithms[p.HashAlgorithm]
+	if !ok {
+		return fmt.Errorf("unknown hash algorithm %q", p.HashAlgorithm)
+	}
+	rules, ok := blockVersions[p.BlockVersion]
+	if !ok {
+		return fmt.Errorf("unsupported block version %d", p.BlockVersion)
+	}
+	if p.Transaction.ID() != p.TxID {
+		return errors.New("transaction does not match the proof's ID")
+	}
+	node := sum(rules.leaf(p.Transaction))
+	if hex.EncodeToString(node) != p.Leaf {
+		return errors.New("transaction does not hash to the proof's leaf")
+	}
+	for i, step := range p.Path {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return fmt.Errorf("step %d: invalid hash", i)
+		}
+		switch step.Side {
+		case "left":
+			node = sum(append(append([]byte{}, sibling...), node...))
+		case "right":
+			node = sum(append(append([]byte{}, node...), sibling...))
+		default:
+			return fmt.Errorf("step %d: side must be left or right", i)
+		}
+	}
+	root, err := hex.DecodeString(p.MerkleRoot)
+	if err != nil || !bytes.Equal(node, root) {
+		return errors.New("path does not lead to the Merkle root")
+	}
+	return nil
+}
+
+func getProof(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["txid"]
+	proof, ok := tenantOf(r).chain.Proof(id)
+	if !ok {
+		writeError(w, r, apierr.Errorf(codeTxNotFound, "no transaction %s on the chain", id))
+		return
+	}
+	respond(w, r, proof)
+}
+
+// verifyProof checks a submitted proof and whether its block is the one this
+// node has at that height.
+func verifyProof(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var proof MerkleProof
+	if err := decodeJSON(r.Body, &proof); err != nil {
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "invalid proof: %w", err))
+		return
+	}
+	resp := map[string]any{"valid": true}
+	if err := VerifyProof(&proof); err != nil {
+		resp["valid"] = false
+		resp["reason"] = err.Error()
+	}
+	block := tenantOf(r).chain.BlockAt(proof.Block)
+	resp["on_chain"] = block != nil && block.Hash == proof.BlockHash && block.MerkleRoot == proof.MerkleRoot
+	json.NewEncoder(w).Encode(resp)
+}
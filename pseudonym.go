@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"blockchain/apierr"
+)
+
+var (
+	pseudonymize     bool
+	pseudonymKeyFile = "pseudonym.key"
+	pseudonymFile    = "pseudonyms.json"
+)
+
+// pseudonymPrefix marks a user field holding a pseudonym.
+const pseudonymPrefix = "p-"
+
+var (
+	ErrNotPseudonymous  = errors.New("user must be a pseudonym from POST /pseudonyms")
+	ErrUnknownPseudonym = errors.New("pseudonym not found")
+)
+
+// PseudonymTable maps members to the pseudonyms the chain names them by
+// under -pseudonymize. A pseudonym is an HMAC-SHA256 of the member's ID keyed
+// with a secret kept next to the table, so the chain, which cannot forget,
+// never holds who borrowed what, and a pseudonym cannot be traced back to a
+// member by guessing IDs without the key. The table is the only way back from
+// a pseudonym; it and the key are written readable by the node's user alone.
+type PseudonymTable struct {
+	key []byte
+
+	mu    sync.RWMutex
+	path  string
+	users map[string]string
+}
+
+var Pseudonyms *PseudonymTable
+
+// OpenPseudonyms reads the table and its key, from keySrc or keyPath,
+// creating the key on first run.
+func OpenPseudonyms(path, keySrc, keyPath string) (*PseudonymTable, error) {
+	key, err := loadSecret(keySrc, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	t := &PseudonymTable{key: key, path: path, users: map[string]string{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &t.users); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *PseudonymTable) saveLocked() error {
+	return writeFileAtomic(t.path, func(f *os.File) error {
+		if err := f.Chmod(0o600); err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t.users)
+	})
+}
+
+// pseudonymOf computes a user's pseudonym without recording it.
+func (t *PseudonymTable) pseudonymOf(user string) string {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(user))
+	return pseudonymPrefix + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Register returns a user's pseudonym, recording it so it can be resolved.
+func (t *PseudonymTable) Register(user string) (string, error) {
+	p := t.pseudonymOf(user)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.users[p]; ok {
+		return p, nil
+	}
+	t.users[p] = user
+	if err := t.saveLocked(); err != nil {
+		delete(t.users, p)
+		return "", err
+	}
+	return p, nil
+}
+
+// User resolves a pseudonym.
+func (t *PseudonymTable) User(p string) (string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	user, ok := t.users[p]
+	if !ok {
+		return "", ErrUnknownPseudonym
+	}
+	return user, nil
+}
+
+// memberOf is the member a transaction's user names: the user itself or, for
+// a pseudonym, who it stands for. Users the table does not know are taken as
+// they are.
+func memberOf(user string) string {
+	if Pseudonyms == nil || !strings.HasPrefix(user, pseudonymPrefix) {
+		return user
+	}
+	if m, err := Pseudonyms.User(user); err == nil {
+		return m
+	}
+	return user
+}
+
+// checkPseudonymous refuses, under -pseudonymize, a transaction that names a
+// user other than by a registered pseudonym. Blocks from before the flag and
+// from peers are not checked, since what is on the chain stays there.
+func checkPseudonymous(tx Transaction) error {
+	if !pseudonymize || tx.User == "" {
+		return nil
+	}
+	if _, err := Pseudonyms.User(tx.User); err != nil {
+		return fmt.Errorf("%w, not %q", ErrNotPseudonymous, tx.User)
+	}
+	return nil
+}
+
+// Pseudonym pairs a user with their pseudonym.
+type Pseudonym struct {
+	User      string `json:"user"`
+	Pseudonym string `json:"pseudonym"`
+}
+
+// registerPseudonym answers POST /pseudonyms with the pseudonym a client puts
+// in the user field of the transactions it signs for the user.
+func registerPseudonym(w http.ResponseWriter, r *http.Request) {
+	if Pseudonyms == nil {
+		writeError(w, r, apierr.New(apierr.NotFound, "the node does not run with -pseudonymize"))
+		return
+	}
+	var req Pseudonym
+	if err := decodeJSON(r.Body, &req); err != nil || !validMemberID(req.User) {
+		writeError(w, r, apierr.New(apierr.InvalidRequest, "invalid pseudonym request"))
+		return
+	}
+	p, err := Pseudonyms.Register(req.User)
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.Internal, err))
+		return
+	}
+	respond(w, r, Pseudonym{User: req.User, Pseudonym: p})
+}
+
+// resolvePseudonym answers GET /pseudonyms/{pseudonym} for staff.
+func resolvePseudonym(w http.ResponseWriter, r *http.Request) {
+	if Pseudonyms == nil {
+		writeError(w, r, apierr.New(apierr.NotFound, "the node does not run with -pseudonymize"))
+		return
+	}
+	p := mux.Vars(r)["pseudonym"]
+	user, err := Pseudonyms.User(p)
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	respond(w, r, Pseudonym{User: user, Pseudonym: p})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/segmentio/kafka-go"
+)
+
+// publishURL names where committed blocks and their domain events are
+// published: kafka://broker[,broker...]/topic or nats://server[,server...]/subject.
+var publishURL string
+
+// outboxEnabled makes stores queue the events of each block they store in
+// their outbox, in the same transaction. It is set when publishing is on.
+var outboxEnabled bool
+
+const (
+	outboxBatch      = 100
+	publishRetryMax  = 30 * time.Second
+	publishPollEvery = time.Second
+)
+
+// OutboxEvent is an event waiting in a store's outbox to be published.
+type OutboxEvent struct {
+	Seq       int64           `json:"-"` // outbox position, assigned by the store
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	BlockHash string          `json:"block_hash"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// OutboxStore is implemented by stores that keep an outbox of events to
+// publish. Events are queued by Append and Replace while outboxEnabled is
+// set, so an event is never lost between storing a block and publishing it.
+type OutboxStore interface {
+	// PendingEvents returns up to limit queued events, oldest first.
+	PendingEvents(limit int) ([]OutboxEvent, error)
+	// AckEvents removes the events up to and including seq.
+	AckEvents(seq int64) error
+}
+
+// TxEventData is the data of a domain event for one transaction.
+type TxEventData struct {
+	Pos         int         `json:"pos"`
+	BlockHash   string      `json:"block_hash"`
+	ID          string      `json:"id"`
+	Transaction Transaction `json:"transaction"`
+}
+
+// domainEvents returns the events of a committed block: block.committed,
+// then one per transaction. IDs match those on /events.
+func domainEvents(b *Block) ([]OutboxEvent, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	events := []OutboxEvent{{ID: eventID{b.Pos, 0}.String(), Type: "block.committed", BlockHash: b.Hash, Data: data}}
+	for i, tx := range b.Transactions {
+		if tx.IsGenesis {
+			continue
+		}
+		typ := "transaction." + tx.Kind()
+		if t, ok := txTypes[tx.Kind()]; ok && t.Event != "" {
+			typ = t.Event
+		}
+		data, err := json.Marshal(TxEventData{Pos: b.Pos, BlockHash: b.Hash, ID: tx.ID(), Transaction: tx})
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, OutboxEvent{ID: eventID{b.Pos, i + 1}.String(), Type: typ, BlockHash: b.Hash, Data: data})
+	}
+	return events, nil
+}
+
+// replacedEvents returns the events of the blocks in a replacement chain
+// that the store did not already hold, as reported by stored.
+func replacedEvents(blocks []*Block, stored func(*Block) bool) ([]OutboxEvent, error) {
+	var events []OutboxEvent
+	for _, b := range blocks {
+		if stored(b) {
+			continue
+		}
+		evs, err := domainEvents(b)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, evs...)
+	}
+	return events, nil
+}
+
+// eventSink delivers events to a broker. Publish returns only once the
+// broker has acknowledged every event.
+type eventSink interface {
+	Publish(ctx context.Context, events []OutboxEvent) error
+	Close() error
+}
+
+func newEventSink(raw string) (eventSink, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -publish URL: %w", err)
+	}
+	target := strings.Trim(u.Path, "/")
+	if u.Host == "" || target == "" {
+		return nil, fmt.Errorf("-publish URL %q needs brokers and a topic or subject", raw)
+	}
+	hosts := strings.Split(u.Host, ",")
+	switch u.Scheme {
+	case "kafka":
+		return &kafkaSink{w: &kafka.Writer{
+			Addr:         kafka.TCP(hosts...),
+			Topic:        target,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchSize:    outboxBatch,
+			BatchTimeout: 10 * time.Millisecond,
+		}}, nil
+	case "nats":
+		for i, h := range hosts {
+			hosts[i] = "nats://" + h
+		}
+		nc, err := nats.Connect(strings.Join(hosts, ","), nats.Name("library-chain"),
+			nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true))
+		if err != nil {
+			return nil, fmt.Errorf("connect to NATS: %w", err)
+		}
+		js, err := jetstream.New(nc)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		return &natsSink{nc: nc, js: js, subject: target}, nil
+	default:
+		return nil, fmt.Errorf("-publish URL %q must start with kafka:// or nats://", raw)
+	}
+}
+
+// kafkaSink writes every event to one topic, keyed by chain ID so they stay
+// in one partition and in order. The event type and ID are headers.
+type kafkaSink struct {
+	w *kafka.Writer
+}
+
+func (s *kafkaSink) Publish(ctx context.Context, events []OutboxEvent) error {
+	msgs := make([]kafka.Message, len(events))
+	for i, ev := range events {
+		value, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		msgs[i] = kafka.Message{
+			Key:   []byte(chainID),
+			Value: value,
+			Headers: []kafka.Header{
+				{Key: "type", Value: []byte(ev.Type)},
+				{Key: "id", Value: []byte(ev.ID)},
+			},
+		}
+	}
+	return s.w.WriteMessages(ctx, msgs...)
+}
+
+func (s *kafkaSink) Close() error { return s.w.Close() }
+
+// natsSink publishes each event to JetStream on <subject>.<type>, with the
+// block hash and event ID as message ID so the stream drops duplicates sent
+// after a retry.
+type natsSink struct {
+	nc      *nats.Conn
+	js      jetstream.JetStream
+	subject string
+}
+
+func (s *natsSink) Publish(ctx context.Context, events []OutboxEvent) error {
+	for _, ev := range events {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		msg := nats.NewMsg(s.subject + "." + ev.Type)
+		msg.Data = data
+		if _, err := s.js.PublishMsg(ctx, msg, jetstream.WithMsgID(ev.BlockHash+":"+ev.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *natsSink) Close() error {
+	return s.nc.Drain()
+}
+
+// startPublisher publishes the store's outbox to the -publish broker until
+// shutdown. Events are removed from the outbox only once the broker has
+// acknowledged them, so each is delivered at least once: after a failure
+// or a crash, unacknowledged events are sent again.
+func startPublisher(store Store) error {
+	outbox, ok := store.(OutboxStore)
+	if !ok {
+		return fmt.Errorf("publishing events needs an outbox; use -store bolt, sqlite or postgres, not %s", storeKind)
+	}
+	sink, err := newEventSink(publishURL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		publishOutbox(ctx, outbox, sink)
+	}()
+	onShutdown(func(context.Context) error {
+		cancel()
+		<-done
+		return sink.Close()
+	})
+	log.Printf("Publishing events to %s", publishURL)
+	return nil
+}
+
+func publishOutbox(ctx context.Context, outbox OutboxStore, sink eventSink) {
+	blocks, unsubscribe := NewBlocks.Subscribe()
+	defer unsubscribe()
+	poll := time.NewTicker(publishPollEvery)
+	defer poll.Stop()
+	backoff := time.Second
+	for {
+		n, err := publishBatch(ctx, outbox, sink)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			publishErrors.Inc()
+			log.Printf("Error publishing events, retrying in %v: %v", backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, publishRetryMax)
+			continue
+		}
+		backoff = time.Second
+		if n == outboxBatch {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-blocks:
+		case <-poll.C:
+		}
+	}
+}
+
+// publishBatch sends the oldest queued events and acknowledges them in the
+// outbox. It returns how many it sent.
+func publishBatch(ctx context.Context, outbox OutboxStore, sink eventSink) (int, error) {
+	events, err := outbox.PendingEvents(outboxBatch)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+	if err := sink.Publish(ctx, events); err != nil {
+		return 0, err
+	}
+	eventsPublished.Add(float64(len(events)))
+	if err := outbox.AckEvents(events[len(events)-1].Seq); err != nil {
+		return 0, fmt.Errorf("acknowledge events: %w", err)
+	}
+	return len(events), nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"blockchain/apierr"
+)
+
+var (
+	consensusMode = "pow"
+	raftID        string
+	raftAddr      = "127.0.0.1:7000"
+	raftDir       = "raft"
+	raftBootstrap bool
+	raftJoin      string
+	raftJoinKey   string
+	raftTimeout   = 10 * time.Second
+)
+
+// Consensus is set when the node runs in raft mode.
+var Consensus *RaftNode
+
+const (
+	raftOpBlock  = "block"
+	raftOpMember = "member"
+)
+
+type raftCommand struct {
+	Op      string `json:"op"`
+	Block   *Block `json:"block,omitempty"`
+	ID      string `json:"id,omitempty"`
+	HTTPURL string `json:"http_url,omitempty"`
+}
+
+// RaftNode orders blocks through a Raft log. The leader mines each block and
+// proposes it; every member appends it once a quorum has committed it.
+type RaftNode struct {
+	raft *raft.Raft
+	fsm  *chainFSM
+}
+
+type chainFSM struct {
+	bc      *Blockchain
+	mu      sync.RWMutex
+	members map[string]string
+	// failed is the first committed block this member could not apply.
+	// Every later one is refused with it, and /readyz reports it, since
+	// the local chain no longer follows the log.
+	failed error
+}
+
+func (f *chainFSM) Apply(l *raft.Log) any {
+	var cmd raftCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return err
+	}
+	switch cmd.Op {
+	case raftOpBlock:
+		if err := f.Failed(); err != nil {
+			return err
+		}
+		if err := f.bc.applyCommitted(cmd.Block); err != nil {
+			err = fmt.Errorf("apply raft log entry %d: %w", l.Index, err)
+			log.Printf("Error: %v; this member is out of step with the cluster and no longer ready", err)
+			f.mu.Lock()
+			f.failed = err
+			f.mu.Unlock()
+			return err
+		}
+		return nil
+	case raftOpMember:
+		f.mu.Lock()
+		f.members[cmd.ID] = cmd.HTTPURL
+		f.mu.Unlock()
+		return nil
+	default:
+		return fmt.Errorf("unknown raft command %q", cmd.Op)
+	}
+}
+
+// Failed returns the error that stopped this member applying blocks, if
+// any.
+func (f *chainFSM) Failed() error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.failed
+}
+
+type chainFSMSnapshot struct {
+	Blocks  []*Block          `json:"blocks"`
+	Members map[string]string `json:"members"`
+}
+
+func (f *chainFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	members := make(map[string]string, len(f.members))
+	for k, v := range f.members {
+		members[k] = v
+	}
+	return &chainFSMSnapshot{Blocks: f.bc.Snapshot(), Members: members}, nil
+}
+
+func (f *chainFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var snap chainFSMSnapshot
+	if err := json.NewDecoder(rc).Decode(&snap); err != nil {
+		return err
+	}
+	if err := f.bc.checkReplacement(snap.Blocks); err != nil {
+		return err
+	}
+	if err := f.bc.install(snap.Blocks); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.members = snap.Members
+	f.failed = nil
+	f.mu.Unlock()
+	return nil
+}
+
+func (s *chainFSMSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *chainFSMSnapshot) Release() {}
+
+// applyCommitted appends a block committed by Raft. The leader holds writeMu
+// while waiting for the commit, so neither this nor Restore may take it;
+// the FSM applies one entry at a time on its own.
+//
+// The bootstrap leader commits its genesis block first, so members that
+// created their own genesis before joining switch to the cluster's.
+func (bc *Blockchain) applyCommitted(block *Block) error {
+	if block == nil || block.Pos < 0 {
+		return errors.New("raft log entry holds no block")
+	}
+	tip := bc.Tip()
+	if block.Pos == 0 && tip.Pos == 0 && tip.Hash != block.Hash {
+		genesis := []*Block{block}
+		if err := bc.checkReplacement(genesis); err != nil {
+			return err
+		}
+		return bc.install(genesis)
+	}
+	if block.Pos <= tip.Pos && bc.Snapshot()[block.Pos].Hash == block.Hash {
+		return nil
+	}
+	if err := checkBlock(block, tip); err != nil {
+		return err
+	}
+	if err := bc.checkPeerBlock(block); err != nil {
+		return err
+	}
+	if err := storeAppend(context.Background(), bc.store, block); err != nil {
+		return err
+	}
+	bc.appendBlock(block)
+	return nil
+}
+
+func startRaft(bc *Blockchain) (*RaftNode, error) {
+	if raftID == "" {
+		return nil, errors.New("raft mode needs -raft-id")
+	}
+	if err := os.MkdirAll(raftDir, 0o700); err != nil {
+		return nil, err
+	}
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(raftID)
+
+	store, err := newRaftBoltStore(filepath.Join(raftDir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(raftDir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveTCPAddr("tcp", raftAddr)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(raftAddr, addr, 3, raftTimeout, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	fsm := &chainFSM{bc: bc, members: map[string]string{}}
+	r, err := raft.NewRaft(config, fsm, store, store, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+	node := &RaftNode{raft: r, fsm: fsm}
+	onShutdown(func(context.Context) error {
+		if err := r.Shutdown().Error(); err != nil {
+			return err
+		}
+		return store.Close()
+	})
+
+	if raftBootstrap {
+		cfg := raft.Configuration{Servers: []raft.Server{{ID: config.LocalID, Address: transport.LocalAddr()}}}
+		if err := r.BootstrapCluster(cfg).Error(); err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+			return nil, err
+		}
+		go func() {
+			for !node.IsLeader() {
+				time.Sleep(100 * time.Millisecond)
+			}
+			if err := node.apply(raftCommand{Op: raftOpMember, ID: raftID, HTTPURL: advertiseURL}); err != nil {
+				log.Printf("Error registering raft member: %v", err)
+			}
+			if err := node.apply(raftCommand{Op: raftOpBlock, Block: bc.Snapshot()[0]}); err != nil {
+				log.Printf("Error committing genesis block: %v", err)
+			}
+		}()
+	}
+	if raftJoin != "" {
+		if err := joinRaft(raftJoin); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+func joinRaft(leader string) error {
+	if advertiseURL == "" {
+		return errors.New("joining a raft cluster needs -advertise")
+	}
+	req, err := newPeerRequest("POST", leader+"/raft/join", map[string]string{
+		"id":        raftID,
+		"raft_addr": raftAddr,
+		"http_url":  advertiseURL,
+	})
+	if err != nil {
+		return err
+	}
+	if raftJoinKey != "" {
+		key, err := fetchSecret(raftJoinKey)
+		if err != nil {
+			return fmt.Errorf("-raft-join-key: %w", err)
+		}
+		req.Header.Set("X-API-Key", strings.TrimSpace(string(key)))
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("join %s: %s", leader, resp.Status)
+	}
+	return nil
+}
+
+func (n *RaftNode) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+func (n *RaftNode) apply(cmd raftCommand) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	future := n.raft.Apply(data, raftTimeout)
+	if err := future.Error(); err != nil {
+		return err
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// Commit proposes block and returns once a quorum has committed and applied
+// it locally.
+func (n *RaftNode) Commit(block *Block) error {
+	if !n.IsLeader() {
+		return errors.New("not the raft leader")
+	}
+	if err := n.fsm.Failed(); err != nil {
+		return err
+	}
+	return n.apply(raftCommand{Op: raftOpBlock, Block: block})
+}
+
+func (n *RaftNode) leaderURL() string {
+	_, id := n.raft.LeaderWithID()
+	n.fsm.mu.RLock()
+	defer n.fsm.mu.RUnlock()
+	return n.fsm.members[string(id)]
+}
+
+// forwardToLeader proxies requests that change the chain to the leader when
+// this node is a follower.
+func forwardToLeader(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if Consensus == nil || Consensus.IsLeader() || tenantOf(r).ID != "" {
+			next(w, r)
+			return
+		}
+		leader := Consensus.leaderURL()
+		target, err := url.Parse(leader)
+		if leader == "" || err != nil {
+			writeError(w, r, apierr.New(apierr.Unavailable, "no raft leader available"))
+			return
+		}
+		httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+	}
+}
+
+func raftJoinHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if Consensus == nil {
+		writeError(w, r, apierr.New(apierr.NotFound, "raft mode is not enabled"))
+		return
+	}
+	var req struct {
+		ID       string `json:"id"`
+		RaftAddr string `json:"raft_addr"`
+		HTTPURL  string `json:"http_url"`
+	}
+	if err := decodeJSON(r.Body, &req); err != nil || req.ID == "" || req.RaftAddr == "" {
+		writeError(w, r, apierr.New(apierr.InvalidRequest, "invalid join request"))
+		return
+	}
+	f := Consensus.raft.AddVoter(raft.ServerID(req.ID), raft.ServerAddress(req.RaftAddr), 0, raftTimeout)
+	if err := f.Error(); err != nil {
+		writeError(w, r, apierr.Wrap(apierr.Conflict, err))
+		return
+	}
+	if err := Consensus.apply(raftCommand{Op: raftOpMember, ID: req.ID, HTTPURL: req.HTTPURL}); err != nil {
+		writeError(w, r, apierr.Wrap(apierr.Internal, err))
+		return
+	}
+	log.Printf("Raft member %s joined at %s", req.ID, req.RaftAddr)
+	json.NewEncoder(w).Encode(map[string]string{"status": "joined"})
+}
+
+func raftStatus(w http.ResponseWriter, r *http.Request) {
+	if Consensus == nil {
+		respond(w, r, map[string]string{"mode": consensusMode})
+		return
+	}
+	addr, id := Consensus.raft.LeaderWithID()
+	respond(w, r, map[string]any{
+		"mode":        consensusMode,
+		"id":          raftID,
+		"state":       Consensus.raft.State().String(),
+		"leader_id":   id,
+		"leader_addr": addr,
+		"leader_url":  Consensus.leaderURL(),
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+
+	"blockchain/apierr"
+)
+
+// Roles carried in wallets and tokens. Librarians run the library and may act
+// for any member, members act only for themselves, and auditors only read
+// validation and report endpoints. Wallets created before these roles existed
+// have the role "staff", which is treated as librarian.
+const (
+	RoleLibrarian = "librarian"
+	RoleMember    = "member"
+	RoleAuditor   = "auditor"
+)
+
+func normalizeRole(role string) string {
+	if role == "staff" {
+		return RoleLibrarian
+	}
+	return role
+}
+
+func validRole(role string) bool {
+	switch normalizeRole(role) {
+	case RoleLibrarian, RoleMember, RoleAuditor:
+		return true
+	}
+	return false
+}
+
+// requireRole wraps next with requireAuth and admits only the given roles,
+// or API keys with the matching scope. A token bound to a tenant is only
+// admitted to that tenant's routes.
+func requireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		switch claims := authClaims(r.Context()); {
+		case claims == nil:
+		case claims.Tenant != "" && claims.Tenant != tenantOf(r).ID:
+			writeAuthError(w, r, apierr.Errorf(apierr.Forbidden, "this token is for tenant %q", claims.Tenant))
+			return
+		case claims.key != nil:
+			if !claims.key.allows(roles) {
+				writeAuthError(w, r, apierr.Errorf(apierr.Forbidden, "api key %q lacks the scope for this", claims.key.Name))
+				return
+			}
+		case !slices.Contains(roles, normalizeRole(claims.Role)):
+			writeAuthError(w, r, apierr.Errorf(apierr.Forbidden, "role %q may not do this", claims.Role))
+			return
+		}
+		next(w, r)
+	})
+}
+
+// mayRecord reports whether claims may submit a transaction of the given
+// kind: librarian-only types need a librarian's token or an admin API key or
+// HMAC client.
+func mayRecord(claims *Claims, kind string) bool {
+	if typ, ok := txTypes[kind]; !ok || !typ.Librarian || claims == nil {
+		return true
+	}
+	if claims.key != nil {
+		return claims.key.allows([]string{RoleLibrarian})
+	}
+	return normalizeRole(claims.Role) == RoleLibrarian
+}
+
+// requireSelf admits librarians, members and write API keys, members only
+// for transactions whose user is themselves, and librarian-only types only
+// from librarians and admin keys. The body is read and put back for next.
+func requireSelf(next http.HandlerFunc) http.HandlerFunc {
+	return requireRole(func(w http.ResponseWriter, r *http.Request) {
+		claims := authClaims(r.Context())
+		if claims == nil || claims.key == nil && normalizeRole(claims.Role) == RoleLibrarian {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeAuthError(w, r, apierr.New(apierr.InvalidRequest, "invalid payload"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var tx Transaction
+		if json.Unmarshal(body, &tx) == nil {
+			if claims.key == nil && memberOf(tx.User) != claims.Subject {
+				writeAuthError(w, r, apierr.New(apierr.Forbidden, "members may only act for themselves"))
+				return
+			}
+			if !mayRecord(claims, tx.Kind()) {
+				writeAuthError(w, r, apierr.Errorf(apierr.Forbidden, "only librarians may submit %s transactions", tx.Kind()))
+				return
+			}
+		}
+		next(w, r)
+	}, RoleLibrarian, RoleMember)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"blockchain/apierr"
+)
+
+var (
+	repairAndExit bool
+	repairRehash  bool
+	repairReport  string
+)
+
+// RepairedBlock is a block a repair rewrote or removed.
+type RepairedBlock struct {
+	Pos     int    `json:"pos"`
+	Hash    string `json:"hash"`
+	NewHash string `json:"new_hash,omitempty"`
+	Txs     int    `json:"transactions"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// RepairReport records what a repair found and changed.
+type RepairReport struct {
+	Time         string          `json:"time"`
+	Store        string          `json:"store"`
+	HeightBefore int             `json:"height_before"`
+	HeightAfter  int             `json:"height_after"`
+	FirstInvalid *int            `json:"first_invalid,omitempty"`
+	Reason       string          `json:"reason,omitempty"`
+	Rehashed     []RepairedBlock `json:"rehashed,omitempty"`
+	Dropped      []RepairedBlock `json:"dropped,omitempty"`
+	Backup       string          `json:"backup,omitempty"`
+	ReportFile   string          `json:"report_file,omitempty"`
+}
+
+// repairBlocks cuts blocks at the first invalid one. With rehash it instead
+// rebuilds that block and the ones after it: each is re-linked, re-hashed,
+// re-mined and signed by this node, and the chain is cut at the first block
+// that is still invalid, such as one holding a forged transaction.
+func repairBlocks(blocks []*Block, rehash bool) ([]*Block, RepairReport) {
+	report := RepairReport{HeightBefore: len(blocks)}
+	v := validateBlocks(blocks, nil)
+	if v.Valid {
+		report.HeightAfter = len(blocks)
+		return blocks, report
+	}
+	report.FirstInvalid, report.Reason = v.FirstInvalid, v.Reason
+	first := *v.FirstInvalid
+	out := blocks[:first:first]
+	i := first
+	if rehash {
+		var prev *Block
+		if first > 0 {
+			prev = blocks[first-1]
+		}
+		for ; i < len(blocks); i++ {
+			b := blocks[i]
+			nb := *b
+			nb.Migrated = nil
+			nb.Version = currentBlockVersion
+			if nb.UnixMilli == 0 {
+				nb.UnixMilli = b.Time().UnixMilli()
+			}
+			nb.Prevhash = ""
+			if prev != nil {
+				nb.Prevhash = prev.Hash
+			}
+			nb.MerkleRoot = merkleRoot(nb.Version, nb.Transactions)
+			nb.Producer = nodePublicKey()
+			nb.mineBlock()
+			nb.sign(NodeKey)
+			if err := checkBlock(&nb, prev); err != nil {
+				report.Dropped = append(report.Dropped, RepairedBlock{Pos: b.Pos, Hash: b.Hash, Txs: len(b.Transactions), Reason: err.Error()})
+				i++
+				break
+			}
+			report.Rehashed = append(report.Rehashed, RepairedBlock{Pos: b.Pos, Hash: b.Hash, NewHash: nb.Hash, Txs: len(nb.Transactions)})
+			out = append(out, &nb)
+			prev = &nb
+		}
+	}
+	for ; i < len(blocks); i++ {
+		b := blocks[i]
+		report.Dropped = append(report.Dropped, RepairedBlock{Pos: b.Pos, Hash: b.Hash, Txs: len(b.Transactions)})
+	}
+	report.HeightAfter = len(out)
+	return out, report
+}
+
+// Repair fixes a chain that fails validation by truncating it at the first
+// invalid block, or rebuilding from there with rehash. The chain as it was
+// is written to a backup archive first, and the report to reportPath, or a
+// repair-<time>.json file in the data directory if that is empty.
+func (bc *Blockchain) Repair(rehash bool, reportPath string) (RepairReport, error) {
+	if Consensus != nil {
+		return RepairReport{}, errors.New("a raft member cannot repair its chain on its own; restore it from another member")
+	}
+	bc.writeMu.Lock()
+	defer bc.writeMu.Unlock()
+	now := time.Now()
+	blocks := bc.Snapshot()
+	repaired, report := repairBlocks(blocks, rehash)
+	report.Time = now.UTC().Format(time.RFC3339)
+	report.Store = storeKind
+	if report.FirstInvalid == nil {
+		return report, nil
+	}
+	if len(repaired) == 0 {
+		return report, errors.New("the genesis block is invalid; restore the chain from a backup or repair with rehash")
+	}
+	report.Backup = filepath.Join(dataDir, fmt.Sprintf("chain-backup-%d-repair-%d.tar.gz", len(blocks)-1, now.Unix()))
+	f, err := os.Create(report.Backup)
+	if err != nil {
+		return report, err
+	}
+	err = writeBackup(f, blocks)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return report, fmt.Errorf("write %s: %w", report.Backup, err)
+	}
+	if err := bc.install(repaired); err != nil {
+		return report, err
+	}
+	report.ReportFile = reportPath
+	if report.ReportFile == "" {
+		report.ReportFile = filepath.Join(dataDir, fmt.Sprintf("repair-%d.json", now.Unix()))
+	}
+	err = writeFileAtomic(report.ReportFile, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	})
+	if err != nil {
+		return report, fmt.Errorf("write %s: %w", report.ReportFile, err)
+	}
+	log.Printf("Repaired chain from block %d: %d blocks rehashed, %d dropped; previous chain in %s, report in %s",
+		*report.FirstInvalid, len(report.Rehashed), len(report.Dropped), report.Backup, report.ReportFile)
+	return report, nil
+}
+
+// adminRepair repairs the chain; ?rehash=true rebuilds the blocks after the
+// damage instead of dropping them.
+func adminRepair(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rehash := false
+	if v := r.URL.Query().Get("rehash"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, r, apierr.New(apierr.InvalidRequest, "rehash must be true or false"))
+			return
+		}
+		rehash = b
+	}
+	report, err := BlockChain.Repair(rehash, "")
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.Internal, err).WithDetails(report))
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// overdueScanInterval enables a background scan that keeps the overdue
+// report ready; with 0 the report is built on every request.
+var overdueScanInterval time.Duration
+
+type OverdueGroup struct {
+	User  string `json:"user"`
+	Loans []Loan `json:"loans"`
+}
+
+type OverdueReport struct {
+	AsOf        string         `json:"as_of"`
+	GeneratedAt string         `json:"generated_at"`
+	Total       int            `json:"total"`
+	Users       []OverdueGroup `json:"users"`
+}
+
+var overdueCache struct {
+	mu     sync.RWMutex
+	report *OverdueReport
+}
+
+// Loans returns every current loan.
+func (bc *Blockchain) Loans() []Loan {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	loans := make([]Loan, 0, len(bc.state.loans))
+	for _, l := range bc.state.loans {
+		loans = append(loans, l)
+	}
+	return loans
+}
+
+// overdueReport lists loans whose due date is before the day of now,
+// grouped by member.
+func overdueReport(bc *Blockchain, now time.Time) *OverdueReport {
+	today := now.UTC().Format(time.DateOnly)
+	byUser := map[string][]Loan{}
+	total := 0
+	for _, l := range bc.Loans() {
+		due, err := parseDate(l.DueDate)
+		if err != nil || due.Format(time.DateOnly) >= today {
+			continue
+		}
+		byUser[l.User] = append(byUser[l.User], l)
+		total++
+	}
+	report := &OverdueReport{AsOf: today, GeneratedAt: now.UTC().Format(time.RFC3339), Total: total, Users: []OverdueGroup{}}
+	for user, loans := range byUser {
+		sort.Slice(loans, func(i, j int) bool { return loans[i].DueDate < loans[j].DueDate })
+		report.Users = append(report.Users, OverdueGroup{User: user, Loans: loans})
+	}
+	sort.Slice(report.Users, func(i, j int) bool { return report.Users[i].User < report.Users[j].User })
+	return report
+}
+
+func overdueScanLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		report := overdueReport(BlockChain, clock.Now())
+		overdueCache.mu.Lock()
+		overdueCache.report = report
+		overdueCache.mu.Unlock()
+		if report.Total > 0 {
+			log.Printf("Overdue scan: %d loans past due for %d members", report.Total, len(report.Users))
+		}
+	}
+}
+
+func getOverdueReport(w http.ResponseWriter, r *http.Request) {
+	t := tenantOf(r)
+	var report *OverdueReport
+	if t.ID == "" {
+		overdueCache.mu.RLock()
+		report = overdueCache.report
+		overdueCache.mu.RUnlock()
+	}
+	if report == nil {
+		report = overdueReport(t.chain, clock.Now())
+	}
+	respond(w, r, report)
+}
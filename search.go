@@ -0,0 +1,275 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/mapping"
+
+	"blockchain/apierr"
+)
+
+// SearchIndex is a full-text index over the catalog's books and the members
+// named in transactions. It lives in memory: it is built from the catalog
+// and the chain at startup and kept up to date as both change.
+type SearchIndex struct {
+	mu    sync.RWMutex
+	idx   bleve.Index
+	books *Catalog
+}
+
+var Search *SearchIndex
+
+// SearchHit is one match, best first. Book holds the catalog entry of a
+// matching book.
+type SearchHit struct {
+	Type  string  `json:"type"`
+	ID    string  `json:"id"`
+	Score float64 `json:"score"`
+	Book  *Book   `json:"book,omitempty"`
+}
+
+type SearchResults struct {
+	Query string      `json:"query"`
+	Total int         `json:"total"`
+	Hits  []SearchHit `json:"hits"`
+}
+
+func searchMapping() mapping.IndexMapping {
+	keyword := bleve.NewKeywordFieldMapping()
+	keyword.IncludeInAll = false
+
+	book := bleve.NewDocumentMapping()
+	book.AddFieldMappingsAt("type", keyword)
+	book.AddFieldMappingsAt("title", bleve.NewTextFieldMapping())
+	book.AddFieldMappingsAt("author", bleve.NewTextFieldMapping())
+	book.AddFieldMappingsAt("isbn", bleve.NewKeywordFieldMapping())
+	book.AddFieldMappingsAt("kind", bleve.NewKeywordFieldMapping())
+	book.AddFieldMappingsAt("serial", bleve.NewKeywordFieldMapping())
+	book.AddFieldMappingsAt("withdrawn", bleve.NewBooleanFieldMapping())
+
+	user := bleve.NewDocumentMapping()
+	user.AddFieldMappingsAt("type", keyword)
+	user.AddFieldMappingsAt("name", bleve.NewTextFieldMapping())
+
+	m := bleve.NewIndexMapping()
+	m.TypeField = "type"
+	m.AddDocumentMapping("book", book)
+	m.AddDocumentMapping("user", user)
+	return m
+}
+
+// NewSearchIndex indexes books and the members in blocks, and follows the
+// catalog's changes from then on.
+func NewSearchIndex(books *Catalog, blocks []*Block) (*SearchIndex, error) {
+	idx, err := buildSearchIndex(books, blocks)
+	if err != nil {
+		return nil, err
+	}
+	s := &SearchIndex{idx: idx, books: books}
+	books.search = s
+	return s, nil
+}
+
+// buildSearchIndex indexes every book in the catalog and every member on
+// the chain.
+func buildSearchIndex(books *Catalog, blocks []*Block) (bleve.Index, error) {
+	idx, err := bleve.NewMemOnly(searchMapping())
+	if err != nil {
+		return nil, err
+	}
+	batch := idx.NewBatch()
+	for _, b := range books.List(true) {
+		if err := batch.Index(bookDoc(b)); err != nil {
+			return nil, err
+		}
+	}
+	seen := map[string]bool{}
+	for _, b := range blocks {
+		for _, tx := range b.Transactions {
+			if user := searchUser(tx); user != "" && !seen[user] {
+				seen[user] = true
+				if err := batch.Index(userDoc(user)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if err := idx.Batch(batch); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Rebuild indexes the catalog and blocks afresh, for when the chain has been
+// replaced and members may have gone from it.
+func (s *SearchIndex) Rebuild(books *Catalog, blocks []*Block) error {
+	idx, err := buildSearchIndex(books, blocks)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	old := s.idx
+	s.idx = idx
+	s.mu.Unlock()
+	return old.Close()
+}
+
+func (s *SearchIndex) index() bleve.Index {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.idx
+}
+
+func bookDoc(b Book) (string, any) {
+	return "book:" + b.Id, map[string]any{
+		"type":      "book",
+		"title":     b.Title,
+		"author":    b.Author,
+		"isbn":      isbnDigits(b.ISBN),
+		"kind":      b.kindOf(),
+		"serial":    b.Serial,
+		"withdrawn": b.Withdrawn,
+	}
+}
+
+func userDoc(name string) (string, any) {
+	return "user:" + name, map[string]any{"type": "user", "name": name}
+}
+
+// searchUser is the member a transaction names, as search should show them:
+// the user of a detached transaction is taken from its payload, and nothing
+// is indexed for one that was redacted. Encrypted users and pseudonyms are
+// left out too, so that /search neither shows ciphertext nor links a
+// pseudonym to its member.
+func searchUser(tx Transaction) string {
+	user := tx.User
+	if tx.PayloadHash != "" {
+		if Payloads == nil {
+			return ""
+		}
+		p, err := Payloads.Get(tx.PayloadHash)
+		if err != nil {
+			return ""
+		}
+		user = p.User
+	}
+	if strings.HasPrefix(user, sealedUserPrefix) || strings.HasPrefix(user, pseudonymPrefix) {
+		return ""
+	}
+	return user
+}
+
+// isbnDigits drops the hyphens and spaces an ISBN may be written with, so
+// either form finds the book.
+func isbnDigits(s string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(s)
+}
+
+// IndexBlock adds the members a block names. Books come through the
+// catalog, which indexes them as it learns of them.
+func (s *SearchIndex) IndexBlock(b *Block) {
+	idx := s.index()
+	batch := idx.NewBatch()
+	for _, tx := range b.Transactions {
+		user := searchUser(tx)
+		if user == "" {
+			continue
+		}
+		if err := batch.Index(userDoc(user)); err != nil {
+			log.Printf("Error indexing user %s of block %d for search: %v", user, b.Pos, err)
+		}
+	}
+	if err := idx.Batch(batch); err != nil {
+		log.Printf("Error indexing block %d for search: %v", b.Pos, err)
+	}
+}
+
+// IndexBook adds or replaces a book.
+func (s *SearchIndex) IndexBook(b Book) {
+	if err := s.index().Index(bookDoc(b)); err != nil {
+		log.Printf("Error indexing book %s for search: %v", b.Id, err)
+	}
+}
+
+// indexBook keeps the search index in step with the catalog, once there is
+// one.
+func (c *Catalog) indexBook(b Book) {
+	if c.search != nil {
+		c.search.IndexBook(b)
+	}
+}
+
+// Query runs a query string, such as "tolkien" or "title:hobbit author:tolk*",
+// over the index. kind limits it to "book" or "user"; withdrawn books are
+// left out unless includeWithdrawn is set.
+func (s *SearchIndex) Query(q, kind string, includeWithdrawn bool, offset, limit int) (SearchResults, error) {
+	terms := q
+	if validISBN(q) {
+		terms = isbnDigits(q)
+	}
+	qs := bleve.NewQueryStringQuery(terms)
+	if _, err := qs.Parse(); err != nil {
+		return SearchResults{}, apierr.Errorf(apierr.InvalidRequest, "invalid query: %v", err)
+	}
+	bq := bleve.NewBooleanQuery()
+	bq.AddMust(qs)
+	if kind != "" {
+		tq := bleve.NewTermQuery(kind)
+		tq.SetField("type")
+		bq.AddMust(tq)
+	}
+	if !includeWithdrawn {
+		wq := bleve.NewBoolFieldQuery(true)
+		wq.SetField("withdrawn")
+		bq.AddMustNot(wq)
+	}
+	res, err := s.index().Search(bleve.NewSearchRequestOptions(bq, limit, offset, false))
+	if err != nil {
+		return SearchResults{}, err
+	}
+	out := SearchResults{Query: q, Total: int(res.Total), Hits: []SearchHit{}}
+	for _, h := range res.Hits {
+		kind, id, _ := strings.Cut(h.ID, ":")
+		hit := SearchHit{Type: kind, ID: id, Score: h.Score}
+		if kind == "book" {
+			b, err := s.books.Get(id)
+			if err != nil {
+				continue
+			}
+			hit.Book = &b
+		}
+		out.Hits = append(out.Hits, hit)
+	}
+	return out, nil
+}
+
+// search answers GET /search?q=, with optional type (book or user),
+// include_withdrawn, offset and limit.
+func search(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	text := strings.TrimSpace(q.Get("q"))
+	if text == "" {
+		writeError(w, r, apierr.New(apierr.InvalidRequest, "q is required"))
+		return
+	}
+	kind := q.Get("type")
+	if kind != "" && kind != "book" && kind != "user" {
+		writeError(w, r, apierr.New(apierr.InvalidRequest, "type must be book or user"))
+		return
+	}
+	offset, limit, err := parsePage(r)
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.InvalidRequest, err))
+		return
+	}
+	results, err := tenantOf(r).search.Query(text, kind, q.Get("include_withdrawn") == "true", offset, limit)
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	respond(w, r, results)
+}
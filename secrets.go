@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"blockchain/keys"
+)
+
+// Secret sources, one per secret. Empty keeps the secret in its file under
+// the data directory, created on first run where the node can make one.
+var (
+	nodeKeySource      string
+	authKeySource      string
+	pseudonymKeySource string
+	hmacClientsSource  string
+	secretRefresh      time.Duration
+)
+
+var secretClient = &http.Client{Timeout: 15 * time.Second}
+
+// fetchSecret reads a secret from its source:
+//
+//	env:NAME          an environment variable
+//	file:PATH         a file
+//	cmd:COMMAND       what a shell command prints
+//	vault:PATH#FIELD  a field of a HashiCorp Vault secret (KV version 1 or 2)
+//	aws-kms:SOURCE    a ciphertext from another source, in base64, decrypted
+//	                  with AWS KMS
+func fetchSecret(src string) ([]byte, error) {
+	kind, arg, ok := strings.Cut(src, ":")
+	if !ok || arg == "" {
+		return nil, fmt.Errorf("secret source %q is not env:, file:, cmd:, vault: or aws-kms:", src)
+	}
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(arg)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", arg)
+		}
+		return []byte(v), nil
+	case "file":
+		return os.ReadFile(arg)
+	case "cmd":
+		cmd := exec.Command("sh", "-c", arg)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("secret command: %w", err)
+		}
+		return out, nil
+	case "vault":
+		path, field, ok := strings.Cut(arg, "#")
+		if !ok || field == "" {
+			return nil, fmt.Errorf("vault source %q needs a #field", src)
+		}
+		v, err := vaultFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return v.Read(path, field)
+	case "aws-kms":
+		blob, err := fetchSecret(arg)
+		if err != nil {
+			return nil, err
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(blob)))
+		if err != nil {
+			return nil, errors.New("aws-kms ciphertext is not base64")
+		}
+		return kmsDecrypt(ciphertext)
+	default:
+		return nil, fmt.Errorf("secret source %q is not env:, file:, cmd:, vault: or aws-kms:", src)
+	}
+}
+
+// fetchKey reads a key of at least min bytes from src, written as hex or in
+// base64.
+func fetchKey(src string, min int) ([]byte, error) {
+	text, err := fetchSecret(src)
+	if err != nil {
+		return nil, err
+	}
+	text = bytes.TrimSpace(text)
+	key, err := hex.DecodeString(string(text))
+	if err != nil {
+		if key, err = base64.StdEncoding.DecodeString(string(text)); err != nil {
+			return nil, errors.New("key is neither hex nor base64")
+		}
+	}
+	if len(key) < min {
+		return nil, fmt.Errorf("key is %d bytes, less than %d", len(key), min)
+	}
+	return key, nil
+}
+
+// loadSecret reads a key from src or, without one, from the file at path,
+// creating it there on first run.
+func loadSecret(src, path string) ([]byte, error) {
+	if src == "" {
+		return loadOrCreateSecret(path)
+	}
+	return fetchKey(src, 32)
+}
+
+// loadNodeKey reads the node's identity key, an Ed25519 seed, from
+// -node-key-source or, without one, from -node-key.
+func loadNodeKey() (ed25519.PrivateKey, error) {
+	if nodeKeySource == "" {
+		return keys.LoadOrCreateNodeKey(nodeKeyFile)
+	}
+	seed, err := fetchKey(nodeKeySource, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("node key is %d bytes, not %d", len(seed), ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// refreshSecrets rereads, every interval, the secrets the node can swap
+// while it runs: the token signing key and the HMAC clients. The node key,
+// the pseudonym key and encryption keys are read once, since the chain
+// depends on them.
+func refreshSecrets(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if authKeySource != "" {
+			key, err := fetchKey(authKeySource, 32)
+			switch {
+			case err != nil:
+				log.Printf("Keeping the token signing key: %v", err)
+			case Tokens.Rotate(key):
+				log.Printf("Rotated the token signing key from %s", authKeySource)
+			}
+		}
+		if hmacClientsSource != "" && HMACClients != nil {
+			data, err := fetchSecret(hmacClientsSource)
+			var clients map[string]HMACClient
+			if err == nil {
+				clients, err = parseHMACClients(data)
+			}
+			if err != nil {
+				log.Printf("Keeping the HMAC clients: %v", err)
+				continue
+			}
+			HMACClients.replace(clients)
+		}
+	}
+}
+
+// vaultClient reads secrets from Vault's HTTP API. It is set up from the
+// environment the Vault CLI uses: VAULT_ADDR, VAULT_NAMESPACE, and either
+// VAULT_TOKEN or an AppRole in VAULT_ROLE_ID and VAULT_SECRET_ID. Its token
+// is renewed before it expires, and an AppRole logs in again when renewal
+// fails.
+type vaultClient struct {
+	addr      string
+	namespace string
+	roleID    string
+	secretID  string
+
+	mu       sync.Mutex
+	token    string
+	renewing bool
+}
+
+var (
+	vaultOnce sync.Once
+	vault     *vaultClient
+	vaultErr  error
+)
+
+func vaultFromEnv() (*vaultClient, error) {
+	vaultOnce.Do(func() {
+		addr := os.Getenv("VAULT_ADDR")
+		if addr == "" {
+			vaultErr = errors.New("vault: sources need VAULT_ADDR")
+			return
+		}
+		vault = &vaultClient{
+			addr:      strings.TrimRight(addr, "/"),
+			namespace: os.Getenv("VAULT_NAMESPACE"),
+			roleID:    os.Getenv("VAULT_ROLE_ID"),
+			secretID:  os.Getenv("VAULT_SECRET_ID"),
+			token:     os.Getenv("VAULT_TOKEN"),
+		}
+		if vault.token == "" && vault.roleID == "" {
+			vault, vaultErr = nil, errors.New("vault: sources need VAULT_TOKEN, or VAULT_ROLE_ID and VAULT_SECRET_ID")
+		}
+	})
+	return vault, vaultErr
+}
+
+// vaultAuth is the auth block of a Vault response.
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+func (v *vaultClient) call(method, path string, body, out any) error {
+	var in io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		in = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, v.addr+"/v1/"+strings.TrimLeft(path, "/"), in)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	token := v.token
+	v.mu.Unlock()
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	resp, err := secretClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("vault: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(data, &e)
+		return fmt.Errorf("vault: %s %s: %s %s", method, path, resp.Status, strings.Join(e.Errors, "; "))
+	}
+	return json.Unmarshal(data, out)
+}
+
+// login gets a token for the AppRole.
+func (v *vaultClient) login() (vaultAuth, error) {
+	var resp struct {
+		Auth vaultAuth `json:"auth"`
+	}
+	v.mu.Lock()
+	v.token = ""
+	v.mu.Unlock()
+	err := v.call("POST", "auth/approle/login", map[string]string{"role_id": v.roleID, "secret_id": v.secretID}, &resp)
+	if err != nil {
+		return vaultAuth{}, err
+	}
+	v.mu.Lock()
+	v.token = resp.Auth.ClientToken
+	v.mu.Unlock()
+	return resp.Auth, nil
+}
+
+// Read returns one field of the secret at path. KV version 2 paths include
+// data/, as in secret/data/library.
+func (v *vaultClient) Read(path, field string) ([]byte, error) {
+	if err := v.start(); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := v.call("GET", path, nil, &resp); err != nil {
+		return nil, err
+	}
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	s, ok := data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault: %s has no string field %q", path, field)
+	}
+	return []byte(s), nil
+}
+
+// start logs in if need be and starts renewing the token, once.
+func (v *vaultClient) start() error {
+	v.mu.Lock()
+	if v.renewing {
+		v.mu.Unlock()
+		return nil
+	}
+	v.renewing = true
+	token := v.token
+	v.mu.Unlock()
+	var auth vaultAuth
+	var err error
+	if token == "" {
+		auth, err = v.login()
+	} else {
+		auth, err = v.lookupSelf()
+	}
+	if err != nil {
+		v.mu.Lock()
+		v.renewing = false
+		v.mu.Unlock()
+		return err
+	}
+	go v.renewLoop(auth)
+	return nil
+}
+
+func (v *vaultClient) lookupSelf() (vaultAuth, error) {
+	var resp struct {
+		Data struct {
+			TTL       int  `json:"ttl"`
+			Renewable bool `json:"renewable"`
+		} `json:"data"`
+	}
+	if err := v.call("GET", "auth/token/lookup-self", nil, &resp); err != nil {
+		return vaultAuth{}, err
+	}
+	return vaultAuth{LeaseDuration: resp.Data.TTL, Renewable: resp.Data.Renewable}, nil
+}
+
+// renewLoop renews the token when two thirds of its lease have passed. A
+// token that never expires is left alone; one that cannot be renewed is
+// replaced by logging in again, which needs an AppRole.
+func (v *vaultClient) renewLoop(auth vaultAuth) {
+	for auth.LeaseDuration > 0 {
+		time.Sleep(time.Duration(auth.LeaseDuration) * time.Second * 2 / 3)
+		var err error
+		if auth.Renewable {
+			var resp struct {
+				Auth vaultAuth `json:"auth"`
+			}
+			if err = v.call("POST", "auth/token/renew-self", map[string]any{}, &resp); err == nil {
+				auth = resp.Auth
+				continue
+			}
+		}
+		if v.roleID == "" {
+			if err == nil {
+				err = errors.New("token is not renewable")
+			}
+			log.Printf("Vault token will expire: %v", err)
+			return
+		}
+		if auth, err = v.login(); err != nil {
+			log.Printf("Error logging in to Vault again: %v", err)
+			auth = vaultAuth{LeaseDuration: 90}
+		}
+	}
+}
+
+// kmsDecrypt decrypts a ciphertext with AWS KMS, using the credentials and
+// region in the standard AWS_* variables. AWS_ENDPOINT_URL_KMS overrides the
+// endpoint.
+func kmsDecrypt(ciphertext []byte) ([]byte, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if region == "" || accessKey == "" || secretKey == "" {
+		return nil, errors.New("aws-kms: sources need AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_KMS")
+	if endpoint == "" {
+		endpoint = "https://kms." + region + ".amazonaws.com"
+	}
+	body, _ := json.Marshal(map[string]string{"CiphertextBlob": base64.StdEncoding.EncodeToString(ciphertext)})
+	req, err := http.NewRequest("POST", strings.TrimRight(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signAWS(req, body, accessKey, secretKey, region, "kms", time.Now().UTC())
+	resp, err := secretClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("aws-kms: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("aws-kms: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("aws-kms: %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	var out struct {
+		Plaintext []byte `json:"Plaintext"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("aws-kms: %w", err)
+	}
+	return out.Plaintext, nil
+}
+
+// signAWS signs a request with AWS Signature Version 4, covering the host,
+// the body and every X-Amz- and Content-Type header already set.
+func signAWS(req *http.Request, body []byte, accessKey, secretKey, region, service string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodySum := sha256.Sum256(body)
+	canonical := strings.Join([]string{
+		req.Method, path, req.URL.RawQuery, canonicalHeaders.String(), signed, hex.EncodeToString(bodySum[:]),
+	}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var shutdownTimeout = 30 * time.Second
+
+// shuttingDown is set once a stop signal arrives, so /readyz takes the node
+// out of rotation while requests drain.
+var shuttingDown atomic.Bool
+
+var (
+	shutdownMu    sync.Mutex
+	shutdownHooks []func(context.Context) error
+)
+
+// onShutdown registers fn to run after the HTTP server has drained. Hooks run
+// in reverse order of registration, so whatever is started first, such as
+// the store, is stopped last.
+func onShutdown(fn func(context.Context) error) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+// runServer serves HTTP until SIGINT or SIGTERM. It then stops accepting
+// connections, waits up to -shutdown-timeout for in-flight requests, and
+// runs the shutdown hooks within what is left of that time.
+func runServer(srv *http.Server) error {
+	errc := make(chan error, 1)
+	go func() { errc <- serve(srv) }()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errc:
+		return err
+	case s := <-sig:
+		log.Printf("Received %v, shutting down", s)
+	}
+	signal.Stop(sig)
+	shuttingDown.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var errs []error
+	if err := srv.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		errs = append(errs, err)
+	}
+	shutdownMu.Lock()
+	hooks := shutdownHooks
+	shutdownMu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i](ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// streams holds a channel per open long-lived response, such as a WebSocket
+// or an event stream, closed to tell it the server is shutting down.
+// srv.Shutdown does not wait for hijacked connections and would wait out its
+// timeout on streams that never end.
+var streams = struct {
+	sync.Mutex
+	m      map[chan struct{}]struct{}
+	closed bool
+}{m: map[chan struct{}]struct{}{}}
+
+// trackStream registers a long-lived response. The returned channel is
+// closed when the server shuts down; call untrack when the stream ends.
+func trackStream() (quit <-chan struct{}, untrack func()) {
+	ch := make(chan struct{})
+	streams.Lock()
+	defer streams.Unlock()
+	if streams.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	streams.m[ch] = struct{}{}
+	return ch, func() {
+		streams.Lock()
+		delete(streams.m, ch)
+		streams.Unlock()
+	}
+}
+
+// closeStreams ends every tracked stream; srv.RegisterOnShutdown runs it
+// when the server stops.
+func closeStreams() {
+	streams.Lock()
+	defer streams.Unlock()
+	streams.closed = true
+	for ch := range streams.m {
+		close(ch)
+	}
+	clear(streams.m)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrUnsigned         = errors.New("transaction is not signed")
+	ErrInvalidPublicKey = errors.New("invalid public key")
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// SigningBytes returns the payload a client signs: the JSON encoding of the
+// transaction with the signature field left out. The due date and fine, and
+// a checkout date the node stamped, are assigned by the node after the
+// member signs, so they are left out too; the block hash still covers them.
+// So is the payload hash, which replaces the signed fields in the block.
+func (c Transaction) SigningBytes() []byte {
+	c.Signature = ""
+	c.PayloadHash = ""
+	c.DueDate = ""
+	c.Fine = 0
+	if c.Stamped {
+		c.CheckoutDate = ""
+		c.Stamped = false
+	}
+	bytes, _ := json.Marshal(c)
+	return bytes
+}
+
+func (c *Transaction) Sign(priv ed25519.PrivateKey) {
+	c.PublicKey = hex.EncodeToString(priv.Public().(ed25519.PublicKey))
+	c.Signature = hex.EncodeToString(ed25519.Sign(priv, c.SigningBytes()))
+}
+
+// Verify checks a transaction as a client sent it. Transactions in blocks
+// are checked with verifyOnChain.
+func (c Transaction) Verify() error {
+	if c.IsGenesis {
+		return nil
+	}
+	if c.PayloadHash != "" {
+		return ErrPayloadHash
+	}
+	if strings.HasPrefix(c.User, sealedUserPrefix) {
+		return ErrSealedUser
+	}
+	if c.PublicKey == "" || c.Signature == "" {
+		return ErrUnsigned
+	}
+	pub, err := hex.DecodeString(c.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return ErrInvalidPublicKey
+	}
+	sig, err := hex.DecodeString(c.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(pub), c.SigningBytes(), sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"blockchain/apierr"
+)
+
+var snapshotInterval time.Duration
+
+// Snapshot marks how far the block log has been verified: the tip there,
+// the log's length and a SHA-256 digest of it up to the tip's record, and
+// the library state last saved. Startup trusts the blocks it covers while
+// the log still matches the digest, and only verifies and replays the ones
+// after them.
+type Snapshot struct {
+	Height    int            `json:"height"`
+	TipHash   string         `json:"tip_hash"`
+	Created   string         `json:"created"`
+	Offset    int64          `json:"offset"`
+	LogDigest string         `json:"log_digest"`
+	State     *StateSnapshot `json:"state,omitempty"`
+	// Blocks is only set in snapshots from before they recorded an offset,
+	// which held every block up to the height while the log held the rest.
+	Blocks []*Block `json:"blocks,omitempty"`
+}
+
+type SnapshotInfo struct {
+	Height  int    `json:"height"`
+	TipHash string `json:"tip_hash"`
+	Created string `json:"created"`
+	Path    string `json:"path"`
+}
+
+// Compactor is implemented by stores that can snapshot their contents and
+// rewrite their log without the records replay skips.
+type Compactor interface {
+	Snapshot() (SnapshotInfo, error)
+	Compact() (SnapshotInfo, error)
+}
+
+func snapshotPath(path string) string {
+	return path + ".snapshot"
+}
+
+func writeSnapshot(path string, snap *Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if data, err = dataKeys.Seal(data); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	})
+}
+
+func readSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = dataKeys.Open(data); err != nil {
+		return nil, err
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	if snap.Blocks != nil && len(snap.Blocks) != snap.Height+1 {
+		return nil, errors.New("snapshot block count does not match its height")
+	}
+	return &snap, nil
+}
+
+// snapshotCheckpoint is the point up to which the store's snapshot vouches
+// for the chain, as a checkpoint to validate from, or nil.
+func snapshotCheckpoint(store Store) *Checkpoint {
+	ts, ok := store.(interface{ Trusted() *Snapshot })
+	if !ok {
+		return nil
+	}
+	snap := ts.Trusted()
+	if snap == nil {
+		return nil
+	}
+	return &Checkpoint{Height: snap.Height, TipHash: snap.TipHash, Created: snap.Created}
+}
+
+// writeFileAtomic writes path via a synced temp file and a rename, so readers
+// see either the old or the new contents.
+func writeFileAtomic(path string, write func(*os.File) error) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func snapshotLoop(c Compactor, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		BlockChain.saveState()
+		info, err := c.Snapshot()
+		if err != nil {
+			log.Printf("Error writing snapshot: %v", err)
+			continue
+		}
+		log.Printf("Wrote snapshot at height %d", info.Height)
+	}
+}
+
+func compactorOrError(w http.ResponseWriter, r *http.Request) Compactor {
+	c, ok := BlockChain.store.(Compactor)
+	if !ok {
+		writeError(w, r, apierr.New(apierr.NotImplemented, "storage backend does not support snapshots"))
+		return nil
+	}
+	return c
+}
+
+func adminSnapshot(w http.ResponseWriter, r *http.Request) {
+	c := compactorOrError(w, r)
+	if c == nil {
+		return
+	}
+	BlockChain.saveState()
+	info, err := c.Snapshot()
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.Internal, err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func adminCompact(w http.ResponseWriter, r *http.Request) {
+	c := compactorOrError(w, r)
+	if c == nil {
+		return
+	}
+	BlockChain.saveState()
+	info, err := c.Compact()
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.Internal, err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
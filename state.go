@@ -0,0 +1,688 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"blockchain/apierr"
+)
+
+var (
+	ErrNotCheckedOut = errors.New("book is not checked out")
+	ErrNotHolder     = errors.New("book is checked out by another member")
+	ErrAlreadyHeld   = errors.New("member already has a hold on this book")
+	ErrHasBook       = errors.New("member already has this book checked out")
+	ErrNoHold        = errors.New("member has no hold on this book")
+	ErrRenewalLimit  = errors.New("loan has reached the renewal limit")
+	ErrBookOnHold    = errors.New("book is on hold for another member")
+	ErrOverpayment   = errors.New("payment exceeds the outstanding fines")
+	ErrCheckedOut    = errors.New("book is already checked out")
+)
+
+// Lending policy for books; other kinds of item have their own, from
+// -asset-kinds. Due dates are recorded on checkouts and renewals, and fines
+// on returns, when they are submitted, so changing the policy only affects
+// later transactions. Transactions from before due dates were recorded fall
+// back to deriving one. Fines are in cents.
+var (
+	loanDays    = 14
+	maxRenewals = 2
+	finePerDay  = int64(25)
+)
+
+// Loan is a book that is currently checked out.
+type Loan struct {
+	BookId       string `json:"bookid"`
+	User         string `json:"user"`
+	CheckoutDate string `json:"checkout_date"`
+	DueDate      string `json:"due_date"`
+	Renewals     int    `json:"renewals"`
+	Block        int    `json:"block"`
+	// Kind is the kind of item on loan, empty for a book.
+	Kind string `json:"kind,omitempty"`
+}
+
+// dueAfter returns the date a loan period of days after start, which is a
+// transaction date or, failing that, the block timestamp.
+func dueAfter(start, blockTime string, days int) string {
+	t, err := parseDate(start)
+	if err != nil {
+		if t, err = parseDate(blockTime); err != nil {
+			return ""
+		}
+	}
+	return t.AddDate(0, 0, days).Format(time.DateOnly)
+}
+
+// fineFor returns the fine for returning a loan on the given date, which is
+// the fine per day of the item's kind for each whole day past the due date.
+func fineFor(loan Loan, returned time.Time) int64 {
+	due, err := parseDate(loan.DueDate)
+	if err != nil {
+		return 0
+	}
+	due = due.Truncate(24 * time.Hour)
+	days := int64(returned.UTC().Truncate(24*time.Hour).Sub(due) / (24 * time.Hour))
+	if days <= 0 {
+		return 0
+	}
+	return days * policyFor(loan.Kind).FinePerDay
+}
+
+// Hold is a member's place in a book's reservation queue.
+type Hold struct {
+	User  string `json:"user"`
+	Date  string `json:"date,omitempty"`
+	Block int    `json:"block"`
+}
+
+// LibraryState is what the chain says about the library right now. It is
+// derived by applying blocks in order and updated as each block arrives.
+// Stores that implement StateStore keep a copy, so a restart only applies the
+// blocks after it.
+type LibraryState struct {
+	height  int
+	tipHash string
+	loans   map[string]Loan
+	holds   map[string][]Hold
+	fines   map[string]int64
+	stats   *LibraryStats
+	// locations is the branch each book transferred on this chain went to,
+	// "" for the node's own library.
+	locations map[string]string
+	// kinds is the kind of each item registered on this chain that is not
+	// a book.
+	kinds map[string]string
+	// records is what registered transaction types keep about items, by
+	// type and then book ID. Records are replaced, never modified in place.
+	records map[string]map[string]json.RawMessage
+}
+
+func newLibraryState() *LibraryState {
+	return &LibraryState{height: -1, loans: map[string]Loan{}, holds: map[string][]Hold{}, fines: map[string]int64{}, stats: newLibraryStats(), locations: map[string]string{}, kinds: map[string]string{}, records: map[string]map[string]json.RawMessage{}}
+}
+
+// StateSnapshot is the stored form of LibraryState as of the block at Height.
+type StateSnapshot struct {
+	Height  int               `json:"height"`
+	TipHash string            `json:"tip_hash"`
+	Loans   map[string]Loan   `json:"loans"`
+	Holds   map[string][]Hold `json:"holds"`
+	Fines   map[string]int64  `json:"fines"`
+	// Locations is empty until a book is transferred, and stateRoot leaves
+	// it out until then, so older checkpoint roots still match.
+	Locations map[string]string `json:"locations,omitempty"`
+	// Kinds is the kind of each registered item that is not a book, and is
+	// likewise left out while there are none.
+	Kinds map[string]string `json:"kinds,omitempty"`
+	// Records holds the transaction types' records, likewise only once
+	// there are some.
+	Records map[string]map[string]json.RawMessage `json:"records,omitempty"`
+	// Stats is only stored, not served or hashed into checkpoints; a stored
+	// state without it predates the statistics.
+	Stats *LibraryStats `json:"stats,omitempty"`
+}
+
+// snapshot copies the state. Hold queues are never modified in place, so
+// they are shared.
+func (s *LibraryState) snapshot() *StateSnapshot {
+	snap := &StateSnapshot{
+		Height:  s.height,
+		TipHash: s.tipHash,
+		Loans:   make(map[string]Loan, len(s.loans)),
+		Holds:   make(map[string][]Hold, len(s.holds)),
+		Fines:   make(map[string]int64, len(s.fines)),
+	}
+	for k, v := range s.loans {
+		snap.Loans[k] = v
+	}
+	for k, v := range s.holds {
+		snap.Holds[k] = v[:len(v):len(v)]
+	}
+	for k, v := range s.fines {
+		snap.Fines[k] = v
+	}
+	if len(s.locations) > 0 {
+		snap.Locations = make(map[string]string, len(s.locations))
+		for k, v := range s.locations {
+			snap.Locations[k] = v
+		}
+	}
+	if len(s.kinds) > 0 {
+		snap.Kinds = make(map[string]string, len(s.kinds))
+		for k, v := range s.kinds {
+			snap.Kinds[k] = v
+		}
+	}
+	if len(s.records) > 0 {
+		snap.Records = make(map[string]map[string]json.RawMessage, len(s.records))
+		for typ, recs := range s.records {
+			snap.Records[typ] = make(map[string]json.RawMessage, len(recs))
+			for k, v := range recs {
+				snap.Records[typ][k] = v
+			}
+		}
+	}
+	return snap
+}
+
+func restoreState(snap *StateSnapshot) *LibraryState {
+	s := newLibraryState()
+	s.height, s.tipHash = snap.Height, snap.TipHash
+	for k, v := range snap.Loans {
+		s.loans[k] = v
+	}
+	for k, v := range snap.Holds {
+		s.holds[k] = v
+	}
+	for k, v := range snap.Fines {
+		s.fines[k] = v
+	}
+	for k, v := range snap.Locations {
+		s.locations[k] = v
+	}
+	for k, v := range snap.Kinds {
+		s.kinds[k] = v
+	}
+	for typ, recs := range snap.Records {
+		for k, v := range recs {
+			s.setRecord(typ, k, v)
+		}
+	}
+	if snap.Stats != nil {
+		s.stats = snap.Stats.clone()
+	}
+	return s
+}
+
+func (s *LibraryState) holdIndex(bookID, user string) int {
+	for i, h := range s.holds[bookID] {
+		if h.User == user {
+			return i
+		}
+	}
+	return -1
+}
+
+// dropHold removes a member from a book's queue. It copies the queue, since
+// readers may still hold the old slice.
+func (s *LibraryState) dropHold(bookID, user string) {
+	i := s.holdIndex(bookID, user)
+	if i < 0 {
+		return
+	}
+	queue := s.holds[bookID]
+	rest := append(append([]Hold{}, queue[:i]...), queue[i+1:]...)
+	if len(rest) == 0 {
+		delete(s.holds, bookID)
+		return
+	}
+	s.holds[bookID] = rest
+}
+
+// Apply updates the state with a block. Blocks at or below the state's
+// height are already reflected in it and are skipped.
+func (s *LibraryState) Apply(b *Block) {
+	if b.Pos <= s.height {
+		return
+	}
+	s.height, s.tipHash = b.Pos, b.Hash
+	for _, tx := range b.Transactions {
+		s.applyTx(tx, b.Pos, b.Timestamp)
+	}
+}
+
+// applyTx updates the state with one transaction of the block at pos, by
+// its type's rules. Types the node does not know are skipped.
+func (s *LibraryState) applyTx(tx Transaction, pos int, blockTime string) {
+	if tx.IsGenesis {
+		return
+	}
+	typ, ok := txTypes[tx.Kind()]
+	if !ok {
+		return
+	}
+	tx = tx.attached()
+	if typ.Entry {
+		s.noteKind(tx.Book)
+	}
+	if typ.Apply != nil {
+		typ.Apply(s, tx, pos, blockTime)
+	}
+}
+
+func (s *LibraryState) applyCheckout(tx Transaction, pos int, blockTime string) {
+	kind := s.kinds[tx.BookId]
+	due := tx.DueDate
+	if due == "" {
+		due = dueAfter(tx.CheckoutDate, blockTime, policyFor(kind).LoanDays)
+	}
+	s.loans[tx.BookId] = Loan{
+		BookId:       tx.BookId,
+		User:         tx.User,
+		CheckoutDate: tx.CheckoutDate,
+		DueDate:      due,
+		Block:        pos,
+		Kind:         kind,
+	}
+	s.stats.checkedOut(tx, blockTime)
+	s.dropHold(tx.BookId, tx.User)
+}
+
+func (s *LibraryState) applyReturn(tx Transaction, pos int, blockTime string) {
+	s.endLoan(tx.BookId, tx.Date, blockTime)
+	if tx.Fine > 0 {
+		s.fines[tx.User] += tx.Fine
+	}
+}
+
+// endLoan ends a book's loan, if it has one, on date or failing that at
+// blockTime.
+func (s *LibraryState) endLoan(bookID, date, blockTime string) {
+	if loan, ok := s.loans[bookID]; ok {
+		s.stats.loanEnded(loan, date, blockTime)
+	}
+	delete(s.loans, bookID)
+}
+
+func (s *LibraryState) applyPayment(tx Transaction, pos int, blockTime string) {
+	s.fines[tx.User] -= tx.Amount
+	if s.fines[tx.User] <= 0 {
+		delete(s.fines, tx.User)
+	}
+}
+
+func (s *LibraryState) applyReserve(tx Transaction, pos int, blockTime string) {
+	if s.holdIndex(tx.BookId, tx.User) < 0 {
+		queue := s.holds[tx.BookId]
+		s.holds[tx.BookId] = append(queue[:len(queue):len(queue)], Hold{User: tx.User, Date: tx.Date, Block: pos})
+	}
+}
+
+func (s *LibraryState) applyCancelHold(tx Transaction, pos int, blockTime string) {
+	s.dropHold(tx.BookId, tx.User)
+}
+
+func (s *LibraryState) applyRenew(tx Transaction, pos int, blockTime string) {
+	if loan, ok := s.loans[tx.BookId]; ok && loan.User == tx.User {
+		due := tx.DueDate
+		if due == "" {
+			due = dueAfter(loan.DueDate, blockTime, policyFor(loan.Kind).LoanDays)
+		}
+		loan.DueDate = due
+		loan.Renewals++
+		s.loans[tx.BookId] = loan
+	}
+}
+
+func (s *LibraryState) applyTransfer(tx Transaction, pos int, blockTime string) {
+	s.locations[tx.BookId] = tx.ToBranch
+}
+
+// record returns what a transaction type has recorded about a book.
+func (s *LibraryState) record(typ, bookID string) (json.RawMessage, bool) {
+	rec, ok := s.records[typ][bookID]
+	return rec, ok
+}
+
+// setRecord stores a transaction type's record about a book.
+func (s *LibraryState) setRecord(typ, bookID string, rec json.RawMessage) {
+	recs, ok := s.records[typ]
+	if !ok {
+		recs = map[string]json.RawMessage{}
+		s.records[typ] = recs
+	}
+	recs[bookID] = rec
+}
+
+// putRecord stores a transaction type's record about a book as JSON.
+func (s *LibraryState) putRecord(typ, bookID string, rec any) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	s.setRecord(typ, bookID, data)
+}
+
+// noteKind remembers the kind of an item registered or transferred in, so
+// loans of it follow its kind's policy.
+func (s *LibraryState) noteKind(b *Book) {
+	if b != nil && b.Kind != "" {
+		s.kinds[b.Id] = b.Kind
+	}
+}
+
+// Loan returns the current loan of a book, if it is checked out.
+func (bc *Blockchain) Loan(bookID string) (Loan, bool) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	loan, ok := bc.state.loans[bookID]
+	return loan, ok
+}
+
+// Holds returns a book's reservation queue, first in line first.
+func (bc *Blockchain) Holds(bookID string) []Hold {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	queue, ok := bc.state.holds[bookID]
+	if !ok {
+		return []Hold{}
+	}
+	return queue[:len(queue):len(queue)]
+}
+
+// Records returns what each transaction type has recorded about a book.
+func (bc *Blockchain) Records(bookID string) map[string]json.RawMessage {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	var out map[string]json.RawMessage
+	for typ, recs := range bc.state.records {
+		if rec, ok := recs[bookID]; ok {
+			if out == nil {
+				out = map[string]json.RawMessage{}
+			}
+			out[typ] = rec
+		}
+	}
+	return out
+}
+
+// checkState rejects transactions that contradict the current state of the
+// library.
+func (bc *Blockchain) checkState(tx Transaction) error {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if err := bc.state.check(tx); err != nil {
+		return err
+	}
+	if err := bc.state.checkLoanRules(tx, clock.Now()); err != nil {
+		return err
+	}
+	return bc.state.checkCustody(tx, bc.branchID())
+}
+
+// checkBatch checks transactions meant for one block against the state in
+// order, as if each accepted one had already been applied, so a block cannot
+// check the same book out twice or repeat a transaction. It returns one
+// error slot per transaction.
+func (bc *Blockchain) checkBatch(txs []Transaction) []error {
+	ids := txIDs(txs)
+	bc.mu.RLock()
+	s := restoreState(bc.state.snapshot())
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if _, ok := bc.byTxID[id]; ok {
+			seen[id] = true
+		}
+	}
+	bc.mu.RUnlock()
+	return s.checkTxs(txs, ids, seen, bc.branchID(), clock.Now().Format(time.RFC3339))
+}
+
+func txIDs(txs []Transaction) []string {
+	ids := make([]string, len(txs))
+	for i, tx := range txs {
+		ids[i] = tx.ID()
+	}
+	return ids
+}
+
+// checkTxs is checkBatch against s, which it updates with every transaction
+// it accepts. seen holds the IDs already on the chain.
+func (s *LibraryState) checkTxs(txs []Transaction, ids []string, seen map[string]bool, branch, blockTime string) []error {
+	errs := make([]error, len(txs))
+	for i, tx := range txs {
+		if seen[ids[i]] {
+			errs[i] = fmt.Errorf("%w: %s", ErrDuplicateTx, ids[i])
+			continue
+		}
+		if errs[i] = s.check(tx); errs[i] == nil {
+			errs[i] = s.checkLoanRules(tx, clock.Now())
+		}
+		if errs[i] == nil {
+			errs[i] = s.checkCustody(tx, branch)
+		}
+		if errs[i] == nil {
+			seen[ids[i]] = true
+			s.applyTx(tx, s.height+1, blockTime)
+		}
+	}
+	return errs
+}
+
+// checkPeerBlock checks a block produced by another node against the state
+// at the tip it extends, by the rules checkBatch holds this node's own
+// blocks to.
+func (bc *Blockchain) checkPeerBlock(b *Block) error {
+	if err := checkNodeOnly(b); err != nil {
+		return err
+	}
+	for i, err := range bc.checkBatch(b.Transactions) {
+		if err != nil {
+			return fmt.Errorf("transaction %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// checkForkState checks the blocks of a peer's chain past the fork point as
+// checkPeerBlock would, each against the state the blocks before it leave.
+func (bc *Blockchain) checkForkState(blocks []*Block, fork int) error {
+	s := newLibraryState()
+	seen := map[string]bool{}
+	for _, b := range blocks[:fork] {
+		s.Apply(b)
+		for _, id := range txIDs(b.Transactions) {
+			seen[id] = true
+		}
+	}
+	for _, b := range blocks[fork:] {
+		if err := checkNodeOnly(b); err != nil {
+			return fmt.Errorf("block %d of peer chain: %w", b.Pos, err)
+		}
+		for i, err := range s.checkTxs(b.Transactions, txIDs(b.Transactions), seen, bc.branchID(), b.Timestamp) {
+			if err != nil {
+				return fmt.Errorf("block %d of peer chain: transaction %d: %w", b.Pos, i, err)
+			}
+		}
+		s.height, s.tipHash = b.Pos, b.Hash
+	}
+	return nil
+}
+
+// checkNodeOnly refuses transactions of a type clients may not submit unless
+// the node that produced the block signed them.
+func checkNodeOnly(b *Block) error {
+	for i, tx := range b.Transactions {
+		typ, ok := txTypes[tx.Kind()]
+		if !ok || typ.NodeOnly == "" || tx.IsGenesis {
+			continue
+		}
+		if tx.PublicKey != b.Producer && (b.Migrated == nil || tx.PublicKey != b.Migrated.Producer) {
+			return fmt.Errorf("transaction %d: %s not signed by the block's producer", i, tx.Kind())
+		}
+	}
+	return nil
+}
+
+// check rejects a transaction that contradicts the state, by its type's
+// rules.
+func (s *LibraryState) check(tx Transaction) error {
+	if tx.IsGenesis {
+		return nil
+	}
+	if typ, ok := txTypes[tx.Kind()]; ok && typ.Check != nil {
+		return typ.Check(s, tx)
+	}
+	return nil
+}
+
+// checkAvailable refuses to lend or transfer a book that is out or written
+// off.
+func (s *LibraryState) checkAvailable(tx Transaction) error {
+	if _, onLoan := s.loans[tx.BookId]; onLoan {
+		return fmt.Errorf("%w: %s", ErrCheckedOut, tx.BookId)
+	}
+	if s.writtenOff(tx.BookId) {
+		return ErrWrittenOff
+	}
+	return nil
+}
+
+// checkBorrower requires the book to be on loan to the transaction's member.
+func (s *LibraryState) checkBorrower(tx Transaction) error {
+	loan, onLoan := s.loans[tx.BookId]
+	if !onLoan {
+		return ErrNotCheckedOut
+	}
+	if loan.User != tx.User {
+		return ErrNotHolder
+	}
+	return nil
+}
+
+func (s *LibraryState) checkRenew(tx Transaction) error {
+	if err := s.checkBorrower(tx); err != nil {
+		return err
+	}
+	if loan := s.loans[tx.BookId]; loan.Renewals >= policyFor(loan.Kind).MaxRenewals {
+		return ErrRenewalLimit
+	}
+	if len(s.holds[tx.BookId]) > 0 {
+		return ErrBookOnHold
+	}
+	return nil
+}
+
+func (s *LibraryState) checkReserve(tx Transaction) error {
+	if s.holdIndex(tx.BookId, tx.User) >= 0 {
+		return ErrAlreadyHeld
+	}
+	if loan, onLoan := s.loans[tx.BookId]; onLoan && loan.User == tx.User {
+		return ErrHasBook
+	}
+	if s.writtenOff(tx.BookId) {
+		return ErrWrittenOff
+	}
+	return nil
+}
+
+func (s *LibraryState) checkCancelHold(tx Transaction) error {
+	if s.holdIndex(tx.BookId, tx.User) < 0 {
+		return ErrNoHold
+	}
+	return nil
+}
+
+func (s *LibraryState) checkPayment(tx Transaction) error {
+	if tx.Amount > s.fines[tx.User] {
+		return ErrOverpayment
+	}
+	return nil
+}
+
+// applyPolicy records on a transaction what the lending policy says about
+// it: the due date of a checkout or renewal and the fine for a late return.
+// The fine runs to the return date, or to today if the return has none.
+func (bc *Blockchain) applyPolicy(tx *Transaction) {
+	now := clock.Now().UTC()
+	switch tx.Kind() {
+	case TxCheckout:
+		stampCheckout(tx, now)
+		tx.DueDate = dueAfter(tx.CheckoutDate, now.Format(time.RFC3339), bc.Policy(tx.BookId).LoanDays)
+	case TxRenew:
+		if loan, ok := bc.Loan(tx.BookId); ok {
+			tx.DueDate = dueAfter(loan.DueDate, now.Format(time.RFC3339), policyFor(loan.Kind).LoanDays)
+		}
+	case TxReturn:
+		tx.Fine = 0
+		if loan, ok := bc.Loan(tx.BookId); ok {
+			returned, err := parseDate(tx.Date)
+			if err != nil {
+				returned = now
+			}
+			tx.Fine = fineFor(loan, returned)
+		}
+	}
+}
+
+// Policy returns the loan policy of the kind of item the chain registered
+// under bookID.
+func (bc *Blockchain) Policy(bookID string) AssetKind {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return policyFor(bc.state.kinds[bookID])
+}
+
+// Fines returns what a member owes in cents.
+func (bc *Blockchain) Fines(user string) int64 {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.state.fines[user]
+}
+
+// checkSubmission applies the local pseudonym, catalog, member and state
+// rules to a transaction submitted by a client.
+func checkSubmission(t *Tenant, tx Transaction) error {
+	if err := checkPseudonymous(tx); err != nil {
+		return err
+	}
+	if err := checkCatalog(t.books, tx); err != nil {
+		return err
+	}
+	if err := checkMember(t.members, tx); err != nil {
+		return err
+	}
+	return t.chain.checkState(tx)
+}
+
+// isConflict reports whether err means a transaction is well formed but
+// contradicts the catalog or chain state.
+func isConflict(err error) bool {
+	for _, target := range []error{ErrBookWithdrawn, ErrNotCheckedOut, ErrNotHolder, ErrAlreadyHeld, ErrHasBook, ErrNoHold, ErrRenewalLimit, ErrBookOnHold, ErrOverpayment, ErrCheckedOut, ErrUnknownBook, ErrDuplicateTx, ErrBookAway, ErrWrittenOff, ErrAlreadyDonated, ErrLoanLimit, ErrAgeRestricted, ErrUnknownMember, ErrMemberSuspended} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+type BookStatus struct {
+	BookId   string `json:"bookid"`
+	Status   string `json:"status"`
+	Loan     *Loan  `json:"loan,omitempty"`
+	Holds    int    `json:"holds"`
+	NextHold string `json:"next_hold,omitempty"`
+	// Records holds what registered transaction types, such as donations
+	// and audits, have recorded about the book, by type.
+	Records map[string]json.RawMessage `json:"records,omitempty"`
+}
+
+func getBookStatus(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	t := tenantOf(r)
+	_, err := t.books.Get(id)
+	if err != nil && len(t.chain.BookHistory(id)) == 0 {
+		writeError(w, r, apierr.Errorf(codeBookNotFound, "unknown book %s", id))
+		return
+	}
+	status := BookStatus{BookId: id, Status: "available"}
+	if loan, ok := t.chain.Loan(id); ok {
+		status.Status = "checked_out"
+		status.Loan = &loan
+	}
+	if holds := t.chain.Holds(id); len(holds) > 0 {
+		status.Holds = len(holds)
+		status.NextHold = holds[0].User
+	}
+	status.Records = t.chain.Records(id)
+	if _, ok := status.Records[TxWriteOff]; ok {
+		status.Status = "written_off"
+	}
+	respond(w, r, status)
+}
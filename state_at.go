@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"blockchain/apierr"
+)
+
+// HistoricalState is the library state as it was once a block was added.
+type HistoricalState struct {
+	*StateSnapshot
+	Timestamp string `json:"timestamp"`
+}
+
+// StateAt rebuilds the library state as of the block at height by replaying
+// the chain up to it.
+func (bc *Blockchain) StateAt(height int) (*HistoricalState, bool) {
+	blocks := bc.Snapshot()
+	if height < 0 || height >= len(blocks) {
+		return nil, false
+	}
+	s := newLibraryState()
+	for _, b := range blocks[:height+1] {
+		s.Apply(b)
+	}
+	return &HistoricalState{StateSnapshot: s.snapshot(), Timestamp: blocks[height].Timestamp}, true
+}
+
+// HeightAt returns the height of the last block added at or before t, or -1
+// if the chain started after t.
+func (bc *Blockchain) HeightAt(t time.Time) int {
+	height := -1
+	for _, b := range bc.Snapshot() {
+		ts := b.Time()
+		if ts.IsZero() {
+			continue
+		}
+		if ts.After(t) {
+			break
+		}
+		height = b.Pos
+	}
+	return height
+}
+
+// stateHeight reads the height or at query parameter. A plain at date
+// covers that whole day. Without either it is the current tip.
+func stateHeight(r *http.Request) (int, error) {
+	q := r.URL.Query()
+	h, at := q.Get("height"), q.Get("at")
+	switch {
+	case h != "" && at != "":
+		return 0, errors.New("use either height or at, not both")
+	case h != "":
+		n, err := strconv.Atoi(h)
+		if err != nil {
+			return 0, errors.New("height must be an integer")
+		}
+		return n, nil
+	case at != "":
+		t, err := parseDate(at)
+		if err != nil {
+			return 0, fmt.Errorf("invalid at timestamp %q", at)
+		}
+		if _, err := time.Parse(time.DateOnly, at); err == nil {
+			t = t.Add(24*time.Hour - time.Nanosecond)
+		}
+		return tenantOf(r).chain.HeightAt(t), nil
+	}
+	return tenantOf(r).chain.Height() - 1, nil
+}
+
+func getState(w http.ResponseWriter, r *http.Request) {
+	height, err := stateHeight(r)
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.InvalidRequest, err))
+		return
+	}
+	state, ok := tenantOf(r).chain.StateAt(height)
+	if !ok {
+		err := apierr.Errorf(codeBlockNotFound, "no block at height %d", height)
+		if at := r.URL.Query().Get("at"); at != "" {
+			err = apierr.Errorf(codeBlockNotFound, "no block at or before %s", at)
+		}
+		writeError(w, r, err)
+		return
+	}
+	respond(w, r, state)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+)
+
+// StateStore is implemented by stores that keep the library state next to
+// the blocks. The saved state is replaced after every block, and LoadState
+// returns ErrNotFound until the first save.
+type StateStore interface {
+	LoadState() (*StateSnapshot, error)
+	SaveState(snap *StateSnapshot) error
+}
+
+func statePath(path string) string {
+	return path + ".state"
+}
+
+func readStateFile(path string) (*StateSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data, err = dataKeys.Open(data); err != nil {
+		return nil, err
+	}
+	var snap StateSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+func writeStateFile(path string, snap *StateSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if data, err = dataKeys.Seal(data); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	})
+}
+
+// loadState starts from the state saved in the store, if it describes a
+// block of the chain being loaded. Blocks up to that one are then skipped by
+// LibraryState.Apply. It runs before the blocks are loaded.
+func (bc *Blockchain) loadState() {
+	ss, ok := bc.store.(StateStore)
+	if !ok {
+		return
+	}
+	snap, err := ss.LoadState()
+	if errors.Is(err, ErrNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("Could not load library state, replaying the chain: %v", err)
+		return
+	}
+	if snap.Stats == nil {
+		log.Printf("Saved library state at block %d has no statistics, replaying the chain", snap.Height)
+		return
+	}
+	block, err := bc.store.GetByPos(snap.Height)
+	if err != nil || block.Hash != snap.TipHash {
+		log.Printf("Saved library state at block %d does not match the chain, replaying it", snap.Height)
+		return
+	}
+	bc.state = restoreState(snap)
+	log.Printf("Loaded library state at block %d", snap.Height)
+}
+
+// stateSaveInterval is how many blocks apart the library state is saved as
+// blocks are appended. Loading replays the blocks after the saved state, so
+// it only bounds the work of the next startup; the state is saved on
+// shutdown too.
+const stateSaveInterval = 100
+
+// saveState writes the current library state to the store.
+func (bc *Blockchain) saveState() {
+	ss, ok := bc.store.(StateStore)
+	if !ok {
+		return
+	}
+	bc.mu.RLock()
+	snap := bc.state.snapshot()
+	snap.Stats = bc.state.stats.clone()
+	bc.mu.RUnlock()
+	if err := ss.SaveState(snap); err != nil {
+		log.Printf("Error saving library state at block %d: %v", snap.Height, err)
+	}
+}
+
+// View returns the blocks together with a copy of the library state as of
+// the last of them.
+func (bc *Blockchain) View() ([]*Block, *StateSnapshot) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.Blocks[:len(bc.Blocks):len(bc.Blocks)], bc.state.snapshot()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"blockchain/apierr"
+)
+
+// LibraryStats are running totals kept alongside the library state, so the
+// statistics endpoint never has to scan the chain.
+type LibraryStats struct {
+	Checkouts      int            `json:"checkouts"`
+	CheckoutsByDay map[string]int `json:"checkouts_by_day"`
+	ByBook         map[string]int `json:"by_book"`
+	ByUser         map[string]int `json:"by_user"`
+	// Returns and LoanSeconds cover the loans that have ended, for the
+	// average loan duration.
+	Returns     int   `json:"returns"`
+	LoanSeconds int64 `json:"loan_seconds"`
+}
+
+func newLibraryStats() *LibraryStats {
+	return &LibraryStats{CheckoutsByDay: map[string]int{}, ByBook: map[string]int{}, ByUser: map[string]int{}}
+}
+
+func (st *LibraryStats) clone() *LibraryStats {
+	c := *st
+	c.CheckoutsByDay = copyCounts(st.CheckoutsByDay)
+	c.ByBook = copyCounts(st.ByBook)
+	c.ByUser = copyCounts(st.ByUser)
+	return &c
+}
+
+func copyCounts(m map[string]int) map[string]int {
+	c := make(map[string]int, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// checkedOut counts a checkout on the day of its transaction date or,
+// failing that, of its block.
+func (st *LibraryStats) checkedOut(tx Transaction, blockTime string) {
+	st.Checkouts++
+	st.ByBook[tx.BookId]++
+	st.ByUser[tx.User]++
+	if day, err := txTime(tx.CheckoutDate, blockTime); err == nil {
+		st.CheckoutsByDay[day.UTC().Format(time.DateOnly)]++
+	}
+}
+
+// loanEnded adds the length of a loan returned on date, or failing that at
+// blockTime.
+func (st *LibraryStats) loanEnded(loan Loan, date, blockTime string) {
+	start, err := parseDate(loan.CheckoutDate)
+	if err != nil {
+		return
+	}
+	end, err := txTime(date, blockTime)
+	if err != nil || end.Before(start) {
+		return
+	}
+	st.Returns++
+	st.LoanSeconds += int64(end.Sub(start) / time.Second)
+}
+
+func txTime(date, blockTime string) (time.Time, error) {
+	if date != "" {
+		return parseDate(date)
+	}
+	return parseDate(blockTime)
+}
+
+type DayCount struct {
+	Date      string `json:"date"`
+	Checkouts int    `json:"checkouts"`
+}
+
+type BookCount struct {
+	BookId    string `json:"bookid"`
+	Title     string `json:"title,omitempty"`
+	Checkouts int    `json:"checkouts"`
+}
+
+type UserCount struct {
+	User      string `json:"user"`
+	Checkouts int    `json:"checkouts"`
+}
+
+type StatsReport struct {
+	Height          int         `json:"height"`
+	Checkouts       int         `json:"checkouts"`
+	ActiveLoans     int         `json:"active_loans"`
+	CheckoutsPerDay []DayCount  `json:"checkouts_per_day"`
+	MostBorrowed    []BookCount `json:"most_borrowed"`
+	MostActiveUsers []UserCount `json:"most_active_users"`
+	CompletedLoans  int         `json:"completed_loans"`
+	AverageLoanDays float64     `json:"average_loan_days"`
+}
+
+// Stats reports the running totals: checkouts for each of the days days up
+// to now, and the top books and members by checkouts, titled from catalog.
+func (bc *Blockchain) Stats(catalog *Catalog, now time.Time, days, top int) *StatsReport {
+	bc.mu.RLock()
+	st := bc.state.stats
+	report := &StatsReport{
+		Height:          bc.state.height,
+		Checkouts:       st.Checkouts,
+		ActiveLoans:     len(bc.state.loans),
+		CheckoutsPerDay: make([]DayCount, 0, days),
+		CompletedLoans:  st.Returns,
+	}
+	today := now.UTC().Truncate(24 * time.Hour)
+	for i := days - 1; i >= 0; i-- {
+		day := today.AddDate(0, 0, -i).Format(time.DateOnly)
+		report.CheckoutsPerDay = append(report.CheckoutsPerDay, DayCount{Date: day, Checkouts: st.CheckoutsByDay[day]})
+	}
+	books := topCounts(st.ByBook, top)
+	users := topCounts(st.ByUser, top)
+	if st.Returns > 0 {
+		report.AverageLoanDays = float64(st.LoanSeconds) / float64(st.Returns) / (24 * 60 * 60)
+	}
+	bc.mu.RUnlock()
+
+	report.MostBorrowed = make([]BookCount, 0, len(books))
+	for _, c := range books {
+		count := BookCount{BookId: c.key, Checkouts: c.n}
+		if b, err := catalog.Get(c.key); err == nil {
+			count.Title = b.Title
+		}
+		report.MostBorrowed = append(report.MostBorrowed, count)
+	}
+	report.MostActiveUsers = make([]UserCount, 0, len(users))
+	for _, c := range users {
+		report.MostActiveUsers = append(report.MostActiveUsers, UserCount{User: c.key, Checkouts: c.n})
+	}
+	return report
+}
+
+type keyCount struct {
+	key string
+	n   int
+}
+
+// topCounts returns the n keys with the highest counts, ties broken by key.
+func topCounts(m map[string]int, n int) []keyCount {
+	counts := make([]keyCount, 0, len(m))
+	for k, v := range m {
+		counts = append(counts, keyCount{k, v})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].n != counts[j].n {
+			return counts[i].n > counts[j].n
+		}
+		return counts[i].key < counts[j].key
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// intParam reads an optional positive integer query parameter no larger
+// than max.
+func intParam(r *http.Request, name string, def, max int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > max {
+		return 0, fmt.Errorf("%s must be between 1 and %d", name, max)
+	}
+	return n, nil
+}
+
+// getStats answers GET /stats, with optional days (default 30) and top
+// (default 10).
+func getStats(w http.ResponseWriter, r *http.Request) {
+	days, err := intParam(r, "days", 30, 366)
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.InvalidRequest, err))
+		return
+	}
+	top, err := intParam(r, "top", 10, 100)
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.InvalidRequest, err))
+		return
+	}
+	t := tenantOf(r)
+	respond(w, r, t.chain.Stats(t.books, clock.Now(), days, top))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+var ErrNotFound = errors.New("block not found")
+
+// Store persists blocks. Blocks are appended in position order starting at
+// the genesis block.
+type Store interface {
+	Append(block *Block) error
+	GetByPos(pos int) (*Block, error)
+	GetByHash(hash string) (*Block, error)
+	Iterate(fn func(*Block) error) error
+	Tip() (*Block, error)
+	// Replace discards the stored chain and stores blocks in its place.
+	Replace(blocks []*Block) error
+	Close() error
+}
+
+var storeKind = "log"
+
+func openStore(kind string) (Store, error) {
+	switch kind {
+	case "log":
+		store, err := NewLogStore(logFile, fsyncPolicy, fsyncInterval)
+		if err != nil {
+			return nil, err
+		}
+		return store, importJSONChain(store, chainFile)
+	case "json":
+		return NewJSONFileStore(chainFile)
+	case "bolt":
+		store, err := NewBoltStore(boltFile)
+		if err != nil {
+			return nil, err
+		}
+		return store, importJSONChain(store, chainFile)
+	case "sqlite":
+		store, err := NewSQLiteStore(sqliteFile)
+		if err != nil {
+			return nil, err
+		}
+		return store, importJSONChain(store, chainFile)
+	case "postgres":
+		store, err := NewPostgresStore(postgresDSN)
+		if err != nil {
+			return nil, err
+		}
+		return store, importJSONChain(store, chainFile)
+	default:
+		return nil, fmt.Errorf("unknown store %q", kind)
+	}
+}
+
+// importJSONChain copies the blocks of an existing JSON chain file into an
+// empty store, so switching backends keeps the ledger.
+func importJSONChain(dst Store, path string) error {
+	if _, err := dst.Tip(); err != ErrNotFound || !fileExists(path) {
+		return nil
+	}
+	src, err := NewJSONFileStore(path)
+	if err != nil {
+		return err
+	}
+	n := 0
+	err = src.Iterate(func(b *Block) error {
+		n++
+		return dst.Append(b)
+	})
+	if err != nil {
+		return fmt.Errorf("import %s: %w", path, err)
+	}
+	if n > 0 {
+		log.Printf("Imported %d blocks from %s", n, path)
+	}
+	return nil
+}
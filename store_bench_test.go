@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// benchChain opens a log store in a temporary directory under the given
+// fsync policy, with a fresh node key and difficulty 0, so the benchmarks
+// time persistence rather than mining. Both are put back when b ends.
+func benchChain(b *testing.B, dir, policy string) (*Blockchain, *LogStore) {
+	b.Helper()
+	key, diff := NodeKey, difficulty
+	b.Cleanup(func() { NodeKey, difficulty = key, diff })
+	if NodeKey == nil {
+		_, NodeKey, _ = ed25519.GenerateKey(nil)
+	}
+	difficulty = 0
+	store, err := NewLogStore(filepath.Join(dir, "chain.log"), policy, time.Second)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bc, err := NewBlockChain(store)
+	if err != nil {
+		store.Close()
+		b.Fatal(err)
+	}
+	return bc, store
+}
+
+// benchTx is a small signed transaction the chain state accepts any number
+// of, standing in for a checkout.
+func benchTx(i int) Transaction {
+	return anchorTx(AnchorReceipt{Method: "bench", Height: i, TipHash: fmt.Sprintf("%064x", i), Receipt: "bench"})
+}
+
+// BenchmarkAddBlock appends blocks of one transaction each, signed in
+// advance as a client would. README.md gives the target in blocks/s.
+func BenchmarkAddBlock(b *testing.B) {
+	for _, policy := range []string{FsyncAlways, FsyncInterval, FsyncNever} {
+		b.Run(policy, func(b *testing.B) {
+			bc, store := benchChain(b, b.TempDir(), policy)
+			defer store.Close()
+			txs := make([]Transaction, b.N)
+			for i := range txs {
+				txs[i] = benchTx(i)
+			}
+			ctx := context.Background()
+			b.ResetTimer()
+			for _, tx := range txs {
+				if _, err := bc.AddBlock(ctx, tx); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "blocks/s")
+		})
+	}
+}
+
+// BenchmarkLoadChain opens a stored chain of n blocks, as a node does on
+// startup: replaying the log, indexing and verifying every block.
+func BenchmarkLoadChain(b *testing.B) {
+	for _, n := range []int{1000, 10000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			dir := b.TempDir()
+			bc, store := benchChain(b, dir, FsyncNever)
+			for i := range n - 1 {
+				if _, err := bc.AddBlock(context.Background(), benchTx(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := store.Close(); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for range b.N {
+				bc, store := benchChain(b, dir, FsyncNever)
+				if bc.Height() != n {
+					b.Fatalf("loaded %d blocks, want %d", bc.Height(), n)
+				}
+				store.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltFile     = "blockchain.db"
+	blocksBucket = []byte("blocks")
+	hashBucket   = []byte("hashes")
+	stateBucket  = []byte("state")
+	stateKey     = []byte("library")
+	outboxBucket = []byte("outbox")
+)
+
+// BoltStore keeps each block as a JSON value keyed by its big-endian
+// position, plus a hash index, so appends only write the new block.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{blocksBucket, hashBucket, stateBucket, outboxBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func posKey(pos int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(pos))
+	return key
+}
+
+func (s *BoltStore) Append(block *Block) error {
+	data, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket(blocksBucket)
+		next := 0
+		if k, _ := blocks.Cursor().Last(); k != nil {
+			next = int(binary.BigEndian.Uint64(k)) + 1
+		}
+		if block.Pos != next {
+			return fmt.Errorf("append block %d: store tip is %d", block.Pos, next-1)
+		}
+		key := posKey(block.Pos)
+		if err := blocks.Put(key, data); err != nil {
+			return err
+		}
+		if err := tx.Bucket(hashBucket).Put([]byte(block.Hash), key); err != nil {
+			return err
+		}
+		if !outboxEnabled {
+			return nil
+		}
+		events, err := domainEvents(block)
+		if err != nil {
+			return err
+		}
+		return boltEnqueue(tx, events)
+	})
+}
+
+func boltEnqueue(tx *bolt.Tx, events []OutboxEvent) error {
+	outbox := tx.Bucket(outboxBucket)
+	for _, ev := range events {
+		seq, err := outbox.NextSequence()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		if err := outbox.Put(posKey(int(seq)), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) PendingEvents(limit int) ([]OutboxEvent, error) {
+	var events []OutboxEvent
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(outboxBucket).Cursor()
+		for k, v := c.First(); k != nil && len(events) < limit; k, v = c.Next() {
+			var ev OutboxEvent
+			if err := json.Unmarshal(v, &ev); err != nil {
+				return err
+			}
+			ev.Seq = int64(binary.BigEndian.Uint64(k))
+			events = append(events, ev)
+		}
+		return nil
+	})
+	return events, err
+}
+
+func (s *BoltStore) AckEvents(seq int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(outboxBucket).Cursor()
+		for k, _ := c.First(); k != nil && int64(binary.BigEndian.Uint64(k)) <= seq; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Replace(blocks []*Block) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var events []OutboxEvent
+		if outboxEnabled {
+			old := tx.Bucket(hashBucket)
+			var err error
+			if events, err = replacedEvents(blocks, func(b *Block) bool {
+				return old.Get([]byte(b.Hash)) != nil
+			}); err != nil {
+				return err
+			}
+		}
+		for _, name := range [][]byte{blocksBucket, hashBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		bb, err := tx.CreateBucket(blocksBucket)
+		if err != nil {
+			return err
+		}
+		hb, err := tx.CreateBucket(hashBucket)
+		if err != nil {
+			return err
+		}
+		for _, block := range blocks {
+			data, err := json.Marshal(block)
+			if err != nil {
+				return err
+			}
+			key := posKey(block.Pos)
+			if err := bb.Put(key, data); err != nil {
+				return err
+			}
+			if err := hb.Put([]byte(block.Hash), key); err != nil {
+				return err
+			}
+		}
+		return boltEnqueue(tx, events)
+	})
+}
+
+func decodeBlock(data []byte) (*Block, error) {
+	var b Block
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s *BoltStore) GetByPos(pos int) (*Block, error) {
+	if pos < 0 {
+		return nil, ErrNotFound
+	}
+	var block *Block
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(blocksBucket).Get(posKey(pos))
+		if data == nil {
+			return ErrNotFound
+		}
+		var err error
+		block, err = decodeBlock(data)
+		return err
+	})
+	return block, err
+}
+
+func (s *BoltStore) GetByHash(hash string) (*Block, error) {
+	var block *Block
+	err := s.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(hashBucket).Get([]byte(hash))
+		if key == nil {
+			return ErrNotFound
+		}
+		data := tx.Bucket(blocksBucket).Get(key)
+		if data == nil {
+			return ErrNotFound
+		}
+		var err error
+		block, err = decodeBlock(data)
+		return err
+	})
+	return block, err
+}
+
+func (s *BoltStore) Iterate(fn func(*Block) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(blocksBucket).ForEach(func(_, data []byte) error {
+			block, err := decodeBlock(data)
+			if err != nil {
+				return err
+			}
+			return fn(block)
+		})
+	})
+}
+
+func (s *BoltStore) Tip() (*Block, error) {
+	var block *Block
+	err := s.db.View(func(tx *bolt.Tx) error {
+		_, data := tx.Bucket(blocksBucket).Cursor().Last()
+		if data == nil {
+			return ErrNotFound
+		}
+		var err error
+		block, err = decodeBlock(data)
+		return err
+	})
+	return block, err
+}
+
+func (s *BoltStore) LoadState() (*StateSnapshot, error) {
+	var snap *StateSnapshot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(stateBucket).Get(stateKey)
+		if data == nil {
+			return ErrNotFound
+		}
+		snap = &StateSnapshot{}
+		return json.Unmarshal(data, snap)
+	})
+	return snap, err
+}
+
+func (s *BoltStore) SaveState(snap *StateSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).Put(stateKey, data)
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
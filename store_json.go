@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var chainFile = "blockchain.json"
+
+// JSONFileStore keeps the chain in memory and rewrites the whole file on
+// every append.
+type JSONFileStore struct {
+	mu     sync.RWMutex
+	path   string
+	blocks []*Block
+	byHash map[string]*Block
+}
+
+func NewJSONFileStore(path string) (*JSONFileStore, error) {
+	s := &JSONFileStore{path: path, byHash: map[string]*Block{}}
+	blocks, err := recoverChainFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		s.blocks = append(s.blocks, b)
+		s.byHash[b.Hash] = b
+	}
+	return s, nil
+}
+
+func (s *JSONFileStore) Append(block *Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if block.Pos != len(s.blocks) {
+		return fmt.Errorf("append block %d: store tip is %d", block.Pos, len(s.blocks)-1)
+	}
+	blocks := append(s.blocks, block)
+	if err := s.save(blocks); err != nil {
+		return err
+	}
+	s.blocks = blocks
+	s.byHash[block.Hash] = block
+	return nil
+}
+
+func (s *JSONFileStore) Replace(blocks []*Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(blocks); err != nil {
+		return err
+	}
+	s.blocks = blocks
+	s.byHash = map[string]*Block{}
+	for _, b := range blocks {
+		s.byHash[b.Hash] = b
+	}
+	return nil
+}
+
+func (s *JSONFileStore) GetByPos(pos int) (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if pos < 0 || pos >= len(s.blocks) {
+		return nil, ErrNotFound
+	}
+	return s.blocks[pos], nil
+}
+
+func (s *JSONFileStore) GetByHash(hash string) (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.byHash[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return b, nil
+}
+
+func (s *JSONFileStore) Iterate(fn func(*Block) error) error {
+	s.mu.RLock()
+	blocks := s.blocks
+	s.mu.RUnlock()
+	for _, b := range blocks {
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *JSONFileStore) Tip() (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.blocks) == 0 {
+		return nil, ErrNotFound
+	}
+	return s.blocks[len(s.blocks)-1], nil
+}
+
+func (s *JSONFileStore) LoadState() (*StateSnapshot, error) {
+	return readStateFile(statePath(s.path))
+}
+
+func (s *JSONFileStore) SaveState(snap *StateSnapshot) error {
+	return writeStateFile(statePath(s.path), snap)
+}
+
+func (s *JSONFileStore) Close() error {
+	return nil
+}
+
+// save writes the chain to a temp file, syncs it and renames it over the
+// old file, so a crash leaves either the old chain or the new one.
+func (s *JSONFileStore) save(blocks []*Block) error {
+	err := writeFileAtomic(s.path, func(f *os.File) error {
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(Blockchain{Blocks: blocks})
+	})
+	if err != nil {
+		return fmt.Errorf("save chain file: %w", err)
+	}
+	return nil
+}
+
+// recoverChainFile loads the chain file, repairing what an interrupted save
+// can leave behind. A leftover temp file is used if the chain file is
+// missing or unreadable and the temp file is complete, and removed
+// otherwise. A truncated chain file keeps the blocks before the damage; the
+// damaged file is kept aside as path.corrupt-<unix time>. A file from which
+// nothing can be read is an error rather than an empty chain, so a new
+// genesis block never replaces an existing chain.
+func recoverChainFile(path string) ([]*Block, error) {
+	tmp := path + ".tmp"
+	blocks, err := readChainFile(path)
+	if fileExists(tmp) {
+		if err != nil {
+			if tmpBlocks, tmpErr := readChainFile(tmp); tmpErr == nil {
+				log.Printf("Recovering %s from interrupted save %s", path, tmp)
+				if err := os.Rename(tmp, path); err != nil {
+					return nil, err
+				}
+				return tmpBlocks, nil
+			}
+		}
+		log.Printf("Removing incomplete save %s", tmp)
+		os.Remove(tmp)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err == nil {
+		return blocks, nil
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("chain file %s is unreadable (%v); restore it from a backup or move it aside to start a new chain", path, err)
+	}
+	aside := fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix())
+	log.Printf("Warning: %s is damaged after block %d (%v); keeping %d blocks, original saved as %s", path, len(blocks)-1, err, len(blocks), aside)
+	data, rerr := os.ReadFile(path)
+	if rerr != nil {
+		return nil, rerr
+	}
+	if err := os.WriteFile(aside, data, 0o644); err != nil {
+		return nil, err
+	}
+	s := &JSONFileStore{path: path}
+	if err := s.save(blocks); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// readChainFile decodes the chain file block by block. On a decoding error
+// it returns the blocks read before it along with the error.
+func readChainFile(path string) ([]*Block, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	var blocks []*Block
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return blocks, err
+		}
+		if key, _ := tok.(string); key != "blocks" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return blocks, err
+			}
+			continue
+		}
+		if err := expectDelim(dec, '['); err != nil {
+			return blocks, err
+		}
+		for dec.More() {
+			var b Block
+			if err := dec.Decode(&b); err != nil {
+				return blocks, err
+			}
+			blocks = append(blocks, &b)
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return blocks, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return blocks, err
+	}
+	return blocks, nil
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if tok != want {
+		return fmt.Errorf("expected %v, found %v", want, tok)
+	}
+	return nil
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var logFile = "chain.log"
+
+const (
+	recordHeaderSize = 8
+	maxRecordSize    = 64 << 20
+	// logBufferSize is how much of the log is buffered between flushes
+	// under -fsync interval and never.
+	logBufferSize = 1 << 20
+)
+
+// LogStore appends each block to chain.log as a record of
+//
+//	[4-byte big-endian length][4-byte CRC32 of payload][JSON payload]
+//
+// and keeps the decoded chain in memory. On open the log is replayed and a
+// torn or corrupt tail is truncated.
+//
+// Under -fsync always each record is written to the log and synced before
+// Append returns, and a torn tail is all a crash can leave. Under interval
+// and never, appends are buffered in memory and every record is first
+// written to a write-ahead log, so blocks a crashed process had not flushed
+// are re-applied on open. The buffer is flushed, the log synced and the WAL
+// cleared on a timer, or only on Close.
+//
+// A snapshot file next to the log records the tip, the log's length and
+// digest there and the library state (see Snapshot). Open still reads every
+// record, but while the log matches the snapshot the chain only verifies the
+// blocks after its tip and the state only replays them. Compact rewrites the
+// log without the records replay skipped and snapshots it.
+//
+// With -encryption-key, each payload, in the log and the WAL alike, is sealed
+// on its own, and so are the snapshot and state files.
+//
+// An append that fails part way is rolled back: the log is cut back to size
+// and, under interval and never, the WAL to where it was and the buffer
+// refilled from the records the WAL holds, so no stray bytes are left for a
+// later append or a restart to trip over.
+type LogStore struct {
+	mu     sync.RWMutex
+	path   string
+	file   *os.File
+	w      *bufio.Writer
+	wal    *WAL
+	policy string
+	// rec is reused to encode each record.
+	rec []byte
+	// size is the length of the log up to its last good record on disk:
+	// after each append under -fsync always, or as of the last checkpoint.
+	size int64
+	// digest is the SHA-256 of every record appended, buffered or not.
+	digest hash.Hash
+	// trusted is the snapshot the log matched on open.
+	trusted *Snapshot
+	// saved is the library state last saved, for the next snapshot.
+	saved *StateSnapshot
+	// legacy is set while the log is missing blocks an old-format snapshot
+	// held.
+	legacy bool
+	stop   chan struct{}
+	blocks []*Block
+	byHash map[string]*Block
+}
+
+func NewLogStore(path, policy string, interval time.Duration) (*LogStore, error) {
+	if !validFsyncPolicy(policy) {
+		return nil, fmt.Errorf("unknown fsync policy %q", policy)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	wal, err := OpenWAL(walPath(path))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	s := &LogStore{path: path, file: file, wal: wal, policy: policy, digest: sha256.New(), stop: make(chan struct{}), byHash: map[string]*Block{}}
+	if err := s.replay(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	s.w = bufio.NewWriterSize(file, logBufferSize)
+	if err := s.recoverWAL(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	if s.legacy {
+		log.Printf("Writing the blocks of the old-format snapshot back into %s", path)
+		if err := s.Replace(s.blocks); err != nil {
+			s.closeFiles()
+			return nil, err
+		}
+	}
+	if policy == FsyncInterval {
+		go startFsyncLoop(s, interval, s.stop)
+	}
+	return s, nil
+}
+
+func (s *LogStore) recoverWAL() error {
+	recovered := 0
+	err := s.wal.Replay(func(payload []byte) error {
+		block, err := openBlock(payload)
+		if err != nil {
+			return err
+		}
+		if block.Pos != len(s.blocks) {
+			return nil
+		}
+		rec := encodeRecord(payload)
+		if _, err := s.w.Write(rec); err != nil {
+			return err
+		}
+		s.digest.Write(rec)
+		s.blocks = append(s.blocks, block)
+		s.byHash[block.Hash] = block
+		recovered++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("recover wal: %w", err)
+	}
+	if recovered > 0 {
+		log.Printf("Recovered %d blocks from %s", recovered, s.wal.file.Name())
+	}
+	return s.checkpoint()
+}
+
+// checkpoint makes the block log durable and clears the WAL.
+func (s *LogStore) checkpoint() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpointLocked()
+}
+
+func (s *LogStore) checkpointLocked() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	size, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	s.size = size
+	return s.wal.Reset()
+}
+
+func (s *LogStore) closeFiles() {
+	s.wal.Close()
+	s.file.Close()
+}
+
+func (s *LogStore) replay() error {
+	snap, err := readSnapshot(snapshotPath(s.path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("load snapshot: %w", err)
+	}
+	if snap != nil && snap.Blocks != nil {
+		for _, b := range snap.Blocks {
+			s.blocks = append(s.blocks, b)
+			s.byHash[b.Hash] = b
+		}
+		s.legacy, snap = true, nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(s.file)
+	var (
+		offset int64
+		rec    []byte
+	)
+	for {
+		payload, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			var block *Block
+			block, err = openBlock(payload)
+			if errors.Is(err, errUnsealable) {
+				return fmt.Errorf("%s: %w", s.file.Name(), err)
+			}
+			known := err == nil && block.Pos < len(s.blocks) && s.blocks[block.Pos].Hash == block.Hash
+			if err == nil && !known && block.Pos != len(s.blocks) {
+				err = fmt.Errorf("block %d out of order", block.Pos)
+			}
+			if err == nil {
+				if !known {
+					s.blocks = append(s.blocks, block)
+					s.byHash[block.Hash] = block
+				}
+				rec = appendRecord(rec[:0], payload)
+				s.digest.Write(rec)
+				offset += int64(len(rec))
+				if snap != nil && offset == snap.Offset {
+					s.trust(snap)
+				}
+				continue
+			}
+		}
+		log.Printf("Warning: %s is corrupt after block %d at offset %d (%v); truncating", s.file.Name(), len(s.blocks)-1, offset, err)
+		if err := s.file.Truncate(offset); err != nil {
+			return err
+		}
+		break
+	}
+	if snap != nil && s.trusted == nil {
+		log.Printf("Warning: %s does not match its snapshot at block %d; verifying the whole chain", s.file.Name(), snap.Height)
+	}
+	s.size = offset
+	_, err = s.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// trust takes snap as vouching for the blocks read so far if they end at
+// its tip and the log up to here has its digest.
+func (s *LogStore) trust(snap *Snapshot) {
+	if len(s.blocks) != snap.Height+1 || s.blocks[snap.Height].Hash != snap.TipHash {
+		return
+	}
+	if hex.EncodeToString(s.digest.Sum(nil)) != snap.LogDigest {
+		return
+	}
+	s.trusted = snap
+}
+
+// Trusted returns the snapshot the log matched on open, or nil.
+func (s *LogStore) Trusted() *Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.trusted
+}
+
+func (s *LogStore) Snapshot() (SnapshotInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshotLocked()
+}
+
+// snapshotLocked makes the log durable and records its length and digest
+// with the tip and the last saved library state.
+func (s *LogStore) snapshotLocked() (SnapshotInfo, error) {
+	if len(s.blocks) == 0 {
+		return SnapshotInfo{}, ErrNotFound
+	}
+	if err := s.checkpointLocked(); err != nil {
+		return SnapshotInfo{}, err
+	}
+	tip := s.blocks[len(s.blocks)-1]
+	snap := &Snapshot{
+		Height:    tip.Pos,
+		TipHash:   tip.Hash,
+		Created:   time.Now().UTC().Format(time.RFC3339),
+		Offset:    s.size,
+		LogDigest: hex.EncodeToString(s.digest.Sum(nil)),
+		State:     s.saved,
+	}
+	path := snapshotPath(s.path)
+	if err := writeSnapshot(path, snap); err != nil {
+		return SnapshotInfo{}, err
+	}
+	return SnapshotInfo{Height: snap.Height, TipHash: snap.TipHash, Created: snap.Created, Path: path}, nil
+}
+
+// Compact rewrites the log with one record per block, dropping any that
+// replay skipped, and snapshots it.
+func (s *LogStore) Compact() (SnapshotInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.replaceLocked(s.blocks); err != nil {
+		return SnapshotInfo{}, err
+	}
+	return s.snapshotLocked()
+}
+
+func readRecord(r io.Reader) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("torn record header")
+		}
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxRecordSize {
+		return nil, fmt.Errorf("record length %d too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errors.New("torn record payload")
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+func encodeRecord(payload []byte) []byte {
+	return appendRecord(make([]byte, 0, recordHeaderSize+len(payload)), payload)
+}
+
+// appendRecord appends the record of payload to dst.
+func appendRecord(dst, payload []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(payload)))
+	dst = binary.BigEndian.AppendUint32(dst, crc32.ChecksumIEEE(payload))
+	return append(dst, payload...)
+}
+
+// sealBlock encodes a block as a log payload.
+func sealBlock(block *Block) ([]byte, error) {
+	payload, err := json.Marshal(block)
+	if err != nil {
+		return nil, err
+	}
+	return dataKeys.Seal(payload)
+}
+
+// errUnsealable marks a payload that passed its checksum but could not be
+// decrypted. Unlike a torn tail, it is never truncated away.
+var errUnsealable = errors.New("cannot decrypt block")
+
+// openBlock decodes a log payload.
+func openBlock(payload []byte) (*Block, error) {
+	plain, err := dataKeys.Open(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUnsealable, err)
+	}
+	return decodeBlock(plain)
+}
+
+func (s *LogStore) Append(block *Block) error {
+	payload, err := sealBlock(block)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if block.Pos != len(s.blocks) {
+		return fmt.Errorf("append block %d: store tip is %d", block.Pos, len(s.blocks)-1)
+	}
+	s.rec = appendRecord(s.rec[:0], payload)
+	if s.policy == FsyncAlways {
+		if _, err := s.file.Write(s.rec); err != nil {
+			return s.rollback(0, err)
+		}
+		if err := s.file.Sync(); err != nil {
+			return s.rollback(0, err)
+		}
+		s.size += int64(len(s.rec))
+		s.digest.Write(s.rec)
+	} else {
+		walSize := s.wal.Size()
+		if err := s.wal.WriteRecord(s.rec); err != nil {
+			return s.rollback(walSize, fmt.Errorf("write wal: %w", err))
+		}
+		if _, err := s.w.Write(s.rec); err != nil {
+			return s.rollback(walSize, err)
+		}
+		s.digest.Write(s.rec)
+	}
+	s.blocks = append(s.blocks, block)
+	s.byHash[block.Hash] = block
+	return nil
+}
+
+// rollback undoes an append that failed with cause. The log is cut back to
+// its last good size; under interval and never the WAL is cut back to
+// walSize and the buffer, whose errors are sticky, is reset and refilled
+// with the records the WAL still holds, which are exactly those appended
+// since the last checkpoint.
+func (s *LogStore) rollback(walSize int64, cause error) error {
+	errs := []error{cause}
+	if s.policy != FsyncAlways {
+		if err := s.wal.Truncate(walSize); err != nil {
+			errs = append(errs, fmt.Errorf("roll back wal: %w", err))
+		}
+	}
+	if err := s.file.Truncate(s.size); err != nil {
+		errs = append(errs, fmt.Errorf("roll back log: %w", err))
+	}
+	if _, err := s.file.Seek(s.size, io.SeekStart); err != nil {
+		errs = append(errs, fmt.Errorf("roll back log: %w", err))
+	}
+	if s.policy != FsyncAlways {
+		s.w.Reset(s.file)
+		err := s.wal.Replay(func(payload []byte) error {
+			_, err := s.w.Write(encodeRecord(payload))
+			return err
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("roll back log: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Replace rewrites the block log with blocks and removes the snapshot, which
+// no longer describes the stored chain.
+func (s *LogStore) Replace(blocks []*Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.replaceLocked(blocks)
+}
+
+func (s *LogStore) replaceLocked(blocks []*Block) error {
+	digest := sha256.New()
+	err := writeFileAtomic(s.path, func(f *os.File) error {
+		w := bufio.NewWriter(io.MultiWriter(f, digest))
+		for _, b := range blocks {
+			payload, err := sealBlock(b)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(encodeRecord(payload)); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(snapshotPath(s.path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	s.size = size
+	s.digest = digest
+	s.trusted, s.legacy = nil, false
+	s.w.Reset(file)
+	s.blocks = blocks
+	s.byHash = map[string]*Block{}
+	for _, b := range blocks {
+		s.byHash[b.Hash] = b
+	}
+	return s.wal.Reset()
+}
+
+func (s *LogStore) GetByPos(pos int) (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if pos < 0 || pos >= len(s.blocks) {
+		return nil, ErrNotFound
+	}
+	return s.blocks[pos], nil
+}
+
+func (s *LogStore) GetByHash(hash string) (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.byHash[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return b, nil
+}
+
+func (s *LogStore) Iterate(fn func(*Block) error) error {
+	s.mu.RLock()
+	blocks := s.blocks
+	s.mu.RUnlock()
+	for _, b := range blocks {
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *LogStore) Tip() (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.blocks) == 0 {
+		return nil, ErrNotFound
+	}
+	return s.blocks[len(s.blocks)-1], nil
+}
+
+// LoadState returns the saved library state, or the snapshot's if that is
+// newer.
+func (s *LogStore) LoadState() (*StateSnapshot, error) {
+	snap, err := readStateFile(statePath(s.path))
+	if trusted := s.Trusted(); trusted != nil && trusted.State != nil && (err != nil || trusted.State.Height > snap.Height) {
+		return trusted.State, nil
+	}
+	return snap, err
+}
+
+func (s *LogStore) SaveState(snap *StateSnapshot) error {
+	if err := writeStateFile(statePath(s.path), snap); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.saved = snap
+	s.mu.Unlock()
+	return nil
+}
+
+// Rekey rewrites the log, and the saved state, with the current key. The
+// snapshot is dropped along the way, as by Replace.
+func (s *LogStore) Rekey() error {
+	s.mu.RLock()
+	blocks := s.blocks
+	s.mu.RUnlock()
+	if err := s.Replace(blocks); err != nil {
+		return err
+	}
+	snap, err := s.LoadState()
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.SaveState(snap)
+}
+
+func (s *LogStore) Close() error {
+	close(s.stop)
+	err := s.checkpoint()
+	s.closeFiles()
+	return err
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var postgresDSN = os.Getenv("DATABASE_URL")
+
+// ErrTipMoved is returned by a shared store when another writer appended a
+// block after the caller read the tip.
+var ErrTipMoved = errors.New("chain tip moved")
+
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS blocks (
+	pos       BIGINT PRIMARY KEY,
+	hash      TEXT NOT NULL UNIQUE,
+	prevhash  TEXT NOT NULL,
+	timestamp TEXT NOT NULL,
+	data      JSONB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS transactions (
+	block_pos     BIGINT NOT NULL REFERENCES blocks(pos),
+	idx           INTEGER NOT NULL,
+	bookid        TEXT NOT NULL,
+	"user"        TEXT NOT NULL,
+	checkout_date TEXT NOT NULL,
+	public_key    TEXT NOT NULL,
+	PRIMARY KEY (block_pos, idx)
+);
+CREATE INDEX IF NOT EXISTS transactions_user ON transactions("user");
+CREATE INDEX IF NOT EXISTS transactions_bookid ON transactions(bookid);
+CREATE TABLE IF NOT EXISTS library_state (
+	id     INTEGER PRIMARY KEY CHECK (id = 1),
+	height BIGINT NOT NULL,
+	data   JSONB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS outbox (
+	seq        BIGSERIAL PRIMARY KEY,
+	event_id   TEXT NOT NULL,
+	type       TEXT NOT NULL,
+	block_hash TEXT NOT NULL,
+	data       JSONB NOT NULL
+);
+`
+
+// PostgresStore lets several API replicas share one chain. Appends only
+// succeed if the block extends the tip currently in the database.
+type PostgresStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresStore(dsn string) (*PostgresStore, error) {
+	if dsn == "" {
+		return nil, errors.New("postgres store needs -postgres-dsn or DATABASE_URL")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pool.Exec(ctx, postgresSchema); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &PostgresStore{pool: pool}, nil
+}
+
+func (s *PostgresStore) Append(block *Block) error {
+	data, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `INSERT INTO blocks (pos, hash, prevhash, timestamp, data)
+		SELECT $1, $2, $3, $4, $5
+		WHERE COALESCE((SELECT hash FROM blocks ORDER BY pos DESC LIMIT 1), '') = $3
+		  AND COALESCE((SELECT MAX(pos) + 1 FROM blocks), 0) = $1`,
+		block.Pos, block.Hash, block.Prevhash, block.Timestamp, data)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return ErrTipMoved
+	}
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTipMoved
+	}
+	if err := postgresInsertTransactions(ctx, tx, block); err != nil {
+		return err
+	}
+	if outboxEnabled {
+		events, err := domainEvents(block)
+		if err != nil {
+			return err
+		}
+		if err := postgresEnqueue(ctx, tx, events); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func postgresEnqueue(ctx context.Context, tx pgx.Tx, events []OutboxEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	batch := &pgx.Batch{}
+	for _, ev := range events {
+		batch.Queue(`INSERT INTO outbox (event_id, type, block_hash, data) VALUES ($1, $2, $3, $4)`,
+			ev.ID, ev.Type, ev.BlockHash, []byte(ev.Data))
+	}
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return fmt.Errorf("queue events: %w", err)
+	}
+	return nil
+}
+
+func postgresInsertTransactions(ctx context.Context, tx pgx.Tx, block *Block) error {
+	batch := &pgx.Batch{}
+	for i, t := range block.Transactions {
+		batch.Queue(`INSERT INTO transactions (block_pos, idx, bookid, "user", checkout_date, public_key) VALUES ($1, $2, $3, $4, $5, $6)`,
+			block.Pos, i, t.BookId, t.User, t.CheckoutDate, t.PublicKey)
+	}
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return fmt.Errorf("insert transactions: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) Replace(blocks []*Block) error {
+	ctx := context.Background()
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `LOCK TABLE blocks, transactions IN ACCESS EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+	var events []OutboxEvent
+	if outboxEnabled {
+		if events, err = replacedEvents(blocks, func(b *Block) bool {
+			var exists bool
+			err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM blocks WHERE hash = $1)`, b.Hash).Scan(&exists)
+			return err == nil && exists
+		}); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM transactions`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM blocks`); err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		data, err := json.Marshal(block)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO blocks (pos, hash, prevhash, timestamp, data) VALUES ($1, $2, $3, $4, $5)`,
+			block.Pos, block.Hash, block.Prevhash, block.Timestamp, data)
+		if err != nil {
+			return err
+		}
+		if err := postgresInsertTransactions(ctx, tx, block); err != nil {
+			return err
+		}
+	}
+	if err := postgresEnqueue(ctx, tx, events); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *PostgresStore) queryBlock(query string, args ...any) (*Block, error) {
+	var data []byte
+	err := s.pool.QueryRow(context.Background(), query, args...).Scan(&data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlock(data)
+}
+
+func (s *PostgresStore) GetByPos(pos int) (*Block, error) {
+	return s.queryBlock(`SELECT data FROM blocks WHERE pos = $1`, pos)
+}
+
+func (s *PostgresStore) GetByHash(hash string) (*Block, error) {
+	return s.queryBlock(`SELECT data FROM blocks WHERE hash = $1`, hash)
+}
+
+func (s *PostgresStore) Tip() (*Block, error) {
+	return s.queryBlock(`SELECT data FROM blocks ORDER BY pos DESC LIMIT 1`)
+}
+
+func (s *PostgresStore) Iterate(fn func(*Block) error) error {
+	rows, err := s.pool.Query(context.Background(), `SELECT data FROM blocks ORDER BY pos`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		block, err := decodeBlock(data)
+		if err != nil {
+			return err
+		}
+		if err := fn(block); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// CheckoutsByUser returns every checkout recorded for user, oldest first.
+func (s *PostgresStore) CheckoutsByUser(user string) ([]Transaction, error) {
+	rows, err := s.pool.Query(context.Background(), `SELECT bookid, "user", checkout_date, public_key FROM transactions
+		WHERE "user" = $1 ORDER BY block_pos, idx`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	checkouts := []Transaction{}
+	for rows.Next() {
+		var c Transaction
+		if err := rows.Scan(&c.BookId, &c.User, &c.CheckoutDate, &c.PublicKey); err != nil {
+			return nil, err
+		}
+		checkouts = append(checkouts, c)
+	}
+	return checkouts, rows.Err()
+}
+
+func (s *PostgresStore) LoadState() (*StateSnapshot, error) {
+	var data []byte
+	err := s.pool.QueryRow(context.Background(), `SELECT data FROM library_state WHERE id = 1`).Scan(&data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap StateSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// SaveState keeps the highest state written by any replica sharing the
+// database.
+func (s *PostgresStore) SaveState(snap *StateSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.Exec(context.Background(), `INSERT INTO library_state (id, height, data) VALUES (1, $1, $2)
+		ON CONFLICT (id) DO UPDATE SET height = excluded.height, data = excluded.data
+		WHERE library_state.height <= excluded.height`, snap.Height, data)
+	return err
+}
+
+// PendingEvents returns the oldest queued events. Replicas sharing the
+// database may publish the same event; consumers see it at least once
+// either way.
+func (s *PostgresStore) PendingEvents(limit int) ([]OutboxEvent, error) {
+	rows, err := s.pool.Query(context.Background(), `SELECT seq, event_id, type, block_hash, data FROM outbox ORDER BY seq LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []OutboxEvent
+	for rows.Next() {
+		var ev OutboxEvent
+		var data []byte
+		if err := rows.Scan(&ev.Seq, &ev.ID, &ev.Type, &ev.BlockHash, &data); err != nil {
+			return nil, err
+		}
+		ev.Data = json.RawMessage(data)
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+func (s *PostgresStore) AckEvents(seq int64) error {
+	_, err := s.pool.Exec(context.Background(), `DELETE FROM outbox WHERE seq <= $1`, seq)
+	return err
+}
+
+func (s *PostgresStore) Close() error {
+	s.pool.Close()
+	return nil
+}
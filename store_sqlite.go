@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+var sqliteFile = "blockchain.sqlite"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS blocks (
+	pos       INTEGER PRIMARY KEY,
+	hash      TEXT NOT NULL UNIQUE,
+	prevhash  TEXT NOT NULL,
+	timestamp TEXT NOT NULL,
+	data      TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS transactions (
+	block_pos     INTEGER NOT NULL REFERENCES blocks(pos),
+	idx           INTEGER NOT NULL,
+	bookid        TEXT NOT NULL,
+	"user"        TEXT NOT NULL,
+	checkout_date TEXT NOT NULL,
+	public_key    TEXT NOT NULL,
+	PRIMARY KEY (block_pos, idx)
+);
+CREATE INDEX IF NOT EXISTS transactions_user ON transactions("user");
+CREATE INDEX IF NOT EXISTS transactions_bookid ON transactions(bookid);
+CREATE TABLE IF NOT EXISTS library_state (
+	id     INTEGER PRIMARY KEY CHECK (id = 1),
+	height INTEGER NOT NULL,
+	data   TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS outbox (
+	seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+	event_id   TEXT NOT NULL,
+	type       TEXT NOT NULL,
+	block_hash TEXT NOT NULL,
+	data       TEXT NOT NULL
+);
+`
+
+// SQLiteStore writes each block as a row plus one row per transaction, so
+// checkouts can be queried with SQL instead of scanning the chain.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Append(block *Block) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var next int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(pos) + 1, 0) FROM blocks`).Scan(&next); err != nil {
+		return err
+	}
+	if block.Pos != next {
+		return fmt.Errorf("append block %d: store tip is %d", block.Pos, next-1)
+	}
+	if err := sqliteInsert(tx, block); err != nil {
+		return err
+	}
+	if outboxEnabled {
+		events, err := domainEvents(block)
+		if err != nil {
+			return err
+		}
+		if err := sqliteEnqueue(tx, events); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func sqliteInsert(tx *sql.Tx, block *Block) error {
+	data, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO blocks (pos, hash, prevhash, timestamp, data) VALUES (?, ?, ?, ?, ?)`,
+		block.Pos, block.Hash, block.Prevhash, block.Timestamp, string(data))
+	if err != nil {
+		return err
+	}
+	for i, t := range block.Transactions {
+		_, err = tx.Exec(`INSERT INTO transactions (block_pos, idx, bookid, "user", checkout_date, public_key) VALUES (?, ?, ?, ?, ?, ?)`,
+			block.Pos, i, t.BookId, t.User, t.CheckoutDate, t.PublicKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Replace(blocks []*Block) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var events []OutboxEvent
+	if outboxEnabled {
+		if events, err = replacedEvents(blocks, func(b *Block) bool {
+			var n int
+			err := tx.QueryRow(`SELECT COUNT(*) FROM blocks WHERE hash = ?`, b.Hash).Scan(&n)
+			return err == nil && n > 0
+		}); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM transactions; DELETE FROM blocks`); err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		if err := sqliteInsert(tx, b); err != nil {
+			return err
+		}
+	}
+	if err := sqliteEnqueue(tx, events); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func sqliteEnqueue(tx *sql.Tx, events []OutboxEvent) error {
+	for _, ev := range events {
+		if _, err := tx.Exec(`INSERT INTO outbox (event_id, type, block_hash, data) VALUES (?, ?, ?, ?)`,
+			ev.ID, ev.Type, ev.BlockHash, string(ev.Data)); err != nil {
+			return fmt.Errorf("queue event %s: %w", ev.ID, err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) PendingEvents(limit int) ([]OutboxEvent, error) {
+	rows, err := s.db.Query(`SELECT seq, event_id, type, block_hash, data FROM outbox ORDER BY seq LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []OutboxEvent
+	for rows.Next() {
+		var ev OutboxEvent
+		var data string
+		if err := rows.Scan(&ev.Seq, &ev.ID, &ev.Type, &ev.BlockHash, &data); err != nil {
+			return nil, err
+		}
+		ev.Data = json.RawMessage(data)
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+func (s *SQLiteStore) AckEvents(seq int64) error {
+	_, err := s.db.Exec(`DELETE FROM outbox WHERE seq <= ?`, seq)
+	return err
+}
+
+func (s *SQLiteStore) queryBlock(query string, args ...any) (*Block, error) {
+	var data string
+	err := s.db.QueryRow(query, args...).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlock([]byte(data))
+}
+
+func (s *SQLiteStore) GetByPos(pos int) (*Block, error) {
+	return s.queryBlock(`SELECT data FROM blocks WHERE pos = ?`, pos)
+}
+
+func (s *SQLiteStore) GetByHash(hash string) (*Block, error) {
+	return s.queryBlock(`SELECT data FROM blocks WHERE hash = ?`, hash)
+}
+
+func (s *SQLiteStore) Tip() (*Block, error) {
+	return s.queryBlock(`SELECT data FROM blocks ORDER BY pos DESC LIMIT 1`)
+}
+
+func (s *SQLiteStore) Iterate(fn func(*Block) error) error {
+	rows, err := s.db.Query(`SELECT data FROM blocks ORDER BY pos`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		block, err := decodeBlock([]byte(data))
+		if err != nil {
+			return err
+		}
+		if err := fn(block); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// CheckoutsByUser returns every checkout recorded for user, oldest first.
+func (s *SQLiteStore) CheckoutsByUser(user string) ([]Transaction, error) {
+	rows, err := s.db.Query(`SELECT bookid, "user", checkout_date, public_key FROM transactions
+		WHERE "user" = ? ORDER BY block_pos, idx`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	checkouts := []Transaction{}
+	for rows.Next() {
+		var c Transaction
+		if err := rows.Scan(&c.BookId, &c.User, &c.CheckoutDate, &c.PublicKey); err != nil {
+			return nil, err
+		}
+		checkouts = append(checkouts, c)
+	}
+	return checkouts, rows.Err()
+}
+
+func (s *SQLiteStore) LoadState() (*StateSnapshot, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM library_state WHERE id = 1`).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap StateSnapshot
+	if err := json.Unmarshal([]byte(data), &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+func (s *SQLiteStore) SaveState(snap *StateSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO library_state (id, height, data) VALUES (1, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET height = excluded.height, data = excluded.data`, snap.Height, string(data))
+	return err
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
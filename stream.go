@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// streamFlushEvery is how many blocks a streamed response writes between
+// flushes, so clients see blocks arrive while the rest are encoded.
+const streamFlushEvery = 64
+
+// blockStream writes blocks through a buffer, flushing it to the client
+// every streamFlushEvery blocks.
+type blockStream struct {
+	*bufio.Writer
+	flusher http.Flusher
+	n       int
+}
+
+func newBlockStream(w http.ResponseWriter, mt string) *blockStream {
+	w.Header().Set("Content-Type", mt)
+	w.Header().Add("Vary", "Accept")
+	flusher, _ := w.(http.Flusher)
+	return &blockStream{Writer: bufio.NewWriter(w), flusher: flusher}
+}
+
+// written counts a block and flushes when enough have gone by.
+func (s *blockStream) written() error {
+	s.n++
+	if s.n%streamFlushEvery != 0 {
+		return nil
+	}
+	return s.Flush()
+}
+
+func (s *blockStream) Flush() error {
+	if err := s.Writer.Flush(); err != nil {
+		return err
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
+
+// streamBlockPage writes page as json.MarshalIndent(page, "", "  ") would,
+// but marshals one block at a time, so a response never holds more than one
+// encoded block in memory.
+func streamBlockPage(w http.ResponseWriter, page BlockPage) error {
+	s := newBlockStream(w, mediaJSON)
+	s.WriteString("{\n  \"blocks\": [")
+	for i, b := range page.Blocks {
+		data, err := json.MarshalIndent(b, "    ", "  ")
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			s.WriteString(",")
+		}
+		s.WriteString("\n    ")
+		s.Write(data)
+		if err := s.written(); err != nil {
+			return err
+		}
+	}
+	if len(page.Blocks) > 0 {
+		s.WriteString("\n  ")
+	}
+	fmt.Fprintf(s, "],\n  \"total\": %d,\n  \"offset\": %d,\n  \"limit\": %d\n}", page.Total, page.Offset, page.Limit)
+	return s.Flush()
+}
+
+// streamNDJSON writes blocks as newline-delimited JSON, one block per line.
+func streamNDJSON(w http.ResponseWriter, blocks []*Block) error {
+	s := newBlockStream(w, mediaNDJSON)
+	enc := json.NewEncoder(s)
+	for _, b := range blocks {
+		if err := enc.Encode(b); err != nil {
+			return err
+		}
+		if err := s.written(); err != nil {
+			return err
+		}
+	}
+	return s.Flush()
+}
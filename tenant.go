@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"blockchain/apierr"
+)
+
+var (
+	tenantFile = "tenants.json"
+	tenantDir  = "tenants"
+)
+
+var (
+	ErrTenantNotFound = errors.New("tenant not found")
+	ErrTenantExists   = errors.New("tenant already exists")
+	ErrInvalidTenant  = errors.New("tenant id must be 1 to 32 lowercase letters, digits or hyphens, starting with a letter or digit")
+)
+
+var validTenantID = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// Tenant is one library branch: a chain, catalog, member registry, search
+// index and mempool of its own, kept under tenants/<id> in the data
+// directory. The node's own
+// library is the tenant with an empty ID, made of the package's globals.
+// Branch chains live on this node only; they are not sent to peers or
+// replicated through raft.
+type Tenant struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Created string `json:"created"`
+
+	chain   *Blockchain
+	books   *Catalog
+	members *MemberRegistry
+	search  *SearchIndex
+	pool    *TxPool
+	store   Store
+	stop    func(context.Context) error
+}
+
+// homeTenant is the node's own library, for requests that name no tenant.
+var homeTenant *Tenant
+
+// TenantInfo is a tenant as the admin API shows it.
+type TenantInfo struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Created string `json:"created"`
+	Height  int    `json:"height"`
+	Tip     string `json:"tip"`
+	Books   int    `json:"books"`
+}
+
+func (t *Tenant) info() TenantInfo {
+	tip := t.chain.Tip()
+	return TenantInfo{ID: t.ID, Name: t.Name, Created: t.Created, Height: tip.Pos, Tip: tip.Hash, Books: len(t.books.List(true))}
+}
+
+// openTenant opens or creates a branch's chain and catalog, builds its search
+// index and starts mining its mempool.
+func openTenant(t *Tenant) error {
+	dir := filepath.Join(tenantDir, t.ID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	store, err := NewLogStore(filepath.Join(dir, "chain.log"), fsyncPolicy, fsyncInterval)
+	if err != nil {
+		return err
+	}
+	chain, err := NewBlockChain(store)
+	if err != nil {
+		store.Close()
+		return err
+	}
+	books, err := OpenCatalog(filepath.Join(dir, "catalog.json"))
+	if err == nil {
+		err = books.Apply(chain.Snapshot()...)
+	}
+	var members *MemberRegistry
+	if err == nil {
+		members, err = OpenMembers(filepath.Join(dir, "members.json"))
+	}
+	if err != nil {
+		store.Close()
+		return err
+	}
+	search, err := NewSearchIndex(books, chain.Snapshot())
+	if err != nil {
+		store.Close()
+		return err
+	}
+	chain.branch = t
+	t.chain, t.books, t.members, t.search, t.pool, t.store = chain, books, members, search, &TxPool{}, store
+	t.stop = startBlockProducer(t, blockInterval)
+	return nil
+}
+
+// close mines what is pending and closes the branch's store.
+func (t *Tenant) close(ctx context.Context) error {
+	err := t.stop(ctx)
+	t.chain.writeMu.Lock()
+	defer t.chain.writeMu.Unlock()
+	t.chain.saveState()
+	return errors.Join(err, t.store.Close())
+}
+
+// noteRejected reports a refused checkout on the node's event stream, which
+// only covers the node's own library.
+func (t *Tenant) noteRejected(tx Transaction, err error) {
+	if t.ID == "" {
+		noteRejected(tx, err)
+	}
+}
+
+// TenantRegistry is the list of branches, kept in a JSON file, with each
+// branch opened while the node runs.
+type TenantRegistry struct {
+	mu      sync.RWMutex
+	path    string
+	tenants map[string]*Tenant
+}
+
+var Tenants *TenantRegistry
+
+// OpenTenants reads the registry and opens every branch in it.
+func OpenTenants(path string) (*TenantRegistry, error) {
+	reg := &TenantRegistry{path: path, tenants: map[string]*Tenant{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return reg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*Tenant
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, t := range list {
+		if err := openTenant(t); err != nil {
+			reg.Close(context.Background())
+			return nil, fmt.Errorf("open tenant %s: %w", t.ID, err)
+		}
+		reg.tenants[t.ID] = t
+	}
+	return reg, nil
+}
+
+func (reg *TenantRegistry) saveLocked() error {
+	return writeFileAtomic(reg.path, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(reg.listLocked())
+	})
+}
+
+func (reg *TenantRegistry) listLocked() []*Tenant {
+	list := make([]*Tenant, 0, len(reg.tenants))
+	for _, t := range reg.tenants {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (reg *TenantRegistry) List() []*Tenant {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.listLocked()
+}
+
+func (reg *TenantRegistry) Get(id string) (*Tenant, error) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	t, ok := reg.tenants[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTenantNotFound, id)
+	}
+	return t, nil
+}
+
+// Create opens a new branch with a fresh chain.
+func (reg *TenantRegistry) Create(id, name string) (*Tenant, error) {
+	if !validTenantID.MatchString(id) {
+		return nil, ErrInvalidTenant
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.tenants[id]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrTenantExists, id)
+	}
+	if fileExists(filepath.Join(tenantDir, id)) {
+		return nil, fmt.Errorf("%w: %s has data left in %s", ErrTenantExists, id, filepath.Join(tenantDir, id))
+	}
+	t := &Tenant{ID: id, Name: name, Created: time.Now().UTC().Format(time.RFC3339)}
+	if err := openTenant(t); err != nil {
+		return nil, err
+	}
+	reg.tenants[id] = t
+	if err := reg.saveLocked(); err != nil {
+		delete(reg.tenants, id)
+		t.close(context.Background())
+		return nil, err
+	}
+	return t, nil
+}
+
+// Delete closes a branch and drops it from the registry. Its data is kept,
+// moved aside to tenants/<id>.deleted-<unix time>.
+func (reg *TenantRegistry) Delete(ctx context.Context, id string) (*Tenant, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	t, ok := reg.tenants[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTenantNotFound, id)
+	}
+	delete(reg.tenants, id)
+	if err := reg.saveLocked(); err != nil {
+		reg.tenants[id] = t
+		return nil, err
+	}
+	if err := t.close(ctx); err != nil {
+		return t, err
+	}
+	dir := filepath.Join(tenantDir, id)
+	return t, os.Rename(dir, fmt.Sprintf("%s.deleted-%d", dir, time.Now().Unix()))
+}
+
+// Close closes every branch, for shutdown.
+func (reg *TenantRegistry) Close(ctx context.Context) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	var errs []error
+	for _, t := range reg.tenants {
+		errs = append(errs, t.close(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+type tenantContextKey struct{}
+
+// tenantOf returns the library a request is for: the branch its path or
+// token names, or the node's own.
+func tenantOf(r *http.Request) *Tenant {
+	if t, ok := r.Context().Value(tenantContextKey{}).(*Tenant); ok {
+		return t
+	}
+	return homeTenant
+}
+
+// withTenant routes a request to the branch named by the {tenant} in its
+// path or, failing that, by the tenant its access token is bound to.
+func withTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["tenant"]
+		if id == "" && authEnabled {
+			if claims, err := Tokens.Parse(bearerToken(r.Header.Get("Authorization")), tokenAccess); err == nil {
+				id = claims.Tenant
+			}
+		}
+		if id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t, err := Tenants.Get(id)
+		if err != nil {
+			writeError(w, r, apiError(err, apierr.Internal))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, t)))
+	})
+}
+
+func listTenants(w http.ResponseWriter, r *http.Request) {
+	infos := []TenantInfo{}
+	for _, t := range Tenants.List() {
+		infos = append(infos, t.info())
+	}
+	respond(w, r, infos)
+}
+
+func getTenant(w http.ResponseWriter, r *http.Request) {
+	t, err := Tenants.Get(mux.Vars(r)["tenant"])
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	respond(w, r, t.info())
+}
+
+func createTenant(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "invalid tenant request: %w", err))
+		return
+	}
+	t, err := Tenants.Create(req.ID, req.Name)
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t.info())
+}
+
+func deleteTenant(w http.ResponseWriter, r *http.Request) {
+	t, err := Tenants.Delete(r.Context(), mux.Vars(r)["tenant"])
+	if t == nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	if err != nil {
+		reqLog(r).Error("Error closing tenant", "tenant", t.ID, "error", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "tenant deleted", "id": t.ID})
+}
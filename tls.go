@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	tlsCertFile     string
+	tlsKeyFile      string
+	autocertDomains string
+	autocertCache   = "autocert"
+	autocertEmail   string
+	redirectAddr    string
+)
+
+// serve runs srv on its address: plain HTTP by default, TLS with -tls-cert
+// and -tls-key, or TLS with certificates from Let's Encrypt for -autocert
+// domains. With -redirect-addr a second listener sends plain HTTP requests
+// to HTTPS and, under autocert, answers ACME HTTP challenges; it is shut
+// down along with srv.
+func serve(srv *http.Server) error {
+	var redirect http.Handler = http.HandlerFunc(redirectToHTTPS)
+	switch {
+	case autocertDomains != "":
+		if tlsCertFile != "" || tlsKeyFile != "" {
+			return errors.New("-autocert cannot be combined with -tls-cert or -tls-key")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(autocertCache),
+			HostPolicy: autocert.HostWhitelist(strings.Split(autocertDomains, ",")...),
+			Email:      autocertEmail,
+		}
+		srv.TLSConfig = m.TLSConfig()
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+		redirect = m.HTTPHandler(redirect)
+	case tlsCertFile != "" || tlsKeyFile != "":
+		if tlsCertFile == "" || tlsKeyFile == "" {
+			return errors.New("-tls-cert and -tls-key must be given together")
+		}
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	default:
+		if redirectAddr != "" {
+			return errors.New("-redirect-addr needs TLS")
+		}
+		log.Printf("Listening on %s", srv.Addr)
+		return srv.ListenAndServe()
+	}
+	if peerCAs != nil {
+		// Browsers and API clients have no certificate, so one is only
+		// verified when given; requirePeerCert insists on it for peer routes.
+		srv.TLSConfig.ClientCAs = peerCAs
+		srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if redirectAddr != "" {
+		rs := &http.Server{Addr: redirectAddr, Handler: redirect}
+		srv.RegisterOnShutdown(func() { rs.Shutdown(context.Background()) })
+		go func() {
+			log.Printf("Redirecting HTTP on %s to HTTPS", redirectAddr)
+			if err := rs.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("HTTP redirect listener stopped: %v", err)
+			}
+		}()
+	}
+	log.Printf("Listening on %s (TLS)", srv.Addr)
+	return srv.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+}
+
+// redirectToHTTPS sends the request to the same host and path over HTTPS,
+// on the TLS port when it is not 443.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(listenAddr); err == nil && port != "443" && port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
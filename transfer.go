@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"blockchain/apierr"
+)
+
+var ErrBookAway = errors.New("book is at another branch")
+
+// branchID returns the tenant the chain belongs to, "" for the node's own.
+func (bc *Blockchain) branchID() string {
+	if bc.branch == nil {
+		return ""
+	}
+	return bc.branch.ID
+}
+
+// checkCustody refuses to lend a book, or send it on, from a library the
+// chain says it was transferred away from. A transfer arriving from another
+// branch is not checked here: the sending branch's chain is the one that
+// knows where the book is.
+func (s *LibraryState) checkCustody(tx Transaction, branch string) error {
+	switch tx.Kind() {
+	case TxCheckout:
+	case TxTransfer:
+		if tx.FromBranch != branch {
+			return nil
+		}
+	default:
+		return nil
+	}
+	if loc, ok := s.locations[tx.BookId]; ok && loc != branch {
+		return fmt.Errorf("%w: %s", ErrBookAway, branchName(loc))
+	}
+	return nil
+}
+
+// branchName names a branch in messages.
+func branchName(id string) string {
+	if id == "" {
+		return "the main library"
+	}
+	return id
+}
+
+// Location returns the branch a book was last transferred to, if this chain
+// has recorded a transfer of it.
+func (bc *Blockchain) Location(bookID string) (string, bool) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	branch, ok := bc.state.locations[bookID]
+	return branch, ok
+}
+
+// BookLocation is where a library's chain says a book is. Branch is a tenant
+// ID, "" for the node's own library.
+type BookLocation struct {
+	BookId    string    `json:"bookid"`
+	Branch    string    `json:"branch"`
+	Here      bool      `json:"here"`
+	Transfers []TxEvent `json:"transfers"`
+}
+
+func getBookLocation(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	t := tenantOf(r)
+	history := t.chain.BookHistory(id)
+	if _, err := t.books.Get(id); err != nil && len(history) == 0 {
+		writeError(w, r, apierr.Errorf(codeBookNotFound, "unknown book %s", id))
+		return
+	}
+	loc := BookLocation{BookId: id, Branch: t.ID, Transfers: []TxEvent{}}
+	if branch, ok := t.chain.Location(id); ok {
+		loc.Branch = branch
+	}
+	loc.Here = loc.Branch == t.ID
+	for _, ev := range history {
+		if ev.Kind() == TxTransfer {
+			loc.Transfers = append(loc.Transfers, ev)
+		}
+	}
+	respond(w, r, loc)
+}
+
+// transferBook answers POST /books/{id}/transfer {"to": "<branch>"}, moving
+// a book from the request's library to another library on this node. The
+// transfer, signed by the node, is recorded on the sending chain and then on
+// the receiving one, whose catalog picks the book up from it.
+func transferBook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	from := tenantOf(r)
+	var req struct {
+		To string `json:"to"`
+	}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "invalid transfer request: %w", err))
+		return
+	}
+	to := homeTenant
+	if req.To != "" {
+		var err error
+		if to, err = Tenants.Get(req.To); err != nil {
+			writeError(w, r, apiError(err, apierr.Internal))
+			return
+		}
+	}
+	if to == from {
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "book %s cannot be transferred to the library it is in", id))
+		return
+	}
+	book, err := from.books.Get(id)
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	if book.Withdrawn {
+		writeError(w, r, apiError(ErrBookWithdrawn, apierr.Conflict))
+		return
+	}
+	tx := Transaction{
+		Type:       TxTransfer,
+		BookId:     id,
+		Date:       clock.Now().UTC().Format(time.RFC3339),
+		Book:       &book,
+		FromBranch: from.ID,
+		ToBranch:   to.ID,
+	}
+	tx.Sign(NodeKey)
+	// Check both sides first, so a transfer is rarely left half recorded.
+	for _, t := range []*Tenant{from, to} {
+		if err := t.chain.checkState(tx); err != nil {
+			writeError(w, r, apiError(err, apierr.Conflict))
+			return
+		}
+	}
+	if _, err := from.chain.AddBlock(r.Context(), tx); err != nil {
+		writeError(w, r, txError(err))
+		return
+	}
+	if _, err := to.chain.AddBlock(r.Context(), tx); err != nil {
+		reqLog(r).Error("Transfer recorded by the sending branch only; POST /admin/transfers/finish records it on the receiving one", "book", id, "from", from.ID, "to", to.ID, "error", err)
+		writeError(w, r, txError(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "book transferred", "id": tx.ID(), "from": from.ID, "to": to.ID})
+}
+
+// tenantByID returns a tenant, the node's own library for "".
+func tenantByID(id string) (*Tenant, error) {
+	if id == "" {
+		return homeTenant, nil
+	}
+	return Tenants.Get(id)
+}
+
+// FinishedTransfer is a transfer finishTransfers recorded on the receiving
+// chain, or failed to.
+type FinishedTransfer struct {
+	ID     string `json:"id"`
+	BookId string `json:"bookid"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Error  string `json:"error,omitempty"`
+}
+
+// finishTransfers records on the receiving chain every transfer a sending
+// chain recorded but the receiving one did not, as happens when the second
+// AddBlock of transferBook fails or the node stops between the two.
+// Transfers the receiving chain already holds are skipped, so running it
+// again is harmless. The node runs it at startup outside raft mode.
+func finishTransfers(ctx context.Context) []FinishedTransfer {
+	out := []FinishedTransfer{}
+	for _, from := range allTenants() {
+		for _, b := range from.chain.Snapshot() {
+			for _, tx := range b.Transactions {
+				if tx.Kind() != TxTransfer || tx.FromBranch != from.ID {
+					continue
+				}
+				to, err := tenantByID(tx.ToBranch)
+				if err != nil {
+					continue
+				}
+				id := tx.ID()
+				if _, ok := to.chain.TxBlock(id); ok {
+					continue
+				}
+				f := FinishedTransfer{ID: id, BookId: tx.BookId, From: from.ID, To: to.ID}
+				if _, err := to.chain.AddBlock(ctx, tx); err != nil {
+					f.Error = err.Error()
+				}
+				out = append(out, f)
+			}
+		}
+	}
+	return out
+}
+
+// adminFinishTransfers answers POST /admin/transfers/finish with the
+// half-recorded transfers it finished.
+func adminFinishTransfers(w http.ResponseWriter, r *http.Request) {
+	finished := finishTransfers(r.Context())
+	for _, f := range finished {
+		if f.Error != "" {
+			reqLog(r).Error("Error finishing transfer", "id", f.ID, "book", f.BookId, "from", f.From, "to", f.To, "error", f.Error)
+			continue
+		}
+		reqLog(r).Info("Finished transfer", "id", f.ID, "book", f.BookId, "from", f.From, "to", f.To)
+	}
+	respond(w, r, finished)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var ErrDuplicateTx = errors.New("transaction was already submitted")
+
+// ID identifies a transaction by a hash of the payload its member signed.
+// That payload includes the client's nonce, so a member who means to submit
+// the same payload twice sends a fresh nonce, while a retried request keeps
+// its ID and is recognised. A detached or encrypted transaction the node can
+// attach has the ID it was submitted with.
+func (t Transaction) ID() string {
+	if full, err := t.attach(); err == nil {
+		t = full
+	}
+	sum := sha256.Sum256(t.SigningBytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// TxBlock returns the position of the block that recorded a transaction.
+func (bc *Blockchain) TxBlock(id string) (int, bool) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	pos, ok := bc.byTxID[id]
+	return pos, ok
+}
+
+// checkDuplicate rejects a transaction that is already on the chain or
+// waiting in the mempool.
+func checkDuplicate(t *Tenant, tx Transaction) error {
+	id := tx.ID()
+	if _, ok := t.chain.TxBlock(id); ok || t.pool.Has(id) {
+		return fmt.Errorf("%w: %s", ErrDuplicateTx, id)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	TxCheckout       = "checkout"
+	TxReturn         = "return"
+	TxReserve        = "reserve"
+	TxCancelHold     = "cancel_hold"
+	TxRenew          = "renew"
+	TxPayment        = "payment"
+	TxBookRegistered = "book_registered"
+	TxAnchor         = "anchor"
+	TxTransfer       = "transfer"
+)
+
+// TxType is what the chain knows about one type of transaction. Types
+// register themselves with registerTxType, and payload validation,
+// checkFields, the state rules and the state itself look them up, so a new
+// type does not need changes to the chain code. A type with a payload of its
+// own carries it as JSON in Data and gives a Decode for it; what it derives
+// from the chain goes in the state's per-type records.
+type TxType struct {
+	Name string
+	// Event names the domain event published for it; types without one
+	// publish "transaction.<name>".
+	Event string
+	// Book and User say whether a client must name a book and a member.
+	Book, User bool
+	// Librarian types are refused from members' tokens.
+	Librarian bool
+	// NodeOnly, when set, is why clients may not submit the type.
+	NodeOnly string
+	// Entry types carry a catalog entry in Book, which the catalog and the
+	// state pick up.
+	Entry bool
+	// Decode parses Data. Types without one may not carry Data.
+	Decode func(data json.RawMessage) (any, error)
+	// Fields checks the fields the type must and must not carry, beyond
+	// those checkFields checks for every type.
+	Fields func(t Transaction) error
+	// Check rejects a transaction that contradicts the state.
+	Check func(s *LibraryState, tx Transaction) error
+	// Apply updates the state with a transaction of the block at pos.
+	Apply func(s *LibraryState, tx Transaction, pos int, blockTime string)
+}
+
+var txTypes = map[string]*TxType{}
+
+// registerTxType adds a transaction type. Types register from init
+// functions, so a clash is a programming error and panics.
+func registerTxType(t *TxType) {
+	if _, ok := txTypes[t.Name]; ok {
+		panic("transaction type registered twice: " + t.Name)
+	}
+	txTypes[t.Name] = t
+}
+
+func init() {
+	registerTxType(&TxType{
+		Name: TxCheckout, Event: "book.checked_out", Book: true, User: true,
+		Fields: checkoutFields,
+		Check:  (*LibraryState).checkAvailable,
+		Apply:  (*LibraryState).applyCheckout,
+	})
+	registerTxType(&TxType{
+		Name: TxReturn, Event: "book.returned", Book: true, User: true,
+		Fields: bookTxFields,
+		Check:  (*LibraryState).checkBorrower,
+		Apply:  (*LibraryState).applyReturn,
+	})
+	registerTxType(&TxType{
+		Name: TxReserve, Event: "hold.placed", Book: true, User: true,
+		Fields: bookTxFields,
+		Check:  (*LibraryState).checkReserve,
+		Apply:  (*LibraryState).applyReserve,
+	})
+	registerTxType(&TxType{
+		Name: TxCancelHold, Event: "hold.cancelled", Book: true, User: true,
+		Fields: bookTxFields,
+		Check:  (*LibraryState).checkCancelHold,
+		Apply:  (*LibraryState).applyCancelHold,
+	})
+	registerTxType(&TxType{
+		Name: TxRenew, Event: "loan.renewed", Book: true, User: true,
+		Fields: bookTxFields,
+		Check:  (*LibraryState).checkRenew,
+		Apply:  (*LibraryState).applyRenew,
+	})
+	registerTxType(&TxType{
+		Name: TxPayment, Event: "fine.paid", User: true,
+		Fields: paymentFields,
+		Check:  (*LibraryState).checkPayment,
+		Apply:  (*LibraryState).applyPayment,
+	})
+	registerTxType(&TxType{
+		Name: TxBookRegistered, Event: "book.registered", Book: true, Entry: true,
+		NodeOnly: "books are registered with POST /new",
+		Fields:   registrationFields,
+	})
+	registerTxType(&TxType{
+		Name: TxAnchor, Event: "chain.anchored",
+		NodeOnly: "anchors are recorded by the node with -anchor-method",
+		Fields:   anchorFields,
+	})
+	registerTxType(&TxType{
+		Name: TxTransfer, Event: "book.transferred", Book: true, Entry: true,
+		NodeOnly: "transfers are made with POST /books/{id}/transfer",
+		Fields:   transferFields,
+		Check:    (*LibraryState).checkAvailable,
+		Apply:    (*LibraryState).applyTransfer,
+	})
+}
+
+// Kind returns the transaction type, treating an empty Type as a checkout.
+func (t Transaction) Kind() string {
+	if t.Type == "" {
+		return TxCheckout
+	}
+	return t.Type
+}
+
+// decodeData parses the transaction's Data with its type's decoder.
+func (t Transaction) decodeData(typ *TxType) (any, error) {
+	if typ.Decode == nil {
+		if len(t.Data) > 0 {
+			return nil, fmt.Errorf("%s carries data", t.Kind())
+		}
+		return nil, nil
+	}
+	v, err := typ.Decode(t.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s data: %w", t.Kind(), err)
+	}
+	return v, nil
+}
+
+// decodeStrict decodes a payload, refusing fields the type does not have.
+func decodeStrict(raw json.RawMessage, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// recordDate is the date a record made from tx carries: the transaction's
+// date or, failing that, the time of its block.
+func recordDate(tx Transaction, blockTime string) string {
+	if tx.Date != "" {
+		return tx.Date
+	}
+	return blockTime
+}
+
+// checkFields enforces the fields each transaction type must and must not
+// carry. Signatures are checked separately by Verify.
+func (t Transaction) checkFields() error {
+	if t.IsGenesis {
+		return nil
+	}
+	if t.PayloadHash != "" {
+		if len(t.PayloadHash) != sha256.Size*2 || t.User != "" || t.PublicKey != "" || t.Signature != "" {
+			return errors.New("detached transaction carries its payload")
+		}
+		t = t.attached()
+	}
+	typ, ok := txTypes[t.Kind()]
+	if !ok {
+		return fmt.Errorf("unknown transaction type %q", t.Type)
+	}
+	if t.DueDate != "" {
+		if k := t.Kind(); k != TxCheckout && k != TxRenew {
+			return fmt.Errorf("%s carries a due date", k)
+		}
+		if _, err := parseDate(t.DueDate); err != nil {
+			return fmt.Errorf("invalid due date %q", t.DueDate)
+		}
+	}
+	if t.Fine < 0 || (t.Fine > 0 && t.Kind() != TxReturn) {
+		return fmt.Errorf("%s carries an invalid fine", t.Kind())
+	}
+	if t.Amount != 0 && t.Kind() != TxPayment {
+		return fmt.Errorf("%s carries an amount", t.Kind())
+	}
+	if t.Anchor != nil && t.Kind() != TxAnchor {
+		return fmt.Errorf("%s carries an anchor receipt", t.Kind())
+	}
+	if (t.FromBranch != "" || t.ToBranch != "") && t.Kind() != TxTransfer {
+		return fmt.Errorf("%s carries transfer branches", t.Kind())
+	}
+	if t.Stamped && (t.Kind() != TxCheckout || t.CheckoutDate == "") {
+		return fmt.Errorf("%s carries a stamp without a checkout date", t.Kind())
+	}
+	if _, err := t.decodeData(typ); err != nil {
+		return err
+	}
+	if typ.Fields != nil {
+		return typ.Fields(t)
+	}
+	return nil
+}
+
+func checkoutFields(t Transaction) error {
+	if t.BookId == "" || t.User == "" {
+		return errors.New("checkout needs a book and a user")
+	}
+	if t.Book != nil {
+		return errors.New("checkout carries book details")
+	}
+	return nil
+}
+
+// bookTxFields checks a member's transaction about a book other than a
+// checkout.
+func bookTxFields(t Transaction) error {
+	if t.BookId == "" || t.User == "" {
+		return fmt.Errorf("%s needs a book and a user", t.Kind())
+	}
+	if t.Book != nil || t.CheckoutDate != "" {
+		return fmt.Errorf("%s carries checkout fields", t.Kind())
+	}
+	return nil
+}
+
+func paymentFields(t Transaction) error {
+	if t.User == "" || t.Amount <= 0 {
+		return errors.New("payment needs a user and a positive amount")
+	}
+	if t.BookId != "" || t.Book != nil || t.CheckoutDate != "" {
+		return errors.New("payment carries book fields")
+	}
+	return nil
+}
+
+func registrationFields(t Transaction) error {
+	if t.Book == nil || t.Book.Id == "" {
+		return errors.New("book registration has no book")
+	}
+	if t.Book.Id != t.BookId {
+		return errors.New("book registration id does not match its book")
+	}
+	return nil
+}
+
+func anchorFields(t Transaction) error {
+	if a := t.Anchor; a == nil || a.Method == "" || a.TipHash == "" || a.Receipt == "" {
+		return errors.New("anchor needs a method, tip hash and receipt")
+	}
+	if t.BookId != "" || t.User != "" || t.Book != nil || t.CheckoutDate != "" {
+		return errors.New("anchor carries book fields")
+	}
+	return nil
+}
+
+func transferFields(t Transaction) error {
+	if t.Book == nil || t.Book.Id == "" || t.Book.Id != t.BookId {
+		return errors.New("transfer needs the book it moves")
+	}
+	if t.FromBranch == t.ToBranch {
+		return errors.New("transfer needs two different branches")
+	}
+	if t.User != "" || t.CheckoutDate != "" {
+		return errors.New("transfer carries checkout fields")
+	}
+	return nil
+}
+
+// bookRegistration builds a registration for a catalog entry, signed by this
+// node.
+func bookRegistration(book Book) Transaction {
+	book.Withdrawn = false
+	tx := Transaction{Type: TxBookRegistered, BookId: book.Id, Book: &book}
+	tx.Sign(NodeKey)
+	return tx
+}
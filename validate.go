@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"blockchain/apierr"
+)
+
+// verifyWorkers is how many goroutines check blocks; zero starts one per
+// CPU.
+var verifyWorkers int
+
+type ValidationReport struct {
+	Valid        bool        `json:"valid"`
+	Height       int         `json:"height"`
+	FirstInvalid *int        `json:"first_invalid,omitempty"`
+	Reason       string      `json:"reason,omitempty"`
+	Checkpoint   *Checkpoint `json:"checkpoint,omitempty"`
+}
+
+// checkBlock verifies block against its predecessor. prevBlock is nil for
+// the genesis block.
+func checkBlock(block, prevBlock *Block) (err error) {
+	defer func() {
+		if err != nil {
+			validationFailures.Inc()
+		}
+	}()
+	if err := checkLink(block, prevBlock); err != nil {
+		return err
+	}
+	return checkContents(block, prevBlock)
+}
+
+// checkLink checks the cheap part of checkBlock: that block follows
+// prevBlock in position, hash and version.
+func checkLink(block, prevBlock *Block) error {
+	if block == nil {
+		return errors.New("missing block")
+	}
+	if _, ok := blockVersions[block.Version]; !ok {
+		return fmt.Errorf("unsupported block version %d", block.Version)
+	}
+	if prevBlock == nil {
+		if block.Pos != 0 {
+			return fmt.Errorf("genesis block has position %d", block.Pos)
+		}
+		if block.Prevhash != "" {
+			return errors.New("genesis block has a previous hash")
+		}
+		if p := block.Params(); p != nil {
+			if err := checkChainParams(p); err != nil {
+				return err
+			}
+		}
+	} else {
+		if prevBlock.Pos+1 != block.Pos {
+			return fmt.Errorf("position %d does not follow %d", block.Pos, prevBlock.Pos)
+		}
+		if prevBlock.Hash != block.Prevhash {
+			return errors.New("previous hash does not match preceding block")
+		}
+		if block.Version < prevBlock.Version {
+			return fmt.Errorf("block version %d follows version %d", block.Version, prevBlock.Version)
+		}
+	}
+	return nil
+}
+
+// checkContents checks the costly part of checkBlock: the block's
+// transactions, Merkle root, hash, proof of work and signature. It only
+// reads prevBlock, so blocks can be checked concurrently.
+func checkContents(block, prevBlock *Block) error {
+	if block == nil {
+		return errors.New("missing block")
+	}
+	rules, ok := blockVersions[block.Version]
+	if !ok {
+		return fmt.Errorf("unsupported block version %d", block.Version)
+	}
+	// Transactions in baseline blocks, and in blocks migrated from them,
+	// were never signed by their clients.
+	unsigned := rules.unsigned || block.Migrated != nil && blockVersions[block.Migrated.Version].unsigned
+	for i, tx := range block.Transactions {
+		if tx.IsGenesis && prevBlock != nil {
+			return fmt.Errorf("transaction %d: genesis transaction outside genesis block", i)
+		}
+		if tx.Chain != nil && (!tx.IsGenesis || i != 0) {
+			return fmt.Errorf("transaction %d: chain parameters outside the genesis transaction", i)
+		}
+		if err := tx.checkFields(); err != nil {
+			return fmt.Errorf("transaction %d: %w", i, err)
+		}
+		if unsigned {
+			continue
+		}
+		if err := tx.verifyOnChain(); err != nil {
+			return fmt.Errorf("transaction %d: %w", i, err)
+		}
+	}
+	if err := rules.validate(block, prevBlock); err != nil {
+		return err
+	}
+	if !rules.unsigned && block.MerkleRoot != merkleRoot(block.Version, block.Transactions) {
+		return errors.New("merkle root does not match transactions")
+	}
+	if !block.ValidateHash(block.Hash) {
+		return errors.New("stored hash does not match block contents")
+	}
+	if !meetsTarget(block.Hash, block.Difficulty) {
+		return fmt.Errorf("hash does not meet difficulty %d", block.Difficulty)
+	}
+	if rules.unsigned {
+		return nil
+	}
+	if err := block.verifySignature(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (bc *Blockchain) Validate() ValidationReport {
+	return validateBlocks(bc.Snapshot(), nil)
+}
+
+// ValidateFromCheckpoint checks only the blocks after the newest trusted
+// checkpoint, falling back to the whole chain if there is none.
+func (bc *Blockchain) ValidateFromCheckpoint() ValidationReport {
+	blocks := bc.Snapshot()
+	var cp *Checkpoint
+	if Checkpoints != nil {
+		cp = Checkpoints.trusted(blocks)
+	}
+	return validateBlocks(blocks, cp)
+}
+
+// validateBlocks checks blocks. With a checkpoint, the blocks up to and
+// including its tip are taken as valid.
+func validateBlocks(blocks []*Block, cp *Checkpoint) ValidationReport {
+	return validateBlocksProgress(blocks, cp, nil)
+}
+
+// verifyBatch is how many blocks a verify worker takes at a time.
+const verifyBatch = 256
+
+// validateBlocksProgress is validateBlocks counting checked blocks in
+// checked, if it is not nil. The contents of the blocks are checked by
+// -verify-workers goroutines, which stop past the first failure any of them
+// finds, and the links between blocks in a sequential pass after them. The
+// first invalid block is reported, as if the chain were walked in order.
+func validateBlocksProgress(blocks []*Block, cp *Checkpoint, checked *atomic.Int64) ValidationReport {
+	report := ValidationReport{Valid: true, Height: len(blocks), Checkpoint: cp}
+	start := 0
+	if cp != nil {
+		start = cp.Height + 1
+	}
+	prevOf := func(i int) *Block {
+		if i == 0 {
+			return nil
+		}
+		return blocks[i-1]
+	}
+	var (
+		next    atomic.Int64
+		firstMu sync.Mutex
+		first   = len(blocks)
+		reason  error
+		wg      sync.WaitGroup
+	)
+	next.Store(int64(start))
+	bad := func() int {
+		firstMu.Lock()
+		defer firstMu.Unlock()
+		return first
+	}
+	for range workerCount(len(blocks) - start) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				lo := int(next.Add(verifyBatch)) - verifyBatch
+				if lo >= len(blocks) || lo >= bad() {
+					return
+				}
+				for i := lo; i < min(lo+verifyBatch, len(blocks)); i++ {
+					if err := checkContents(blocks[i], prevOf(i)); err != nil {
+						firstMu.Lock()
+						if i < first {
+							first, reason = i, err
+						}
+						firstMu.Unlock()
+						break
+					}
+					if checked != nil {
+						checked.Add(1)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for i := start; i < len(blocks) && i <= first; i++ {
+		if err := checkLink(blocks[i], prevOf(i)); err != nil {
+			first, reason = i, err
+			break
+		}
+	}
+	if reason != nil {
+		validationFailures.Inc()
+		report.Valid = false
+		report.FirstInvalid = &first
+		report.Reason = reason.Error()
+	}
+	return report
+}
+
+// workerCount is how many verify workers to start for n blocks: one per
+// batch, up to -verify-workers, or the number of CPUs without it.
+func workerCount(n int) int {
+	workers := verifyWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return max(1, min(workers, (n+verifyBatch-1)/verifyBatch))
+}
+
+// validateChain checks the whole chain, or with ?from=checkpoint only the
+// blocks after the newest trusted checkpoint. Tenant chains have no
+// checkpoints.
+func validateChain(w http.ResponseWriter, r *http.Request) {
+	t := tenantOf(r)
+	var report ValidationReport
+	switch from := r.URL.Query().Get("from"); {
+	case from == "" || from == "genesis":
+		report = t.chain.Validate()
+	case from == "checkpoint" && t.ID != "":
+		writeError(w, r, apierr.New(apierr.InvalidRequest, "tenant chains have no checkpoints"))
+		return
+	case from == "checkpoint":
+		report = t.chain.ValidateFromCheckpoint()
+	default:
+		writeError(w, r, apierr.New(apierr.InvalidRequest, "from must be genesis or checkpoint"))
+		return
+	}
+	respond(w, r, report)
+}
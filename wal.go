@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+)
+
+var (
+	fsyncPolicy   = FsyncAlways
+	fsyncInterval = time.Second
+)
+
+func validFsyncPolicy(policy string) bool {
+	return policy == FsyncAlways || policy == FsyncInterval || policy == FsyncNever
+}
+
+// WAL holds records that have been written to a data file but not yet
+// fsynced there. Records are cleared by Reset once the data file is durable.
+type WAL struct {
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func OpenWAL(path string) (*WAL, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &WAL{file: file, size: info.Size()}, nil
+}
+
+// WriteRecord writes an encoded record, leaving it to the operating system
+// to sync.
+func (w *WAL) WriteRecord(record []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.file.Write(record)
+	w.size += int64(n)
+	return err
+}
+
+// Size is the length of the WAL, for Truncate to cut it back to.
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// Truncate cuts the WAL back to size, dropping a record that failed part
+// way through being written.
+func (w *WAL) Truncate(size int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.file.Truncate(size); err != nil {
+		return err
+	}
+	w.size = size
+	return nil
+}
+
+// Replay calls fn for every intact record. A torn tail left by a crash while
+// writing the WAL itself is ignored.
+func (w *WAL) Replay(fn func(payload []byte) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(w.file)
+	for {
+		payload, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			log.Printf("Warning: ignoring corrupt tail of %s: %v", w.file.Name(), err)
+			return nil
+		}
+		if err := fn(payload); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *WAL) Reset() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	w.size = 0
+	return w.file.Sync()
+}
+
+func (w *WAL) Close() error {
+	return w.file.Close()
+}
+
+// startFsyncLoop checkpoints s every interval until stop is closed.
+func startFsyncLoop(s *LogStore, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.checkpoint(); err != nil {
+				log.Printf("Error syncing %s: %v", s.file.Name(), err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func walPath(path string) string {
+	return fmt.Sprintf("%s.wal", path)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"blockchain/apierr"
+	"blockchain/keys"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	Wallets   *keys.Keystore
+	walletDir = "wallets"
+)
+
+type walletRequest struct {
+	Name       string `json:"name"`
+	Role       string `json:"role"`
+	Tenant     string `json:"tenant,omitempty"`
+	Passphrase string `json:"passphrase"`
+}
+
+func createWallet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var req walletRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "invalid wallet request: %w", err))
+		return
+	}
+	if !validRole(req.Role) {
+		writeError(w, r, apierr.New(apierr.InvalidRequest, `role must be "librarian", "member" or "auditor"`))
+		return
+	}
+	if authClaims(r.Context()) == nil && authEnabled && normalizeRole(req.Role) != RoleLibrarian {
+		writeError(w, r, apierr.New(apierr.InvalidRequest, "the first wallet must be a librarian"))
+		return
+	}
+	if len(req.Passphrase) < 8 {
+		writeError(w, r, apierr.New(apierr.InvalidRequest, "passphrase must be at least 8 characters"))
+		return
+	}
+	if req.Tenant != "" {
+		if _, err := Tenants.Get(req.Tenant); err != nil {
+			writeError(w, r, apiError(err, apierr.Internal))
+			return
+		}
+	}
+	info, err := Wallets.Generate(req.Name, req.Role, req.Tenant, req.Passphrase)
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
+
+func listWallets(w http.ResponseWriter, r *http.Request) {
+	infos, err := Wallets.List()
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	respond(w, r, infos)
+}
+
+func getWallet(w http.ResponseWriter, r *http.Request) {
+	info, err := Wallets.Get(mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	respond(w, r, info)
+}
+
+func exportWallet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var req walletRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, r, apierr.Errorf(apierr.InvalidRequest, "invalid wallet request: %w", err))
+		return
+	}
+	name := mux.Vars(r)["name"]
+	priv, err := Wallets.Export(name, req.Passphrase)
+	if err != nil {
+		writeError(w, r, apiError(err, apierr.Internal))
+		return
+	}
+	info, _ := Wallets.Get(name)
+	json.NewEncoder(w).Encode(map[string]string{
+		"name":        info.Name,
+		"public_key":  info.PublicKey,
+		"private_key": hex.EncodeToString(priv),
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"blockchain/apierr"
+)
+
+//go:embed explorer
+var explorerFiles embed.FS
+
+// explorerBlock is a block as the web explorer shows it, with whether it
+// passes validation.
+type explorerBlock struct {
+	*Block
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// ExplorerPage is a page of blocks for the web explorer, newest first.
+type ExplorerPage struct {
+	Blocks    []explorerBlock `json:"blocks"`
+	Total     int             `json:"total"`
+	Offset    int             `json:"offset"`
+	Limit     int             `json:"limit"`
+	Integrity IntegrityReport `json:"integrity"`
+}
+
+// explorerStatus caches why each block from the first invalid one onwards
+// fails validation, for the tip and integrity check it was computed for.
+// Blocks before the first invalid one passed the integrity check.
+var explorerStatus struct {
+	sync.Mutex
+	tip       string
+	checkedAt string
+	reasons   map[int]string
+}
+
+func blockReasons(blocks []*Block, report IntegrityReport) map[int]string {
+	if report.Valid {
+		return nil
+	}
+	tip := blocks[len(blocks)-1].Hash
+	explorerStatus.Lock()
+	defer explorerStatus.Unlock()
+	if explorerStatus.tip == tip && explorerStatus.checkedAt == report.CheckedAt {
+		return explorerStatus.reasons
+	}
+	reasons := map[int]string{}
+	for i := *report.FirstInvalid; i < len(blocks); i++ {
+		var prev *Block
+		if i > 0 {
+			prev = blocks[i-1]
+		}
+		if err := checkBlock(blocks[i], prev); err != nil {
+			reasons[i] = err.Error()
+		}
+	}
+	explorerStatus.tip, explorerStatus.checkedAt, explorerStatus.reasons = tip, report.CheckedAt, reasons
+	return reasons
+}
+
+// getExplorerBlocks serves a page of blocks, newest first, with each block's
+// validation result and the last integrity report.
+func getExplorerBlocks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	offset, limit, err := parsePage(r)
+	if err != nil {
+		writeError(w, r, apierr.Wrap(apierr.InvalidRequest, err))
+		return
+	}
+	blocks := BlockChain.Snapshot()
+	report := BlockChain.Integrity()
+	reasons := blockReasons(blocks, report)
+	page := ExplorerPage{Blocks: []explorerBlock{}, Total: len(blocks), Offset: offset, Limit: limit, Integrity: report}
+	for i := len(blocks) - 1 - offset; i >= 0 && len(page.Blocks) < limit; i-- {
+		reason := reasons[i]
+		page.Blocks = append(page.Blocks, explorerBlock{Block: blocks[i], Valid: reason == "", Reason: reason})
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	json.NewEncoder(w).Encode(page)
+}
+
+// explorerHandler serves the embedded explorer page and its assets.
+func explorerHandler() http.Handler {
+	files, err := fs.Sub(explorerFiles, "explorer")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/explorer/", http.FileServer(http.FS(files)))
+}
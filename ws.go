@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"blockchain/apierr"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// ValidationEvent reports the outcome of an integrity check, or a block
+// from a peer that failed validation.
+type ValidationEvent struct {
+	Source string `json:"source"` // "integrity" or "peer"
+	Valid  bool   `json:"valid"`
+	Pos    *int   `json:"pos,omitempty"`
+	Hash   string `json:"hash,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Time   string `json:"time"`
+}
+
+// Validations carries validation events as they happen.
+var Validations = newFeed[ValidationEvent]()
+
+func publishValidation(ev ValidationEvent) {
+	ev.Time = time.Now().UTC().Format(time.RFC3339)
+	Validations.publish(ev)
+}
+
+// wsMessage is one message on /ws: a "block" that was appended, or a
+// "validation" event.
+type wsMessage struct {
+	Type       string           `json:"type"`
+	Block      *Block           `json:"block,omitempty"`
+	Validation *ValidationEvent `json:"validation,omitempty"`
+}
+
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || origin == "http://"+r.Host || origin == "https://"+r.Host || allowedOrigin(origin)
+	},
+}
+
+// streamWS upgrades to a WebSocket and pushes every block appended from now
+// on, or from ?from=N to replay the chain from height N first, along with
+// validation events. Like StreamBlocks, each notification re-reads the
+// snapshot, so a slow client still gets every block in order. Messages from
+// the client are ignored.
+func streamWS(w http.ResponseWriter, r *http.Request) {
+	next := BlockChain.Tip().Pos + 1
+	if v := r.URL.Query().Get("from"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, apierr.New(apierr.InvalidRequest, "from must be a non-negative integer"))
+			return
+		}
+		next = n
+	}
+	blocks, cancelBlocks := NewBlocks.Subscribe()
+	defer cancelBlocks()
+	validations, cancelValidations := Validations.Subscribe()
+	defer cancelValidations()
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	quit, untrack := trackStream()
+	defer untrack()
+	wsClients.Inc()
+	defer wsClients.Dec()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	send := func(msg wsMessage) bool {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteJSON(msg) == nil
+	}
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		snapshot := BlockChain.Snapshot()
+		for ; next < len(snapshot); next++ {
+			if !send(wsMessage{Type: "block", Block: snapshot[next]}) {
+				return
+			}
+		}
+		select {
+		case <-done:
+			return
+		case <-quit:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(wsWriteWait))
+			return
+		case <-blocks:
+		case ev := <-validations:
+			if !send(wsMessage{Type: "validation", Validation: &ev}) {
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}